@@ -0,0 +1,147 @@
+package magi
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DefaultAdaptiveInterval is the default time between samples of the queue depth
+var DefaultAdaptiveInterval = time.Second
+
+// AdaptiveConcurrency describes how the worker pool scales with the depth of the queues
+type AdaptiveConcurrency struct {
+	Min           int           // workers kept when the queues are drained, at least 1
+	Max           int           // workers at most, however deep the queues are
+	JobsPerWorker int           // queued jobs calling for another worker, 1 if zero
+	Interval      time.Duration // time between samples, DefaultAdaptiveInterval if zero
+	Queues        []string      // queues sampled, all the registered queues if empty
+}
+
+// SetAdaptiveConcurrency replaces the fixed size of the worker pool with one
+// scaling between the bounds with the number of jobs queued, as sampled
+// with QLEN. Like SetConcurrency, it must be called before processing
+// starts. Scaling down waits for the workers to finish their jobs, and the
+// sampling stops when the instance is closed, or when the concurrency is set
+// again.
+func (m *Magi) SetAdaptiveConcurrency(config AdaptiveConcurrency) {
+	m.stopScaler()
+	if config.Min < 1 {
+		config.Min = 1
+	}
+	if config.Max < config.Min {
+		config.Max = config.Min
+	}
+	if config.JobsPerWorker < 1 {
+		config.JobsPerWorker = 1
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultAdaptiveInterval
+	}
+	// The pool has room for the most workers, the slots of the inactive
+	// workers are held by the scaler
+	workers := make(chan struct{}, config.Max)
+	parked := config.Max - config.Min
+	for i := 0; i < parked; i++ {
+		workers <- struct{}{}
+	}
+	m.workers = workers
+	atomic.StoreInt32(&m.activeWorkers, int32(config.Min))
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	m.scalerQuit = quit
+	m.scalerDone = done
+	m.processing.Add(1)
+	go func() {
+		defer m.processing.Done()
+		defer close(done)
+		m.runAdaptiveConcurrency(config, workers, parked, quit)
+	}()
+}
+
+// stopScaler stops the scaler of adaptive concurrency, if any, and waits
+// for it to exit so that it no longer resizes the pool
+func (m *Magi) stopScaler() {
+	if m.scalerQuit == nil {
+		return
+	}
+	close(m.scalerQuit)
+	<-m.scalerDone
+	m.scalerQuit = nil
+	m.scalerDone = nil
+}
+
+// Workers returns the number of workers of the pool, which varies with the
+// depth of the queues under adaptive concurrency
+func (m *Magi) Workers() int {
+	if n := atomic.LoadInt32(&m.activeWorkers); n > 0 {
+		return int(n)
+	}
+	return cap(m.workers)
+}
+
+// runAdaptiveConcurrency samples the depth of the queues and scales the pool
+// of workers until the instance is closed or the scaler is stopped
+func (m *Magi) runAdaptiveConcurrency(config AdaptiveConcurrency, workers chan struct{}, parked int, quit <-chan struct{}) {
+	ticker := m.clock.NewTicker(config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.quit:
+			return
+		case <-quit:
+			return
+		case <-ticker.C():
+		}
+		depth, err := m.queueDepth(config.Queues)
+		if err != nil {
+			m.logf("Error: %v", err)
+			continue
+		}
+		target := (depth + config.JobsPerWorker - 1) / config.JobsPerWorker
+		if target < config.Min {
+			target = config.Min
+		}
+		if target > config.Max {
+			target = config.Max
+		}
+		active := config.Max - parked
+		// Give back slots to grow the pool
+		for ; active < target; active++ {
+			<-workers
+			parked--
+		}
+		// Take the slots freed by the workers to shrink the pool, the rest
+		// are taken on the following samples
+	shrink:
+		for ; active > target; active-- {
+			select {
+			case workers <- struct{}{}:
+				parked++
+			default:
+				break shrink
+			}
+		}
+		atomic.StoreInt32(&m.activeWorkers, int32(active))
+	}
+}
+
+// queueDepth returns the number of jobs queued in the queues, or in all the
+// registered queues if none is given
+func (m *Magi) queueDepth(queues []string) (int, error) {
+	if len(queues) == 0 {
+		m.mutex.RLock()
+		for queueName := range m.processors {
+			queues = append(queues, queueName)
+		}
+		m.mutex.RUnlock()
+	}
+	depth := 0
+	for _, queueName := range queues {
+		n, err := m.dqCluster.QueueLength(queueName)
+		if err != nil {
+			return 0, err
+		}
+		depth += n
+	}
+	return depth, nil
+}
@@ -0,0 +1,159 @@
+package magi
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evanhuang8/magi/clock"
+	"github.com/evanhuang8/magi/cluster"
+	"github.com/evanhuang8/magi/job"
+)
+
+// AsyncFlushTimeout is the time Close waits for the jobs added with
+// AddJobAsync to be confirmed by disque before closing the connections
+var AsyncFlushTimeout = 5 * time.Second
+
+// TrackedReplicationTimeout is the time a job added with AddJobTracked has
+// to be replicated before it's reported as failed
+var TrackedReplicationTimeout = 5 * time.Second
+
+// AsyncResult is the outcome of adding a job with AddJobAsync
+type AsyncResult struct {
+	Job *job.Job
+	Err error
+}
+
+// AsyncFlushError is the error of Close for the jobs added with AddJobAsync
+// that disque did not confirm within AsyncFlushTimeout, which may be lost
+type AsyncFlushError struct {
+	Jobs []*job.Job
+}
+
+func (e *AsyncFlushError) Error() string {
+	counts := make(map[string]int)
+	queues := []string{}
+	for _, _job := range e.Jobs {
+		if counts[_job.QueueName] == 0 {
+			queues = append(queues, _job.QueueName)
+		}
+		counts[_job.QueueName]++
+	}
+	sort.Strings(queues)
+	perQueue := make([]string, len(queues))
+	for i, queueName := range queues {
+		perQueue[i] = fmt.Sprintf("%s: %d", queueName, counts[queueName])
+	}
+	return fmt.Sprintf("Magi Error: %d async jobs are not confirmed (%s)!", len(e.Jobs), strings.Join(perQueue, ", "))
+}
+
+// asyncJobs tracks the jobs being added by AddJobAsync
+type asyncJobs struct {
+	pending map[*job.Job]struct{}
+	wg      sync.WaitGroup
+	mutex   sync.Mutex
+}
+
+func (a *asyncJobs) start(_job *job.Job) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.pending == nil {
+		a.pending = make(map[*job.Job]struct{})
+	}
+	a.pending[_job] = struct{}{}
+	a.wg.Add(1)
+}
+
+func (a *asyncJobs) done(_job *job.Job) {
+	a.mutex.Lock()
+	delete(a.pending, _job)
+	a.mutex.Unlock()
+	a.wg.Done()
+}
+
+// flush waits up to the timeout for the pending jobs to be confirmed,
+// returning the ones that are not
+func (a *asyncJobs) flush(c clock.Clock, timeout time.Duration) []*job.Job {
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-c.After(timeout):
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	jobs := make([]*job.Job, 0, len(a.pending))
+	for _job := range a.pending {
+		jobs = append(jobs, _job)
+	}
+	return jobs
+}
+
+// AddJobAsync adds a job to the queue without waiting for disque to confirm
+// it, and returns a channel receiving the outcome once it's known. Close
+// waits for the pending jobs to be confirmed before closing the connections,
+// see AsyncFlushTimeout.
+func (m *Magi) AddJobAsync(queueName string, body string, ETA time.Time, config *cluster.DisqueOpConfig) <-chan AsyncResult {
+	result := make(chan AsyncResult, 1)
+	_job := job.New(queueName, body, nil, ETA, m.clock.Now())
+	m.async.start(_job)
+	go func() {
+		err := m.addJob(_job, config)
+		m.async.done(_job)
+		if err != nil {
+			result <- AsyncResult{nil, err}
+			return
+		}
+		result <- AsyncResult{_job, nil}
+	}()
+	return result
+}
+
+// AddJobTracked adds a job to the queue with ADDJOB ASYNC, returning the job
+// as soon as the node receiving it stores it, along with a channel reporting
+// whether it's then replicated in the background. Until then the job lives
+// on a single node and may be lost with it, so its id is only provisional.
+//
+// The channel receives job.ErrJobNotReplicated if the job is not replicated
+// to the nodes of the config's Replicate, or of the queue's defaults, within
+// TrackedReplicationTimeout, and is closed once the outcome is known, so a
+// receive gives nil for a replicated job. Without a replication level the
+// job is confirmed once any node shows it. If the job can not be added at
+// all, the job returned is nil and the channel receives the error. Close
+// waits for the pending confirmations like for the jobs of AddJobAsync.
+func (m *Magi) AddJobTracked(queueName string, body string, ETA time.Time, config *cluster.DisqueOpConfig) (*job.Job, <-chan error) {
+	result := make(chan error, 1)
+	m.mutex.RLock()
+	defaults := m.queueDefaults[queueName]
+	m.mutex.RUnlock()
+	config = config.Merge(defaults)
+	config.Async = true
+	_job := job.New(queueName, body, nil, ETA, m.clock.Now())
+	m.async.start(_job)
+	err := m.addJob(_job, config)
+	if err != nil {
+		m.async.done(_job)
+		result <- err
+		close(result)
+		return nil, result
+	}
+	replicas := config.Replicate
+	if replicas < 1 {
+		replicas = 1
+	}
+	go func() {
+		defer close(result)
+		err := m.waitReplicated(_job.ID, replicas, TrackedReplicationTimeout)
+		m.async.done(_job)
+		if err != nil {
+			result <- err
+		}
+	}()
+	return _job, result
+}
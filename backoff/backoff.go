@@ -0,0 +1,99 @@
+package backoff
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff is a strategy for the delays between the attempts of an operation
+type Backoff interface {
+	Next(attempt int) time.Duration // delay before the attempt, starting from 1
+	Reset()                         // clears any state kept between attempts
+}
+
+// Exponential is a backoff growing by a factor with every attempt
+type Exponential struct {
+	Initial time.Duration // delay before the first attempt
+	Max     time.Duration // upper bound of the delay, no bound if zero
+	Factor  float64       // growth factor of the delay, 2 if zero
+}
+
+// NewExponential creates an exponential backoff
+func NewExponential(initial time.Duration, max time.Duration, factor float64) *Exponential {
+	return &Exponential{
+		Initial: initial,
+		Max:     max,
+		Factor:  factor,
+	}
+}
+
+// Next returns the delay before the attempt
+func (b *Exponential) Next(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	factor := b.Factor
+	if factor <= 0 {
+		factor = 2
+	}
+	delay := float64(b.Initial) * math.Pow(factor, float64(attempt-1))
+	if b.Max > 0 && delay > float64(b.Max) {
+		return b.Max
+	}
+	return time.Duration(delay)
+}
+
+// Reset does nothing, the exponential backoff is stateless
+func (b *Exponential) Reset() {}
+
+// Constant is a backoff with the same delay for every attempt
+type Constant struct {
+	Delay time.Duration
+}
+
+// NewConstant creates a constant backoff
+func NewConstant(delay time.Duration) *Constant {
+	return &Constant{
+		Delay: delay,
+	}
+}
+
+// Next returns the delay before the attempt
+func (b *Constant) Next(attempt int) time.Duration {
+	return b.Delay
+}
+
+// Reset does nothing, the constant backoff is stateless
+func (b *Constant) Reset() {}
+
+// Jitter randomizes the delays of a backoff, so that the attempts of several
+// callers backing off at the same time are spread out
+type Jitter struct {
+	Backoff  Backoff
+	Fraction float64 // fraction of the delay that is randomized, between 0 and 1
+}
+
+// NewJitter creates a backoff randomizing the fraction of the delays of b
+func NewJitter(b Backoff, fraction float64) *Jitter {
+	return &Jitter{
+		Backoff:  b,
+		Fraction: fraction,
+	}
+}
+
+// Next returns the delay before the attempt, reduced by a random part of the fraction
+func (b *Jitter) Next(attempt int) time.Duration {
+	delay := b.Backoff.Next(attempt)
+	fraction := math.Min(math.Max(b.Fraction, 0), 1)
+	spread := int64(float64(delay) * fraction)
+	if spread <= 0 {
+		return delay
+	}
+	return delay - time.Duration(rand.Int63n(spread+1))
+}
+
+// Reset resets the underlying backoff
+func (b *Jitter) Reset() {
+	b.Backoff.Reset()
+}
@@ -0,0 +1,134 @@
+package magi
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of the circuit breaker of a queue
+type BreakerState int
+
+const (
+	// BreakerClosed is the normal state, jobs are fetched and processed
+	BreakerClosed BreakerState = iota
+	// BreakerOpen pauses fetching jobs of the queue until the cooldown passes
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe job through to test the processor
+	BreakerHalfOpen
+)
+
+func (state BreakerState) String() string {
+	switch state {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// BreakerProbeInterval is the time between checks for the result of a probe job
+var BreakerProbeInterval = 100 * time.Millisecond
+
+// circuitBreaker pauses a queue after consecutive processing failures
+type circuitBreaker struct {
+	failures    int           // consecutive failures opening the breaker
+	cooldown    time.Duration // time the breaker stays open
+	consecutive int           // current consecutive failures
+	state       BreakerState
+	openedAt    time.Time
+	probing     bool // whether a probe job is fetched or processed
+	mutex       sync.Mutex
+}
+
+// allow returns whether a job can be fetched, otherwise how long to wait
+// before asking again, and whether the breaker changed its state
+func (b *circuitBreaker) allow(now time.Time) (bool, time.Duration, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		remaining := b.openedAt.Add(b.cooldown).Sub(now)
+		if remaining > 0 {
+			return false, remaining, false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return true, 0, true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false, BreakerProbeInterval, false
+		}
+		b.probing = true
+		return true, 0, false
+	}
+	return true, 0, false
+}
+
+// cancelProbe lets another probe through when no job was fetched
+func (b *circuitBreaker) cancelProbe() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.probing = false
+}
+
+// record counts the result of processing a job, returning whether the
+// breaker changed its state
+func (b *circuitBreaker) record(success bool, now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	previous := b.state
+	if success {
+		b.consecutive = 0
+		b.state = BreakerClosed
+	} else {
+		b.consecutive++
+		if b.state == BreakerHalfOpen || b.consecutive >= b.failures {
+			b.state = BreakerOpen
+			b.openedAt = now
+		}
+	}
+	b.probing = false
+	return b.state != previous
+}
+
+func (b *circuitBreaker) current() BreakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state
+}
+
+// SetCircuitBreaker pauses fetching the jobs of the queue for the cooldown
+// after the given number of consecutive processing failures. Once the
+// cooldown passes, a single probe job is processed: if it succeeds the queue
+// resumes, otherwise it is paused for another cooldown. A failures of 0
+// removes the breaker.
+func (m *Magi) SetCircuitBreaker(queueName string, failures int, cooldown time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.breakers == nil {
+		m.breakers = make(map[string]*circuitBreaker)
+	}
+	if failures < 1 {
+		delete(m.breakers, queueName)
+		return
+	}
+	m.breakers[queueName] = &circuitBreaker{
+		failures: failures,
+		cooldown: cooldown,
+	}
+}
+
+// breaker returns the circuit breaker of the queue, if any
+func (m *Magi) breaker(queueName string) *circuitBreaker {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.breakers[queueName]
+}
+
+// breakerChanged notifies the change of state of the queue's breaker
+func (m *Magi) breakerChanged(queueName string, state BreakerState) {
+	if m.OnBreakerStateChange != nil {
+		m.OnBreakerStateChange(queueName, state)
+	}
+}
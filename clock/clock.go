@@ -0,0 +1,160 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time used by magi, so that it can be replaced in tests
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at intervals
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// New creates a clock backed by the real time
+func New() Clock {
+	return &realClock{}
+}
+
+type realClock struct{}
+
+func (c *realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (c *realClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t *realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t *realTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// Mock is a fake clock that only moves when told to
+type Mock struct {
+	now    time.Time
+	timers []*mockTimer
+	mutex  sync.Mutex
+}
+
+type mockTimer struct {
+	at      time.Time
+	period  time.Duration
+	c       chan time.Time
+	stopped bool
+}
+
+// NewMock creates a fake clock starting at the time
+func NewMock(start time.Time) *Mock {
+	return &Mock{
+		now: start,
+	}
+}
+
+// Now returns the current time of the fake clock
+func (m *Mock) Now() time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.now
+}
+
+// After returns a channel receiving the time once the clock moves past the duration
+func (m *Mock) After(d time.Duration) <-chan time.Time {
+	return m.schedule(d, 0).c
+}
+
+// NewTicker returns a ticker firing every time the clock moves past the duration
+func (m *Mock) NewTicker(d time.Duration) Ticker {
+	return &mockTicker{
+		mock:  m,
+		timer: m.schedule(d, d),
+	}
+}
+
+// Add moves the clock forward by the duration, firing any due timers
+func (m *Mock) Add(d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.now = m.now.Add(d)
+	m.fire()
+}
+
+// Set moves the clock to the time, firing any due timers
+func (m *Mock) Set(t time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.now = t
+	m.fire()
+}
+
+func (m *Mock) schedule(d time.Duration, period time.Duration) *mockTimer {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	timer := &mockTimer{
+		at:     m.now.Add(d),
+		period: period,
+		c:      make(chan time.Time, 1),
+	}
+	m.timers = append(m.timers, timer)
+	m.fire()
+	return timer
+}
+
+// Fire due timers, must be called with the mutex held
+func (m *Mock) fire() {
+	timers := m.timers[:0]
+	for _, timer := range m.timers {
+		if timer.stopped {
+			continue
+		}
+		if !timer.at.After(m.now) {
+			// Drop the tick if the receiver is behind, like time.Ticker
+			select {
+			case timer.c <- m.now:
+			default:
+			}
+			if timer.period <= 0 {
+				continue
+			}
+			for !timer.at.After(m.now) {
+				timer.at = timer.at.Add(timer.period)
+			}
+		}
+		timers = append(timers, timer)
+	}
+	m.timers = timers
+}
+
+type mockTicker struct {
+	mock  *Mock
+	timer *mockTimer
+}
+
+func (t *mockTicker) C() <-chan time.Time {
+	return t.timer.c
+}
+
+func (t *mockTicker) Stop() {
+	t.mock.mutex.Lock()
+	defer t.mock.mutex.Unlock()
+	t.timer.stopped = true
+}
@@ -0,0 +1,66 @@
+package cluster
+
+import (
+	"time"
+
+	"github.com/goware/disque"
+)
+
+// JobBackend is the job queue used by Magi, implemented by DisqueCluster and
+// MemoryCluster. Alternative queues (or mocks) only need to provide these
+// methods to be used with ProducerWithBackend and ConsumerWithBackends.
+type JobBackend interface {
+	Add(queueName string, data string, config *DisqueOpConfig) (*disque.Job, error)
+	Get(id string) (*disque.Job, error)
+	GetMany(ids []string) ([]*disque.Job, error)
+	Fetch(queueName string, config *DisqueOpConfig) (*disque.Job, error)
+	FetchWithOptions(queueName string, config *DisqueOpConfig, options *FetchOptions) (*disque.Job, *Counters, error)
+	Ack(id string) error
+	AckMany(ids []string) error
+	Nack(id string) error
+	Wait(id string) error
+	Dequeue(id string) (int, error)
+	Enqueue(id string) error
+	Show(id string) (map[string]interface{}, error)
+	ListQueues(pattern string) ([]string, error)
+	QueueLength(queueName string) (int, error)
+	SetOrdered(queueName string, ordered bool)
+	Size() int
+	Chain()
+	Unchain()
+	Close() error
+}
+
+// LockBackend is the store of the locks and indexes used by Magi, implemented
+// by RedisCluster and MemoryCluster. It is made of independent instances,
+// locks are taken on each of them and held on a quorum.
+type LockBackend interface {
+	GetQuorum() int
+	Instances() int
+	SetNX(i int, key string, value string, ttl time.Duration) (bool, error)
+	CompareAndDelete(i int, key string, value string) (bool, error)
+	CompareAndExtend(i int, key string, value string, ttl time.Duration) (bool, error)
+	Set(key string, value string, ttl time.Duration) (bool, error)
+	Get(key string) (string, error)
+	Del(key string) error
+	Incr(key string, ttl time.Duration) (int, error)
+	HSet(key string, field string, value string) (bool, error)
+	HGetAll(key string) (map[string]string, error)
+	HDel(key string, field string) error
+	Scan(i int, pattern string) ([]string, error)
+	Inspect(i int, key string) (string, time.Duration, error)
+	Close() error
+}
+
+// Make sure the clusters implement the backends
+var (
+	_ JobBackend  = (*DisqueCluster)(nil)
+	_ JobBackend  = (*MemoryCluster)(nil)
+	_ LockBackend = (*RedisCluster)(nil)
+	_ LockBackend = (*RedisSlotCluster)(nil)
+	_ LockBackend = memoryLocks{}
+	_ LockBackend = (*ShardedLockBackend)(nil)
+	_ JobBackend  = (*NamespacedJobBackend)(nil)
+	_ LockBackend = (*NamespacedLockBackend)(nil)
+	_ Sharded     = (*ShardedLockBackend)(nil)
+)
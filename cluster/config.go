@@ -0,0 +1,282 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Host is the typed form of a host of a cluster, the map based hosts of
+// DisqueClusterConfig and RedisClusterConfig are built from it with HostMaps
+type Host struct {
+	Address string // host and port of the node
+	Auth    string // password of the node, redis only
+	DB      string // database selected on the node, redis only
+}
+
+// Map returns the map based form of the host
+func (h Host) Map() map[string]interface{} {
+	host := map[string]interface{}{
+		"address": h.Address,
+	}
+	if h.Auth != "" {
+		host["auth"] = h.Auth
+	}
+	if h.DB != "" {
+		host["db"] = h.DB
+	}
+	return host
+}
+
+// HostMaps returns the map based form of the hosts
+func HostMaps(hosts ...Host) []map[string]interface{} {
+	maps := make([]map[string]interface{}, len(hosts))
+	for i, host := range hosts {
+		maps[i] = host.Map()
+	}
+	return maps
+}
+
+// Config holds the configs of the clusters loaded from a standard source by
+// LoadConfigFromJSON or LoadConfigFromEnv. A cluster missing from the source
+// has a nil config.
+type Config struct {
+	Disque *DisqueClusterConfig
+	Redis  *RedisClusterConfig
+}
+
+// ErrConfigNoAddress is the error for loading a host without an address
+var ErrConfigNoAddress = errors.New("Config Error: host has no address!")
+
+// ErrConfigNoPrefix is the error for loading the configs from the environment without a prefix
+var ErrConfigNoPrefix = errors.New("Config Error: environment variables need a prefix!")
+
+// lbModes are the names of the load balancing modes in the loaded configs
+var lbModes = map[string]DisqueClusterLBMode{
+	"round-robin":      DisqueClusterLBModeRoundRobin,
+	"random":           DisqueClusterLBModeRandom,
+	"latency-weighted": DisqueClusterLBModeLatencyWeighted,
+}
+
+// unknownKey returns the error for a misspelled key in a loaded config
+func unknownKey(key string) error {
+	return fmt.Errorf("Config Error: unknown key %q!", key)
+}
+
+// decodeStrict decodes the JSON object into the fields by key, failing on
+// the keys that are not expected
+func decodeStrict(raw json.RawMessage, fields map[string]interface{}) error {
+	var object map[string]json.RawMessage
+	err := json.Unmarshal(raw, &object)
+	if err != nil {
+		return err
+	}
+	for key, value := range object {
+		field, exists := fields[key]
+		if !exists {
+			return unknownKey(key)
+		}
+		err = json.Unmarshal(value, field)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeHosts decodes a JSON array of hosts
+func decodeHosts(raw json.RawMessage) ([]Host, error) {
+	var objects []json.RawMessage
+	err := json.Unmarshal(raw, &objects)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]Host, len(objects))
+	for i, object := range objects {
+		host := &hosts[i]
+		err = decodeStrict(object, map[string]interface{}{
+			"address": &host.Address,
+			"auth":    &host.Auth,
+			"db":      &host.DB,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if host.Address == "" {
+			return nil, ErrConfigNoAddress
+		}
+	}
+	return hosts, nil
+}
+
+// LoadConfigFromJSON loads the configs of the clusters from a JSON object of
+// the form
+//
+//	{
+//	  "disque": {
+//	    "hosts": [{"address": "127.0.0.1:7711"}],
+//	    "lb_mode": "random"
+//	  },
+//	  "redis": {
+//	    "hosts": [{"address": "127.0.0.1:7777", "auth": "secret", "db": "1"}]
+//	  }
+//	}
+//
+// Unknown keys, e.g. misspelled ones, fail the loading.
+func LoadConfigFromJSON(r io.Reader) (*Config, error) {
+	var raw json.RawMessage
+	err := json.NewDecoder(r).Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+	var disque, redis json.RawMessage
+	err = decodeStrict(raw, map[string]interface{}{
+		"disque": &disque,
+		"redis":  &redis,
+	})
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if disque != nil {
+		var hosts json.RawMessage
+		var lbMode string
+		err = decodeStrict(disque, map[string]interface{}{
+			"hosts":   &hosts,
+			"lb_mode": &lbMode,
+		})
+		if err != nil {
+			return nil, err
+		}
+		_hosts, err := decodeHosts(hosts)
+		if err != nil {
+			return nil, err
+		}
+		config.Disque, err = disqueConfig(_hosts, lbMode)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if redis != nil {
+		var hosts json.RawMessage
+		err = decodeStrict(redis, map[string]interface{}{
+			"hosts": &hosts,
+		})
+		if err != nil {
+			return nil, err
+		}
+		_hosts, err := decodeHosts(hosts)
+		if err != nil {
+			return nil, err
+		}
+		config.Redis = &RedisClusterConfig{
+			Hosts: HostMaps(_hosts...),
+		}
+	}
+	return config, nil
+}
+
+// disqueConfig creates the disque cluster config from the loaded hosts and
+// the name of the load balancing mode
+func disqueConfig(hosts []Host, lbMode string) (*DisqueClusterConfig, error) {
+	config := &DisqueClusterConfig{
+		Hosts: HostMaps(hosts...),
+	}
+	if lbMode != "" {
+		mode, exists := lbModes[lbMode]
+		if !exists {
+			return nil, fmt.Errorf("Config Error: unknown lb mode %q!", lbMode)
+		}
+		config.LBMode = mode
+	}
+	return config, nil
+}
+
+// envKeys are the variables read by LoadConfigFromEnv, after the prefix
+var envKeys = []string{
+	"DISQUE_HOSTS",
+	"DISQUE_LB_MODE",
+	"REDIS_HOSTS",
+	"REDIS_AUTH",
+	"REDIS_DB",
+}
+
+// LoadConfigFromEnv loads the configs of the clusters from the environment
+// variables named by the prefix, e.g. with the prefix "MAGI_"
+//
+//	MAGI_DISQUE_HOSTS=127.0.0.1:7711,127.0.0.1:7712
+//	MAGI_DISQUE_LB_MODE=random
+//	MAGI_REDIS_HOSTS=127.0.0.1:7777
+//	MAGI_REDIS_AUTH=secret
+//	MAGI_REDIS_DB=1
+//
+// The auth and db apply to all the redis hosts. Other variables with the
+// prefix are left to the application, except for the unknown DISQUE_ and
+// REDIS_ ones, e.g. misspelled keys, which fail the loading. The prefix is
+// required.
+func LoadConfigFromEnv(prefix string) (*Config, error) {
+	if prefix == "" {
+		return nil, ErrConfigNoPrefix
+	}
+	values := map[string]string{}
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, prefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(variable, prefix), "=", 2)
+		known := false
+		for _, key := range envKeys {
+			known = known || parts[0] == key
+		}
+		if !known {
+			if strings.HasPrefix(parts[0], "DISQUE_") || strings.HasPrefix(parts[0], "REDIS_") {
+				return nil, unknownKey(prefix + parts[0])
+			}
+			continue
+		}
+		if len(parts) == 2 {
+			values[parts[0]] = parts[1]
+		}
+	}
+	config := &Config{}
+	if values["DISQUE_HOSTS"] != "" {
+		hosts, err := envHosts(values["DISQUE_HOSTS"], "", "")
+		if err != nil {
+			return nil, err
+		}
+		config.Disque, err = disqueConfig(hosts, values["DISQUE_LB_MODE"])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if values["REDIS_HOSTS"] != "" {
+		hosts, err := envHosts(values["REDIS_HOSTS"], values["REDIS_AUTH"], values["REDIS_DB"])
+		if err != nil {
+			return nil, err
+		}
+		config.Redis = &RedisClusterConfig{
+			Hosts: HostMaps(hosts...),
+		}
+	}
+	return config, nil
+}
+
+// envHosts creates the hosts from a comma separated list of addresses
+func envHosts(addresses string, auth string, db string) ([]Host, error) {
+	hosts := []Host{}
+	for _, address := range strings.Split(addresses, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			return nil, ErrConfigNoAddress
+		}
+		hosts = append(hosts, Host{
+			Address: address,
+			Auth:    auth,
+			DB:      db,
+		})
+	}
+	return hosts, nil
+}
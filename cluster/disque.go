@@ -1,8 +1,17 @@
 package cluster
 
 import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/evanhuang8/magi/backoff"
+	"github.com/garyburd/redigo/redis"
 	"github.com/goware/disque"
 )
 
@@ -12,8 +21,43 @@ type DisqueClusterLBMode int
 const (
 	// DisqueClusterLBModeRoundRobin is the round robin lb mode
 	DisqueClusterLBModeRoundRobin = 1 << iota
+	// DisqueClusterLBModeRandom is the lb mode picking nodes uniformly at random
+	DisqueClusterLBModeRandom
+	// DisqueClusterLBModeLatencyWeighted is the lb mode picking nodes at
+	// random, weighted towards the nodes with the lower recent response times
+	DisqueClusterLBModeLatencyWeighted
 )
 
+var (
+	// ErrClusterDown is the error for a node refusing commands because the cluster is down
+	ErrClusterDown = errors.New("Disque Error: the cluster is down!")
+	// ErrNodeLoading is the error for a node refusing commands while loading its dataset
+	ErrNodeLoading = errors.New("Disque Error: the node is loading its dataset!")
+)
+
+// classifyError maps the errors of the nodes being unavailable to ErrClusterDown and ErrNodeLoading
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	message := err.Error()
+	switch {
+	case strings.HasPrefix(message, "LOADING"):
+		return ErrNodeLoading
+	case strings.HasPrefix(message, "CLUSTERDOWN"), strings.HasPrefix(message, "CLUSTER-DOWN"):
+		return ErrClusterDown
+	}
+	return err
+}
+
+// isUnavailable returns whether the error is caused by the node being temporarily unavailable
+func isUnavailable(err error) bool {
+	return err == ErrClusterDown || err == ErrNodeLoading
+}
+
+// DisqueDefaultTTL is the ttl disque assigns to a job when none is specified
+const DisqueDefaultTTL = 24 * time.Hour
+
 // DisqueCluster is a struct representing a disque cluster with multiple instances
 type DisqueCluster struct {
 	config *DisqueClusterConfig
@@ -21,14 +65,32 @@ type DisqueCluster struct {
 	pools     []*disque.Pool
 	poolIndex int
 
-	lbMode  DisqueClusterLBMode
-	lbFixed bool
+	conns []*redis.Pool // raw connection pools for commands the disque lib does not wrap
+
+	lbMode    DisqueClusterLBMode
+	lbFixed   bool
+	latencies []time.Duration // moving average of the response times by node
+
+	orderedQueues map[string]bool
+	drained       map[int]bool // nodes not fetched from, by index
+	nodeIDs       []string     // ids of the nodes reported by HELLO, by index, empty if not known yet
+
+	mutex sync.Mutex // guards poolIndex, lbFixed, latencies, orderedQueues, drained and nodeIDs
 }
 
 // DisqueClusterConfig is the config struct for creating a disque cluster
 type DisqueClusterConfig struct {
 	Hosts  []map[string]interface{}
 	LBMode DisqueClusterLBMode
+	// Backoff between failing over to the following nodes, no delay if nil
+	Backoff backoff.Backoff
+	// Called when an operation on the queue fails over from the node at the
+	// address, which for an ordered queue means it may no longer be in order.
+	// New reports it to the logger of the instance.
+	OnFailover func(queueName string, address string, err error)
+	// Hooks for the connections dialed by magi itself for the commands the
+	// disque lib does not wrap, the lib's own connections are not observed
+	ConnHooks
 }
 
 // DisqueOpConfig is the config struct for any disque operations
@@ -39,6 +101,9 @@ type DisqueOpConfig struct {
 	RetryAfter time.Duration
 	TTL        time.Duration
 	MaxLen     int
+	// Async makes ADDJOB return once the node receiving the job stores it,
+	// replicating it in the background, see Magi.AddJobTracked
+	Async bool
 }
 
 // Config generates a config representation for the underlying disque lib
@@ -53,6 +118,37 @@ func (c *DisqueOpConfig) Config() disque.Config {
 	}
 }
 
+// Merge returns a copy of the config, with the unset fields filled from the defaults
+func (c *DisqueOpConfig) Merge(defaults *DisqueOpConfig) *DisqueOpConfig {
+	merged := &DisqueOpConfig{}
+	if c != nil {
+		*merged = *c
+	}
+	if defaults == nil {
+		return merged
+	}
+	if merged.Timeout == 0 {
+		merged.Timeout = defaults.Timeout
+	}
+	if merged.Replicate == 0 {
+		merged.Replicate = defaults.Replicate
+	}
+	if merged.Delay == 0 {
+		merged.Delay = defaults.Delay
+	}
+	if merged.RetryAfter == 0 {
+		merged.RetryAfter = defaults.RetryAfter
+	}
+	if merged.TTL == 0 {
+		merged.TTL = defaults.TTL
+	}
+	if merged.MaxLen == 0 {
+		merged.MaxLen = defaults.MaxLen
+	}
+	merged.Async = merged.Async || defaults.Async
+	return merged
+}
+
 // NewDisqueCluster creates disque connection pools to the cluster using hosts information
 func NewDisqueCluster(config *DisqueClusterConfig) (*DisqueCluster, error) {
 	var lbMode DisqueClusterLBMode
@@ -67,15 +163,19 @@ func NewDisqueCluster(config *DisqueClusterConfig) (*DisqueCluster, error) {
 	}
 	n := len(config.Hosts)
 	pools := make([]*disque.Pool, n, n)
+	conns := make([]*redis.Pool, n, n)
 	for i, host := range config.Hosts {
 		pool, err := disque.New(host["address"].(string))
 		if err != nil {
 			return nil, err
 		}
 		pools[i] = pool
+		conns[i] = newPool(host, &config.ConnHooks)
 	}
 	cluster.pools = pools
+	cluster.conns = conns
 	cluster.poolIndex = 0
+	cluster.latencies = make([]time.Duration, n)
 	return cluster, nil
 }
 
@@ -87,96 +187,728 @@ func (cluster *DisqueCluster) Close() error {
 			return err
 		}
 	}
+	for _, conn := range cluster.conns {
+		err := conn.Close()
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// Size returns the number of nodes in the cluster
+func (cluster *DisqueCluster) Size() int {
+	return len(cluster.pools)
+}
+
 // Add adds a job to the disque cluster
 func (cluster *DisqueCluster) Add(queueName string, data string, config *DisqueOpConfig) (*disque.Job, error) {
-	pool := cluster.getPool()
-	if config != nil {
-		pool = pool.With(config.Config())
-	}
-	job, err := pool.Add(data, queueName)
+	var job *disque.Job
+	err := cluster.onQueuePool(queueName, func(i int) error {
+		if config != nil && config.Async {
+			return cluster.timed(i, func() error {
+				var err error
+				job, err = cluster.addRaw(i, queueName, data, config)
+				return err
+			})
+		}
+		pool := cluster.pools[i]
+		if config != nil {
+			pool = pool.With(config.Config())
+		}
+		return cluster.timed(i, func() error {
+			var err error
+			job, err = pool.Add(data, queueName)
+			return err
+		})
+	})
 	return job, err
 }
 
+// addRaw issues ADDJOB on the node for the options the disque lib does not
+// support, which is ASYNC
+func (cluster *DisqueCluster) addRaw(i int, queueName string, data string, config *DisqueOpConfig) (*disque.Job, error) {
+	args := []interface{}{queueName, data, int(config.Timeout / time.Millisecond)}
+	if config.Replicate > 0 {
+		args = append(args, "REPLICATE", config.Replicate)
+	}
+	if config.Delay > 0 {
+		args = append(args, "DELAY", int(config.Delay.Seconds()))
+	}
+	if config.RetryAfter > 0 {
+		args = append(args, "RETRY", int(config.RetryAfter.Seconds()))
+	}
+	if config.TTL > 0 {
+		args = append(args, "TTL", int(config.TTL.Seconds()))
+	}
+	if config.MaxLen > 0 {
+		args = append(args, "MAXLEN", config.MaxLen)
+	}
+	args = append(args, "ASYNC")
+	conn := cluster.conns[i].Get()
+	defer conn.Close()
+	id, err := redis.String(conn.Do("ADDJOB", args...))
+	if err != nil {
+		return nil, err
+	}
+	return &disque.Job{
+		ID:    id,
+		Data:  data,
+		Queue: queueName,
+	}, nil
+}
+
 // Get finds a job in the disque cluster by its id
 func (cluster *DisqueCluster) Get(id string) (*disque.Job, error) {
-	pool := cluster.getPool()
-	job, err := pool.Fetch(id)
+	i := cluster.getPoolIndex()
+	var job *disque.Job
+	err := cluster.timed(i, func() error {
+		var err error
+		job, err = cluster.pools[i].Fetch(id)
+		return err
+	})
 	return job, err
 }
 
 // Ack tries to ack a job as done in the disque cluster
 func (cluster *DisqueCluster) Ack(id string) error {
-	pool := cluster.getPool()
+	i := cluster.getPoolIndex()
 	job := &disque.Job{
 		ID: id,
 	}
-	err := pool.Ack(job)
-	return err
+	return cluster.timed(i, func() error {
+		return cluster.pools[i].Ack(job)
+	})
+}
+
+// DisqueAckBatchSize is the maximum number of jobs acked by a single ACKJOB
+var DisqueAckBatchSize = 256
+
+// AckError is the error for acking several jobs, some of which failed
+type AckError struct {
+	IDs []string // ids of the jobs not acked
+	Err error    // last error encountered
+}
+
+func (err *AckError) Error() string {
+	return fmt.Sprintf("Disque Error: fail to ack %d jobs! (%v)", len(err.IDs), err.Err)
+}
+
+// AckMany acks the jobs as done in the disque cluster, with as few ACKJOB as
+// possible. If some of them fail, the error is an *AckError listing the ids
+// of the jobs not acked.
+func (cluster *DisqueCluster) AckMany(ids []string) error {
+	return ackBatches(ids, func(batch []string) error {
+		args := make([]interface{}, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		i := cluster.getPoolIndex()
+		conn := cluster.conns[i].Get()
+		defer conn.Close()
+		return cluster.timed(i, func() error {
+			_, err := conn.Do("ACKJOB", args...)
+			return err
+		})
+	})
+}
+
+// ackBatches acks the jobs in batches of DisqueAckBatchSize, collecting the
+// ids of the batches failing
+func ackBatches(ids []string, ack func(batch []string) error) error {
+	var failed *AckError
+	size := DisqueAckBatchSize
+	if size <= 0 {
+		size = len(ids)
+	}
+	for start := 0; start < len(ids); start += size {
+		end := start + size
+		if end > len(ids) {
+			end = len(ids)
+		}
+		err := ack(ids[start:end])
+		if err == nil {
+			continue
+		}
+		if failed == nil {
+			failed = &AckError{}
+		}
+		failed.IDs = append(failed.IDs, ids[start:end]...)
+		failed.Err = err
+	}
+	if failed != nil {
+		return failed
+	}
+	return nil
 }
 
 // Nack tries to nack a job so that job is put back into the queue
 func (cluster *DisqueCluster) Nack(id string) error {
-	pool := cluster.getPool()
+	i := cluster.getPoolIndex()
 	job := &disque.Job{
 		ID: id,
 	}
-	err := pool.Nack(job)
-	return err
+	return cluster.timed(i, func() error {
+		return cluster.pools[i].Nack(job)
+	})
+}
+
+// Dequeue removes a job from its queue without acknowledging it, returning
+// the number of nodes that had the job queued
+func (cluster *DisqueCluster) Dequeue(id string) (int, error) {
+	var err error
+	n := 0
+	for _, pool := range cluster.conns {
+		conn := pool.Get()
+		count, e := redis.Int(conn.Do("DEQUEUE", id))
+		conn.Close()
+		if e != nil {
+			err = e
+			continue
+		}
+		n += count
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return 0, err
+}
+
+// ErrDisqueJobNotFound is the error for enqueuing a job unknown to the cluster
+var ErrDisqueJobNotFound = errors.New("Disque Error: job is not found!")
+
+// Enqueue queues a job again right away, e.g. one taken out of its queue by
+// Dequeue or delivered to a consumer, without waiting for its retry or delay.
+// A job that is already queued is left as is. It fails with
+// ErrDisqueJobNotFound if no node knows the job.
+func (cluster *DisqueCluster) Enqueue(id string) error {
+	var err error
+	n := 0
+	for _, pool := range cluster.conns {
+		conn := pool.Get()
+		count, e := redis.Int(conn.Do("ENQUEUE", id))
+		conn.Close()
+		if e != nil {
+			err = e
+			continue
+		}
+		n += count
+	}
+	if n > 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Nothing was queued, either the job is already queued or it's gone
+	fields, err := cluster.Show(id)
+	if err != nil {
+		return err
+	}
+	if fields == nil {
+		return ErrDisqueJobNotFound
+	}
+	return nil
+}
+
+// QueueLength returns the number of jobs queued in the queue, summed over the
+// nodes since each node has its own queue
+func (cluster *DisqueCluster) QueueLength(queueName string) (int, error) {
+	n := 0
+	for _, pool := range cluster.conns {
+		conn := pool.Get()
+		count, err := redis.Int(conn.Do("QLEN", queueName))
+		conn.Close()
+		if err != nil {
+			return 0, err
+		}
+		n += count
+	}
+	return n, nil
+}
+
+// Show returns the fields of the SHOW reply for a job, keyed by field name,
+// from the first node that knows the job, or nil if no node knows the job
+func (cluster *DisqueCluster) Show(id string) (map[string]interface{}, error) {
+	var err error
+	for _, pool := range cluster.conns {
+		conn := pool.Get()
+		reply, e := redis.Values(conn.Do("SHOW", id))
+		conn.Close()
+		if e == redis.ErrNil {
+			continue
+		}
+		if e != nil {
+			err = e
+			continue
+		}
+		return showFields(reply), nil
+	}
+	return nil, err
+}
+
+// showFields keys the fields of a SHOW reply by field name
+func showFields(reply []interface{}) map[string]interface{} {
+	fields := make(map[string]interface{}, len(reply)/2)
+	for i := 0; i+1 < len(reply); i += 2 {
+		name, err := redis.String(reply[i], nil)
+		if err != nil {
+			continue
+		}
+		fields[name] = reply[i+1]
+	}
+	return fields
+}
+
+// showJob creates the job from the fields of a SHOW reply
+func showJob(fields map[string]interface{}) *disque.Job {
+	job := &disque.Job{}
+	job.ID, _ = redis.String(fields["id"], nil)
+	job.Queue, _ = redis.String(fields["queue"], nil)
+	job.Data, _ = redis.String(fields["body"], nil)
+	job.Nacks, _ = redis.Int(fields["nacks"], nil)
+	job.AdditionalDeliveries, _ = redis.Int(fields["additional-deliveries"], nil)
+	ttl, _ := redis.Int(fields["ttl"], nil)
+	job.TTL = time.Duration(ttl) * time.Second
+	retry, _ := redis.Int(fields["retry"], nil)
+	job.Retry = time.Duration(retry) * time.Second
+	delay, _ := redis.Int(fields["delay"], nil)
+	job.Delay = time.Duration(delay) * time.Second
+	return job
+}
+
+// GetError is the error for getting several jobs, some of which could not
+// be looked up on every node
+type GetError struct {
+	IDs []string // ids of the jobs not found on the nodes reached
+	Err error    // last error encountered
+}
+
+func (err *GetError) Error() string {
+	return fmt.Sprintf("Disque Error: fail to look up %d jobs! (%v)", len(err.IDs), err.Err)
+}
+
+// GetMany finds the jobs in the disque cluster by their ids, pipelining the
+// SHOW of the jobs on the node that created them, see NodeForJob. The jobs
+// whose node is unknown or can not be reached are looked up on each node in
+// turn instead, since disque replicates them. The jobs are in the order of
+// the ids, nil for the ones not found. If some nodes can not be reached, the
+// jobs found on the others are returned along with a *GetError listing the
+// ids that may be on the nodes not reached.
+func (cluster *DisqueCluster) GetMany(ids []string) ([]*disque.Job, error) {
+	jobs := make([]*disque.Job, len(ids))
+	owned := make(map[int][]int) // indexes of the ids by the node that created them
+	pending := []int{}           // indexes of the ids to look up on every node
+	nodeIDs := cluster.helloNodeIDs()
+	for k, id := range ids {
+		i := -1
+		if parsed, err := ParseJobID(id); err == nil {
+			i = nodeIndex(nodeIDs, parsed.Node)
+		}
+		if i < 0 {
+			pending = append(pending, k)
+			continue
+		}
+		owned[i] = append(owned[i], k)
+	}
+	failed := make(map[int]bool) // indexes of the ids not looked up on a node
+	var lastErr error
+	for i, ks := range owned {
+		_, notShown, err := cluster.showMany(i, ids, ks, jobs)
+		if err != nil {
+			lastErr = err
+		}
+		for _, k := range notShown {
+			failed[k] = true
+		}
+		pending = append(pending, notShown...)
+	}
+	for i := range cluster.conns {
+		if len(pending) == 0 {
+			break
+		}
+		remaining, notShown, err := cluster.showMany(i, ids, pending, jobs)
+		if err != nil {
+			lastErr = err
+		}
+		for _, k := range notShown {
+			failed[k] = true
+		}
+		pending = remaining
+	}
+	missing := []string{}
+	for _, k := range pending {
+		if failed[k] {
+			missing = append(missing, ids[k])
+		}
+	}
+	if len(missing) > 0 {
+		return jobs, &GetError{
+			IDs: missing,
+			Err: lastErr,
+		}
+	}
+	return jobs, nil
+}
+
+// showMany pipelines the SHOW of the ids at the indexes on the node, filling
+// in the jobs found. It returns the indexes of the jobs not found, and among
+// them those that could not be looked up, along with the last error.
+func (cluster *DisqueCluster) showMany(i int, ids []string, pending []int, jobs []*disque.Job) ([]int, []int, error) {
+	remaining := []int{}
+	failed := []int{}
+	err := cluster.timed(i, func() error {
+		conn := cluster.conns[i].Get()
+		defer conn.Close()
+		for _, k := range pending {
+			conn.Send("SHOW", ids[k])
+		}
+		err := conn.Flush()
+		lastErr := err
+		for _, k := range pending {
+			if err != nil {
+				// The connection is broken, the replies are lost
+				failed = append(failed, k)
+				remaining = append(remaining, k)
+				continue
+			}
+			reply, e := redis.Values(conn.Receive())
+			if e == redis.ErrNil {
+				remaining = append(remaining, k)
+				continue
+			}
+			if e != nil {
+				if _, ok := e.(redis.Error); !ok {
+					err = e
+				}
+				lastErr = e
+				failed = append(failed, k)
+				remaining = append(remaining, k)
+				continue
+			}
+			jobs[k] = showJob(showFields(reply))
+		}
+		return lastErr
+	})
+	return remaining, failed, err
 }
 
 // Wait tries to extend a job's processing status
 func (cluster *DisqueCluster) Wait(id string) error {
-	pool := cluster.getPool()
+	i := cluster.getPoolIndex()
 	job := &disque.Job{
 		ID: id,
 	}
-	err := pool.Wait(job)
-	return err
+	return cluster.timed(i, func() error {
+		return cluster.pools[i].Wait(job)
+	})
 }
 
+// DisqueFetchTimeout is the time a fetch waits for a job by default
+var DisqueFetchTimeout = 2 * time.Second
+
+// FetchOptions are the options for receiving jobs
+type FetchOptions struct {
+	WithCounters bool          // request the delivery counters of the job, which is slower
+	NoHang       bool          // return immediately if the queue is empty
+	Timeout      time.Duration // time waiting for a job, DisqueFetchTimeout if zero
+}
+
+// Counters are the delivery counters of a received job
+type Counters struct {
+	Nacks                int // times the job was nacked
+	AdditionalDeliveries int // times the job was redelivered without a nack
+}
+
+// errNoJob is the error of the disque lib for a fetch timing out without a job
+var errNoJob = errors.New("no data available")
+
 // Fetch receives job from the disque cluster for processing
 func (cluster *DisqueCluster) Fetch(queueName string, config *DisqueOpConfig) (*disque.Job, error) {
-	pool := cluster.getPool()
-	if config != nil {
-		pool = pool.With(config.Config())
-	}
-	pool = pool.Timeout(2 * time.Second)
-	job, err := pool.Get(queueName)
+	job, _, err := cluster.FetchWithOptions(queueName, config, nil)
 	return job, err
 }
 
+// FetchWithOptions receives job from the disque cluster for processing, along
+// with its delivery counters if requested by the options
+func (cluster *DisqueCluster) FetchWithOptions(queueName string, config *DisqueOpConfig, options *FetchOptions) (*disque.Job, *Counters, error) {
+	if options == nil {
+		options = &FetchOptions{}
+	}
+	timeout := DisqueFetchTimeout
+	if options.Timeout > 0 {
+		timeout = options.Timeout
+	}
+	var job *disque.Job
+	var counters *Counters
+	err := cluster.onFetchPool(queueName, func(i int) error {
+		var err error
+		if options.NoHang {
+			// Only fetches not waiting for a job tell the response time of the node
+			return cluster.timed(i, func() error {
+				var err error
+				job, counters, err = cluster.fetchRaw(i, queueName, options, timeout)
+				return err
+			})
+		}
+		if options.WithCounters {
+			job, counters, err = cluster.fetchRaw(i, queueName, options, timeout)
+			return err
+		}
+		pool := cluster.pools[i]
+		if config != nil {
+			pool = pool.With(config.Config())
+		}
+		pool = pool.Timeout(timeout)
+		job, err = pool.Get(queueName)
+		return err
+	})
+	return job, counters, err
+}
+
+// fetchRaw issues GETJOB on the node for the options the disque lib does not
+// support, which are NOHANG and WITHCOUNTERS
+func (cluster *DisqueCluster) fetchRaw(i int, queueName string, options *FetchOptions, timeout time.Duration) (*disque.Job, *Counters, error) {
+	args := []interface{}{}
+	if options.NoHang {
+		args = append(args, "NOHANG")
+	} else {
+		args = append(args, "TIMEOUT", int(timeout/time.Millisecond))
+	}
+	if options.WithCounters {
+		args = append(args, "WITHCOUNTERS")
+	}
+	args = append(args, "FROM", queueName)
+	conn := cluster.conns[i].Get()
+	defer conn.Close()
+	reply, err := redis.Values(conn.Do("GETJOB", args...))
+	if err == redis.ErrNil || (err == nil && len(reply) == 0) {
+		return nil, nil, errNoJob
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	fields, err := redis.Values(reply[0], nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(fields) < 3 {
+		return nil, nil, errNoJob
+	}
+	job := &disque.Job{}
+	job.Queue, _ = redis.String(fields[0], nil)
+	job.ID, _ = redis.String(fields[1], nil)
+	job.Data, _ = redis.String(fields[2], nil)
+	if !options.WithCounters {
+		return job, nil, nil
+	}
+	counters := &Counters{}
+	for k := 3; k+1 < len(fields); k += 2 {
+		name, _ := redis.String(fields[k], nil)
+		value, _ := redis.Int(fields[k+1], nil)
+		switch name {
+		case "nacks":
+			counters.Nacks = value
+		case "additional-deliveries":
+			counters.AdditionalDeliveries = value
+		}
+	}
+	return job, counters, nil
+}
+
+var (
+	// ErrDisqueInvalidJobID is the error for a malformed disque job id
+	ErrDisqueInvalidJobID = errors.New("Disque Error: invalid job id!")
+	// ErrDisqueUnknownNode is the error for a job whose node is not among the configured hosts
+	ErrDisqueUnknownNode = errors.New("Disque Error: job node is not a configured host!")
+)
+
+// JobID is the components of a disque job id, such as
+// D-dcb833cf-8YL1NT17e9+wsA/09NqxscQI-05a1
+type JobID struct {
+	Node   string        // first 8 characters of the id of the node that created the job
+	Random string        // random part making the id unique
+	TTL    time.Duration // ttl of the job when it was created, in whole minutes
+}
+
+// ParseJobID splits a disque job id into its components
+func ParseJobID(id string) (*JobID, error) {
+	parts := strings.Split(id, "-")
+	if len(parts) != 4 || parts[0] != "D" {
+		return nil, ErrDisqueInvalidJobID
+	}
+	node, random, ttl := parts[1], parts[2], parts[3]
+	if len(node) != 8 || len(random) != 24 || len(ttl) != 4 {
+		return nil, ErrDisqueInvalidJobID
+	}
+	if _, err := hex.DecodeString(node); err != nil {
+		return nil, ErrDisqueInvalidJobID
+	}
+	minutes, err := strconv.ParseUint(ttl, 16, 16)
+	if err != nil {
+		return nil, ErrDisqueInvalidJobID
+	}
+	return &JobID{
+		Node:   node,
+		Random: random,
+		TTL:    time.Duration(minutes) * time.Minute,
+	}, nil
+}
+
+// NodeForJob returns the address of the configured host that created the job.
+// Disque embeds the first 8 characters of the node id in each job id, e.g.
+// D-dcb833cf-8YL1NT17e9+wsA/09NqxscQI-05a1, which is matched against the
+// node ids reported by HELLO on each of the configured hosts.
+func (cluster *DisqueCluster) NodeForJob(id string) (string, error) {
+	parsed, err := ParseJobID(id)
+	if err != nil {
+		return "", err
+	}
+	i := nodeIndex(cluster.helloNodeIDs(), parsed.Node)
+	if i < 0 {
+		return "", ErrDisqueUnknownNode
+	}
+	return cluster.config.Hosts[i]["address"].(string), nil
+}
+
+// helloNodeIDs returns the ids of the nodes by the index of the configured
+// hosts, asking the nodes not known yet with HELLO. The ids of the nodes not
+// reached are left empty.
+func (cluster *DisqueCluster) helloNodeIDs() []string {
+	cluster.mutex.Lock()
+	nodeIDs := make([]string, len(cluster.conns))
+	copy(nodeIDs, cluster.nodeIDs)
+	cluster.mutex.Unlock()
+	for i, pool := range cluster.conns {
+		if nodeIDs[i] != "" {
+			continue
+		}
+		var reply []interface{}
+		err := cluster.timed(i, func() error {
+			conn := pool.Get()
+			defer conn.Close()
+			var err error
+			reply, err = redis.Values(conn.Do("HELLO"))
+			return err
+		})
+		if err != nil || len(reply) < 2 {
+			continue
+		}
+		nodeIDs[i], _ = redis.String(reply[1], nil)
+	}
+	cluster.mutex.Lock()
+	cluster.nodeIDs = nodeIDs
+	cluster.mutex.Unlock()
+	return nodeIDs
+}
+
+// nodeIndex returns the index of the node whose id starts with the prefix, or -1
+func nodeIndex(nodeIDs []string, prefix string) int {
+	for i, nodeID := range nodeIDs {
+		if nodeID != "" && strings.HasPrefix(nodeID, prefix) {
+			return i
+		}
+	}
+	return -1
+}
+
+// QueueIterator iterates over the queues known to the cluster with QSCAN, node by node
+type QueueIterator struct {
+	cluster *DisqueCluster
+	pattern string
+	count   int
+	node    int
+	cursor  string
+}
+
+// IterateQueues creates an iterator over the queues with names matching the
+// glob pattern, an empty pattern matches all queues. Since each disque node
+// tracks its own queues, a queue may be returned once for every node that has it.
+func (cluster *DisqueCluster) IterateQueues(pattern string, count int) *QueueIterator {
+	return &QueueIterator{
+		cluster: cluster,
+		pattern: pattern,
+		count:   count,
+		cursor:  "0",
+	}
+}
+
+// Next returns the next batch of queue names, and false once the iteration is done
+func (it *QueueIterator) Next() ([]string, bool, error) {
+	if it.node >= len(it.cluster.conns) {
+		return nil, false, nil
+	}
+	args := []interface{}{it.cursor}
+	if it.count > 0 {
+		args = append(args, "COUNT", it.count)
+	}
+	conn := it.cluster.conns[it.node].Get()
+	reply, err := redis.Values(conn.Do("QSCAN", args...))
+	conn.Close()
+	if err != nil {
+		return nil, false, err
+	}
+	var names []string
+	_, err = redis.Scan(reply, &it.cursor, &names)
+	if err != nil {
+		return nil, false, err
+	}
+	// Move on to the next node once the cursor is exhausted
+	if it.cursor == "0" {
+		it.node++
+	}
+	queues := make([]string, 0, len(names))
+	for _, name := range names {
+		if it.pattern != "" {
+			matched, err := path.Match(it.pattern, name)
+			if err != nil {
+				return nil, false, err
+			}
+			if !matched {
+				continue
+			}
+		}
+		queues = append(queues, name)
+	}
+	return queues, true, nil
+}
+
+// ListQueues returns the names of all the queues matching the glob pattern
+func (cluster *DisqueCluster) ListQueues(pattern string) ([]string, error) {
+	it := cluster.IterateQueues(pattern, 0)
+	seen := make(map[string]bool)
+	queues := []string{}
+	for {
+		names, more, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			break
+		}
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				queues = append(queues, name)
+			}
+		}
+	}
+	return queues, nil
+}
+
 // Pool chaining functions
 
 // Chain sets the index of pool to use for subsequent operations
 func (cluster *DisqueCluster) Chain() {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
 	cluster.poolIndex = cluster.nextPoolIndex()
 	cluster.lbFixed = true
 }
 
 // Unchain unsets the index of the pool
 func (cluster *DisqueCluster) Unchain() {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
 	cluster.lbFixed = false
 }
-
-func (cluster *DisqueCluster) nextPoolIndex() int {
-	n := len(cluster.pools)
-	i := cluster.poolIndex
-	if !cluster.lbFixed {
-		if cluster.lbMode == DisqueClusterLBModeRoundRobin {
-			i++
-			if i >= n {
-				i = 0
-			}
-		}
-	}
-	return i
-}
-
-func (cluster *DisqueCluster) getPool() *disque.Pool {
-	i := cluster.nextPoolIndex()
-	cluster.poolIndex = i
-	return cluster.pools[i]
-}
@@ -0,0 +1,74 @@
+package cluster
+
+import (
+	"errors"
+)
+
+// errNodeDrained is the error of a fetch skipping a drained node
+var errNodeDrained = errors.New("node is drained")
+
+// DrainNode stops fetching jobs from the node at the address, e.g. before
+// taking it down for maintenance, while the jobs already fetched from it can
+// still be acked, nacked and waited on. Fetches go to the other nodes,
+// including those of ordered queues designated to the node, and find no job
+// while all the nodes are drained. Adding jobs is not affected.
+// It fails with ErrDisqueUnknownNode if the address is not a configured host.
+func (cluster *DisqueCluster) DrainNode(address string) error {
+	return cluster.setDrained(address, true)
+}
+
+// UndrainNode resumes fetching jobs from the node at the address
+func (cluster *DisqueCluster) UndrainNode(address string) error {
+	return cluster.setDrained(address, false)
+}
+
+// DrainedNodes returns the addresses of the drained nodes
+func (cluster *DisqueCluster) DrainedNodes() []string {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	addresses := []string{}
+	for i, host := range cluster.config.Hosts {
+		if cluster.drained[i] {
+			addresses = append(addresses, host["address"].(string))
+		}
+	}
+	return addresses
+}
+
+func (cluster *DisqueCluster) setDrained(address string, drained bool) error {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	for i, host := range cluster.config.Hosts {
+		if host["address"] != address {
+			continue
+		}
+		if cluster.drained == nil {
+			cluster.drained = make(map[int]bool)
+		}
+		if drained {
+			cluster.drained[i] = true
+		} else {
+			delete(cluster.drained, i)
+		}
+		return nil
+	}
+	return ErrDisqueUnknownNode
+}
+
+// isDrained returns whether the node at the index is drained
+func (cluster *DisqueCluster) isDrained(i int) bool {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	return cluster.drained[i]
+}
+
+// onFetchPool runs the fetch on the pool for the queue like onQueuePool,
+// skipping the drained nodes
+func (cluster *DisqueCluster) onFetchPool(queueName string, op func(i int) error) error {
+	return cluster.onQueuePool(queueName, func(i int) error {
+		if cluster.isDrained(i) {
+			return errNodeDrained
+		}
+		return op(i)
+	})
+}
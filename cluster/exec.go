@@ -0,0 +1,50 @@
+package cluster
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+// Exec issues an arbitrary command on a node of the disque cluster, chosen
+// the same way as for the other operations, so that it stays on the node of
+// a chained operation. It goes through magi's own connection pools, is
+// reported to the connection hooks and feeds the latency of the node.
+//
+// Exec is an unsupported escape hatch for commands magi does not wrap. The
+// reply is returned as is, and magi makes no guarantee that a command does
+// not interfere with the jobs it manages.
+func (cluster *DisqueCluster) Exec(command string, args ...interface{}) (interface{}, error) {
+	i := cluster.getPoolIndex()
+	var reply interface{}
+	err := cluster.timed(i, func() error {
+		conn := cluster.conns[i].Get()
+		defer conn.Close()
+		var err error
+		reply, err = conn.Do(command, args...)
+		return err
+	})
+	return reply, err
+}
+
+// Exec issues an arbitrary command on the ith redis instance, through the
+// connection pool of the instance. Commands are not replicated to the other
+// instances, it is up to the caller to issue them on each instance if needed.
+//
+// Exec is an unsupported escape hatch for commands magi does not wrap, and
+// magi makes no guarantee that a command does not interfere with its locks.
+func (cluster *RedisCluster) Exec(i int, command string, args ...interface{}) (interface{}, error) {
+	conn := cluster.pools[i].Get()
+	defer conn.Close()
+	return conn.Do(command, args...)
+}
+
+// Exec issues an arbitrary command on the node serving the slot of the key,
+// following the redirections of the cluster. The key only routes the command,
+// it still needs to be among the arguments.
+//
+// Exec is an unsupported escape hatch for commands magi does not wrap, and
+// magi makes no guarantee that a command does not interfere with its locks.
+func (cluster *RedisSlotCluster) Exec(key string, command string, args ...interface{}) (interface{}, error) {
+	return cluster.do(key, func(conn redis.Conn) (interface{}, error) {
+		return conn.Do(command, args...)
+	})
+}
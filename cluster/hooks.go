@@ -0,0 +1,56 @@
+package cluster
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+// ConnHooks are the callbacks for observing the connections of a cluster.
+// Any of them can be left nil, and they're called in their own goroutines so
+// that a slow hook never blocks a connection from being dialed or used.
+type ConnHooks struct {
+	OnConnect    func(address string)            // a connection is opened
+	OnDisconnect func(address string)            // a connection is closed
+	OnConnError  func(address string, err error) // a connection fails to open or errors
+}
+
+func (hooks *ConnHooks) connect(address string) {
+	if hooks != nil && hooks.OnConnect != nil {
+		go hooks.OnConnect(address)
+	}
+}
+
+func (hooks *ConnHooks) disconnect(address string) {
+	if hooks != nil && hooks.OnDisconnect != nil {
+		go hooks.OnDisconnect(address)
+	}
+}
+
+func (hooks *ConnHooks) connError(address string, err error) {
+	if hooks != nil && hooks.OnConnError != nil {
+		go hooks.OnConnError(address, err)
+	}
+}
+
+// hookedConn is a connection reporting its errors and closing to the hooks
+type hookedConn struct {
+	redis.Conn
+	address string
+	hooks   *ConnHooks
+}
+
+func (conn *hookedConn) Do(command string, args ...interface{}) (interface{}, error) {
+	reply, err := conn.Conn.Do(command, args...)
+	if err != nil {
+		// Error replies from the server are not connection errors
+		if _, ok := err.(redis.Error); !ok && err != redis.ErrNil {
+			conn.hooks.connError(conn.address, err)
+		}
+	}
+	return reply, err
+}
+
+func (conn *hookedConn) Close() error {
+	err := conn.Conn.Close()
+	conn.hooks.disconnect(conn.address)
+	return err
+}
@@ -0,0 +1,655 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/evanhuang8/magi/clock"
+	"github.com/goware/disque"
+)
+
+// MemoryPollInterval is the time between checks of a blocking fetch on a MemoryCluster
+var MemoryPollInterval = 10 * time.Millisecond
+
+// memoryDefaultRetry is the retry of jobs added without one, like disque's default
+var memoryDefaultRetry = 5 * time.Minute
+
+// memoryNodeID is the id of the single node of a MemoryCluster
+const memoryNodeID = "00000000000000000000000000000000000000000"
+
+// MemoryCluster is an in-memory stand-in for both the disque and the redis
+// clusters, so that code using Magi can be tested without running the
+// servers. It behaves like a single node of each: jobs are delivered in the
+// order they're added, redelivered after their retry unless acked, and keys
+// expire after their ttl. The cluster is the job backend, and Locks returns
+// the lock backend.
+type MemoryCluster struct {
+	clock  clock.Clock
+	jobs   map[string]*memoryJob
+	seq    int64 // order of the jobs
+	keys   map[string]*memoryKey
+	notify chan struct{}
+	mutex  sync.Mutex
+}
+
+type memoryJob struct {
+	id          string
+	queueName   string
+	data        string
+	seq         int64
+	createdAt   time.Time
+	expiresAt   time.Time
+	retry       time.Duration
+	delay       time.Duration
+	queued      bool
+	availableAt time.Time // when a queued job can be fetched
+	requeueAt   time.Time // when a fetched job is queued again, never if zero
+	nacks       int
+	deliveries  int
+}
+
+type memoryKey struct {
+	value     string
+	hash      map[string]string
+	expiresAt time.Time // never if zero
+}
+
+// NewMemoryCluster creates an empty in-memory cluster
+func NewMemoryCluster() *MemoryCluster {
+	return &MemoryCluster{
+		clock:  clock.New(),
+		jobs:   make(map[string]*memoryJob),
+		keys:   make(map[string]*memoryKey),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// SetClock replaces the source of time for delays, retries and ttls
+func (c *MemoryCluster) SetClock(clock clock.Clock) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.clock = clock
+}
+
+// Wake up a blocking fetch
+func (c *MemoryCluster) wake() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Add adds a job to the queue
+func (c *MemoryCluster) Add(queueName string, data string, config *DisqueOpConfig) (*disque.Job, error) {
+	if config == nil {
+		config = &DisqueOpConfig{}
+	}
+	if config.Replicate > 1 {
+		return nil, errors.New("NOREPL Not enough reachable nodes for the requested replication level")
+	}
+	raw := make([]byte, 12)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if config.MaxLen > 0 && c.queueLength(queueName) >= config.MaxLen {
+		return nil, errors.New("MAXLEN Queue is already longer than the specified MAXLEN count")
+	}
+	now := c.clock.Now()
+	ttl := DisqueDefaultTTL
+	if config.TTL > 0 {
+		ttl = config.TTL
+	}
+	retry := memoryDefaultRetry
+	if config.RetryAfter > 0 {
+		retry = config.RetryAfter
+	}
+	c.seq++
+	job := &memoryJob{
+		id:          "D-" + memoryNodeID[:8] + "-" + hex.EncodeToString(raw) + "-05a1",
+		queueName:   queueName,
+		data:        data,
+		seq:         c.seq,
+		createdAt:   now,
+		expiresAt:   now.Add(ttl),
+		retry:       retry,
+		delay:       config.Delay,
+		queued:      true,
+		availableAt: now.Add(config.Delay),
+	}
+	c.jobs[job.id] = job
+	c.wake()
+	return job.disque(), nil
+}
+
+// Get returns the job by its id
+func (c *MemoryCluster) Get(id string) (*disque.Job, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.update()
+	job, exists := c.jobs[id]
+	if !exists {
+		return nil, errNoJob
+	}
+	return job.disque(), nil
+}
+
+// GetMany returns the jobs by their ids, nil for the ones not found
+func (c *MemoryCluster) GetMany(ids []string) ([]*disque.Job, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.update()
+	jobs := make([]*disque.Job, len(ids))
+	for k, id := range ids {
+		if job, exists := c.jobs[id]; exists {
+			jobs[k] = job.disque()
+		}
+	}
+	return jobs, nil
+}
+
+// Fetch receives job from the queue for processing
+func (c *MemoryCluster) Fetch(queueName string, config *DisqueOpConfig) (*disque.Job, error) {
+	job, _, err := c.FetchWithOptions(queueName, config, nil)
+	return job, err
+}
+
+// FetchWithOptions receives job from the queue for processing, along with its
+// delivery counters if requested by the options
+func (c *MemoryCluster) FetchWithOptions(queueName string, config *DisqueOpConfig, options *FetchOptions) (*disque.Job, *Counters, error) {
+	if options == nil {
+		options = &FetchOptions{}
+	}
+	timeout := DisqueFetchTimeout
+	if options.Timeout > 0 {
+		timeout = options.Timeout
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		job, counters := c.next(queueName)
+		if job != nil {
+			if !options.WithCounters {
+				counters = nil
+			}
+			return job, counters, nil
+		}
+		remaining := deadline.Sub(time.Now())
+		if options.NoHang || remaining <= 0 {
+			return nil, nil, errNoJob
+		}
+		if remaining > MemoryPollInterval {
+			remaining = MemoryPollInterval
+		}
+		select {
+		case <-c.notify:
+		case <-time.After(remaining):
+		}
+	}
+}
+
+// next delivers the first job available in the queue, if any
+func (c *MemoryCluster) next(queueName string) (*disque.Job, *Counters) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.update()
+	now := c.clock.Now()
+	var next *memoryJob
+	for _, job := range c.jobs {
+		if job.queueName != queueName || !job.queued || job.availableAt.After(now) {
+			continue
+		}
+		if next == nil || job.seq < next.seq {
+			next = job
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+	next.queued = false
+	next.deliveries++
+	next.requeueAt = now.Add(next.retry)
+	counters := &Counters{
+		Nacks:                next.nacks,
+		AdditionalDeliveries: next.additionalDeliveries(),
+	}
+	return next.disque(), counters
+}
+
+// update expires and requeues the jobs due, must be called with the mutex held
+func (c *MemoryCluster) update() {
+	now := c.clock.Now()
+	for id, job := range c.jobs {
+		if !job.expiresAt.After(now) {
+			delete(c.jobs, id)
+			continue
+		}
+		if !job.queued && !job.requeueAt.IsZero() && !job.requeueAt.After(now) {
+			job.queued = true
+			job.availableAt = now
+			job.requeueAt = time.Time{}
+		}
+	}
+}
+
+// Returns the number of jobs queued, must be called with the mutex held
+func (c *MemoryCluster) queueLength(queueName string) int {
+	n := 0
+	for _, job := range c.jobs {
+		if job.queueName == queueName && job.queued {
+			n++
+		}
+	}
+	return n
+}
+
+// Ack removes the job
+func (c *MemoryCluster) Ack(id string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.jobs, id)
+	return nil
+}
+
+// AckMany acks the jobs as done
+func (c *MemoryCluster) AckMany(ids []string) error {
+	return ackBatches(ids, func(batch []string) error {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		for _, id := range batch {
+			delete(c.jobs, id)
+		}
+		return nil
+	})
+}
+
+// Nack puts the job back into the queue
+func (c *MemoryCluster) Nack(id string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	job, exists := c.jobs[id]
+	if !exists {
+		return nil
+	}
+	job.nacks++
+	job.queued = true
+	job.availableAt = c.clock.Now()
+	job.requeueAt = time.Time{}
+	c.wake()
+	return nil
+}
+
+// Wait postpones the redelivery of the job by its retry
+func (c *MemoryCluster) Wait(id string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	job, exists := c.jobs[id]
+	if exists && !job.queued {
+		job.requeueAt = c.clock.Now().Add(job.retry)
+	}
+	return nil
+}
+
+// Dequeue removes the job from its queue without removing the job, and
+// returns 1 if the job was queued
+func (c *MemoryCluster) Dequeue(id string) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.update()
+	job, exists := c.jobs[id]
+	if !exists || !job.queued {
+		return 0, nil
+	}
+	job.queued = false
+	job.requeueAt = time.Time{}
+	return 1, nil
+}
+
+// Enqueue queues the job again right away, or fails with ErrDisqueJobNotFound
+// if there is no such job
+func (c *MemoryCluster) Enqueue(id string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.update()
+	job, exists := c.jobs[id]
+	if !exists {
+		return ErrDisqueJobNotFound
+	}
+	now := c.clock.Now()
+	if job.queued && !job.availableAt.After(now) {
+		return nil
+	}
+	// Delayed jobs are queued right away too, like disque
+	job.queued = true
+	job.availableAt = now
+	job.requeueAt = time.Time{}
+	c.wake()
+	return nil
+}
+
+// Show returns the fields of the job like the SHOW reply, or nil if there is no such job
+func (c *MemoryCluster) Show(id string) (map[string]interface{}, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.update()
+	job, exists := c.jobs[id]
+	if !exists {
+		return nil, nil
+	}
+	now := c.clock.Now()
+	// Like disque, delayed jobs are active until their delay is over, and
+	// awake to be queued again at the requeue time. The delay is reported in
+	// whole seconds, rounded up so that it covers the time the job is delayed.
+	state := "active"
+	var requeue time.Duration
+	if job.queued && job.availableAt.After(now) {
+		requeue = job.availableAt.Sub(now)
+	} else if job.queued {
+		state = "queued"
+	} else if !job.requeueAt.IsZero() {
+		requeue = job.requeueAt.Sub(now)
+	}
+	return map[string]interface{}{
+		"id":                    []byte(job.id),
+		"queue":                 []byte(job.queueName),
+		"state":                 []byte(state),
+		"repl":                  int64(1),
+		"ttl":                   int64(job.expiresAt.Sub(now) / time.Second),
+		"ctime":                 job.createdAt.UnixNano(),
+		"delay":                 int64((job.delay + time.Second - 1) / time.Second),
+		"retry":                 int64(job.retry / time.Second),
+		"nacks":                 int64(job.nacks),
+		"additional-deliveries": int64(job.additionalDeliveries()),
+		"nodes-delivered":       []interface{}{[]byte(memoryNodeID)},
+		"nodes-confirmed":       []interface{}{},
+		"next-requeue-within":   int64(requeue / time.Millisecond),
+		"next-awake-within":     int64(requeue / time.Millisecond),
+		"body":                  []byte(job.data),
+	}, nil
+}
+
+// QueueLength returns the number of jobs queued in the queue
+func (c *MemoryCluster) QueueLength(queueName string) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.update()
+	return c.queueLength(queueName), nil
+}
+
+// ListQueues returns the names of the queues with queued jobs matching the pattern
+func (c *MemoryCluster) ListQueues(pattern string) ([]string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.update()
+	seen := make(map[string]bool)
+	queues := []string{}
+	for _, job := range c.jobs {
+		if !job.queued || seen[job.queueName] {
+			continue
+		}
+		if pattern != "" {
+			matched, err := path.Match(pattern, job.queueName)
+			if err != nil {
+				return nil, err
+			}
+			if !matched {
+				continue
+			}
+		}
+		seen[job.queueName] = true
+		queues = append(queues, job.queueName)
+	}
+	sort.Strings(queues)
+	return queues, nil
+}
+
+// SetOrdered does nothing, jobs of a single node are always delivered in order
+func (c *MemoryCluster) SetOrdered(queueName string, ordered bool) {}
+
+// Size returns the number of nodes, which is one
+func (c *MemoryCluster) Size() int {
+	return 1
+}
+
+// Chain does nothing, there is a single node
+func (c *MemoryCluster) Chain() {}
+
+// Unchain does nothing, there is a single node
+func (c *MemoryCluster) Unchain() {}
+
+// Close does nothing, the data is kept until the cluster is dropped
+func (c *MemoryCluster) Close() error {
+	return nil
+}
+
+// additionalDeliveries returns the redeliveries of the job that are not caused by a nack
+func (job *memoryJob) additionalDeliveries() int {
+	n := job.deliveries - job.nacks - 1
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// disque returns the job in the form of the disque lib
+func (job *memoryJob) disque() *disque.Job {
+	return &disque.Job{
+		ID:    job.id,
+		Queue: job.queueName,
+		Data:  job.data,
+		Retry: job.retry,
+	}
+}
+
+// memoryLocks is the redis side of a MemoryCluster
+type memoryLocks struct {
+	c *MemoryCluster
+}
+
+// Locks returns the redis side of the cluster, sharing its data
+func (c *MemoryCluster) Locks() LockBackend {
+	return memoryLocks{c}
+}
+
+// GetQuorum returns the quorum of the single instance, which is one
+func (l memoryLocks) GetQuorum() int {
+	return 1
+}
+
+// Instances returns the number of instances, which is one
+func (l memoryLocks) Instances() int {
+	return 1
+}
+
+// Returns the live key, must be called with the mutex held
+func (c *MemoryCluster) key(name string) *memoryKey {
+	key, exists := c.keys[name]
+	if !exists {
+		return nil
+	}
+	if !key.expiresAt.IsZero() && !key.expiresAt.After(c.clock.Now()) {
+		delete(c.keys, name)
+		return nil
+	}
+	return key
+}
+
+// Returns the expiry for the ttl, never if not positive
+func (c *MemoryCluster) expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return c.clock.Now().Add(ttl)
+}
+
+// SetNX sets the key to the value with the ttl, unless the key exists
+func (l memoryLocks) SetNX(i int, key string, value string, ttl time.Duration) (bool, error) {
+	l.c.mutex.Lock()
+	defer l.c.mutex.Unlock()
+	if l.c.key(key) != nil {
+		return false, nil
+	}
+	l.c.keys[key] = &memoryKey{
+		value:     value,
+		expiresAt: l.c.expiry(ttl),
+	}
+	return true, nil
+}
+
+// CompareAndDelete removes the key if it is set to the value
+func (l memoryLocks) CompareAndDelete(i int, key string, value string) (bool, error) {
+	l.c.mutex.Lock()
+	defer l.c.mutex.Unlock()
+	k := l.c.key(key)
+	if k == nil || k.value != value {
+		return false, nil
+	}
+	delete(l.c.keys, key)
+	return true, nil
+}
+
+// CompareAndExtend resets the ttl of the key if it is set to the value
+func (l memoryLocks) CompareAndExtend(i int, key string, value string, ttl time.Duration) (bool, error) {
+	l.c.mutex.Lock()
+	defer l.c.mutex.Unlock()
+	k := l.c.key(key)
+	if k == nil || k.value != value {
+		return false, nil
+	}
+	k.expiresAt = l.c.expiry(ttl)
+	return true, nil
+}
+
+// Set sets the key to the value with the ttl
+func (l memoryLocks) Set(key string, value string, ttl time.Duration) (bool, error) {
+	l.c.mutex.Lock()
+	defer l.c.mutex.Unlock()
+	l.c.keys[key] = &memoryKey{
+		value:     value,
+		expiresAt: l.c.expiry(ttl),
+	}
+	return true, nil
+}
+
+// Get returns the value of the key, or "" if not found
+func (l memoryLocks) Get(key string) (string, error) {
+	l.c.mutex.Lock()
+	defer l.c.mutex.Unlock()
+	k := l.c.key(key)
+	if k == nil {
+		return "", nil
+	}
+	return k.value, nil
+}
+
+// Del removes the key
+func (l memoryLocks) Del(key string) error {
+	l.c.mutex.Lock()
+	defer l.c.mutex.Unlock()
+	delete(l.c.keys, key)
+	return nil
+}
+
+// Incr increments the counter at key, refreshing its ttl
+func (l memoryLocks) Incr(key string, ttl time.Duration) (int, error) {
+	l.c.mutex.Lock()
+	defer l.c.mutex.Unlock()
+	count := 0
+	if k := l.c.key(key); k != nil {
+		n, err := strconv.Atoi(k.value)
+		if err != nil {
+			return 0, err
+		}
+		count = n
+	}
+	count++
+	l.c.keys[key] = &memoryKey{
+		value:     strconv.Itoa(count),
+		expiresAt: l.c.expiry(ttl),
+	}
+	return count, nil
+}
+
+// HSet sets the field of the hash at key to the value
+func (l memoryLocks) HSet(key string, field string, value string) (bool, error) {
+	l.c.mutex.Lock()
+	defer l.c.mutex.Unlock()
+	k := l.c.key(key)
+	if k == nil {
+		k = &memoryKey{}
+		l.c.keys[key] = k
+	}
+	if k.hash == nil {
+		k.hash = make(map[string]string)
+	}
+	k.hash[field] = value
+	return true, nil
+}
+
+// HGetAll returns the fields of the hash at key
+func (l memoryLocks) HGetAll(key string) (map[string]string, error) {
+	l.c.mutex.Lock()
+	defer l.c.mutex.Unlock()
+	fields := make(map[string]string)
+	if k := l.c.key(key); k != nil {
+		for field, value := range k.hash {
+			fields[field] = value
+		}
+	}
+	return fields, nil
+}
+
+// HDel removes the field of the hash at key
+func (l memoryLocks) HDel(key string, field string) error {
+	l.c.mutex.Lock()
+	defer l.c.mutex.Unlock()
+	if k := l.c.key(key); k != nil {
+		delete(k.hash, field)
+	}
+	return nil
+}
+
+// Close does nothing, the data is kept until the cluster is dropped
+func (l memoryLocks) Close() error {
+	return nil
+}
+
+// Scan returns the keys matching the glob-style pattern
+func (l memoryLocks) Scan(i int, pattern string) ([]string, error) {
+	l.c.mutex.Lock()
+	defer l.c.mutex.Unlock()
+	keys := []string{}
+	for name := range l.c.keys {
+		matched, err := path.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if matched && l.c.key(name) != nil {
+			keys = append(keys, name)
+		}
+	}
+	return keys, nil
+}
+
+// Inspect returns the value of the key and the time left before it expires,
+// which is zero if it never does. The value is empty if the key doesn't exist.
+func (l memoryLocks) Inspect(i int, key string) (string, time.Duration, error) {
+	l.c.mutex.Lock()
+	defer l.c.mutex.Unlock()
+	k := l.c.key(key)
+	if k == nil {
+		return "", 0, nil
+	}
+	ttl := time.Duration(0)
+	if !k.expiresAt.IsZero() {
+		ttl = k.expiresAt.Sub(l.c.clock.Now())
+	}
+	return k.value, ttl, nil
+}
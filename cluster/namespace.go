@@ -0,0 +1,201 @@
+package cluster
+
+import (
+	"strings"
+	"time"
+
+	"github.com/goware/disque"
+)
+
+// NamespacedJobBackend prefixes the names of the queues of a job backend
+// with a namespace, so that several applications can share a cluster without
+// their queues colliding. The queue names passed to it and reported by it
+// are the ones without the namespace.
+type NamespacedJobBackend struct {
+	JobBackend
+	Namespace string
+}
+
+// NewNamespacedJobBackend creates a job backend prefixing the queues of jobs with the namespace
+func NewNamespacedJobBackend(jobs JobBackend, namespace string) *NamespacedJobBackend {
+	return &NamespacedJobBackend{
+		JobBackend: jobs,
+		Namespace:  namespace,
+	}
+}
+
+// strip removes the namespace from the queue of the job
+func (backend *NamespacedJobBackend) strip(job *disque.Job) *disque.Job {
+	if job != nil {
+		job.Queue = strings.TrimPrefix(job.Queue, backend.Namespace)
+	}
+	return job
+}
+
+// Add adds a job to the namespaced queue
+func (backend *NamespacedJobBackend) Add(queueName string, data string, config *DisqueOpConfig) (*disque.Job, error) {
+	job, err := backend.JobBackend.Add(backend.Namespace+queueName, data, config)
+	return backend.strip(job), err
+}
+
+// Get returns the job by its id
+func (backend *NamespacedJobBackend) Get(id string) (*disque.Job, error) {
+	job, err := backend.JobBackend.Get(id)
+	return backend.strip(job), err
+}
+
+// GetMany returns the jobs by their ids
+func (backend *NamespacedJobBackend) GetMany(ids []string) ([]*disque.Job, error) {
+	jobs, err := backend.JobBackend.GetMany(ids)
+	for _, job := range jobs {
+		backend.strip(job)
+	}
+	return jobs, err
+}
+
+// Fetch receives a job from the namespaced queue
+func (backend *NamespacedJobBackend) Fetch(queueName string, config *DisqueOpConfig) (*disque.Job, error) {
+	job, err := backend.JobBackend.Fetch(backend.Namespace+queueName, config)
+	return backend.strip(job), err
+}
+
+// FetchWithOptions receives a job from the namespaced queue
+func (backend *NamespacedJobBackend) FetchWithOptions(queueName string, config *DisqueOpConfig, options *FetchOptions) (*disque.Job, *Counters, error) {
+	job, counters, err := backend.JobBackend.FetchWithOptions(backend.Namespace+queueName, config, options)
+	return backend.strip(job), counters, err
+}
+
+// Show returns the fields of the SHOW reply for a job, with the queue
+// without the namespace
+func (backend *NamespacedJobBackend) Show(id string) (map[string]interface{}, error) {
+	fields, err := backend.JobBackend.Show(id)
+	if fields == nil {
+		return fields, err
+	}
+	switch queueName := fields["queue"].(type) {
+	case []byte:
+		fields["queue"] = []byte(strings.TrimPrefix(string(queueName), backend.Namespace))
+	case string:
+		fields["queue"] = strings.TrimPrefix(queueName, backend.Namespace)
+	}
+	return fields, err
+}
+
+// ListQueues returns the queues of the namespace matching the glob pattern
+func (backend *NamespacedJobBackend) ListQueues(pattern string) ([]string, error) {
+	if pattern == "" {
+		pattern = "*"
+	}
+	queues, err := backend.JobBackend.ListQueues(backend.Namespace + pattern)
+	if err != nil {
+		return nil, err
+	}
+	for i, queueName := range queues {
+		queues[i] = strings.TrimPrefix(queueName, backend.Namespace)
+	}
+	return queues, nil
+}
+
+// QueueLength returns the number of jobs queued in the namespaced queue
+func (backend *NamespacedJobBackend) QueueLength(queueName string) (int, error) {
+	return backend.JobBackend.QueueLength(backend.Namespace + queueName)
+}
+
+// SetOrdered sets whether the jobs of the namespaced queue are delivered in order
+func (backend *NamespacedJobBackend) SetOrdered(queueName string, ordered bool) {
+	backend.JobBackend.SetOrdered(backend.Namespace+queueName, ordered)
+}
+
+// NamespacedLockBackend prefixes the keys of a lock backend with a
+// namespace, so that the locks, indexes and counters of several applications
+// sharing a cluster do not collide. The keys passed to it and reported by it
+// are the ones without the namespace.
+type NamespacedLockBackend struct {
+	LockBackend
+	Namespace string
+}
+
+// NewNamespacedLockBackend creates a lock backend prefixing the keys with the namespace
+func NewNamespacedLockBackend(locks LockBackend, namespace string) *NamespacedLockBackend {
+	return &NamespacedLockBackend{
+		LockBackend: locks,
+		Namespace:   namespace,
+	}
+}
+
+// Shard returns the namespaced shard owning the key if the backend is
+// sharded, and the backend itself otherwise
+func (backend *NamespacedLockBackend) Shard(key string) LockBackend {
+	sharded, ok := backend.LockBackend.(Sharded)
+	if !ok {
+		return backend
+	}
+	return NewNamespacedLockBackend(sharded.Shard(backend.Namespace+key), backend.Namespace)
+}
+
+// SetNX sets the namespaced key on the instance if it does not exist
+func (backend *NamespacedLockBackend) SetNX(i int, key string, value string, ttl time.Duration) (bool, error) {
+	return backend.LockBackend.SetNX(i, backend.Namespace+key, value, ttl)
+}
+
+// CompareAndDelete deletes the namespaced key on the instance if it has the value
+func (backend *NamespacedLockBackend) CompareAndDelete(i int, key string, value string) (bool, error) {
+	return backend.LockBackend.CompareAndDelete(i, backend.Namespace+key, value)
+}
+
+// CompareAndExtend extends the namespaced key on the instance if it has the value
+func (backend *NamespacedLockBackend) CompareAndExtend(i int, key string, value string, ttl time.Duration) (bool, error) {
+	return backend.LockBackend.CompareAndExtend(i, backend.Namespace+key, value, ttl)
+}
+
+// Set sets the namespaced key
+func (backend *NamespacedLockBackend) Set(key string, value string, ttl time.Duration) (bool, error) {
+	return backend.LockBackend.Set(backend.Namespace+key, value, ttl)
+}
+
+// Get returns the value of the namespaced key
+func (backend *NamespacedLockBackend) Get(key string) (string, error) {
+	return backend.LockBackend.Get(backend.Namespace + key)
+}
+
+// Del deletes the namespaced key
+func (backend *NamespacedLockBackend) Del(key string) error {
+	return backend.LockBackend.Del(backend.Namespace + key)
+}
+
+// Incr increments the namespaced key
+func (backend *NamespacedLockBackend) Incr(key string, ttl time.Duration) (int, error) {
+	return backend.LockBackend.Incr(backend.Namespace+key, ttl)
+}
+
+// HSet sets the field of the namespaced hash
+func (backend *NamespacedLockBackend) HSet(key string, field string, value string) (bool, error) {
+	return backend.LockBackend.HSet(backend.Namespace+key, field, value)
+}
+
+// HGetAll returns the fields of the namespaced hash
+func (backend *NamespacedLockBackend) HGetAll(key string) (map[string]string, error) {
+	return backend.LockBackend.HGetAll(backend.Namespace + key)
+}
+
+// HDel deletes the field of the namespaced hash
+func (backend *NamespacedLockBackend) HDel(key string, field string) error {
+	return backend.LockBackend.HDel(backend.Namespace+key, field)
+}
+
+// Scan returns the keys of the namespace on the instance matching the pattern
+func (backend *NamespacedLockBackend) Scan(i int, pattern string) ([]string, error) {
+	keys, err := backend.LockBackend.Scan(i, backend.Namespace+pattern)
+	if err != nil {
+		return nil, err
+	}
+	for j, key := range keys {
+		keys[j] = strings.TrimPrefix(key, backend.Namespace)
+	}
+	return keys, nil
+}
+
+// Inspect returns the value and the time to live of the namespaced key on the instance
+func (backend *NamespacedLockBackend) Inspect(i int, key string) (string, time.Duration, error) {
+	return backend.LockBackend.Inspect(i, backend.Namespace+key)
+}
@@ -0,0 +1,103 @@
+package cluster
+
+import (
+	"hash/crc32"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// SetOrdered sets whether jobs of the queue are added to and fetched from a
+// single node, chosen by hashing the queue name, so that they're delivered in
+// order even on a multi-node cluster.
+//
+// This trades throughput for ordering: the load of the queue is no longer
+// spread across the nodes, and the designated node is the bottleneck of the
+// queue. If the designated node fails, the following node takes over, and
+// the failover is reported to the OnFailover hook of the config since
+// ordering is no longer guaranteed.
+func (cluster *DisqueCluster) SetOrdered(queueName string, ordered bool) {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	if cluster.orderedQueues == nil {
+		cluster.orderedQueues = make(map[string]bool)
+	}
+	if ordered {
+		cluster.orderedQueues[queueName] = true
+	} else {
+		delete(cluster.orderedQueues, queueName)
+	}
+}
+
+// IsOrdered returns whether the queue is pinned to a single node
+func (cluster *DisqueCluster) IsOrdered(queueName string) bool {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	return cluster.orderedQueues[queueName]
+}
+
+// queueNode returns the index of the node designated for the queue
+func (cluster *DisqueCluster) queueNode(queueName string) int {
+	return int(crc32.ChecksumIEEE([]byte(queueName)) % uint32(len(cluster.pools)))
+}
+
+// onQueuePool runs the operation on the index of the pool for the queue, which
+// is the designated node for ordered queues, failing over to the following
+// nodes. Other queues fail over only while the nodes are unavailable.
+func (cluster *DisqueCluster) onQueuePool(queueName string, op func(i int) error) error {
+	warn := func(address string, err error) {
+		if cluster.config.OnFailover != nil {
+			go cluster.config.OnFailover(queueName, address, err)
+		}
+	}
+	if !cluster.IsOrdered(queueName) {
+		return cluster.failover(cluster.getPoolIndex(), op, isUnavailable, warn)
+	}
+	return cluster.failover(cluster.queueNode(queueName), op, isNodeFailure, warn)
+}
+
+// failover runs the operation on the nodes from the start one, until it
+// succeeds or fails with an error that is not worth trying another node
+func (cluster *DisqueCluster) failover(start int, op func(i int) error, retryable func(error) bool, warn func(address string, err error)) error {
+	var err error
+	n := len(cluster.pools)
+	attempted := false
+	for k := 0; k < n; k++ {
+		i := (start + k) % n
+		e := classifyError(op(i))
+		if e == errNodeDrained {
+			continue
+		}
+		err = e
+		attempted = true
+		if err == nil || !retryable(err) {
+			// Keep chained operations on the node used
+			cluster.mutex.Lock()
+			if cluster.lbFixed {
+				cluster.poolIndex = i
+			}
+			cluster.mutex.Unlock()
+			return err
+		}
+		warn(cluster.config.Hosts[i]["address"].(string), err)
+		if cluster.config.Backoff != nil && k+1 < n {
+			time.Sleep(cluster.config.Backoff.Next(k + 1))
+		}
+	}
+	if !attempted {
+		// All the nodes are drained
+		return errNoJob
+	}
+	return err
+}
+
+// isNodeFailure returns whether the error is caused by the node being unreachable
+func isNodeFailure(err error) bool {
+	if err.Error() == errNoJob.Error() {
+		return false
+	}
+	if _, ok := err.(redis.Error); ok {
+		return false
+	}
+	return true
+}
@@ -1,6 +1,7 @@
 package cluster
 
 import (
+	"errors"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -23,6 +24,7 @@ type RedisCluster struct {
 // RedisClusterConfig is the config struct for creating a redis locking cluster
 type RedisClusterConfig struct {
 	Hosts []map[string]interface{}
+	ConnHooks
 }
 
 // NewRedisCluster creates a redis connection pool using hosts information
@@ -33,37 +35,49 @@ func NewRedisCluster(config *RedisClusterConfig) *RedisCluster {
 	n := len(config.Hosts)
 	pools := make([]*redis.Pool, n, n)
 	for i, host := range config.Hosts {
-		func(host map[string]interface{}) {
-			pool := &redis.Pool{
-				MaxIdle:     3,
-				IdleTimeout: 240 * time.Second,
-				Dial: func() (redis.Conn, error) {
-					conn, err := redis.Dial("tcp", host["address"].(string))
-					if err != nil {
-						return nil, err
-					}
-					if _, exists := host["auth"]; exists {
-						if _, err := conn.Do("AUTH", host["auth"].(string)); err != nil {
-							conn.Close()
-							return nil, err
-						}
-					}
-					if _, exists := host["db"]; exists {
-						if _, err := conn.Do("SELECT", host["db"].(string)); err != nil {
-							conn.Close()
-							return nil, err
-						}
-					}
-					return conn, nil
-				},
-			}
-			pools[i] = pool
-		}(host)
+		pools[i] = newPool(host, &config.ConnHooks)
 	}
 	cluster.pools = pools
 	return cluster
 }
 
+// newPool creates a redis protocol connection pool to the host
+func newPool(host map[string]interface{}, hooks *ConnHooks) *redis.Pool {
+	address := host["address"].(string)
+	pool := &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			conn, err := redis.Dial("tcp", address)
+			if err != nil {
+				hooks.connError(address, err)
+				return nil, err
+			}
+			if _, exists := host["auth"]; exists {
+				if _, err := conn.Do("AUTH", host["auth"].(string)); err != nil {
+					conn.Close()
+					hooks.connError(address, err)
+					return nil, err
+				}
+			}
+			if _, exists := host["db"]; exists {
+				if _, err := conn.Do("SELECT", host["db"].(string)); err != nil {
+					conn.Close()
+					hooks.connError(address, err)
+					return nil, err
+				}
+			}
+			hooks.connect(address)
+			return &hookedConn{
+				Conn:    conn,
+				address: address,
+				hooks:   hooks,
+			}, nil
+		},
+	}
+	return pool
+}
+
 // Close closes the connection pools to the redis instances
 func (cluster *RedisCluster) Close() error {
 	for _, pool := range cluster.pools {
@@ -84,3 +98,296 @@ func (cluster *RedisCluster) GetQuorum() int {
 func (cluster *RedisCluster) GetPools() *[]*redis.Pool {
 	return &cluster.pools
 }
+
+// Set sets the key to the value with the ttl on every redis instance
+func (cluster *RedisCluster) Set(key string, value string, ttl time.Duration) (bool, error) {
+	var err error
+	n := 0
+	for _, pool := range cluster.pools {
+		conn := pool.Get()
+		_, err = conn.Do("SET", setArgs(key, value, ttl)...)
+		conn.Close()
+		if err != nil {
+			continue
+		}
+		n++
+	}
+	if n < cluster.GetQuorum() {
+		return false, err
+	}
+	return true, nil
+}
+
+// setArgs returns the arguments of SET for the key and the value with the
+// options, expiring after the ttl unless it is zero
+func setArgs(key string, value string, ttl time.Duration, options ...interface{}) []interface{} {
+	args := append([]interface{}{key, value}, options...)
+	if ttl > 0 {
+		args = append(args, "PX", int(ttl/time.Millisecond))
+	}
+	return args
+}
+
+// Get returns the value of the key from the first redis instance that has it
+func (cluster *RedisCluster) Get(key string) (string, error) {
+	var err error
+	for _, pool := range cluster.pools {
+		conn := pool.Get()
+		var value string
+		value, err = redis.String(conn.Do("GET", key))
+		conn.Close()
+		if err == redis.ErrNil {
+			err = nil
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		return value, nil
+	}
+	return "", err
+}
+
+// Incr increments the counter at key on every redis instance, refreshing its
+// ttl, and returns the highest count among the instances
+func (cluster *RedisCluster) Incr(key string, ttl time.Duration) (int, error) {
+	var err error
+	n := 0
+	count := 0
+	for _, pool := range cluster.pools {
+		conn := pool.Get()
+		var value int
+		value, err = redis.Int(incrScript.Do(conn, key, int(ttl/time.Millisecond)))
+		conn.Close()
+		if err != nil {
+			continue
+		}
+		n++
+		if value > count {
+			count = value
+		}
+	}
+	if n < cluster.GetQuorum() {
+		return 0, err
+	}
+	return count, nil
+}
+
+var incrScript = redis.NewScript(1, `
+  local count = redis.call("INCR", KEYS[1])
+  redis.call("PEXPIRE", KEYS[1], ARGV[1])
+  return count
+`)
+
+// Del removes the key from every redis instance
+func (cluster *RedisCluster) Del(key string) error {
+	var err error
+	for _, pool := range cluster.pools {
+		conn := pool.Get()
+		_, e := conn.Do("DEL", key)
+		conn.Close()
+		if e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// HSet sets the field of the hash at key to the value on every redis instance
+func (cluster *RedisCluster) HSet(key string, field string, value string) (bool, error) {
+	var err error
+	n := 0
+	for _, pool := range cluster.pools {
+		conn := pool.Get()
+		_, err = conn.Do("HSET", key, field, value)
+		conn.Close()
+		if err != nil {
+			continue
+		}
+		n++
+	}
+	if n < cluster.GetQuorum() {
+		return false, err
+	}
+	return true, nil
+}
+
+// HGetAll returns the union of the fields of the hash at key on the redis
+// instances, preferring the values of the earlier instances
+func (cluster *RedisCluster) HGetAll(key string) (map[string]string, error) {
+	var err error
+	n := 0
+	fields := make(map[string]string)
+	for _, pool := range cluster.pools {
+		conn := pool.Get()
+		var values map[string]string
+		values, err = redis.StringMap(conn.Do("HGETALL", key))
+		conn.Close()
+		if err != nil {
+			continue
+		}
+		n++
+		for field, value := range values {
+			if _, exists := fields[field]; !exists {
+				fields[field] = value
+			}
+		}
+	}
+	if n < cluster.GetQuorum() {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// HDel removes the field of the hash at key from every redis instance
+func (cluster *RedisCluster) HDel(key string, field string) error {
+	var err error
+	for _, pool := range cluster.pools {
+		conn := pool.Get()
+		_, e := conn.Do("HDEL", key, field)
+		conn.Close()
+		if e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Instances returns the number of redis instances
+func (cluster *RedisCluster) Instances() int {
+	return len(cluster.pools)
+}
+
+// SetNX sets the key to the value with the ttl on the instance, unless the key exists
+func (cluster *RedisCluster) SetNX(i int, key string, value string, ttl time.Duration) (bool, error) {
+	conn := cluster.pools[i].Get()
+	defer conn.Close()
+	reply, err := redis.String(conn.Do("SET", setArgs(key, value, ttl, "NX")...))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return reply == "OK", nil
+}
+
+// CompareAndDelete removes the key from the instance if it is set to the value
+func (cluster *RedisCluster) CompareAndDelete(i int, key string, value string) (bool, error) {
+	conn := cluster.pools[i].Get()
+	defer conn.Close()
+	status, err := redis.Int(compareAndDelete.Do(conn, key, value))
+	if err != nil {
+		return false, err
+	}
+	return status != 0, nil
+}
+
+// CompareAndExtend resets the ttl of the key on the instance if it is set to the value
+func (cluster *RedisCluster) CompareAndExtend(i int, key string, value string, ttl time.Duration) (bool, error) {
+	conn := cluster.pools[i].Get()
+	defer conn.Close()
+	reply, err := redis.String(compareAndExtend.Do(conn, key, value, int(ttl/time.Millisecond)))
+	if err != nil {
+		return false, err
+	}
+	return reply == "OK", nil
+}
+
+var compareAndDelete = redis.NewScript(1, `
+  if redis.call("GET", KEYS[1]) == ARGV[1] then
+    return redis.call("DEL", KEYS[1])
+  else
+    return 0
+  end
+`)
+
+var compareAndExtend = redis.NewScript(1, `
+  if redis.call("GET", KEYS[1]) == ARGV[1] then
+    return redis.call("SET", KEYS[1], ARGV[1], "XX", "PX", ARGV[2])
+  else
+    return "ERR"
+  end
+`)
+
+// Scan returns the keys matching the glob-style pattern on the instance
+func (cluster *RedisCluster) Scan(i int, pattern string) ([]string, error) {
+	conn := cluster.pools[i].Get()
+	defer conn.Close()
+	return scanKeys(conn, pattern)
+}
+
+// scanKeys iterates over the keys matching the pattern with SCAN
+func scanKeys(conn redis.Conn, pattern string) ([]string, error) {
+	keys := []string{}
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 100))
+		if err != nil {
+			return nil, err
+		}
+		if len(reply) != 2 {
+			return nil, errors.New("Redis Error: unexpected SCAN reply!")
+		}
+		cursor, err = redis.String(reply[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		batch, err := redis.Strings(reply[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
+// Inspect returns the value of the key on the instance and the time left
+// before it expires, which is zero if it never does. The value is empty if
+// the key doesn't exist.
+func (cluster *RedisCluster) Inspect(i int, key string) (string, time.Duration, error) {
+	conn := cluster.pools[i].Get()
+	defer conn.Close()
+	reply, err := inspectKey(conn, key)
+	if err != nil {
+		return "", 0, err
+	}
+	return reply.value, reply.ttl, nil
+}
+
+type inspection struct {
+	value string
+	ttl   time.Duration
+}
+
+// inspectKey gets the value and the ttl of the key in one round trip
+func inspectKey(conn redis.Conn, key string) (*inspection, error) {
+	conn.Send("GET", key)
+	conn.Send("PTTL", key)
+	err := conn.Flush()
+	if err != nil {
+		return nil, err
+	}
+	value, err := redis.String(conn.Receive())
+	if err == redis.ErrNil {
+		conn.Receive()
+		return &inspection{}, nil
+	}
+	if err != nil {
+		conn.Receive()
+		return nil, err
+	}
+	ttl, err := redis.Int64(conn.Receive())
+	if err != nil {
+		return nil, err
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	return &inspection{
+		value: value,
+		ttl:   time.Duration(ttl) * time.Millisecond,
+	}, nil
+}
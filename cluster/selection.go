@@ -0,0 +1,132 @@
+package cluster
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// DisqueLatencyDecay is the weight of the latest response time in the moving
+// average of the response times of a node
+var DisqueLatencyDecay = 0.2
+
+// DisqueLatencyPenalty is the response time recorded for an operation failing
+// to reach the node, so that the latency weighted lb mode steers away from it
+var DisqueLatencyPenalty = time.Second
+
+// Latencies returns the moving average of the response times of the nodes,
+// in the order of the configured hosts, zero for the nodes not used yet.
+// Fetches waiting for a job are not counted, since their response time is
+// that of the queue rather than the node.
+func (cluster *DisqueCluster) Latencies() []time.Duration {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	latencies := make([]time.Duration, len(cluster.latencies))
+	copy(latencies, cluster.latencies)
+	return latencies
+}
+
+// ChainTo pins the subsequent operations to the node at the index of the
+// configured hosts, like Chain does with the node picked by the lb mode. It
+// is used to keep the operations on a job of an ordered queue on the node
+// designated for the queue.
+func (cluster *DisqueCluster) ChainTo(i int) {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	cluster.poolIndex = i % len(cluster.pools)
+	cluster.lbFixed = true
+}
+
+// timed runs the operation on the node, recording its response time
+func (cluster *DisqueCluster) timed(i int, op func() error) error {
+	start := time.Now()
+	err := op()
+	elapsed := time.Since(start)
+	if err != nil && err != errNoJob {
+		// Error replies still tell how fast the node is, failing to reach it does not
+		if _, ok := err.(redis.Error); !ok {
+			elapsed = DisqueLatencyPenalty
+		}
+	}
+	cluster.observe(i, elapsed)
+	return err
+}
+
+// observe adds the response time of an operation to the moving average of the node
+func (cluster *DisqueCluster) observe(i int, elapsed time.Duration) {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	if i >= len(cluster.latencies) {
+		return
+	}
+	current := cluster.latencies[i]
+	if current == 0 {
+		cluster.latencies[i] = elapsed
+		return
+	}
+	cluster.latencies[i] = current + time.Duration(DisqueLatencyDecay*float64(elapsed-current))
+}
+
+// nextPoolIndex picks the node for the next operation with the lb mode,
+// unless the operations are chained to a node. It must be called with the
+// mutex held.
+func (cluster *DisqueCluster) nextPoolIndex() int {
+	n := len(cluster.pools)
+	i := cluster.poolIndex
+	if cluster.lbFixed || n <= 1 {
+		return i
+	}
+	switch cluster.lbMode {
+	case DisqueClusterLBModeRoundRobin:
+		i++
+		if i >= n {
+			i = 0
+		}
+	case DisqueClusterLBModeRandom:
+		i = rand.Intn(n)
+	case DisqueClusterLBModeLatencyWeighted:
+		i = pickWeighted(cluster.latencies)
+	}
+	return i
+}
+
+// pickWeighted picks an index at random with a probability inversely
+// proportional to its latency. Nodes without a latency yet are weighted as
+// the fastest node, so that they get a chance to be measured.
+func pickWeighted(latencies []time.Duration) int {
+	fastest := time.Duration(0)
+	for _, latency := range latencies {
+		if latency > 0 && (fastest == 0 || latency < fastest) {
+			fastest = latency
+		}
+	}
+	if fastest == 0 {
+		return rand.Intn(len(latencies))
+	}
+	weights := make([]float64, len(latencies))
+	total := 0.0
+	for i, latency := range latencies {
+		if latency <= 0 {
+			latency = fastest
+		}
+		weights[i] = 1 / float64(latency)
+		total += weights[i]
+	}
+	r := rand.Float64() * total
+	for i, weight := range weights {
+		r -= weight
+		if r < 0 {
+			return i
+		}
+	}
+	return len(latencies) - 1
+}
+
+func (cluster *DisqueCluster) getPoolIndex() int {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	i := cluster.nextPoolIndex()
+	cluster.poolIndex = i
+	return i
+}
@@ -0,0 +1,189 @@
+package cluster
+
+import (
+	"errors"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ErrNoShards is the error for sharding the locks over no backend
+var ErrNoShards = errors.New("Redis Error: sharded locks need at least one shard!")
+
+// ShardReplicas is the number of points each shard has on the hash ring, the
+// more points the more evenly the keys are spread
+var ShardReplicas = 160
+
+// Sharded is implemented by the lock backends spreading the keys over
+// several independent backends, so that a lock is taken on the backend
+// owning its key only
+type Sharded interface {
+	Shard(key string) LockBackend
+}
+
+// ShardedLockBackend spreads the keys over several independent lock
+// backends by consistent hashing, for more lock throughput than a single
+// backend can take. Unlike the instances of a RedisCluster, which all hold
+// every lock, each key lives on a single shard. The shards should have the
+// same number of instances, since Instances and GetQuorum report those of
+// the first shard.
+type ShardedLockBackend struct {
+	shards []LockBackend
+	ring   []uint32       // sorted hashes of the points on the ring
+	owners map[uint32]int // shard owning each point of the ring
+}
+
+// NewShardedLockBackend creates a lock backend spreading the keys over the
+// shards, it fails with ErrNoShards if there is none
+func NewShardedLockBackend(shards ...LockBackend) (*ShardedLockBackend, error) {
+	if len(shards) == 0 {
+		return nil, ErrNoShards
+	}
+	backend := &ShardedLockBackend{
+		shards: shards,
+		owners: make(map[uint32]int),
+	}
+	for i := range shards {
+		for k := 0; k < ShardReplicas; k++ {
+			point := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + "-" + strconv.Itoa(k)))
+			if _, exists := backend.owners[point]; exists {
+				continue
+			}
+			backend.owners[point] = i
+			backend.ring = append(backend.ring, point)
+		}
+	}
+	sort.Sort(uint32Slice(backend.ring))
+	return backend, nil
+}
+
+// NewShardedRedisCluster creates a lock backend spreading the keys over the
+// redis clusters, it fails with ErrNoShards if there is none
+func NewShardedRedisCluster(configs ...*RedisClusterConfig) (*ShardedLockBackend, error) {
+	if len(configs) == 0 {
+		return nil, ErrNoShards
+	}
+	shards := make([]LockBackend, len(configs))
+	for i, config := range configs {
+		shards[i] = NewRedisCluster(config)
+	}
+	return NewShardedLockBackend(shards...)
+}
+
+// Shard returns the backend owning the key, which is the first point of the
+// ring following the hash of the key
+func (backend *ShardedLockBackend) Shard(key string) LockBackend {
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(backend.ring), func(i int) bool {
+		return backend.ring[i] >= hash
+	})
+	if i == len(backend.ring) {
+		i = 0
+	}
+	return backend.shards[backend.owners[backend.ring[i]]]
+}
+
+// Shards returns the backends the keys are spread over
+func (backend *ShardedLockBackend) Shards() []LockBackend {
+	return backend.shards
+}
+
+// GetQuorum returns the quorum of the first shard
+func (backend *ShardedLockBackend) GetQuorum() int {
+	return backend.shards[0].GetQuorum()
+}
+
+// Instances returns the number of instances of the first shard
+func (backend *ShardedLockBackend) Instances() int {
+	return backend.shards[0].Instances()
+}
+
+// SetNX sets the key on the instance of its shard if it does not exist
+func (backend *ShardedLockBackend) SetNX(i int, key string, value string, ttl time.Duration) (bool, error) {
+	return backend.Shard(key).SetNX(i, key, value, ttl)
+}
+
+// CompareAndDelete deletes the key on the instance of its shard if it holds the value
+func (backend *ShardedLockBackend) CompareAndDelete(i int, key string, value string) (bool, error) {
+	return backend.Shard(key).CompareAndDelete(i, key, value)
+}
+
+// CompareAndExtend extends the ttl of the key on the instance of its shard if it holds the value
+func (backend *ShardedLockBackend) CompareAndExtend(i int, key string, value string, ttl time.Duration) (bool, error) {
+	return backend.Shard(key).CompareAndExtend(i, key, value, ttl)
+}
+
+// Set sets the key on its shard
+func (backend *ShardedLockBackend) Set(key string, value string, ttl time.Duration) (bool, error) {
+	return backend.Shard(key).Set(key, value, ttl)
+}
+
+// Get gets the key from its shard
+func (backend *ShardedLockBackend) Get(key string) (string, error) {
+	return backend.Shard(key).Get(key)
+}
+
+// Del deletes the key from its shard
+func (backend *ShardedLockBackend) Del(key string) error {
+	return backend.Shard(key).Del(key)
+}
+
+// Incr increments the key on its shard
+func (backend *ShardedLockBackend) Incr(key string, ttl time.Duration) (int, error) {
+	return backend.Shard(key).Incr(key, ttl)
+}
+
+// HSet sets the field of the hash on its shard
+func (backend *ShardedLockBackend) HSet(key string, field string, value string) (bool, error) {
+	return backend.Shard(key).HSet(key, field, value)
+}
+
+// HGetAll gets all the fields of the hash from its shard
+func (backend *ShardedLockBackend) HGetAll(key string) (map[string]string, error) {
+	return backend.Shard(key).HGetAll(key)
+}
+
+// HDel deletes the field of the hash from its shard
+func (backend *ShardedLockBackend) HDel(key string, field string) error {
+	return backend.Shard(key).HDel(key, field)
+}
+
+// Scan returns the keys matching the pattern on the instance of every shard
+func (backend *ShardedLockBackend) Scan(i int, pattern string) ([]string, error) {
+	var keys []string
+	for _, shard := range backend.shards {
+		if i >= shard.Instances() {
+			continue
+		}
+		found, err := shard.Scan(i, pattern)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, found...)
+	}
+	return keys, nil
+}
+
+// Inspect returns the value and ttl of the key on the instance of its shard
+func (backend *ShardedLockBackend) Inspect(i int, key string) (string, time.Duration, error) {
+	return backend.Shard(key).Inspect(i, key)
+}
+
+// Close closes all the shards
+func (backend *ShardedLockBackend) Close() error {
+	var err error
+	for _, shard := range backend.shards {
+		if e := shard.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// uint32Slice sorts the points of the ring
+type uint32Slice []uint32
+
+func (s uint32Slice) Len() int           { return len(s) }
+func (s uint32Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
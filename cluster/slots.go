@@ -0,0 +1,399 @@
+package cluster
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// RedisClusterSlots is the number of hash slots of a redis cluster
+const RedisClusterSlots = 16384
+
+// ErrRedisNoSlotNode is the error for a hash slot not served by any known node
+var ErrRedisNoSlotNode = errors.New("Redis Error: no node serves the hash slot!")
+
+// ErrRedisTooManyRedirects is the error for a command redirected too many times
+var ErrRedisTooManyRedirects = errors.New("Redis Error: too many redirections!")
+
+// RedisSlotCluster is a client of a redis cluster, which routes every key to
+// the node serving its hash slot, as opposed to RedisCluster, which holds the
+// keys on each of a group of independent instances.
+//
+// Since a key lives on a single shard, locks are held on that shard alone,
+// which makes the cluster a single instance from the point of view of the
+// locks. Every lock script only touches the key of the lock, so scripts never
+// span slots; the ticket queue of GetBlocking does, and blocking locks race
+// for the key instead of waiting in line.
+type RedisSlotCluster struct {
+	config *RedisSlotClusterConfig
+	mutex  sync.RWMutex // guards pools and slots
+	pools  map[string]*redis.Pool
+	slots  [RedisClusterSlots]string // address of the node serving each slot
+}
+
+// RedisSlotClusterConfig is the config struct for creating a redis cluster client
+type RedisSlotClusterConfig struct {
+	Hosts        []map[string]interface{} // seed nodes the slots are discovered from
+	MaxRedirects int                      // redirections followed by a command, 5 if zero
+	ConnHooks
+}
+
+// NewRedisSlotCluster creates a client of the redis cluster, discovering the
+// slots from the seed hosts on first use
+func NewRedisSlotCluster(config *RedisSlotClusterConfig) *RedisSlotCluster {
+	return &RedisSlotCluster{
+		config: config,
+		pools:  make(map[string]*redis.Pool),
+	}
+}
+
+// KeySlot returns the hash slot of the key. Only the part of the key between
+// the first braces is hashed if it is not empty, so that keys sharing a
+// {hash tag} live on the same slot.
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16([]byte(key)) % RedisClusterSlots)
+}
+
+// crc16 computes the CRC16-XMODEM checksum used by redis cluster
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// pool returns the connection pool to the node, creating it if needed
+func (cluster *RedisSlotCluster) pool(address string) *redis.Pool {
+	cluster.mutex.RLock()
+	pool, exists := cluster.pools[address]
+	cluster.mutex.RUnlock()
+	if exists {
+		return pool
+	}
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	if pool, exists = cluster.pools[address]; exists {
+		return pool
+	}
+	host := map[string]interface{}{
+		"address": address,
+	}
+	// Discovered nodes share the credentials of the seed nodes
+	if len(cluster.config.Hosts) > 0 {
+		if auth, exists := cluster.config.Hosts[0]["auth"]; exists {
+			host["auth"] = auth
+		}
+	}
+	pool = newPool(host, &cluster.config.ConnHooks)
+	cluster.pools[address] = pool
+	return pool
+}
+
+// refreshSlots discovers the nodes serving the slots from the known nodes,
+// starting with the seed nodes
+func (cluster *RedisSlotCluster) refreshSlots() error {
+	addresses := []string{}
+	for _, host := range cluster.config.Hosts {
+		addresses = append(addresses, host["address"].(string))
+	}
+	cluster.mutex.RLock()
+	for address := range cluster.pools {
+		addresses = append(addresses, address)
+	}
+	cluster.mutex.RUnlock()
+	err := ErrRedisNoSlotNode
+	for _, address := range addresses {
+		conn := cluster.pool(address).Get()
+		var ranges []interface{}
+		ranges, err = redis.Values(conn.Do("CLUSTER", "SLOTS"))
+		conn.Close()
+		if err != nil {
+			continue
+		}
+		var slots [RedisClusterSlots]string
+		for _, r := range ranges {
+			var start, end int
+			var master []interface{}
+			fields, e := redis.Values(r, nil)
+			if e == nil && len(fields) >= 3 {
+				start, _ = redis.Int(fields[0], nil)
+				end, _ = redis.Int(fields[1], nil)
+				master, e = redis.Values(fields[2], nil)
+			}
+			if e != nil || len(master) < 2 {
+				continue
+			}
+			ip, _ := redis.String(master[0], nil)
+			port, _ := redis.Int(master[1], nil)
+			if ip == "" {
+				// The node answering serves the slots itself
+				ip = address[:strings.LastIndexByte(address, ':')]
+			}
+			for slot := start; slot <= end && slot < RedisClusterSlots; slot++ {
+				slots[slot] = ip + ":" + strconv.Itoa(port)
+			}
+		}
+		cluster.mutex.Lock()
+		cluster.slots = slots
+		cluster.mutex.Unlock()
+		return nil
+	}
+	return err
+}
+
+// node returns the address of the node serving the slot
+func (cluster *RedisSlotCluster) node(slot int) (string, error) {
+	cluster.mutex.RLock()
+	address := cluster.slots[slot]
+	cluster.mutex.RUnlock()
+	if address != "" {
+		return address, nil
+	}
+	err := cluster.refreshSlots()
+	if err != nil {
+		return "", err
+	}
+	cluster.mutex.RLock()
+	address = cluster.slots[slot]
+	cluster.mutex.RUnlock()
+	if address == "" {
+		return "", ErrRedisNoSlotNode
+	}
+	return address, nil
+}
+
+// do runs the operation on a connection to the node serving the slot of the
+// key, following MOVED and ASK redirections
+func (cluster *RedisSlotCluster) do(key string, op func(conn redis.Conn) (interface{}, error)) (interface{}, error) {
+	slot := KeySlot(key)
+	address, err := cluster.node(slot)
+	if err != nil {
+		return nil, err
+	}
+	asking := false
+	var lastErr error // connection error of the last attempt
+	redirects := cluster.config.MaxRedirects
+	if redirects <= 0 {
+		redirects = 5
+	}
+	for i := 0; i <= redirects; i++ {
+		conn := cluster.pool(address).Get()
+		if asking {
+			conn.Do("ASKING")
+		}
+		reply, err := op(conn)
+		conn.Close()
+		redisErr, ok := err.(redis.Error)
+		if err == nil || err == redis.ErrNil {
+			return reply, err
+		}
+		if !ok {
+			// The node may be gone, rediscover the slots before trying again
+			lastErr = err
+			if err = cluster.refreshSlots(); err != nil {
+				return nil, lastErr
+			}
+			if address, err = cluster.node(slot); err != nil {
+				return nil, err
+			}
+			asking = false
+			continue
+		}
+		// Redirections are in the form of "MOVED <slot> <address>"
+		fields := strings.Fields(redisErr.Error())
+		if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+			return reply, err
+		}
+		address = fields[2]
+		lastErr = nil
+		asking = fields[0] == "ASK"
+		if !asking {
+			cluster.mutex.Lock()
+			cluster.slots[slot] = address
+			cluster.mutex.Unlock()
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, ErrRedisTooManyRedirects
+}
+
+// Close closes the connection pools to the nodes
+func (cluster *RedisSlotCluster) Close() error {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	for _, pool := range cluster.pools {
+		err := pool.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetQuorum returns 1, a key is held by its shard alone
+func (cluster *RedisSlotCluster) GetQuorum() int {
+	return 1
+}
+
+// Instances returns 1, the cluster is a single instance for the locks
+func (cluster *RedisSlotCluster) Instances() int {
+	return 1
+}
+
+// SetNX sets the key to the value with the ttl, unless the key exists
+func (cluster *RedisSlotCluster) SetNX(i int, key string, value string, ttl time.Duration) (bool, error) {
+	reply, err := redis.String(cluster.do(key, func(conn redis.Conn) (interface{}, error) {
+		return conn.Do("SET", setArgs(key, value, ttl, "NX")...)
+	}))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return reply == "OK", nil
+}
+
+// CompareAndDelete removes the key if it is set to the value
+func (cluster *RedisSlotCluster) CompareAndDelete(i int, key string, value string) (bool, error) {
+	status, err := redis.Int(cluster.do(key, func(conn redis.Conn) (interface{}, error) {
+		return compareAndDelete.Do(conn, key, value)
+	}))
+	if err != nil {
+		return false, err
+	}
+	return status != 0, nil
+}
+
+// CompareAndExtend resets the ttl of the key if it is set to the value
+func (cluster *RedisSlotCluster) CompareAndExtend(i int, key string, value string, ttl time.Duration) (bool, error) {
+	reply, err := redis.String(cluster.do(key, func(conn redis.Conn) (interface{}, error) {
+		return compareAndExtend.Do(conn, key, value, int(ttl/time.Millisecond))
+	}))
+	if err != nil {
+		return false, err
+	}
+	return reply == "OK", nil
+}
+
+// Set sets the key to the value with the ttl
+func (cluster *RedisSlotCluster) Set(key string, value string, ttl time.Duration) (bool, error) {
+	_, err := cluster.do(key, func(conn redis.Conn) (interface{}, error) {
+		return conn.Do("SET", setArgs(key, value, ttl)...)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Get returns the value of the key, or an empty string if it doesn't exist
+func (cluster *RedisSlotCluster) Get(key string) (string, error) {
+	value, err := redis.String(cluster.do(key, func(conn redis.Conn) (interface{}, error) {
+		return conn.Do("GET", key)
+	}))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return value, err
+}
+
+// Del removes the key
+func (cluster *RedisSlotCluster) Del(key string) error {
+	_, err := cluster.do(key, func(conn redis.Conn) (interface{}, error) {
+		return conn.Do("DEL", key)
+	})
+	return err
+}
+
+// Incr increments the counter at key, refreshing its ttl, and returns the count
+func (cluster *RedisSlotCluster) Incr(key string, ttl time.Duration) (int, error) {
+	return redis.Int(cluster.do(key, func(conn redis.Conn) (interface{}, error) {
+		return incrScript.Do(conn, key, int(ttl/time.Millisecond))
+	}))
+}
+
+// HSet sets the field of the hash at key to the value
+func (cluster *RedisSlotCluster) HSet(key string, field string, value string) (bool, error) {
+	_, err := cluster.do(key, func(conn redis.Conn) (interface{}, error) {
+		return conn.Do("HSET", key, field, value)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// HGetAll returns the fields of the hash at key
+func (cluster *RedisSlotCluster) HGetAll(key string) (map[string]string, error) {
+	return redis.StringMap(cluster.do(key, func(conn redis.Conn) (interface{}, error) {
+		return conn.Do("HGETALL", key)
+	}))
+}
+
+// HDel removes the field of the hash at key
+func (cluster *RedisSlotCluster) HDel(key string, field string) error {
+	_, err := cluster.do(key, func(conn redis.Conn) (interface{}, error) {
+		return conn.Do("HDEL", key, field)
+	})
+	return err
+}
+
+// Scan returns the keys matching the glob-style pattern on every master node
+// of the cluster, the instance is ignored
+func (cluster *RedisSlotCluster) Scan(i int, pattern string) ([]string, error) {
+	if _, err := cluster.node(0); err != nil {
+		return nil, err
+	}
+	cluster.mutex.RLock()
+	masters := make(map[string]bool)
+	for _, address := range cluster.slots {
+		if address != "" {
+			masters[address] = true
+		}
+	}
+	cluster.mutex.RUnlock()
+	keys := []string{}
+	for address := range masters {
+		conn := cluster.pool(address).Get()
+		found, err := scanKeys(conn, pattern)
+		conn.Close()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, found...)
+	}
+	return keys, nil
+}
+
+// Inspect returns the value of the key and the time left before it expires,
+// which is zero if it never does. The value is empty if the key doesn't exist.
+func (cluster *RedisSlotCluster) Inspect(i int, key string) (string, time.Duration, error) {
+	reply, err := cluster.do(key, func(conn redis.Conn) (interface{}, error) {
+		return inspectKey(conn, key)
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	found := reply.(*inspection)
+	return found.value, found.ttl, nil
+}
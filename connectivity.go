@@ -0,0 +1,43 @@
+package magi
+
+import (
+	"sync/atomic"
+
+	"github.com/evanhuang8/magi/cluster"
+)
+
+// connectivity counts the connection errors of the clusters of an instance,
+// so that the jobs processed across an error can be told apart
+type connectivity struct {
+	errors uint64 // accessed atomically
+}
+
+// report counts a connection error, it has the signature of ConnHooks.OnConnError
+func (c *connectivity) report(address string, err error) {
+	atomic.AddUint64(&c.errors, 1)
+}
+
+// count returns the number of connection errors so far
+func (c *connectivity) count() uint64 {
+	return atomic.LoadUint64(&c.errors)
+}
+
+// hooked returns the hooks also reporting the connection errors to c
+func (c *connectivity) hooked(hooks cluster.ConnHooks) cluster.ConnHooks {
+	onConnError := hooks.OnConnError
+	hooks.OnConnError = func(address string, err error) {
+		c.report(address, err)
+		if onConnError != nil {
+			onConnError(address, err)
+		}
+	}
+	return hooks
+}
+
+// ReportConnError records that a connection of the instance failed, which
+// flags the jobs being processed with Event.ConnectivityDisrupted. The
+// clusters connected by New report their errors already, this is for the
+// hooks of custom backends.
+func (m *Magi) ReportConnError(address string, err error) {
+	m.conn.report(address, err)
+}
@@ -0,0 +1,158 @@
+package cron
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrCronInvalidExpression is the error for an expression that can not be parsed
+var ErrCronInvalidExpression = errors.New("Cron Error: invalid cron expression!")
+
+// Expression is a parsed cron expression, with the standard five fields:
+// minute, hour, day of month, month and day of week
+type Expression struct {
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+
+	anyDom bool // whether the day of month is unrestricted
+	anyDow bool // whether the day of week is unrestricted
+}
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses a cron expression. Each field accepts *, numbers, ranges
+// (a-b), steps (*/n or a-b/n) and comma separated lists of them. The macros
+// @yearly, @monthly, @weekly, @daily and @hourly are accepted as well.
+func Parse(expr string) (*Expression, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, exists := macros[expr]; exists {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, ErrCronInvalidExpression
+	}
+	e := &Expression{
+		anyDom: fields[2] == "*",
+		anyDow: fields[4] == "*",
+	}
+	var err error
+	if e.minute, err = parseField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if e.hour, err = parseField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if e.dom, err = parseField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if e.month, err = parseField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if e.dow, err = parseField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// Both 0 and 7 are sunday
+	if e.dow&(1<<7) != 0 {
+		e.dow |= 1
+	}
+	return e, nil
+}
+
+// Parse a field into a set of bits for the values in range
+func parseField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, ErrCronInvalidExpression
+			}
+			step = n
+			part = part[:i]
+		}
+		low, high := min, max
+		if part != "*" {
+			if i := strings.Index(part, "-"); i >= 0 {
+				var err error
+				if low, err = strconv.Atoi(part[:i]); err != nil {
+					return 0, ErrCronInvalidExpression
+				}
+				if high, err = strconv.Atoi(part[i+1:]); err != nil {
+					return 0, ErrCronInvalidExpression
+				}
+			} else {
+				n, err := strconv.Atoi(part)
+				if err != nil {
+					return 0, ErrCronInvalidExpression
+				}
+				low = n
+				high = n
+				// A step on a single value runs until the end of the range
+				if step > 1 {
+					high = max
+				}
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, ErrCronInvalidExpression
+		}
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// Returns whether the day matches, which is either the day of month or the
+// day of week matching when both are restricted, like the classic cron
+func (e *Expression) dayMatches(t time.Time) bool {
+	dom := e.dom&(1<<uint(t.Day())) != 0
+	dow := e.dow&(1<<uint(t.Weekday())) != 0
+	if e.anyDom || e.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time matching the expression strictly after the
+// time, or the zero time if there is none within five years
+func (e *Expression) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc).Add(time.Minute)
+	limit := t.Year() + 5
+	for t.Year() <= limit {
+		if e.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !e.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if e.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if e.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,97 @@
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/evanhuang8/magi/cron"
+)
+
+func TestParse(t *testing.T) {
+	assert := assert.New(t)
+	valid := []string{
+		"* * * * *",
+		"*/15 0-6 1,15 * 1-5",
+		"5/10 * * 1-12/3 7",
+		" 0 12 * * 0 ",
+		"@yearly",
+		"@monthly",
+		"@weekly",
+		"@daily",
+		"@midnight",
+		"@hourly",
+	}
+	for _, expr := range valid {
+		e, err := cron.Parse(expr)
+		assert.Empty(err, expr)
+		assert.NotEmpty(e, expr)
+	}
+	invalid := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-a * * * *",
+		"1,,2 * * * *",
+		"@every",
+	}
+	for _, expr := range invalid {
+		e, err := cron.Parse(expr)
+		assert.Equal(cron.ErrCronInvalidExpression, err, expr)
+		assert.Empty(e, expr)
+	}
+}
+
+func TestNext(t *testing.T) {
+	assert := assert.New(t)
+	// Sunday, 31 December 2017
+	now := time.Date(2017, time.December, 31, 23, 58, 30, 0, time.UTC)
+	cases := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2017, time.December, 31, 23, 59, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"58 23 * * *", time.Date(2018, time.January, 1, 23, 58, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2018, time.January, 1, 9, 0, 0, 0, time.UTC)},
+		{"30 6 15 * *", time.Date(2018, time.January, 15, 6, 30, 0, 0, time.UTC)},
+		{"0 0 1 3 *", time.Date(2018, time.March, 1, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2018, time.January, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2018, time.January, 7, 0, 0, 0, 0, time.UTC)},
+		// Either the day of month or the day of week when both are restricted
+		{"0 0 13 * 5", time.Date(2018, time.January, 5, 0, 0, 0, 0, time.UTC)},
+		// Leap days only
+		{"0 0 29 2 *", time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		e, err := cron.Parse(c.expr)
+		assert.Empty(err, c.expr)
+		assert.Equal(c.next, e.Next(now), c.expr)
+	}
+	// The next time should be strictly after the time
+	e, err := cron.Parse("0 0 * * *")
+	assert.Empty(err)
+	midnight := time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(midnight.AddDate(0, 0, 1), e.Next(midnight))
+	// The time zone of the time should be kept
+	loc := time.FixedZone("UTC+8", 8*60*60)
+	next := e.Next(time.Date(2018, time.January, 1, 12, 0, 0, 0, loc))
+	assert.Equal(time.Date(2018, time.January, 2, 0, 0, 0, 0, loc), next)
+	assert.Equal(loc, next.Location())
+	// There should be no next time for a day that never comes
+	e, err = cron.Parse("0 0 30 2 *")
+	assert.Empty(err)
+	assert.True(e.Next(now).IsZero())
+}
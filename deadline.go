@@ -0,0 +1,63 @@
+package magi
+
+import (
+	"time"
+
+	"github.com/evanhuang8/magi/job"
+)
+
+// SetDeadlineHeader sets the header carrying the time a job must be processed
+// by, formatted as RFC 3339, e.g. job.HeaderProcessBy. Jobs fetched past
+// their deadline are not processed: they're routed to the dead letter queue
+// if the queue has a retry policy, or acked otherwise, and an expired event
+// is emitted. An empty header, the default, disables the check.
+func (m *Magi) SetDeadlineHeader(header string) {
+	m.deadlineHeader = header
+}
+
+// deadline returns the time the job must be processed by, if it has one
+func (m *Magi) deadline(_job *job.Job) (time.Time, bool) {
+	if m.deadlineHeader == "" {
+		return time.Time{}, false
+	}
+	value, exists := _job.Headers[m.deadlineHeader]
+	if !exists {
+		return time.Time{}, false
+	}
+	deadline, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return deadline, true
+}
+
+// isExpired returns whether the job is past its deadline
+func (m *Magi) isExpired(_job *job.Job) bool {
+	deadline, ok := m.deadline(_job)
+	return ok && m.clock.Now().After(deadline)
+}
+
+// expire discards the job past its deadline without processing it, routing
+// it to the dead letter queue if there's a retry policy
+func (m *Magi) expire(queueName string, _job *job.Job, policy *RetryPolicy) error {
+	m.emitJob(EventExpired, queueName, _job, nil)
+	if policy != nil {
+		// Leave the deadline out, so that the dead letter queue processes the job
+		headers := make(map[string]string, len(_job.Headers))
+		for key, value := range _job.Headers {
+			if key != m.deadlineHeader {
+				headers[key] = value
+			}
+		}
+		err := m.requeue(policy.deadLetterQueue(queueName), _job, headers, m.clock.Now())
+		if err != nil {
+			return err
+		}
+	}
+	err := m.dqCluster.Ack(_job.ID)
+	if err != nil {
+		return err
+	}
+	m.emitJob(EventAcked, queueName, _job, nil)
+	return nil
+}
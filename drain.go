@@ -0,0 +1,145 @@
+package magi
+
+import (
+	"errors"
+
+	"github.com/evanhuang8/magi/cluster"
+	"github.com/evanhuang8/magi/job"
+)
+
+// ErrNoNodeDrain is the error for draining a node of a job backend that can't drain its nodes
+var ErrNoNodeDrain = errors.New("Magi Error: the job backend can not drain nodes!")
+
+// nodeDrainer is a job backend whose nodes can be drained, like the disque cluster
+type nodeDrainer interface {
+	DrainNode(address string) error
+	UndrainNode(address string) error
+}
+
+// DrainNode stops fetching jobs from the disque node at the address, see
+// cluster.DisqueCluster.DrainNode. It fails with ErrNoNodeDrain if the job
+// backend can't drain its nodes.
+func (m *Magi) DrainNode(address string) error {
+	drainer, err := m.nodeDrainer()
+	if err != nil {
+		return err
+	}
+	return drainer.DrainNode(address)
+}
+
+// UndrainNode resumes fetching jobs from the disque node at the address
+func (m *Magi) UndrainNode(address string) error {
+	drainer, err := m.nodeDrainer()
+	if err != nil {
+		return err
+	}
+	return drainer.UndrainNode(address)
+}
+
+// nodeDrainer returns the job backend as a node drainer, looking through
+// the namespace
+func (m *Magi) nodeDrainer() (nodeDrainer, error) {
+	backend := m.dqCluster
+	if namespaced, ok := backend.(*cluster.NamespacedJobBackend); ok {
+		backend = namespaced.JobBackend
+	}
+	drainer, ok := backend.(nodeDrainer)
+	if !ok {
+		return nil, ErrNoNodeDrain
+	}
+	return drainer, nil
+}
+
+// DrainAckBatchSize is the number of moved jobs acked together by DrainTo
+var DrainAckBatchSize = 64
+
+// DrainTo moves the jobs waiting in the src queue to the dst queue, keeping
+// their bodies and headers, and returns the number of jobs moved. It stops
+// after moving limit jobs, or once src is empty if limit is 0.
+//
+// Each job is added to dst before it's acked in src, so interrupting the
+// drain never loses a job, but may leave a job in both queues. The moved jobs
+// are acked in batches of DrainAckBatchSize.
+func (m *Magi) DrainTo(src string, dst string, limit int) (int, error) {
+	return m.drain(src, dst, limit, nil)
+}
+
+// ReplayDeadLetter moves the jobs of the dead letter queue back to the target
+// queue like DrainTo, resetting their retry attempts so that the retry policy
+// of the target applies to them afresh, and returns the number of jobs
+// replayed. An interrupted replay is resumed by calling it again.
+func (m *Magi) ReplayDeadLetter(dlqName string, targetQueue string, limit int) (int, error) {
+	return m.drain(dlqName, targetQueue, limit, func(headers map[string]string) map[string]string {
+		replayed := make(map[string]string, len(headers))
+		for key, value := range headers {
+			if key != job.HeaderAttempts && key != job.HeaderOriginID {
+				replayed[key] = value
+			}
+		}
+		return replayed
+	})
+}
+
+// drain moves the jobs from src to dst, with their headers rewritten if
+// rewrite is not nil
+func (m *Magi) drain(src string, dst string, limit int, rewrite func(map[string]string) map[string]string) (int, error) {
+	n := 0
+	empty := 0
+	moved := []string{} // moved jobs waiting to be acked
+	ack := func() error {
+		err := m.dqCluster.AckMany(moved)
+		moved = moved[:0]
+		return err
+	}
+	// Acks the moved jobs before stopping with the error. A failed ack is
+	// returned instead, since the moved jobs are then left in both queues.
+	fail := func(err error) (int, error) {
+		ackErr := ack()
+		if ackErr != nil {
+			m.logf("Error: %v", err)
+			return n, ackErr
+		}
+		return n, err
+	}
+	for limit == 0 || n < limit {
+		details, err := m.dqCluster.Fetch(src, nil)
+		if err != nil {
+			if err.Error() != "no data available" {
+				return fail(err)
+			}
+			// Stop once every node has reported the queue to be empty
+			empty++
+			if empty >= m.dqCluster.Size() {
+				break
+			}
+			continue
+		}
+		empty = 0
+		_job, err := job.FromDetailsWithCodec(details, m.codec)
+		if err != nil {
+			return fail(err)
+		}
+		headers := _job.Headers
+		if rewrite != nil {
+			headers = rewrite(headers)
+		}
+		err = m.requeue(dst, _job, headers, m.clock.Now())
+		if err != nil {
+			// Put the job back for redelivery
+			nackErr := m.dqCluster.Nack(_job.ID)
+			if nackErr != nil {
+				m.jobLogf(_job, "Error: %v", nackErr)
+			}
+			return fail(err)
+		}
+		moved = append(moved, _job.ID)
+		n++
+		if len(moved) >= DrainAckBatchSize {
+			err = ack()
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, ack()
+}
@@ -0,0 +1,33 @@
+package magi
+
+import (
+	"github.com/evanhuang8/magi/job"
+)
+
+// DryRunProcessor is an optional interface for processors that can tell what
+// they would do with a job without doing it, e.g. validating the job and
+// logging the decision. In dry run mode, magi calls DryRun instead of
+// Process, and reports its error on the dry run event.
+type DryRunProcessor interface {
+	Processor
+	DryRun(*job.Job) error
+}
+
+// dryRun acks the job without processing it, calling the processor's DryRun if it has one
+func (m *Magi) dryRun(queueName string, reg *registration, _job *job.Job) {
+	var err error
+	if processor, ok := reg.processor.(DryRunProcessor); ok {
+		err = processor.DryRun(_job)
+	}
+	if err != nil {
+		m.jobLogf(_job, "Dry run: job of queue %s would fail: %v", queueName, err)
+	} else {
+		m.jobLogf(_job, "Dry run: job of queue %s would be processed", queueName)
+	}
+	m.emitJob(EventDryRun, queueName, _job, err)
+	err = m.dqCluster.Ack(_job.ID)
+	if err != nil {
+		return
+	}
+	m.emitJob(EventAcked, queueName, _job, nil)
+}
@@ -0,0 +1,101 @@
+package magi
+
+import (
+	"errors"
+	"time"
+
+	"github.com/evanhuang8/magi/backoff"
+	"github.com/evanhuang8/magi/job"
+)
+
+// AckReplicationTimeout is the time a processed job waits to be replicated
+// to the nodes required by SetAckReplication before it's nacked instead
+var AckReplicationTimeout = time.Second
+
+// AckReplicationPollInterval is the time between the checks of the nodes a
+// processed job is replicated to
+var AckReplicationPollInterval = 50 * time.Millisecond
+
+// SetAckReplication makes the jobs of the queue acked only once disque
+// reports them replicated to at least the number of nodes, as seen by SHOW,
+// so that a job is never acked while it lives on a single node that may
+// die. A job that is not replicated in time is nacked for redelivery, with
+// job.ErrJobNotReplicated on its nacked event.
+//
+// Every ack of the queue then costs at least one more round trip to disque,
+// and up to AckReplicationTimeout for a job that is slow to replicate, during
+// which the worker is busy. Zero turns the check off.
+func (m *Magi) SetAckReplication(queueName string, replicas int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.ackReplicas == nil {
+		m.ackReplicas = make(map[string]int)
+	}
+	if replicas <= 0 {
+		delete(m.ackReplicas, queueName)
+		return
+	}
+	m.ackReplicas[queueName] = replicas
+}
+
+// confirmReplicated waits for the job to be replicated to the nodes required
+// for its queue, or fails with job.ErrJobNotReplicated after the timeout
+func (m *Magi) confirmReplicated(queueName string, id string) error {
+	m.mutex.RLock()
+	replicas := m.ackReplicas[queueName]
+	m.mutex.RUnlock()
+	if replicas == 0 {
+		return nil
+	}
+	return m.waitReplicated(id, replicas, AckReplicationTimeout)
+}
+
+// waitReplicated polls the nodes the job is replicated to until there are at
+// least the number of replicas, or fails with job.ErrJobNotReplicated after
+// the timeout
+func (m *Magi) waitReplicated(id string, replicas int, timeout time.Duration) error {
+	deadline := m.clock.Now().Add(timeout)
+	for {
+		fields, err := m.dqCluster.Show(id)
+		if err == nil && fields != nil && len(job.DetailsFromShow(fields).NodesDelivered) >= replicas {
+			return nil
+		}
+		if !m.clock.Now().Before(deadline) {
+			return job.ErrJobNotReplicated
+		}
+		<-m.clock.After(AckReplicationPollInterval)
+	}
+}
+
+// AckAttempts is the number of times the ack of a processed job is tried
+// when it fails for a transient reason, see job.IsTransient, so that a
+// network blip does not get the job processed again
+var AckAttempts = 3
+
+// AckRetryBackoff is the backoff between the attempts to ack a processed job
+var AckRetryBackoff backoff.Backoff = backoff.NewExponential(50*time.Millisecond, 500*time.Millisecond, 2)
+
+// ErrAckFailed is the error for failing to ack a processed job, which disque
+// is going to deliver again
+var ErrAckFailed = errors.New("Disque Error: fail to ack a processed job, it may be processed again!")
+
+// ack acks the processed job, retrying the transient failures up to
+// AckAttempts times. If it still fails, the job is left to disque, with an
+// ack-failed event reporting the likely duplicate.
+func (m *Magi) ack(queueName string, _job *job.Job) error {
+	var err error
+	for attempt := 1; attempt <= AckAttempts; attempt++ {
+		if attempt > 1 {
+			<-m.clock.After(AckRetryBackoff.Next(attempt - 1))
+		}
+		err = m.dqCluster.Ack(_job.ID)
+		if err == nil || !job.IsTransient(err) {
+			break
+		}
+	}
+	if err != nil {
+		m.jobLogf(_job, "Error: %v", err)
+		m.emitJob(EventAckFailed, queueName, _job, ErrAckFailed)
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package magi
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/evanhuang8/magi/job"
+)
+
+// EventType is the type for job lifecycle events
+type EventType string
+
+const (
+	// EventEnqueued is emitted when a job is added to a queue
+	EventEnqueued EventType = "enqueued"
+	// EventFetched is emitted when a job is received from a queue
+	EventFetched EventType = "fetched"
+	// EventLockAcquired is emitted when the lock on a job is acquired
+	EventLockAcquired EventType = "lock-acquired"
+	// EventProcessed is emitted when a job is processed successfully
+	EventProcessed EventType = "processed"
+	// EventAcked is emitted when a job is acknowledged
+	EventAcked EventType = "acked"
+	// EventNacked is emitted when a job is put back into the queue
+	EventNacked EventType = "nacked"
+	// EventFailed is emitted when processing a job returns an error
+	EventFailed EventType = "failed"
+	// EventLockLost is emitted when the lock on a job is lost during processing
+	EventLockLost EventType = "lock-lost"
+	// EventCancelled is emitted when processing a job is cancelled before it's done
+	EventCancelled EventType = "cancelled"
+	// EventExpired is emitted when a job is discarded for being past its deadline
+	EventExpired EventType = "expired"
+	// EventLeaseOverrun is emitted when the lease of a job being processed
+	// lapses before it's extended, so that the job may be delivered again
+	EventLeaseOverrun EventType = "lease-overrun"
+	// EventDryRun is emitted when a job is fetched in dry run mode instead of being processed
+	EventDryRun EventType = "dry-run"
+	// EventRejected is emitted when a job is put back into the queue because
+	// its processor turns it down, see RoutingProcessor
+	EventRejected EventType = "rejected"
+	// EventAckFailed is emitted when a processed job can not be acked, so
+	// that it's going to be delivered again
+	EventAckFailed EventType = "ack-failed"
+)
+
+// EventBufferSize is the number of events buffered for a slow subscriber
+// before new events are dropped
+var EventBufferSize = 1024
+
+// Event represents a job lifecycle event
+type Event struct {
+	Type      EventType
+	QueueName string
+	JobID     string
+	Time      time.Time
+	Err       error
+	Latency   time.Duration // time the job waited in the queue, only set on fetched events
+	// ConnectivityDisrupted is whether a connection of the instance failed
+	// while the job was processed, only set on processed and failed events.
+	// The job may have been processed twice, see Magi.ReportConnError.
+	ConnectivityDisrupted bool
+	// ExternalID is the user supplied id of the job, see job.Job.ExternalID,
+	// set on the events of a job once it's fetched
+	ExternalID string
+}
+
+// Events returns the stream of job lifecycle events. Events are dropped rather
+// than stalling processing when the buffer is full.
+func (m *Magi) Events() <-chan Event {
+	return m.events
+}
+
+// emit sends an event without blocking
+func (m *Magi) emit(eventType EventType, queueName string, id string, err error) {
+	event := Event{
+		Type:      eventType,
+		QueueName: queueName,
+		JobID:     id,
+		Time:      m.clock.Now(),
+		Err:       err,
+	}
+	m.emitEvent(event)
+}
+
+// emitJob sends an event of the job without blocking, carrying its ids so
+// that the events of a job can be correlated
+func (m *Magi) emitJob(eventType EventType, queueName string, _job *job.Job, err error) {
+	event := Event{
+		Type:       eventType,
+		QueueName:  queueName,
+		JobID:      _job.ID,
+		ExternalID: _job.ExternalID(),
+		Time:       m.clock.Now(),
+		Err:        err,
+	}
+	m.emitEvent(event)
+}
+
+// emitEvent sends the event without blocking, counting the dropped events
+func (m *Magi) emitEvent(event Event) {
+	select {
+	case m.events <- event:
+	default:
+		atomic.AddInt32(&m.droppedEvents, 1)
+	}
+}
@@ -0,0 +1,93 @@
+package magi
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultProcessedHistorySize is the number of processed job ids remembered by default
+var DefaultProcessedHistorySize = 10000
+
+// processedHistory remembers the ids of the most recently processed jobs
+type processedHistory struct {
+	size  int
+	order *list.List // most recent first
+	ids   map[string]*list.Element
+	mutex sync.Mutex
+}
+
+// add records the id, evicting the least recent ids beyond the size
+func (h *processedHistory) add(id string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.ids == nil {
+		h.order = list.New()
+		h.ids = make(map[string]*list.Element)
+	}
+	if h.size == 0 {
+		h.size = DefaultProcessedHistorySize
+	}
+	if element, exists := h.ids[id]; exists {
+		h.order.MoveToFront(element)
+		return
+	}
+	h.ids[id] = h.order.PushFront(id)
+	h.trim()
+}
+
+// contains returns whether the id is remembered
+func (h *processedHistory) contains(id string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	_, exists := h.ids[id]
+	return exists
+}
+
+// len returns the number of ids remembered, and the number that can be
+func (h *processedHistory) len() (int, int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	size := h.size
+	if size == 0 {
+		size = DefaultProcessedHistorySize
+	}
+	if h.order == nil {
+		return 0, size
+	}
+	return h.order.Len(), size
+}
+
+// resize changes the number of ids remembered
+func (h *processedHistory) resize(size int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.size = size
+	h.trim()
+}
+
+// Evict the least recent ids beyond the size, must be called with the mutex held
+func (h *processedHistory) trim() {
+	if h.order == nil {
+		return
+	}
+	for h.order.Len() > h.size {
+		element := h.order.Back()
+		h.order.Remove(element)
+		delete(h.ids, element.Value.(string))
+	}
+}
+
+// SetProcessedHistorySize sets the number of processed job ids remembered for
+// DidProcess, the least recently processed ones are forgotten first
+func (m *Magi) SetProcessedHistorySize(size int) {
+	if size < 1 {
+		size = 1
+	}
+	m.history.resize(size)
+}
+
+// DidProcess returns whether the job was processed by this instance, as far
+// as the recently processed jobs are remembered
+func (m *Magi) DidProcess(id string) bool {
+	return m.history.contains(id)
+}
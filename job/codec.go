@@ -0,0 +1,74 @@
+package job
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// EnvelopeCodec converts between the Magi wrapper for a job's data and the
+// payload stored in disque. Producers and consumers of a queue must use the
+// same codec. Decode returns ErrJobNoEnvelope for a payload that is not
+// wrapped, which is then read as the plain body of the job.
+type EnvelopeCodec interface {
+	Encode(data *Data) (string, error)
+	Decode(payload string) (*Data, error)
+}
+
+// ErrJobNoEnvelope is the error for decoding a payload that is not wrapped by the codec
+var ErrJobNoEnvelope = errors.New("Job Error: payload is not wrapped in an envelope!")
+
+// JSONCodec is the default codec, wrapping the data as a JSON object
+type JSONCodec struct{}
+
+// DefaultCodec is the codec used unless another is set
+var DefaultCodec EnvelopeCodec = JSONCodec{}
+
+// Encode wraps the data as a JSON object
+func (c JSONCodec) Encode(data *Data) (string, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	return string(payload), nil
+}
+
+// Decode unwraps the data from a JSON object, which must have the fields of
+// the wrapper so that plain JSON bodies are not mistaken for envelopes
+func (c JSONCodec) Decode(payload string) (*Data, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal([]byte(payload), &fields)
+	if err != nil {
+		return nil, ErrJobNoEnvelope
+	}
+	if _, exists := fields["CreatedAt"]; !exists {
+		return nil, ErrJobNoEnvelope
+	}
+	var data Data
+	err = json.Unmarshal([]byte(payload), &data)
+	if err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// decode unwraps the payload with the codec, treating a payload written
+// without any envelope as the plain body of the job
+func decode(payload string, codec EnvelopeCodec) (*Data, error) {
+	if codec == nil {
+		codec = DefaultCodec
+	}
+	data, err := codec.Decode(payload)
+	if err == ErrJobNoEnvelope {
+		return &Data{
+			Body: payload,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = decompress(data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
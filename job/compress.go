@@ -0,0 +1,82 @@
+package job
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+)
+
+const (
+	// HeaderEncoding is the header flagging a body compressed by CompressingCodec
+	HeaderEncoding = "content-encoding"
+	// EncodingGzip is the encoding of a body compressed with gzip
+	EncodingGzip = "gzip"
+)
+
+// CompressingCodec wraps a codec, compressing with gzip the bodies larger
+// than the threshold in bytes before they are encoded. Smaller bodies are
+// stored as they are. The compressed bodies are flagged by HeaderEncoding and
+// decompressed when the jobs are read whatever the codec of the consumer, so
+// the queues can mix compressed and uncompressed jobs.
+type CompressingCodec struct {
+	EnvelopeCodec
+	Threshold int
+}
+
+// Encode compresses the body of the data if it's above the threshold and
+// wraps it with the underlying codec
+func (c CompressingCodec) Encode(data *Data) (string, error) {
+	body := data.BodyBytes
+	if body == nil {
+		body = []byte(data.Body)
+	}
+	if len(body) <= c.Threshold {
+		return c.EnvelopeCodec.Encode(data)
+	}
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, err := writer.Write(body)
+	if err != nil {
+		return "", err
+	}
+	err = writer.Close()
+	if err != nil {
+		return "", err
+	}
+	// Flag a copy of the headers, the job's own are left untouched
+	headers := make(map[string]string, len(data.Headers)+1)
+	for key, value := range data.Headers {
+		headers[key] = value
+	}
+	headers[HeaderEncoding] = EncodingGzip
+	compressed := *data
+	compressed.Body = ""
+	compressed.BodyBytes = buffer.Bytes()
+	compressed.Headers = headers
+	return c.EnvelopeCodec.Encode(&compressed)
+}
+
+// decompress restores the body of the data compressed by CompressingCodec,
+// removing the flag from its headers. The body is restored as bytes since
+// the compressed envelope does not keep whether it was text.
+func decompress(data *Data) error {
+	if data.Headers[HeaderEncoding] != EncodingGzip {
+		return nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data.BodyBytes))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	delete(data.Headers, HeaderEncoding)
+	if len(data.Headers) == 0 {
+		data.Headers = nil
+	}
+	data.Body = ""
+	data.BodyBytes = body
+	return nil
+}
@@ -0,0 +1,14 @@
+package job
+
+import (
+	"time"
+)
+
+// Continuation is a follow-up job, returned as the result of processing a
+// job, that is added to its queue once the job is processed successfully and
+// before the job is acked
+type Continuation struct {
+	Queue string    // queue of the follow-up job
+	Body  string    // body of the follow-up job
+	ETA   time.Time // time the follow-up job becomes available, right away if zero
+}
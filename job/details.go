@@ -0,0 +1,67 @@
+package job
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Details represents the full state of a job as reported by disque's SHOW
+type Details struct {
+	ID                   string
+	QueueName            string
+	State                string
+	Replication          int
+	TTL                  time.Duration
+	CreatedAt            time.Time
+	Delay                time.Duration
+	Retry                time.Duration
+	Nacks                int
+	AdditionalDeliveries int
+	NodesDelivered       []string
+	NodesConfirmed       []string
+	NextRequeueWithin    time.Duration
+	NextAwakeWithin      time.Duration
+	Body                 string
+}
+
+// DetailsFromShow creates a Details instance using the fields of a SHOW reply.
+// Fields are looked up by name, so their order in the reply does not matter,
+// and missing or malformed fields are left empty.
+func DetailsFromShow(fields map[string]interface{}) *Details {
+	details := &Details{
+		ID:                   showString(fields["id"]),
+		QueueName:            showString(fields["queue"]),
+		State:                showString(fields["state"]),
+		Replication:          showInt(fields["repl"]),
+		TTL:                  time.Duration(showInt(fields["ttl"])) * time.Second,
+		Delay:                time.Duration(showInt(fields["delay"])) * time.Second,
+		Retry:                time.Duration(showInt(fields["retry"])) * time.Second,
+		Nacks:                showInt(fields["nacks"]),
+		AdditionalDeliveries: showInt(fields["additional-deliveries"]),
+		NodesDelivered:       showStrings(fields["nodes-delivered"]),
+		NodesConfirmed:       showStrings(fields["nodes-confirmed"]),
+		NextRequeueWithin:    time.Duration(showInt(fields["next-requeue-within"])) * time.Millisecond,
+		NextAwakeWithin:      time.Duration(showInt(fields["next-awake-within"])) * time.Millisecond,
+		Body:                 showString(fields["body"]),
+	}
+	if ctime := showInt(fields["ctime"]); ctime > 0 {
+		details.CreatedAt = time.Unix(0, int64(ctime))
+	}
+	return details
+}
+
+func showString(value interface{}) string {
+	s, _ := redis.String(value, nil)
+	return s
+}
+
+func showInt(value interface{}) int {
+	n, _ := redis.Int(value, nil)
+	return n
+}
+
+func showStrings(value interface{}) []string {
+	s, _ := redis.Strings(value, nil)
+	return s
+}
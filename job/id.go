@@ -0,0 +1,30 @@
+package job
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/evanhuang8/magi/cluster"
+)
+
+// ErrJobInvalidID is the error for a malformed disque job id
+var ErrJobInvalidID = errors.New("Job Error: invalid job id!")
+
+// ID is the components of a disque job id, such as
+// D-dcb833cf-8YL1NT17e9+wsA/09NqxscQI-05a1, see cluster.JobID
+type ID cluster.JobID
+
+// ParseID splits a disque job id into its components
+func ParseID(id string) (*ID, error) {
+	parsed, err := cluster.ParseJobID(id)
+	if err != nil {
+		return nil, ErrJobInvalidID
+	}
+	return (*ID)(parsed), nil
+}
+
+// String formats the components back into the job id
+func (id *ID) String() string {
+	return fmt.Sprintf("D-%s-%s-%04x", id.Node, id.Random, int64(id.TTL/time.Minute))
+}
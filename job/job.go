@@ -2,6 +2,11 @@ package job
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/evanhuang8/magi/cluster"
@@ -11,16 +16,79 @@ import (
 // JobTimeout is the default job timeout
 var JobTimeout = "2s"
 
+const (
+	// HeaderExternalID is the header carrying a user supplied id for the job
+	HeaderExternalID = "external-id"
+	// HeaderAttempts is the header carrying the number of failed attempts of the job
+	HeaderAttempts = "attempts"
+	// HeaderOriginID is the header carrying the id of the job a retried job is added for
+	HeaderOriginID = "origin-id"
+	// HeaderParentID is the header carrying the id of the job a continuation is added by
+	HeaderParentID = "parent-id"
+	// HeaderProcessBy is the conventional header carrying the time a job must be processed by
+	HeaderProcessBy = "process-by"
+)
+
+// ErrJobNotReplicated is the error for disque failing to replicate a job to
+// the requested number of nodes before the timeout, the job is not added
+var ErrJobNotReplicated = errors.New("Job Error: job is not replicated to the requested number of nodes!")
+
+var (
+	// ErrQueueFull is the error for disque rejecting a job because its queue
+	// already holds the MaxLen of the config
+	ErrQueueFull = errors.New("Job Error: queue is full!")
+	// ErrQueuePaused is the error for disque rejecting a job because its
+	// queue is paused for input
+	ErrQueuePaused = errors.New("Job Error: queue is paused!")
+)
+
+// addError maps the error replies of ADDJOB to the errors of the job package
+func addError(err error) error {
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "NOREPL"):
+		return ErrJobNotReplicated
+	case strings.HasPrefix(message, "MAXLEN"):
+		return ErrQueueFull
+	case strings.HasPrefix(message, "PAUSED"):
+		return ErrQueuePaused
+	}
+	return err
+}
+
+// IsTransient returns whether adding a job failed for a reason that may go
+// away by itself, so that adding it again later may succeed: the nodes being
+// unreachable, down or loading, or the job not being replicated in time.
+// Jobs rejected by disque, e.g. with ErrQueueFull, ErrQueuePaused or an
+// error reply, are not added again as is.
+func IsTransient(err error) bool {
+	switch err {
+	case nil:
+		return false
+	case ErrJobNotReplicated, cluster.ErrClusterDown, cluster.ErrNodeLoading, io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
 // Job represents a job
 type Job struct {
 	ID           string
 	QueueName    string
 	Body         string
+	Headers      map[string]string
 	ETA          time.Time
 	CreatedAt    time.Time
 	UpdatedAt    time.Time
 	IsProcessing bool
-	Raw          *disque.Job
+	Replicated   int // number of nodes the job is known to be replicated to when added
+	// Delivery counters, only set when the job is fetched with counters
+	Nacks                int
+	AdditionalDeliveries int
+	Raw                  *disque.Job
+
+	raw []byte // exact bytes of a binary body
 }
 
 func (job *Job) String() string {
@@ -28,52 +96,157 @@ func (job *Job) String() string {
 	return string(output)
 }
 
+// ExternalID returns the user supplied id of the job, if any
+func (job *Job) ExternalID() string {
+	return job.Headers[HeaderExternalID]
+}
+
+// AvailableAt returns the time the job can be fetched from its queue, which
+// is when it was added, or its ETA if it was delayed. It is zero for jobs
+// added without an envelope.
+func (job *Job) AvailableAt() time.Time {
+	if job.ETA.After(job.CreatedAt) {
+		return job.ETA
+	}
+	return job.CreatedAt
+}
+
+// Attempts returns the number of failed processing attempts of the job
+func (job *Job) Attempts() int {
+	attempts, err := strconv.Atoi(job.Headers[HeaderAttempts])
+	if err != nil {
+		return 0
+	}
+	return attempts
+}
+
+// RawBody returns the exact bytes of the job's body
+func (job *Job) RawBody() []byte {
+	if job.raw != nil {
+		return job.raw
+	}
+	return []byte(job.Body)
+}
+
+// IsBinary returns whether the job has a binary body
+func (job *Job) IsBinary() bool {
+	return job.raw != nil
+}
+
+// Returns the Magi wrapper for the job's data
+func (job *Job) data() *Data {
+	data := &Data{
+		Headers:   job.Headers,
+		ETA:       job.ETA,
+		CreatedAt: job.CreatedAt,
+		UpdatedAt: job.UpdatedAt,
+	}
+	if job.raw != nil {
+		data.BodyBytes = job.raw
+	} else {
+		data.Body = job.Body
+	}
+	return data
+}
+
 // Data represents the Magi wrapper for the job's data
 type Data struct {
 	Body      string
+	BodyBytes []byte            `json:",omitempty"`
+	Headers   map[string]string `json:",omitempty"`
 	ETA       time.Time
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
 
 // Add adds a job to queue
-func Add(c *cluster.DisqueCluster, queueName string, body string, ETA time.Time, config *cluster.DisqueOpConfig) (*Job, error) {
+func Add(c cluster.JobBackend, queueName string, body string, ETA time.Time, config *cluster.DisqueOpConfig) (*Job, error) {
+	return AddWithHeaders(c, queueName, body, nil, ETA, config)
+}
+
+// AddWithHeaders adds a job carrying the headers to queue
+func AddWithHeaders(c cluster.JobBackend, queueName string, body string, headers map[string]string, ETA time.Time, config *cluster.DisqueOpConfig) (*Job, error) {
+	return AddWithHeadersAt(c, queueName, body, headers, ETA, time.Now(), config)
+}
+
+// AddWithHeadersAt adds a job carrying the headers to queue, with the delay
+// calculated from the ETA relative to now
+func AddWithHeadersAt(c cluster.JobBackend, queueName string, body string, headers map[string]string, ETA time.Time, now time.Time, config *cluster.DisqueOpConfig) (*Job, error) {
+	job := New(queueName, body, headers, ETA, now)
+	err := Enqueue(c, job, config)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// New creates a job that is not yet added to queue
+func New(queueName string, body string, headers map[string]string, ETA time.Time, now time.Time) *Job {
 	job := &Job{
 		QueueName: queueName,
+		Body:      body,
+		Headers:   headers,
 		ETA:       ETA,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	return job
+}
+
+// NewBytes creates a job with a binary body that is not yet added to queue
+func NewBytes(queueName string, body []byte, headers map[string]string, ETA time.Time, now time.Time) *Job {
+	job := New(queueName, string(body), headers, ETA, now)
+	job.raw = body
+	return job
+}
+
+// Enqueue adds the job to its queue, with the delay calculated from the ETA
+// relative to the job's creation time
+func Enqueue(c cluster.JobBackend, job *Job, config *cluster.DisqueOpConfig) error {
+	return EnqueueWithCodec(c, job, config, DefaultCodec)
+}
+
+// EnqueueWithCodec adds the job to its queue, wrapping its data with the codec
+func EnqueueWithCodec(c cluster.JobBackend, job *Job, config *cluster.DisqueOpConfig, codec EnvelopeCodec) error {
+	if codec == nil {
+		codec = DefaultCodec
 	}
 	if config == nil {
 		config = &cluster.DisqueOpConfig{}
 	}
 	// Calculate the delay
-	now := time.Now()
-	job.CreatedAt = now
-	job.UpdatedAt = now
-	delay := ETA.Sub(now)
+	delay := job.ETA.Sub(job.CreatedAt)
 	if delay.Seconds() > 0 {
 		config.Delay = delay
 	}
-	data, _ := json.Marshal(
-		&Data{
-			Body:      body,
-			ETA:       ETA,
-			CreatedAt: now,
-			UpdatedAt: now,
-		},
-	)
-	_job, err := c.Add(queueName, string(data), config)
+	data, err := codec.Encode(job.data())
 	if err != nil {
-		return nil, err
+		return err
+	}
+	_job, err := c.Add(job.QueueName, data, config)
+	if err != nil {
+		return addError(err)
 	}
 	job.ID = _job.ID
-	job.Body = body
-	return job, nil
+	// Confirm the replication when it is explicitly requested
+	if config.Replicate > 0 {
+		job.Replicated = config.Replicate
+		fields, err := c.Show(job.ID)
+		if err == nil && fields != nil {
+			job.Replicated = len(DetailsFromShow(fields).NodesDelivered)
+		}
+	}
+	return nil
 }
 
 // FromDetails creates a Job instance using details data
 func FromDetails(details *disque.Job) (*Job, error) {
-	var data Data
-	err := json.Unmarshal([]byte(details.Data), &data)
+	return FromDetailsWithCodec(details, DefaultCodec)
+}
+
+// FromDetailsWithCodec creates a Job instance using details data wrapped with the codec
+func FromDetailsWithCodec(details *disque.Job, codec EnvelopeCodec) (*Job, error) {
+	data, err := decode(details.Data, codec)
 	if err != nil {
 		return nil, err
 	}
@@ -81,10 +254,15 @@ func FromDetails(details *disque.Job) (*Job, error) {
 		ID:        details.ID,
 		QueueName: details.Queue,
 		Body:      data.Body,
+		Headers:   data.Headers,
 		ETA:       data.ETA,
 		CreatedAt: data.CreatedAt,
 		UpdatedAt: data.UpdatedAt,
 		Raw:       details,
 	}
+	if data.BodyBytes != nil {
+		job.Body = string(data.BodyBytes)
+		job.raw = data.BodyBytes
+	}
 	return job, nil
 }
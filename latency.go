@@ -0,0 +1,48 @@
+package magi
+
+import (
+	"time"
+
+	"github.com/evanhuang8/magi/job"
+)
+
+// queueLatency returns the time the job waited in the queue before it's
+// fetched, measured from the time it's available, see job.AvailableAt.
+//
+// The time is stamped by the producer and compared with the clock of the
+// consumer, so the latency is only as accurate as their clocks are in sync,
+// e.g. with NTP. A latency below zero, from a consumer clock running behind,
+// is reported as zero.
+func (m *Magi) queueLatency(_job *job.Job) (time.Duration, bool) {
+	available := _job.AvailableAt()
+	if available.IsZero() {
+		return 0, false
+	}
+	latency := m.clock.Now().Sub(available)
+	if latency < 0 {
+		latency = 0
+	}
+	return latency, true
+}
+
+// emitFetched emits the fetched event of the job with its queue latency,
+// which is also recorded for the stats of the queue
+func (m *Magi) emitFetched(queueName string, _job *job.Job) {
+	event := Event{
+		Type:       EventFetched,
+		QueueName:  queueName,
+		JobID:      _job.ID,
+		ExternalID: _job.ExternalID(),
+		Time:       m.clock.Now(),
+	}
+	if latency, ok := m.queueLatency(_job); ok {
+		event.Latency = latency
+		m.mutex.Lock()
+		if m.latencies == nil {
+			m.latencies = make(map[string]time.Duration)
+		}
+		m.latencies[queueName] = latency
+		m.mutex.Unlock()
+	}
+	m.emitEvent(event)
+}
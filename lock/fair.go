@@ -0,0 +1,118 @@
+package lock
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/evanhuang8/magi/cluster"
+	"github.com/garyburd/redigo/redis"
+)
+
+// The ticket queue of the blocked acquirers lives on the first redis host of
+// the cluster. Fairness is best effort: it only orders the acquirers going
+// through GetBlocking, and if the host can not be reached, or the lock is not
+// backed by redis, the acquirers fall back to racing each other. Mutual
+// exclusion is still guaranteed by the lock.
+
+// errNoTicketQueue is the error for a lock backend without a ticket queue
+var errNoTicketQueue = errors.New("Lock Error: the lock backend has no ticket queue!")
+
+// Returns the key of the ticket queue for the lock
+func (lock *Lock) ticketQueue() string {
+	return lock.redisKey() + ":waiters"
+}
+
+// Returns how long a ticket stays in line without its holder checking in,
+// so that a crashed acquirer can not block the queue. The acquirers in line
+// sleep for at most half of it between their attempts, whatever the backoff.
+func (lock *Lock) ticketTTL() time.Duration {
+	ttl := 4 * lock.Delay
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return ttl
+}
+
+// Returns the connection to the host of the ticket queue
+func (lock *Lock) ticketConn() (redis.Conn, error) {
+	c, ok := lock.Cluster.(*cluster.RedisCluster)
+	if !ok {
+		return nil, errNoTicketQueue
+	}
+	pools := c.GetPools()
+	return (*pools)[0].Get(), nil
+}
+
+// Gets in line for the lock, returning the ticket
+func (lock *Lock) enqueueTicket() (string, error) {
+	raw := make([]byte, 16)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	ticket := base64.StdEncoding.EncodeToString(raw)
+	conn, err := lock.ticketConn()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	_, err = enqueueTicket.Do(conn, lock.ticketQueue(), ticket, int(lock.ticketTTL()/time.Millisecond))
+	if err != nil {
+		return "", err
+	}
+	return ticket, nil
+}
+
+// Returns whether the ticket is at the head of the line, keeping it alive
+func (lock *Lock) isTicketTurn(ticket string) (bool, error) {
+	conn, err := lock.ticketConn()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	reply, err := redis.Int(checkTicket.Do(conn, lock.ticketQueue(), ticket, int(lock.ticketTTL()/time.Millisecond)))
+	if err != nil {
+		return false, err
+	}
+	return reply == 1, nil
+}
+
+// Leaves the line
+func (lock *Lock) dequeueTicket(ticket string) {
+	conn, err := lock.ticketConn()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Do("LREM", lock.ticketQueue(), 1, ticket)
+	conn.Do("DEL", lock.ticketQueue()+":"+ticket)
+}
+
+// Redis script for getting in line
+var enqueueTicketScript = `
+  redis.call("RPUSH", KEYS[1], ARGV[1])
+  redis.call("PEXPIRE", KEYS[1], ARGV[2])
+  redis.call("SET", KEYS[1] .. ":" .. ARGV[1], 1, "PX", ARGV[2])
+  return 1
+`
+var enqueueTicket = redis.NewScript(1, enqueueTicketScript)
+
+// Redis script for checking the head of the line, dropping the tickets of
+// acquirers that stopped checking in
+var checkTicketScript = `
+  redis.call("PEXPIRE", KEYS[1], ARGV[2])
+  redis.call("SET", KEYS[1] .. ":" .. ARGV[1], 1, "PX", ARGV[2])
+  while true do
+    local head = redis.call("LINDEX", KEYS[1], 0)
+    if not head or head == ARGV[1] then
+      return 1
+    end
+    if redis.call("EXISTS", KEYS[1] .. ":" .. head) == 1 then
+      return 0
+    end
+    redis.call("LPOP", KEYS[1])
+  end
+`
+var checkTicket = redis.NewScript(1, checkTicketScript)
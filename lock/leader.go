@@ -0,0 +1,144 @@
+package lock
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/evanhuang8/magi/cluster"
+)
+
+// ErrLockNoDuration is the error for electing a leader with a lock that never expires
+var ErrLockNoDuration = errors.New("Lock Error: leadership needs a lock duration!")
+
+// Leadership is a contender for the leadership of a key, e.g. to run a
+// background task on a single instance of a fleet. The leader holds an auto
+// renewed lock on the key, while the other contenders retry to acquire it
+// every half of its duration, so that one of them takes over within that
+// time of the lock being released or expiring.
+//
+// A Leadership leads for at most one term: once it resigns or its lock is
+// lost, it stops contending and Elect is called again to run anew.
+type Leadership struct {
+	Key string
+
+	lock *Lock
+
+	leader   bool          // whether the lock is held
+	over     bool          // whether the leadership ended
+	leading  chan struct{} // closed when elected
+	resigned chan struct{} // closed when the leadership ends
+
+	quit     chan struct{} // closed to stop contending
+	quitOnce sync.Once
+	done     chan struct{} // closed when the contending goroutine exits
+
+	mutex sync.Mutex // guards leader and over
+}
+
+// Elect runs for the leadership of the key, acquiring the lock on it with
+// the duration if it's free and retrying in the background otherwise. The
+// error of the first attempt is returned, e.g. for an unreachable cluster.
+func Elect(c cluster.LockBackend, key string, duration time.Duration) (*Leadership, error) {
+	if duration <= 0 {
+		return nil, ErrLockNoDuration
+	}
+	lock := CreateLock(c, key)
+	lock.Duration = duration
+	l := &Leadership{
+		Key:      key,
+		lock:     lock,
+		leading:  make(chan struct{}),
+		resigned: make(chan struct{}),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	elected, err := lock.Get(true)
+	if err != nil {
+		return nil, err
+	}
+	if elected {
+		l.elected()
+	}
+	go l.contend(elected)
+	return l, nil
+}
+
+// Internal contending loop, retrying to acquire the lock until elected and
+// then watching the lock until it's lost
+func (l *Leadership) contend(elected bool) {
+	defer close(l.done)
+	if !elected {
+		ticker := l.lock.Clock.NewTicker(l.lock.Duration / 2)
+		defer ticker.Stop()
+		for !elected {
+			select {
+			case <-l.quit:
+				return
+			case <-ticker.C():
+			}
+			result, err := l.lock.Get(true)
+			elected = err == nil && result
+		}
+		l.elected()
+	}
+	select {
+	case <-l.quit:
+	case <-l.lock.Lost():
+		// Drop whatever is left of the lock, another contender may hold it
+		l.lock.Release()
+		l.stepDown()
+	}
+}
+
+// Marks the contender as the leader
+func (l *Leadership) elected() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.leader = true
+	close(l.leading)
+}
+
+// Ends the leadership, if it's not over yet
+func (l *Leadership) stepDown() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.over {
+		return
+	}
+	l.leader = false
+	l.over = true
+	close(l.resigned)
+}
+
+// IsLeader returns whether the contender is the leader
+func (l *Leadership) IsLeader() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.leader
+}
+
+// Leading returns a channel closed when the contender is elected
+func (l *Leadership) Leading() <-chan struct{} {
+	return l.leading
+}
+
+// Resigned returns a channel closed when the leadership ends, either by
+// Resign or by the lock failing to be renewed, so that the leader stops its
+// task. It's also closed when the contender resigns before being elected.
+func (l *Leadership) Resigned() <-chan struct{} {
+	return l.resigned
+}
+
+// Resign stops contending and releases the lock if it's held, so that
+// another contender can take over
+func (l *Leadership) Resign() {
+	l.quitOnce.Do(func() {
+		close(l.quit)
+	})
+	<-l.done
+	if l.lock.IsActive() {
+		l.lock.Release()
+	}
+	l.stepDown()
+}
@@ -35,15 +35,17 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package lock
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
-	"fmt"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/evanhuang8/magi/backoff"
+	"github.com/evanhuang8/magi/clock"
 	"github.com/evanhuang8/magi/cluster"
-	"github.com/garyburd/redigo/redis"
 )
 
 const (
@@ -55,41 +57,69 @@ const (
 	DefaultDelay = 512 * time.Millisecond
 	// DefaultFactor is the default drift factor
 	DefaultFactor = 0.01
+	// DefaultRenewAhead is the default fraction of the duration left on the lock when it is auto renewed
+	DefaultRenewAhead = 0.5
+	// DefaultMaxDelay is the default cap of the delays between blocking attempts
+	DefaultMaxDelay = 4 * time.Second
+	// DefaultJitter is the default fraction of the delays between blocking attempts that is randomized
+	DefaultJitter = 0.5
 )
 
-// Lock represents a distributed lock on a specific key
+// Lock represents a distributed lock on a specific key.
+//
+// A lock with a zero Duration never expires and is held until it's released,
+// which suits long-lived locks like leadership. Extending or auto renewing
+// it does nothing. If the holder crashes without releasing it, the lock is
+// held until it's removed with ForceRelease.
 type Lock struct {
-	Key       string                // redis key
-	Duration  time.Duration         // duration for the lock
-	Factor    float64               // drift factor
-	Attempts  int                   // maximum attempts to acquire lock before failure
-	Delay     time.Duration         // time between attempts
-	Quorum    int                   // number of individual locks to take before considered success
-	AutoRenew bool                  // whether to auto renew the lock if it expires
-	Cluster   *cluster.RedisCluster // redis cluster
+	Key        string              // redis key
+	Duration   time.Duration       // duration for the lock, no expiry if zero
+	Factor     float64             // drift factor
+	Attempts   int                 // maximum attempts to acquire lock before failure
+	Delay      time.Duration       // time between attempts
+	Backoff    backoff.Backoff     // delays between blocking attempts, see MaxDelay and Jitter if nil
+	MaxDelay   time.Duration       // cap of the delays between blocking attempts, DefaultMaxDelay if zero
+	Jitter     float64             // fraction of the delays randomized, DefaultJitter if zero, none if negative
+	Timeout    time.Duration       // time GetContext retries for, until the context is done if zero
+	Quorum     int                 // number of individual locks to take before considered success
+	AutoRenew  bool                // whether to auto renew the lock if it expires
+	RenewAhead float64             // fraction of the duration left when auto renewing, DefaultRenewAhead if zero
+	Cluster    cluster.LockBackend // redis cluster
+	Clock      clock.Clock         // source of time for expiry and renewal
+	Metadata   string              // stored along with the value of the lock, e.g. the holder's hostname
 
 	value string // random string used for value of lock
 
 	until time.Time // timestamp at which the lock expires
 
-	ar        bool        // indicates whether the auto renew timer is on
-	arControl chan string // auto renew control channel
-	arResult  chan string // auto renew result channel
+	ar        bool          // indicates whether the auto renew timer is on
+	arControl chan string   // auto renew control channel
+	arResult  chan string   // auto renew result channel
+	arDone    chan struct{} // closed when the auto renew timer exits
+	lost      chan struct{} // closed when auto renewal fails to keep the lock
 
 	lockMutex   sync.Mutex // internal mutex for getting lock
 	updateMutex sync.Mutex // internal mutex for updating properties
 }
 
-// CreateLock creates a lock attempt on the job by job id
-func CreateLock(cluster *cluster.RedisCluster, id string) *Lock {
+// CreateLock creates a lock attempt on the job by job id, with the optional
+// metadata stored in the value of the lock, which ScanLocks and
+// ForceRelease report. On a sharded backend, the lock is taken on the shard
+// owning the key.
+func CreateLock(c cluster.LockBackend, id string, metadata ...string) *Lock {
+	if sharded, ok := c.(cluster.Sharded); ok {
+		c = sharded.Shard(storageKey(id))
+	}
 	lock := &Lock{
+		Metadata:  strings.Join(metadata, metadataSeparator),
 		Key:       id,
 		Duration:  DefaultDuration,
 		Attempts:  DefaultAttempts,
 		Delay:     DefaultDelay,
 		Factor:    DefaultFactor,
-		Quorum:    cluster.GetQuorum(),
-		Cluster:   cluster,
+		Quorum:    c.GetQuorum(),
+		Cluster:   c,
+		Clock:     clock.New(),
 		arControl: make(chan string, 2),
 		arResult:  make(chan string, 2),
 	}
@@ -105,12 +135,140 @@ var (
 	ErrLockEmptyLock = errors.New("Lock Error: attempting to operate on a lock that is not acquired!")
 	// ErrLockExtendWhileAR is the error for trying to extend the lock manually while the auto renew process is running
 	ErrLockExtendWhileAR = errors.New("Lock Error: attempting to extend the lock manually while auto renew is running!")
-	// ErrLockLost is the error for lock lost during auto renewal
+	// ErrLockLost is the error for lock lost during auto renewal, reported by Err
 	ErrLockLost = errors.New("Lock Error: lock is lost during auto renewal!")
 )
 
+// metadataSeparator separates the random value of a lock from its metadata,
+// it is not part of the base64 alphabet
+const metadataSeparator = "|"
+
+// Splits the value of a lock into its random part and its metadata
+func splitValue(value string) (string, string) {
+	parts := strings.SplitN(value, metadataSeparator, 2)
+	if len(parts) < 2 {
+		return value, ""
+	}
+	return parts[0], parts[1]
+}
+
+// PrefixKeys makes the locks stored under their key prefixed with
+// cluster.LockPrefix, so that ScanLocks tells them apart from the other keys
+// of the backend. It is off by default, since consumers with and without the
+// prefix lock different keys and would process the same jobs, so it must be
+// switched on for all the consumers of a cluster at once.
+var PrefixKeys = false
+
+// Returns the key a lock on the key is stored under
+func storageKey(key string) string {
+	if PrefixKeys {
+		return cluster.GetKey(key)
+	}
+	return key
+}
+
+// Returns the redis key of the lock
+func (lock *Lock) redisKey() string {
+	return storageKey(lock.Key)
+}
+
 // Get attempts to acquire the lock on the key
 func (lock *Lock) Get(ar bool) (bool, error) {
+	result, err := lock.get(ar)
+	recordAcquisition(lock.Key, result)
+	return result, err
+}
+
+// GetBlocking attempts to acquire the lock on the key, retrying until the timeout.
+// Blocked acquirers wait in line, so that the longest waiting one gets the lock next.
+func (lock *Lock) GetBlocking(ar bool, timeout time.Duration) (bool, error) {
+	return lock.getBlocking(context.Background(), ar, timeout)
+}
+
+// GetContext attempts to acquire the lock on the key like GetBlocking,
+// retrying until the lock's Timeout, or for as long as it takes if it's
+// zero. If the context is done first, it stops waiting right away and
+// returns the context's error.
+func (lock *Lock) GetContext(ctx context.Context, ar bool) (bool, error) {
+	timeout := lock.Timeout
+	if timeout == 0 {
+		timeout = -1
+	}
+	return lock.getBlocking(ctx, ar, timeout)
+}
+
+// Internal blocking get, retrying until the timeout unless it's negative
+func (lock *Lock) getBlocking(ctx context.Context, ar bool, timeout time.Duration) (bool, error) {
+	start := lock.Clock.Now()
+	lock.backoff().Reset()
+	// Get in line, or race for the lock if the ticket queue is unavailable
+	ticket, err := lock.enqueueTicket()
+	if err == nil {
+		defer lock.dequeueTicket(ticket)
+	}
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			recordWait(lock.Key, lock.Clock.Now().Sub(start))
+			return false, err
+		}
+		result := false
+		turn := true
+		if ticket != "" {
+			turn, err = lock.isTicketTurn(ticket)
+			if err != nil {
+				turn = true
+			}
+		}
+		if turn {
+			result, err = lock.Get(ar)
+			if err != nil && err != ErrLockFailedAfterMaxAttempts {
+				return false, err
+			}
+		}
+		elapse := lock.Clock.Now().Sub(start)
+		if result || (timeout >= 0 && elapse >= timeout) {
+			recordWait(lock.Key, elapse)
+			return result, nil
+		}
+		// Make a last attempt at the timeout rather than sleeping past it
+		delay := lock.backoff().Next(attempt)
+		if timeout >= 0 && delay > timeout-elapse {
+			delay = timeout - elapse
+		}
+		// Check in before the ticket expires, or the place in line is lost
+		if ticket != "" && delay > lock.ticketTTL()/2 {
+			delay = lock.ticketTTL() / 2
+		}
+		select {
+		case <-ctx.Done():
+		case <-lock.Clock.After(delay):
+		}
+	}
+}
+
+// Returns the backoff between blocking attempts, which is by default
+// exponential from Delay up to MaxDelay and jittered, so that contenders
+// failing together do not all retry in lockstep
+func (lock *Lock) backoff() backoff.Backoff {
+	if lock.Backoff != nil {
+		return lock.Backoff
+	}
+	max := lock.MaxDelay
+	if max == 0 {
+		max = DefaultMaxDelay
+	}
+	if max < lock.Delay {
+		max = lock.Delay
+	}
+	jitter := lock.Jitter
+	if jitter == 0 {
+		jitter = DefaultJitter
+	}
+	return backoff.NewJitter(backoff.NewExponential(lock.Delay, max, 2), jitter)
+}
+
+// Internal get, does not record stats
+func (lock *Lock) get(ar bool) (bool, error) {
 	var err error
 	// Pick up internal lock
 	lock.lockMutex.Lock()
@@ -122,21 +280,18 @@ func (lock *Lock) Get(ar bool) (bool, error) {
 		return false, err
 	}
 	value := base64.StdEncoding.EncodeToString(raw)
-	pools := lock.Cluster.GetPools()
+	if lock.Metadata != "" {
+		value += metadataSeparator + lock.Metadata
+	}
+	instances := lock.Cluster.Instances()
 	// Attempt to acquire the lock
 	for i := 0; i < lock.Attempts; i++ {
 		// Acquire lock on each node until quorum is achieved
 		n := 0
-		start := time.Now()
-		for _, pool := range *pools {
-			conn := pool.Get()
-			duration := int(lock.Duration / time.Millisecond)
-			reply, err := redis.String(conn.Do("SET", lock.Key, value, "NX", "PX", duration))
-			conn.Close()
-			if err != nil {
-				continue
-			}
-			if reply != "OK" {
+		start := lock.Clock.Now()
+		for k := 0; k < instances; k++ {
+			result, err := lock.Cluster.SetNX(k, lock.redisKey(), value, lock.Duration)
+			if err != nil || !result {
 				continue
 			}
 			n++
@@ -145,25 +300,23 @@ func (lock *Lock) Get(ar bool) (bool, error) {
 			}
 		}
 		// Check if a lock with time left is acquired in a quorum of redis hosts
-		until := time.Now().Add(lock.Duration - time.Now().Sub(start) - time.Duration(int64(float64(lock.Duration)*lock.Factor)) + 2*time.Millisecond)
+		now := lock.Clock.Now()
+		until := now.Add(lock.Duration - now.Sub(start) - time.Duration(int64(float64(lock.Duration)*lock.Factor)) + 2*time.Millisecond)
+		if lock.Duration == 0 {
+			until = time.Time{}
+		}
 		// If not, release any acquired locks
-		if n < lock.Quorum || time.Now().After(until) {
-			pools := lock.Cluster.GetPools()
-			for _, pool := range *pools {
-				if pool == nil {
-					continue
-				}
-				conn := pool.Get()
-				_, err = releaseLock.Do(conn, lock.Key, value)
-				if err != nil {
-					continue
-				}
+		if n < lock.Quorum || (!until.IsZero() && now.After(until)) {
+			for k := 0; k < instances; k++ {
+				_, err = lock.Cluster.CompareAndDelete(k, lock.redisKey(), value)
 			}
 			return false, err
 		}
 		// Lock acquired, set proper values
+		lock.updateMutex.Lock()
 		lock.value = value
 		lock.until = until
+		lock.updateMutex.Unlock()
 		// Start the auto renew timer if necessary
 		if ar {
 			lock.StartAutoRenew()
@@ -176,15 +329,15 @@ func (lock *Lock) Get(ar bool) (bool, error) {
 
 // Release releases the lock on key
 func (lock *Lock) Release() (bool, error) {
-	// Check if lock is indeed acquired
-	if lock.value == "" {
-		return false, ErrLockEmptyLock
-	}
 	// Take the lock mutex
 	lock.lockMutex.Lock()
 	defer lock.lockMutex.Unlock()
+	// Check if lock is indeed acquired
+	if !lock.IsActive() {
+		return false, ErrLockEmptyLock
+	}
 	// Stop auto renew if necessary
-	if lock.ar {
+	if lock.isAutoRenewing() {
 		lock.StopAutoRenew()
 	}
 	// Take the update mutex
@@ -193,20 +346,10 @@ func (lock *Lock) Release() (bool, error) {
 	defer lock.updateMutex.Unlock()
 	// Release locks
 	n := 0
-	pools := lock.Cluster.GetPools()
-	for _, pool := range *pools {
-		if pool == nil {
-			continue
-		}
-		conn := pool.Get()
-		status, err := releaseLock.Do(conn, lock.Key, lock.value)
-		conn.Close()
-		// Ignore error
-		if err != nil {
-			continue
-		}
-		// Key does not exist
-		if status == 0 {
+	for k := 0; k < lock.Cluster.Instances(); k++ {
+		result, err := lock.Cluster.CompareAndDelete(k, lock.redisKey(), lock.value)
+		// Ignore error, or key does not exist
+		if err != nil || !result {
 			continue
 		}
 		// Increment counter
@@ -219,9 +362,13 @@ func (lock *Lock) Release() (bool, error) {
 	return true, nil
 }
 
-// Extend extends the lock by the duration
+// Extend extends the lock to expire after the duration from now, e.g. when
+// the holder knows it needs more time than the renewal cadence gives it. The
+// ttl is only reset on the instances still holding the lock with its value,
+// atomically, and it returns false if fewer than the quorum do, i.e. the
+// lock is no longer owned.
 func (lock *Lock) Extend(duration time.Duration) (bool, error) {
-	if lock.ar {
+	if lock.isAutoRenewing() {
 		err := ErrLockExtendWhileAR
 		return false, err
 	}
@@ -231,33 +378,37 @@ func (lock *Lock) Extend(duration time.Duration) (bool, error) {
 
 // IsActive returns whether the lock is acquired
 func (lock *Lock) IsActive() bool {
+	lock.updateMutex.Lock()
+	defer lock.updateMutex.Unlock()
 	return lock.value != ""
 }
 
+// Returns whether the auto renew timer is on
+func (lock *Lock) isAutoRenewing() bool {
+	lock.updateMutex.Lock()
+	defer lock.updateMutex.Unlock()
+	return lock.ar
+}
+
 // Internal extend, does not check for auto renew status
 func (lock *Lock) extend(duration time.Duration) (bool, error) {
-	if lock.value == "" {
-		return false, ErrLockEmptyLock
-	}
 	// Take internal lock
 	lock.updateMutex.Lock()
 	defer lock.updateMutex.Unlock()
+	if lock.value == "" {
+		return false, ErrLockEmptyLock
+	}
+	// Locks without expiry have nothing to extend
+	if lock.Duration == 0 {
+		return true, nil
+	}
 	// Extend lock on each redis hosts
 	var err error
-	extension := int(duration / time.Millisecond)
 	n := 0
-	pools := lock.Cluster.GetPools()
-	for _, pool := range *pools {
-		if pool == nil {
-			continue
-		}
-		conn := pool.Get()
-		reply, err := extendLock.Do(conn, lock.Key, lock.value, extension)
-		conn.Close()
-		if err != nil {
-			continue
-		}
-		if reply != "OK" {
+	for k := 0; k < lock.Cluster.Instances(); k++ {
+		var result bool
+		result, err = lock.Cluster.CompareAndExtend(k, lock.redisKey(), lock.value, duration)
+		if err != nil || !result {
 			continue
 		}
 		n++
@@ -265,23 +416,68 @@ func (lock *Lock) extend(duration time.Duration) (bool, error) {
 	if n < lock.Quorum {
 		return false, err
 	}
+	now := lock.Clock.Now()
+	lock.until = now.Add(duration - time.Duration(int64(float64(duration)*lock.Factor)))
 	return true, nil
 }
 
-// StartAutoRenew starts the auto renew timer
-func (lock *Lock) StartAutoRenew() error {
-	if lock.value == "" {
-		return ErrLockEmptyLock
+// Returns the time left before the lock expires
+func (lock *Lock) remaining() time.Duration {
+	lock.updateMutex.Lock()
+	defer lock.updateMutex.Unlock()
+	return lock.until.Sub(lock.Clock.Now())
+}
+
+// Returns the time left on the lock at which it is auto renewed
+func (lock *Lock) renewAhead() time.Duration {
+	ahead := lock.RenewAhead
+	if ahead <= 0 || ahead >= 1 {
+		ahead = DefaultRenewAhead
 	}
+	return time.Duration(float64(lock.Duration) * ahead)
+}
+
+// StartAutoRenew starts the auto renew timer, unless the lock never expires
+func (lock *Lock) StartAutoRenew() error {
 	// Take internal lock
 	lock.updateMutex.Lock()
 	defer lock.updateMutex.Unlock()
-	// Start auto renewal
+	if lock.value == "" {
+		return ErrLockEmptyLock
+	}
+	if lock.Duration == 0 {
+		return nil
+	}
+	// Start auto renewal, with channels of its own so that nothing left over
+	// from a previous run is picked up
 	lock.ar = true
-	go lock.autoRenew()
+	lock.arControl = make(chan string, 2)
+	lock.arResult = make(chan string, 2)
+	lock.arDone = make(chan struct{})
+	lock.lost = make(chan struct{})
+	go lock.autoRenew(lock.arControl, lock.arResult, lock.arDone, lock.lost)
 	return nil
 }
 
+// Lost returns a channel closed when the auto renewal fails to keep the
+// lock, so that the holder stops relying on it. It is never closed if the
+// lock is not auto renewed.
+func (lock *Lock) Lost() <-chan struct{} {
+	lock.updateMutex.Lock()
+	defer lock.updateMutex.Unlock()
+	return lock.lost
+}
+
+// Err returns ErrLockLost if the auto renewal failed to keep the lock, nil otherwise
+func (lock *Lock) Err() error {
+	select {
+	case <-lock.Lost():
+		return ErrLockLost
+	default:
+		return nil
+	}
+}
+
 var (
 	// LockARCommandStop is the command for stopping the auto renew timer
 	LockARCommandStop = "STOP"
@@ -289,69 +485,71 @@ var (
 	LockARSignalStopSuccess = "STOPSuccess"
 )
 
-// StopAutoRenew stops the auto renew timer
+// StopAutoRenew stops the auto renew timer, returning false if it was not running
 func (lock *Lock) StopAutoRenew() bool {
-	lock.arControl <- LockARCommandStop
-	signal := <-lock.arResult
+	lock.updateMutex.Lock()
+	control, result, done := lock.arControl, lock.arResult, lock.arDone
+	lock.updateMutex.Unlock()
+	if done == nil {
+		return false
+	}
+	signal := ""
+	select {
+	case control <- LockARCommandStop:
+		select {
+		case signal = <-result:
+		case <-done:
+		}
+	case <-done:
+	}
+	lock.updateMutex.Lock()
+	lock.ar = false
+	lock.updateMutex.Unlock()
 	return signal == LockARSignalStopSuccess
 }
 
 // Auto renew timer
-func (lock *Lock) autoRenew() {
+func (lock *Lock) autoRenew(control chan string, signals chan string, done chan struct{}, lost chan struct{}) {
+	defer close(done)
 	// Start the renewal ticker
-	start := time.Now()
+	ticker := lock.Clock.NewTicker(time.Millisecond)
+	defer ticker.Stop()
 	// Run timer until otherwise told
 	for {
 		// Check commands
 		select {
-		case command := <-lock.arControl:
+		case command := <-control:
 			// Stop auto renew on command
 			if command == LockARCommandStop {
 				// Send signal
-				lock.arResult <- LockARSignalStopSuccess
+				signals <- LockARSignalStopSuccess
 				return
 			}
-		default:
+		case <-ticker.C():
 			// Check if lock is released
-			if lock.value == "" {
+			if !lock.IsActive() {
 				return
 			}
-			// Extend lock if time is past the duration midpoint
-			elapse := float64(time.Now().Sub(start))
-			threshold := float64(lock.Duration) * 0.5
-			if elapse >= threshold {
-				result, err := lock.extend(lock.Duration)
-				if err != nil {
-					fmt.Println(err)
-					panic(ErrLockLost)
-				}
-				if !result {
-					panic(ErrLockLost)
-				}
-				// Reset ticker
-				start = time.Now()
+			// Extend lock well ahead of its expiry
+			if lock.remaining() > lock.renewAhead() {
+				continue
+			}
+			result, err := lock.extend(lock.Duration)
+			if err == ErrLockEmptyLock {
+				return
+			}
+			if err != nil || !result {
+				// Retry once before giving up on the lock
+				result, err = lock.extend(lock.Duration)
+			}
+			if err == ErrLockEmptyLock {
+				return
+			}
+			if err != nil || !result {
+				// Let the holder know instead of renewing a lock it no longer has
+				close(lost)
+				return
 			}
-			time.Sleep(time.Millisecond)
 		}
 	}
 }
-
-// Redis script for releasing lock
-var releaseLockScript = `
-  if redis.call("GET", KEYS[1]) == ARGV[1] then
-    return redis.call("DEL", KEYS[1])
-  else
-    return 0
-  end
-`
-var releaseLock = redis.NewScript(1, releaseLockScript)
-
-// Redis script for extending lock
-var extendLockScript = `
-  if redis.call("GET", KEYS[1]) == ARGV[1] then
-    return redis.call("SET", KEYS[1], ARGV[1], "XX", "PX", ARGV[2])
-  else
-    return "ERR"
-  end
-`
-var extendLock = redis.NewScript(1, extendLockScript)
@@ -0,0 +1,81 @@
+package lock
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/evanhuang8/magi/cluster"
+)
+
+// MultiLock represents a group of locks acquired together on several keys
+type MultiLock struct {
+	Keys  []string
+	locks []*Lock
+}
+
+// ErrLockMultiFailed is the error for failing to acquire all the locks of a multi lock
+var ErrLockMultiFailed = errors.New("Lock Error: fail to acquire all the locks!")
+
+// AcquireAll acquires locks on all the keys, or none of them.
+// The keys are always acquired in sorted order, so that two acquirers
+// contending on overlapping keys can not deadlock each other.
+func AcquireAll(cluster cluster.LockBackend, keys []string, duration time.Duration) (*MultiLock, error) {
+	sorted := make([]string, len(keys))
+	copy(sorted, keys)
+	sort.Strings(sorted)
+	multi := &MultiLock{
+		Keys:  sorted,
+		locks: make([]*Lock, 0, len(sorted)),
+	}
+	for i, key := range sorted {
+		// Skip duplicated keys
+		if i > 0 && key == sorted[i-1] {
+			continue
+		}
+		lock := CreateLock(cluster, key)
+		lock.Duration = duration
+		result, err := lock.Get(false)
+		if err != nil || !result {
+			// Roll back the acquired locks
+			multi.Release()
+			if err == nil {
+				err = ErrLockMultiFailed
+			}
+			return nil, err
+		}
+		multi.locks = append(multi.locks, lock)
+	}
+	return multi, nil
+}
+
+// Release releases all the locks held
+func (multi *MultiLock) Release() (bool, error) {
+	success := true
+	var err error
+	// Release in reverse order of acquisition
+	for i := len(multi.locks) - 1; i >= 0; i-- {
+		result, e := multi.locks[i].Release()
+		if e != nil {
+			err = e
+		}
+		if !result {
+			success = false
+		}
+	}
+	multi.locks = multi.locks[:0]
+	return success, err
+}
+
+// IsActive returns whether all the locks are acquired
+func (multi *MultiLock) IsActive() bool {
+	if len(multi.locks) == 0 {
+		return false
+	}
+	for _, lock := range multi.locks {
+		if !lock.IsActive() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package lock
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/evanhuang8/magi/cluster"
+)
+
+// LockInfo describes a lock found in the lock backend
+type LockInfo struct {
+	Key       string        // key of the lock
+	Value     string        // random value identifying the holder of the lock
+	Metadata  string        // metadata the lock is created with, if any
+	TTL       time.Duration // shortest time left before the lock expires on an instance
+	Instances int           // number of instances holding the lock with the value
+}
+
+// add counts an instance holding the lock, if it agrees with the first
+// holder found
+func (info *LockInfo) add(value string, ttl time.Duration) {
+	if info.Instances == 0 {
+		info.Value, info.Metadata = splitValue(value)
+		info.TTL = ttl
+	} else if token, _ := splitValue(value); token != info.Value {
+		return
+	}
+	info.Instances++
+	if ttl < info.TTL {
+		info.TTL = ttl
+	}
+}
+
+// IsHeld returns whether the lock is held on a quorum of the instances
+func (info *LockInfo) IsHeld(c cluster.LockBackend) bool {
+	return info.Instances >= c.GetQuorum()
+}
+
+// ScanLocks returns the locks whose key matches the glob-style pattern,
+// sorted by key, all of them if the pattern is empty. It is meant for
+// operational inspection, and SCANs every instance of the backend. Without
+// PrefixKeys, the other keys of the backend matching the pattern with a
+// string value are reported as locks too.
+func ScanLocks(c cluster.LockBackend, pattern string) ([]LockInfo, error) {
+	if pattern == "" {
+		pattern = "*"
+	}
+	var err error
+	n := 0
+	locks := make(map[string]*LockInfo)
+	for i := 0; i < c.Instances(); i++ {
+		var keys []string
+		keys, err = c.Scan(i, storageKey(pattern))
+		if err != nil {
+			continue
+		}
+		n++
+		for _, key := range keys {
+			value, ttl, e := c.Inspect(i, key)
+			if e != nil || value == "" {
+				continue
+			}
+			if PrefixKeys {
+				key = strings.TrimPrefix(key, cluster.LockPrefix)
+			}
+			info, exists := locks[key]
+			if !exists {
+				info = &LockInfo{
+					Key: key,
+				}
+				locks[key] = info
+			}
+			info.add(value, ttl)
+		}
+	}
+	if n < c.GetQuorum() {
+		return nil, err
+	}
+	keys := make([]string, 0, len(locks))
+	for key := range locks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	found := make([]LockInfo, len(keys))
+	for i, key := range keys {
+		found[i] = *locks[key]
+	}
+	return found, nil
+}
+
+// ForceRelease removes the lock on the key from every instance, whoever
+// holds it, and returns what the lock was, or nil if it was not found. It is
+// meant for incident response, as the holder keeps running unaware that it
+// lost the lock.
+func ForceRelease(c cluster.LockBackend, key string) (*LockInfo, error) {
+	var info *LockInfo
+	for i := 0; i < c.Instances(); i++ {
+		value, ttl, err := c.Inspect(i, storageKey(key))
+		if err != nil || value == "" {
+			continue
+		}
+		if info == nil {
+			info = &LockInfo{
+				Key: key,
+			}
+		}
+		info.add(value, ttl)
+	}
+	err := c.Del(storageKey(key))
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
@@ -0,0 +1,121 @@
+package lock
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KeyStats represents the acquisition statistics of the locks sharing a key prefix
+type KeyStats struct {
+	Acquired int64         // successful acquisitions
+	Failed   int64         // failed acquisitions due to contention or errors
+	Waits    int64         // blocking acquisitions
+	WaitTime time.Duration // total time spent in blocking acquisitions
+}
+
+// AverageWait returns the average time spent in a blocking acquisition
+func (s KeyStats) AverageWait() time.Duration {
+	if s.Waits == 0 {
+		return 0
+	}
+	return s.WaitTime / time.Duration(s.Waits)
+}
+
+type keyStats struct {
+	acquired int64
+	failed   int64
+	waits    int64
+	waitTime int64
+}
+
+var (
+	statsEnabled int32
+	stats        = make(map[string]*keyStats)
+	statsMutex   sync.RWMutex
+)
+
+// StatsPrefix returns the prefix a key's statistics are grouped under, which
+// is the part before the first colon
+var StatsPrefix = func(key string) string {
+	i := strings.Index(key, ":")
+	if i < 0 {
+		return ""
+	}
+	return key[:i]
+}
+
+// EnableStats turns the collection of acquisition statistics on or off
+func EnableStats(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&statsEnabled, 1)
+	} else {
+		atomic.StoreInt32(&statsEnabled, 0)
+	}
+}
+
+// Stats returns the acquisition statistics by key prefix
+func Stats() map[string]KeyStats {
+	statsMutex.RLock()
+	defer statsMutex.RUnlock()
+	result := make(map[string]KeyStats, len(stats))
+	for prefix, s := range stats {
+		result[prefix] = KeyStats{
+			Acquired: atomic.LoadInt64(&s.acquired),
+			Failed:   atomic.LoadInt64(&s.failed),
+			Waits:    atomic.LoadInt64(&s.waits),
+			WaitTime: time.Duration(atomic.LoadInt64(&s.waitTime)),
+		}
+	}
+	return result
+}
+
+// ResetStats clears all acquisition statistics
+func ResetStats() {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	stats = make(map[string]*keyStats)
+}
+
+// Returns the statistics of the key, or nil if stats are disabled
+func statsFor(key string) *keyStats {
+	if atomic.LoadInt32(&statsEnabled) == 0 {
+		return nil
+	}
+	prefix := StatsPrefix(key)
+	statsMutex.RLock()
+	s, exists := stats[prefix]
+	statsMutex.RUnlock()
+	if exists {
+		return s
+	}
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	if s, exists = stats[prefix]; !exists {
+		s = &keyStats{}
+		stats[prefix] = s
+	}
+	return s
+}
+
+func recordAcquisition(key string, acquired bool) {
+	s := statsFor(key)
+	if s == nil {
+		return
+	}
+	if acquired {
+		atomic.AddInt64(&s.acquired, 1)
+	} else {
+		atomic.AddInt64(&s.failed, 1)
+	}
+}
+
+func recordWait(key string, wait time.Duration) {
+	s := statsFor(key)
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.waits, 1)
+	atomic.AddInt64(&s.waitTime, int64(wait))
+}
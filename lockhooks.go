@@ -0,0 +1,85 @@
+package magi
+
+import (
+	"sync"
+
+	"github.com/evanhuang8/magi/job"
+	"github.com/evanhuang8/magi/lock"
+)
+
+// LockHookBufferSize is the number of calls to the lock hooks queued for a
+// slow hook before new calls are dropped
+var LockHookBufferSize = 1024
+
+// hookQueue delivers the calls to the lock hooks in order on a goroutine of
+// its own, which runs while there are calls queued
+type hookQueue struct {
+	calls   []func()
+	running bool
+	mutex   sync.Mutex
+}
+
+// push queues the call without blocking, and returns false if the queue is full
+func (q *hookQueue) push(call func()) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.calls) >= LockHookBufferSize {
+		return false
+	}
+	q.calls = append(q.calls, call)
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+	return true
+}
+
+func (q *hookQueue) run() {
+	for {
+		q.mutex.Lock()
+		if len(q.calls) == 0 {
+			q.running = false
+			q.mutex.Unlock()
+			return
+		}
+		call := q.calls[0]
+		q.calls[0] = nil
+		q.calls = q.calls[1:]
+		q.mutex.Unlock()
+		call()
+	}
+}
+
+// callLockHook queues the call to the lock hook with the job
+func (m *Magi) callLockHook(hook func(queueName string, id string), _job *job.Job) {
+	queueName, id := _job.QueueName, _job.ID
+	if !m.lockHooks.push(func() {
+		hook(queueName, id)
+	}) {
+		m.jobLogf(_job, "Warning: too many lock hook calls queued, dropping the call")
+	}
+}
+
+// lockAcquired reports the lock acquired on the job to OnLockAcquired
+func (m *Magi) lockAcquired(_job *job.Job) {
+	if m.OnLockAcquired != nil {
+		m.callLockHook(m.OnLockAcquired, _job)
+	}
+}
+
+// lockContended reports the lock on the job held by another consumer to
+// OnLockContended
+func (m *Magi) lockContended(_job *job.Job) {
+	if m.OnLockContended != nil {
+		m.callLockHook(m.OnLockContended, _job)
+	}
+}
+
+// releaseLock releases the lock on the job, reporting it to OnLockReleased
+// if it was held
+func (m *Magi) releaseLock(_lock *lock.Lock, _job *job.Job) {
+	released, err := _lock.Release()
+	if err == nil && released && m.OnLockReleased != nil {
+		m.callLockHook(m.OnLockReleased, _job)
+	}
+}
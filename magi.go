@@ -1,10 +1,14 @@
 package magi
 
 import (
+	"context"
 	"errors"
-	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/evanhuang8/magi/backoff"
+	"github.com/evanhuang8/magi/clock"
 	"github.com/evanhuang8/magi/cluster"
 	"github.com/evanhuang8/magi/job"
 	"github.com/evanhuang8/magi/lock"
@@ -14,59 +18,223 @@ import (
 var MagiAPIVersion = "0.1"
 
 // BlockingTimeout is the timeout used for blocking operations
+//
+// Deprecated: it has no effect, use SetBlockingTimeout or WithBlockingTimeout.
 var BlockingTimeout = "5s"
 
 // Magi represents the top level queue application
 type Magi struct {
 	APIVersion string
 
-	dqCluster *cluster.DisqueCluster
-	rCluster  *cluster.RedisCluster
+	dqCluster cluster.JobBackend
+	rCluster  cluster.LockBackend
+	clock     clock.Clock
+	codec     job.EnvelopeCodec
+	maxBody   int           // maximum size of the encoded jobs, unlimited if zero
+	compress  int           // size of the bodies above which they are compressed, not compressed if zero
+	resultTTL time.Duration // time the results of the processed jobs are stored, not stored if zero
+	events    chan Event
+	logger    Logger
+	conn      *connectivity // connection errors of the clusters
 
-	processors     map[string]*Processor
-	isProcessing   bool
-	processControl chan string
+	processors      map[string]*registration
+	retryPolicies   map[string]*RetryPolicy
+	retryTracker    RetryTracker
+	queueDefaults   map[string]*cluster.DisqueOpConfig
+	isProcessing    int32          // number of running processing loops, accessed atomically
+	processing      sync.WaitGroup // running processing loops
+	quit            chan struct{}  // closed on shutdown
+	quitOnce        sync.Once
+	cancelled       chan struct{} // closed to cancel the jobs being processed
+	cancelOnce      sync.Once
+	closeOnce       sync.Once
+	shutdownGrace   time.Duration
+	workers         chan struct{} // worker slots of the processing pool
+	busy            int32         // number of busy workers, accessed atomically
+	droppedEvents   int32         // number of events dropped for a full buffer, accessed atomically
+	activeWorkers   int32         // number of workers under adaptive concurrency, accessed atomically
+	scalerQuit      chan struct{} // closed to stop the scaler of adaptive concurrency, nil without one
+	scalerDone      chan struct{} // closed when the scaler exits
+	held            heldJobs      // processed jobs waiting for a manual ack
+	lockHooks       hookQueue     // pending calls to the lock hooks
+	async           asyncJobs     // jobs added asynchronously waiting for disque
+	history         processedHistory
+	queueSlots      map[string]chan struct{}
+	breakers        map[string]*circuitBreaker
+	semantics       map[string]DeliverySemantics
+	ackReplicas     map[string]int           // nodes the jobs must be replicated to before they're acked, by queue
+	latencies       map[string]time.Duration // queue latency of the last job fetched by queue
+	fetches         map[string]*FetchStats   // outcomes of the fetches by queue
+	orderingWindows map[string]time.Duration // time the fetched jobs are held to be processed in ETA order, by queue
+	idleBackoff     backoff.Backoff          // pause between the fetches of an empty queue
+	blockingTimeout time.Duration            // time a fetch waits for a job, the cluster default if zero
+	waitTimeout     time.Duration            // time a WAIT extending a lease may take, unlimited if zero
+	deadlineHeader  string                   // header carrying the deadline of the jobs, not checked if empty
+	prefetch        int                      // number of jobs fetched ahead of the workers
+	prefetched      int32                    // number of jobs waiting for a worker, accessed atomically
+
+	// DryRun makes the consumer fetch, lock and ack the jobs without
+	// processing them, see DryRunProcessor
+	DryRun bool
+
+	// ConfirmAck is called with the result of each job processed without
+	// error, before it's acked, e.g. to check that a transaction commits. If
+	// it returns false, the job is nacked instead. It is not called for the
+	// jobs held by a ManualAckProcessor, whose ack is already up to the
+	// processor, nor for queues delivering at most once, which ack first.
+	ConfirmAck func(_job *job.Job, result interface{}) bool
+
+	// CancelOnLeaseOverrun makes the jobs whose lease lapses before it's
+	// extended cancelled and left to disque, instead of only reported with
+	// EventLeaseOverrun, since they may already be delivered again
+	CancelOnLeaseOverrun bool
+
+	// OnPoolSaturated is called when a job can not be dispatched because all workers are busy
+	OnPoolSaturated func()
+	// OnPoolIdle is called when the last busy worker finishes its job
+	OnPoolIdle func()
+	// OnLockUnavailable is called when the lock on a job can not be acquired
+	// because of a redis error, with whether the job is processed without the lock
+	OnLockUnavailable func(queueName string, id string, err error, degraded bool)
+	// OnLockAcquired, OnLockContended and OnLockReleased are called with the
+	// queue and the id of the job when its lock is acquired, found held by
+	// another consumer, and released. They are called in order on a
+	// goroutine of their own, so that they never hold up the processing, and
+	// the calls are dropped if more than LockHookBufferSize are pending.
+	OnLockAcquired  func(queueName string, id string)
+	OnLockContended func(queueName string, id string)
+	OnLockReleased  func(queueName string, id string)
+	// OnBreakerStateChange is called when the circuit breaker of a queue changes its state
+	OnBreakerStateChange func(queueName string, state BreakerState)
+	// OnPanic is called when a processor panics, with the value and the stack
+	// trace of the panic, before it's handled per the panic policy
+	OnPanic func(queueName string, id string, err *PanicError)
+
+	lockUnavailablePolicy LockUnavailablePolicy
+	panicPolicy           PanicPolicy
+	catchUpPolicy         CatchUpPolicy
+
+	mutex sync.RWMutex // guards processors, retryPolicies, queueDefaults, queueSlots, breakers, semantics, latencies, fetches and orderingWindows
 }
 
 var (
 	// MagiProcessCommandStop is the command for stopping the processor
+	//
+	// Deprecated: processing loops stop when quit is closed on Close or
+	// Shutdown, no command is sent anymore.
 	MagiProcessCommandStop = "STOP"
 )
 
 // Producer creates a Magi instance that acts as a producer
 func Producer(config *cluster.DisqueClusterConfig) (*Magi, error) {
-	dqCluster, err := cluster.NewDisqueCluster(config)
+	return New(WithDisque(config))
+}
+
+// ProducerWithBackend creates a Magi instance that acts as a producer on the job backend
+func ProducerWithBackend(jobs cluster.JobBackend) *Magi {
+	producer := &Magi{
+		APIVersion:    MagiAPIVersion,
+		dqCluster:     jobs,
+		clock:         clock.New(),
+		codec:         job.DefaultCodec,
+		events:        make(chan Event, EventBufferSize),
+		logger:        DefaultLogger,
+		quit:          make(chan struct{}),
+		cancelled:     make(chan struct{}),
+		conn:          &connectivity{},
+		shutdownGrace: DefaultShutdownGracePeriod,
+	}
+	return producer
+}
+
+// IndexedProducer creates a Magi instance that acts as a producer, with a redis
+// cluster for indexing jobs by their external ids
+func IndexedProducer(dqConfig *cluster.DisqueClusterConfig, rConfig *cluster.RedisClusterConfig) (*Magi, error) {
+	producer, err := Producer(dqConfig)
 	if err != nil {
 		return nil, err
 	}
-	producer := &Magi{
-		APIVersion:   MagiAPIVersion,
-		dqCluster:    dqCluster,
-		isProcessing: false,
-	}
+	producer.rCluster = cluster.NewRedisCluster(rConfig)
 	return producer, nil
 }
 
 // Consumer creates a Magi instance that acts as a consumer
 func Consumer(dqConfig *cluster.DisqueClusterConfig, rConfig *cluster.RedisClusterConfig) (*Magi, error) {
-	dqCluster, err := cluster.NewDisqueCluster(dqConfig)
-	if err != nil {
-		return nil, err
-	}
-	rCluster := cluster.NewRedisCluster(rConfig)
+	return New(WithDisque(dqConfig), WithRedis(rConfig))
+}
+
+// ConsumerWithBackends creates a Magi instance that acts as a consumer on the
+// job backend, taking the locks on the jobs in the lock backend
+func ConsumerWithBackends(jobs cluster.JobBackend, locks cluster.LockBackend) *Magi {
 	consumer := &Magi{
-		APIVersion:     MagiAPIVersion,
-		dqCluster:      dqCluster,
-		rCluster:       rCluster,
-		isProcessing:   false,
-		processors:     make(map[string]*Processor),
-		processControl: make(chan string, 1),
+		APIVersion:    MagiAPIVersion,
+		dqCluster:     jobs,
+		rCluster:      locks,
+		clock:         clock.New(),
+		codec:         job.DefaultCodec,
+		events:        make(chan Event, EventBufferSize),
+		logger:        DefaultLogger,
+		processors:    make(map[string]*registration),
+		retryPolicies: make(map[string]*RetryPolicy),
+		retryTracker:  NewRedisRetryTracker(locks, DefaultRetryTrackerTTL),
+		workers:       make(chan struct{}, DefaultConcurrency),
+		quit:          make(chan struct{}),
+		cancelled:     make(chan struct{}),
+		conn:          &connectivity{},
+		shutdownGrace: DefaultShutdownGracePeriod,
+		idleBackoff:   newIdleBackoff(DefaultIdleBackoffInitial, DefaultIdleBackoffMax),
 	}
-	return consumer, nil
+	return consumer
 }
 
-// Close terminates all connections from the Magi instance
+// SetClock replaces the source of time used for scheduling jobs, waiting on
+// jobs and timing locks, mostly useful for tests
+func (m *Magi) SetClock(c clock.Clock) {
+	m.clock = c
+}
+
+// SetEnvelopeCodec replaces the codec wrapping the data of the jobs, which
+// must be the same for the producers and consumers of a queue. Jobs written
+// without any envelope are read as plain bodies.
+func (m *Magi) SetEnvelopeCodec(codec job.EnvelopeCodec) {
+	m.codec = codec
+}
+
+// SetMaxBodySize sets the maximum size in bytes of a job, after it's wrapped
+// by the envelope codec, above which adding it fails with ErrBodyTooLarge
+// without reaching disque. Zero means unlimited.
+func (m *Magi) SetMaxBodySize(size int) {
+	m.maxBody = size
+}
+
+// SetCompression makes the jobs whose body is larger than the threshold in
+// bytes compressed with gzip when they are added, see CompressingCodec. The
+// consumers decompress them transparently. Zero disables the compression.
+func (m *Magi) SetCompression(threshold int) {
+	m.compress = threshold
+}
+
+// Close stops the processing loops and terminates all connections from the
+// Magi instance. It is safe to call more than once, the calls after the first
+// one do nothing and return nil.
 func (m *Magi) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		err = m.close()
+	})
+	return err
+}
+
+func (m *Magi) close() error {
+	// Stop all the processing loops at once, closing never blocks whatever
+	// the state of the loops
+	if m.quit != nil {
+		m.quitOnce.Do(func() {
+			close(m.quit)
+		})
+	}
+	// Let the jobs added asynchronously reach disque before disconnecting
+	unconfirmed := m.async.flush(m.clock, AsyncFlushTimeout)
 	if m.dqCluster != nil {
 		err := m.dqCluster.Close()
 		if err != nil {
@@ -79,8 +247,8 @@ func (m *Magi) Close() error {
 			return err
 		}
 	}
-	if m.isProcessing {
-		m.processControl <- MagiProcessCommandStop
+	if len(unconfirmed) > 0 {
+		return &AsyncFlushError{unconfirmed}
 	}
 	return nil
 }
@@ -89,10 +257,136 @@ func (m *Magi) Close() error {
  * Producer methods
  */
 
+// ErrNoIndex is the error for using external ids without a redis cluster to index them
+var ErrNoIndex = errors.New("Magi Error: external ids require a redis cluster!")
+
+// ErrBodyTooLarge is the error for a job larger than the maximum body size
+var ErrBodyTooLarge = errors.New("Magi Error: job body is too large!")
+
+// limitedCodec is an envelope codec refusing to encode jobs larger than max
+type limitedCodec struct {
+	job.EnvelopeCodec
+	max int
+}
+
+func (c limitedCodec) Encode(data *job.Data) (string, error) {
+	payload, err := c.EnvelopeCodec.Encode(data)
+	if err != nil {
+		return "", err
+	}
+	if len(payload) > c.max {
+		return "", ErrBodyTooLarge
+	}
+	return payload, nil
+}
+
 // AddJob adds a job to the queue
 func (m *Magi) AddJob(queueName string, body string, ETA time.Time, config *cluster.DisqueOpConfig) (*job.Job, error) {
-	_job, err := job.Add(m.dqCluster, queueName, body, ETA, config)
-	return _job, err
+	return m.AddJobWithHeaders(queueName, body, nil, ETA, config)
+}
+
+// AddJobDelayed adds a job to the queue that becomes available after the
+// delay, which is passed to disque as is rather than computed from an ETA
+func (m *Magi) AddJobDelayed(queueName string, body string, delay time.Duration, config *cluster.DisqueOpConfig) (*job.Job, error) {
+	now := m.clock.Now()
+	_job := job.New(queueName, body, nil, now.Add(delay), now)
+	config = config.Merge(nil)
+	config.Delay = delay
+	err := m.addJob(_job, config)
+	if err != nil {
+		return nil, err
+	}
+	return _job, nil
+}
+
+// AddJobWithExternalID adds a job to the queue that can be looked up by the
+// external id. If the job can't be indexed, it's removed from the queue so
+// that adding it again does not duplicate it.
+func (m *Magi) AddJobWithExternalID(queueName string, externalID string, body string, ETA time.Time, config *cluster.DisqueOpConfig) (*job.Job, error) {
+	headers := map[string]string{
+		job.HeaderExternalID: externalID,
+	}
+	return m.AddJobWithHeaders(queueName, body, headers, ETA, config)
+}
+
+// AddJobWithHeaders adds a job carrying the headers to the queue
+func (m *Magi) AddJobWithHeaders(queueName string, body string, headers map[string]string, ETA time.Time, config *cluster.DisqueOpConfig) (*job.Job, error) {
+	_job := job.New(queueName, body, headers, ETA, m.clock.Now())
+	err := m.addJob(_job, config)
+	if err != nil {
+		return nil, err
+	}
+	return _job, nil
+}
+
+// AddJobBytes adds a job with a binary body to the queue, which is preserved
+// byte for byte and available to the processor with RawBody
+func (m *Magi) AddJobBytes(queueName string, body []byte, ETA time.Time, config *cluster.DisqueOpConfig) (*job.Job, error) {
+	_job := job.NewBytes(queueName, body, nil, ETA, m.clock.Now())
+	err := m.addJob(_job, config)
+	if err != nil {
+		return nil, err
+	}
+	return _job, nil
+}
+
+func (m *Magi) addJob(_job *job.Job, config *cluster.DisqueOpConfig) error {
+	externalID := _job.ExternalID()
+	if externalID != "" && m.rCluster == nil {
+		return ErrNoIndex
+	}
+	// Apply the queue's defaults
+	m.mutex.RLock()
+	defaults := m.queueDefaults[_job.QueueName]
+	m.mutex.RUnlock()
+	config = config.Merge(defaults)
+	codec := m.codec
+	if codec == nil {
+		codec = job.DefaultCodec
+	}
+	if m.compress > 0 {
+		codec = job.CompressingCodec{EnvelopeCodec: codec, Threshold: m.compress}
+	}
+	if m.maxBody > 0 {
+		codec = limitedCodec{codec, m.maxBody}
+	}
+	err := job.EnqueueWithCodec(m.dqCluster, _job, config, codec)
+	if err != nil {
+		return err
+	}
+	// Index the job by its external id, expiring along with the job
+	if externalID != "" {
+		ttl := cluster.DisqueDefaultTTL
+		if config.TTL > 0 {
+			ttl = config.TTL
+		}
+		_, err = m.rCluster.Set(externalIDKey(externalID), _job.ID, ttl)
+		if err != nil {
+			// Take the job back, so that adding it again does not duplicate it
+			ackErr := m.dqCluster.Ack(_job.ID)
+			if ackErr != nil {
+				m.jobLogf(_job, "Error: %v", ackErr)
+			}
+			return err
+		}
+	}
+	m.emit(EventEnqueued, _job.QueueName, _job.ID, nil)
+	return nil
+}
+
+// SetQueueDefaults sets the default config for adding jobs to a queue. The
+// fields set in the config passed to AddJob override the defaults one by one.
+func (m *Magi) SetQueueDefaults(queueName string, config *cluster.DisqueOpConfig) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.queueDefaults == nil {
+		m.queueDefaults = make(map[string]*cluster.DisqueOpConfig)
+	}
+	if config == nil {
+		delete(m.queueDefaults, queueName)
+		return
+	}
+	m.queueDefaults[queueName] = config.Merge(nil)
 }
 
 // GetJob tries to get the details about a job
@@ -104,10 +398,80 @@ func (m *Magi) GetJob(id string) (*job.Job, error) {
 		}
 		return nil, err
 	}
-	_job, err := job.FromDetails(details)
+	_job, err := job.FromDetailsWithCodec(details, m.codec)
 	return _job, err
 }
 
+// GetJobs tries to get the jobs by their ids at once, with the lookups
+// pipelined rather than a round trip per job. The jobs are in the order of
+// the ids, nil for the ones not found. If some nodes can not be reached, the
+// jobs found on the others are returned along with a *cluster.GetError
+// listing the ids that could not be looked up.
+func (m *Magi) GetJobs(ids []string) ([]*job.Job, error) {
+	details, err := m.dqCluster.GetMany(ids)
+	if details == nil {
+		return nil, err
+	}
+	jobs := make([]*job.Job, len(details))
+	for k, detail := range details {
+		if detail == nil {
+			continue
+		}
+		_job, e := job.FromDetailsWithCodec(detail, m.codec)
+		if e != nil {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		jobs[k] = _job
+	}
+	return jobs, err
+}
+
+// GetJobDetails tries to get the full state of a job as reported by disque
+func (m *Magi) GetJobDetails(id string) (*job.Details, error) {
+	fields, err := m.dqCluster.Show(id)
+	if err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return nil, nil
+	}
+	return job.DetailsFromShow(fields), nil
+}
+
+var (
+	// ErrJobNotFound is the error for a job unknown to the cluster
+	ErrJobNotFound = errors.New("Magi Error: job is not found!")
+	// ErrJobActive is the error for a job that is already delivered to a consumer
+	ErrJobActive = errors.New("Magi Error: job is already active!")
+)
+
+// JobETA returns the time a job is projected to be delivered, from the delay
+// left as reported by disque's SHOW. A queued job is due now. It fails with
+// ErrJobNotFound for unknown jobs, which includes the jobs already acked, and
+// with ErrJobActive for the jobs being processed.
+func (m *Magi) JobETA(id string) (time.Time, error) {
+	details, err := m.GetJobDetails(id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if details == nil {
+		return time.Time{}, ErrJobNotFound
+	}
+	now := m.clock.Now()
+	if details.State == "queued" {
+		return now, nil
+	}
+	// Delayed jobs are active as well until their delay is over, and awake
+	// to be queued at the end of it
+	if details.CreatedAt.Add(details.Delay).After(now) && details.NextAwakeWithin > 0 {
+		return now.Add(details.NextAwakeWithin), nil
+	}
+	return time.Time{}, ErrJobActive
+}
+
 // DeleteJob removes the job from the disque cluster
 func (m *Magi) DeleteJob(id string) (bool, error) {
 	err := m.dqCluster.Ack(id)
@@ -117,6 +481,86 @@ func (m *Magi) DeleteJob(id string) (bool, error) {
 	return true, nil
 }
 
+// GetJobByExternalID tries to get the details about a job by its external id
+func (m *Magi) GetJobByExternalID(externalID string) (*job.Job, error) {
+	if m.rCluster == nil {
+		return nil, ErrNoIndex
+	}
+	id, err := m.rCluster.Get(externalIDKey(externalID))
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, nil
+	}
+	return m.GetJob(id)
+}
+
+// DeleteJobByExternalID removes the job with the external id from the disque cluster
+func (m *Magi) DeleteJobByExternalID(externalID string) (bool, error) {
+	if m.rCluster == nil {
+		return false, ErrNoIndex
+	}
+	key := externalIDKey(externalID)
+	id, err := m.rCluster.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if id == "" {
+		return false, nil
+	}
+	result, err := m.DeleteJob(id)
+	if err != nil {
+		return false, err
+	}
+	err = m.rCluster.Del(key)
+	return result, err
+}
+
+func externalIDKey(externalID string) string {
+	return "extid:" + externalID
+}
+
+// DequeueJob removes a queued job from the queue without acknowledging it.
+//
+// Unlike DeleteJob, which acks the job so that it's removed from the cluster
+// and counted as done, DequeueJob only takes the job out of the queue: the job
+// is kept by disque, and it's queued again once its retry time passes, unless
+// it's added with a zero RetryAfter. Delayed jobs that are not yet queued and
+// jobs already delivered to a consumer are not affected. Use DequeueJob to
+// pause a queued job, and DeleteJob to cancel a job.
+func (m *Magi) DequeueJob(id string) (bool, error) {
+	n, err := m.dqCluster.Dequeue(id)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// EnqueueJob queues the job again right away, without waiting for its retry
+// or delay, e.g. to put back a job paused by DequeueJob or nacked by a
+// consumer. A job that is already queued is left as is. It fails with
+// ErrJobNotFound for unknown jobs, including the acked and expired ones.
+func (m *Magi) EnqueueJob(id string) error {
+	err := m.dqCluster.Enqueue(id)
+	if err == cluster.ErrDisqueJobNotFound {
+		return ErrJobNotFound
+	}
+	return err
+}
+
+// SetOrderedProcessing sets whether jobs of the queue are delivered in order,
+// by adding and fetching them from a single node of the cluster, see
+// cluster.DisqueCluster.SetOrdered for the throughput tradeoff
+func (m *Magi) SetOrderedProcessing(queueName string, ordered bool) {
+	m.dqCluster.SetOrdered(queueName, ordered)
+}
+
+// Queues returns the names of the queues matching the glob pattern
+func (m *Magi) Queues(pattern string) ([]string, error) {
+	return m.dqCluster.ListQueues(pattern)
+}
+
 /**
  * Consumer methods
  */
@@ -127,131 +571,798 @@ type Processor interface {
 	ShouldAutoRenew(*job.Job) bool
 }
 
+// LockDurationProcessor is an optional interface for processors choosing how
+// long the lock on a job is held, e.g. to give long jobs a longer lease up
+// front. A zero duration falls back to lock.DefaultDuration.
+//
+// The duration is the lease of the lock: when ShouldAutoRenew returns true,
+// the lock is renewed along with the job's lease in disque, by the same
+// duration each time, and the renewals happen at least every half of it. When
+// it returns false, the lock expires after the duration even if the job is
+// still being processed.
+type LockDurationProcessor interface {
+	Processor
+	LockDuration(*job.Job) time.Duration
+}
+
+// ContextProcessor is an optional interface for processors that need the
+// context the processor is registered with, which carries the dependencies
+// shared by the jobs of the queue. Magi calls ProcessContext instead of
+// Process for the processors implementing it.
+//
+// The context of each job is derived from the registered one, and is also
+// cancelled when Shutdown runs out of its grace period, or when the lock or
+// the lease on the job is lost. A job returning an error once its context is
+// cancelled is neither acked nor retried, its lock is released and it's
+// redelivered by disque.
+type ContextProcessor interface {
+	Processor
+	ProcessContext(context.Context, *job.Job) (interface{}, error)
+}
+
+// registration is a processor registered for a queue, along with its context
+type registration struct {
+	processor Processor
+	ctx       context.Context
+}
+
+// process runs the processor on the job with the context of the job,
+// reporting the outcome to a StatefulProcessor
+func (r *registration) process(ctx context.Context, _job *job.Job) (interface{}, error) {
+	if processor, ok := r.processor.(StatefulProcessor); ok {
+		return processStateful(processor, func() (interface{}, error) {
+			return r.run(ctx, _job)
+		})
+	}
+	return r.run(ctx, _job)
+}
+
+// run runs the processor on the job with the context of the job
+func (r *registration) run(ctx context.Context, _job *job.Job) (interface{}, error) {
+	if processor, ok := r.processor.(ContextProcessor); ok {
+		return processor.ProcessContext(ctx, _job)
+	}
+	return r.processor.Process(_job)
+}
+
+// ErrJobCancelled is the error for a job whose processing is cancelled
+var ErrJobCancelled = errors.New("Magi Error: job processing is cancelled!")
+
+// jobContext derives the context of a job from the context of its queue,
+// which is cancelled along with the jobs being processed
+func (m *Magi) jobContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-m.cancelled:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
 // Register adds a processor for a queue
 func (m *Magi) Register(queueName string, processor Processor) {
-	m.processors[queueName] = &processor
+	m.RegisterWithContext(queueName, context.Background(), processor)
+}
+
+// RegisterWithContext adds a processor for a queue, passing the context to
+// every ProcessContext call of a ContextProcessor, e.g. to share connection
+// pools or config stored with context.WithValue. All the jobs of the queue
+// see the same context until the processor is registered again.
+func (m *Magi) RegisterWithContext(queueName string, ctx context.Context, processor Processor) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.processors[queueName] = &registration{
+		processor: processor,
+		ctx:       ctx,
+	}
+}
+
+// Unregister removes the processor of the queue, along with the stats kept
+// for the queue. The jobs of the queue fetched afterwards are left to disque
+// for redelivery.
+func (m *Magi) Unregister(queueName string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.processors, queueName)
+	delete(m.latencies, queueName)
+	delete(m.fetches, queueName)
+}
+
+// ErrNoProcessor is the error for processing a queue without a registered processor
+var ErrNoProcessor = errors.New("Magi Error: no processor is registered for the queue!")
+
+// hasProcessor returns whether a processor is registered for the queue
+func (m *Magi) hasProcessor(queueName string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	_, exists := m.processors[queueName]
+	return exists
 }
 
-// Process starts the job processing procedure
-func (m *Magi) Process(queueName string) {
-	m.isProcessing = true
+// Process starts the job processing procedure. It runs until the instance is
+// closed, or returns ErrNoProcessor right away if no processor is registered
+// for the queue.
+func (m *Magi) Process(queueName string) error {
+	if !m.hasProcessor(queueName) {
+		return ErrNoProcessor
+	}
+	m.processing.Add(1)
+	defer m.processing.Done()
+	atomic.AddInt32(&m.isProcessing, 1)
+	defer atomic.AddInt32(&m.isProcessing, -1)
+	m.mutex.RLock()
+	slots := m.queueSlots[queueName]
+	m.mutex.RUnlock()
+	idle := 0        // number of consecutive fetches finding the queue empty
+	unavailable := 0 // number of consecutive fetches failing on unavailable nodes
+	// Fetch ahead of the workers into a bounded buffer if requested
+	var buffer *prefetcher
+	if window := m.orderingWindow(queueName); window > 0 {
+		// Hold the jobs back in a buffer to put them in order
+		size := m.prefetch
+		if size == 0 {
+			size = OrderingBufferSize
+		}
+		buffer = m.newPrefetcher(queueName, slots, size, window)
+		defer close(buffer.jobs)
+	} else if m.prefetch > 0 {
+		buffer = m.newPrefetcher(queueName, slots, m.prefetch, 0)
+		defer close(buffer.jobs)
+	}
+	acquire := func() bool {
+		if buffer != nil {
+			return m.acquirePrefetch(buffer)
+		}
+		return m.acquireWorker(slots)
+	}
+	release := func() {
+		if buffer != nil {
+			m.releasePrefetch(buffer)
+		} else {
+			m.releaseWorker(slots)
+		}
+	}
 	for {
 		select {
-		case command := <-m.processControl:
-			if command == MagiProcessCommandStop {
-				return
-			}
+		case <-m.quit:
+			return nil
 		default:
-			m.dqCluster.Chain()
-			job, err := m.dqCluster.Fetch(queueName, nil)
-			if err != nil {
-				if err.Error() != "no data available" {
-					fmt.Println("Error:", err)
+			// Pause fetching while the circuit breaker of the queue is open
+			breaker := m.breaker(queueName)
+			if breaker != nil {
+				allowed, wait, changed := breaker.allow(m.clock.Now())
+				if changed {
+					m.breakerChanged(queueName, BreakerHalfOpen)
 				}
-			} else {
-				m.process(queueName, job.ID)
+				if !allowed {
+					select {
+					case <-m.quit:
+						return nil
+					case <-m.clock.After(wait):
+					}
+					continue
+				}
+			}
+			// Wait for a free worker, or room in the buffer, before fetching a job
+			if !acquire() {
+				return nil
 			}
-			m.dqCluster.Unchain()
+			start := m.clock.Now()
+			_job, err := m.fetch(queueName, nil)
+			if err != nil || _job == nil {
+				if breaker != nil {
+					breaker.cancelProbe()
+				}
+				release()
+				if err == cluster.ErrClusterDown || err == cluster.ErrNodeLoading {
+					// Give the cluster time to recover instead of hammering it
+					unavailable++
+					if !m.backoffWait(UnavailableBackoff, unavailable, 0) {
+						return nil
+					}
+					continue
+				}
+				unavailable = 0
+				if err != nil {
+					m.logf("Error: %v", err)
+					continue
+				}
+				idle++
+				if !m.backoffWait(m.idleBackoff, idle, m.clock.Now().Sub(start)) {
+					return nil
+				}
+				continue
+			}
+			idle = 0
+			unavailable = 0
+			if buffer != nil {
+				buffer.jobs <- _job
+				continue
+			}
+			m.dispatch(queueName, _job, slots)
+		}
+	}
+}
+
+// DefaultIdleBackoffInitial is the pause after the first fetch finding a queue empty
+var DefaultIdleBackoffInitial = 10 * time.Millisecond
+
+// DefaultIdleBackoffMax is the longest pause between the fetches of an empty queue
+var DefaultIdleBackoffMax = time.Second
+
+// SetIdleBackoff sets the pause between the fetches of an empty queue, which
+// starts at initial and doubles up to max, with jitter, until a job is
+// fetched. The time a fetch already blocked waiting for a job counts towards
+// the pause, so it has no effect when fetches block for longer than max. A
+// zero max disables the pause.
+func (m *Magi) SetIdleBackoff(initial time.Duration, max time.Duration) {
+	m.idleBackoff = newIdleBackoff(initial, max)
+}
+
+// newIdleBackoff creates the backoff between the fetches of an empty queue
+func newIdleBackoff(initial time.Duration, max time.Duration) backoff.Backoff {
+	if max <= 0 {
+		return nil
+	}
+	return backoff.NewJitter(backoff.NewExponential(initial, max, 2), 0.5)
+}
+
+// UnavailableBackoff is the pause between the fetches failing because all the
+// nodes of the cluster are down or loading their dataset
+var UnavailableBackoff backoff.Backoff = backoff.NewJitter(backoff.NewExponential(100*time.Millisecond, 5*time.Second, 2), 0.5)
+
+// backoffWait pauses the processing loop before the next attempt of
+// consecutive failing fetches, not counting the time blocked in the last
+// fetch, returning false if it is shut down in the meantime
+func (m *Magi) backoffWait(b backoff.Backoff, attempt int, blocked time.Duration) bool {
+	if b == nil {
+		return true
+	}
+	wait := b.Next(attempt) - blocked
+	if wait <= 0 {
+		return true
+	}
+	select {
+	case <-m.quit:
+		return false
+	case <-m.clock.After(wait):
+		return true
+	}
+}
+
+// ProcessOnce fetches a single job from the queue without waiting for one,
+// and processes it before returning whether a job was processed. It is
+// mostly useful for tests.
+func (m *Magi) ProcessOnce(queueName string) (bool, error) {
+	if !m.hasProcessor(queueName) {
+		return false, ErrNoProcessor
+	}
+	options := &cluster.FetchOptions{
+		NoHang: true,
+	}
+	_job, err := m.fetch(queueName, options)
+	if err != nil || _job == nil {
+		return false, err
+	}
+	m.process(queueName, _job)
+	return true, nil
+}
+
+// fetch receives a job from the queue with its details, or nil if there is
+// none before the timeout
+func (m *Magi) fetch(queueName string, options *cluster.FetchOptions) (*job.Job, error) {
+	_job, err := m.fetchJob(queueName, options)
+	m.countFetch(queueName, _job, err)
+	return _job, err
+}
+
+// fetchJob receives a job from the queue, see fetch
+func (m *Magi) fetchJob(queueName string, options *cluster.FetchOptions) (*job.Job, error) {
+	opts := cluster.FetchOptions{}
+	if options != nil {
+		opts = *options
+	}
+	// The retry policy needs the delivery counters of the job
+	m.mutex.RLock()
+	_, retry := m.retryPolicies[queueName]
+	m.mutex.RUnlock()
+	opts.WithCounters = opts.WithCounters || retry
+	if opts.Timeout == 0 {
+		opts.Timeout = m.blockingTimeout
+	}
+	m.dqCluster.Chain()
+	job, counters, err := m.dqCluster.FetchWithOptions(queueName, nil, &opts)
+	if err != nil {
+		m.dqCluster.Unchain()
+		if err.Error() == "no data available" {
+			return nil, nil
 		}
+		return nil, err
+	}
+	// Get job details from the node the job is fetched from
+	_job, err := m.GetJob(job.ID)
+	m.dqCluster.Unchain()
+	if err != nil || _job == nil {
+		m.emit(EventFetched, queueName, job.ID, nil)
+		return nil, err
+	}
+	m.emitFetched(queueName, _job)
+	if counters != nil {
+		_job.Nacks = counters.Nacks
+		_job.AdditionalDeliveries = counters.AdditionalDeliveries
 	}
+	return _job, nil
 }
 
 // IsProcessing returns whether it is currently processing jobs
 func (m *Magi) IsProcessing() bool {
-	return m.isProcessing
+	return atomic.LoadInt32(&m.isProcessing) > 0
+}
+
+// DeliverySemantics is the type for the guarantee on how many times a job is processed
+type DeliverySemantics int
+
+const (
+	// AtLeastOnce acks a job after it's processed, so that a job interrupted
+	// by a crash is redelivered and processed again. This is the default.
+	AtLeastOnce DeliverySemantics = iota
+	// AtMostOnce acks a job before it's processed, so that a job is never
+	// processed twice. A job interrupted by a crash, or failing, is lost, and
+	// neither retry policies nor manual acks apply to the queue.
+	AtMostOnce
+)
+
+// SetDeliverySemantics sets how many times the jobs of the queue may be processed
+func (m *Magi) SetDeliverySemantics(queueName string, semantics DeliverySemantics) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.semantics == nil {
+		m.semantics = make(map[string]DeliverySemantics)
+	}
+	if semantics == AtLeastOnce {
+		delete(m.semantics, queueName)
+		return
+	}
+	m.semantics[queueName] = semantics
+}
+
+// deliverySemantics returns the delivery semantics of the queue
+func (m *Magi) deliverySemantics(queueName string) DeliverySemantics {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.semantics[queueName]
+}
+
+// LockUnavailablePolicy is the type for handling jobs when the redis cluster is unavailable
+type LockUnavailablePolicy int
+
+const (
+	// LockUnavailableFailFast leaves the job in disque for redelivery when the
+	// lock can not be acquired, which halts processing during a redis outage
+	LockUnavailableFailFast LockUnavailablePolicy = iota
+	// LockUnavailableSkipLock processes the job without the lock when the lock
+	// can not be acquired, at the risk of the job being processed concurrently
+	LockUnavailableSkipLock
+)
+
+// SetLockUnavailablePolicy sets how jobs are handled when the lock can not be
+// acquired because of a redis error, defaulting to LockUnavailableFailFast
+func (m *Magi) SetLockUnavailablePolicy(policy LockUnavailablePolicy) {
+	m.lockUnavailablePolicy = policy
 }
 
 // ErrDisqueJobWaitFailed is the error for failing to wait on a long processing job
 var ErrDisqueJobWaitFailed = errors.New("Disque Error: fail to wait on a job!")
 
-func (m *Magi) process(queueName string, id string) {
-	var _lock *lock.Lock
-	// Catch panics
-	defer func() {
-		if err := recover(); err != nil {
-			err, ok := err.(error)
-			if ok && err.Error() == lock.ErrLockLost.Error() {
-				// Lock is lost, release remaining lock segments
-				_lock.Release()
-			} else {
-				panic(err)
-			}
+// ErrDisqueJobWaitTimeout is the error for a WAIT on a job taking longer than the wait timeout
+var ErrDisqueJobWaitTimeout = errors.New("Disque Error: wait on a job timed out!")
+
+// WaitRetryInterval is the time between the attempts to extend the lease of
+// a job after a WAIT fails for a transient reason
+var WaitRetryInterval = 100 * time.Millisecond
+
+// SetWaitTimeout sets the time a WAIT extending the lease of a job may take,
+// with no limit if zero, the default. A WAIT timing out, or failing for a
+// transient reason, is tried again until the lease lapses, see
+// CancelOnLeaseOverrun, while other failures cancel the job. A WAIT timing
+// out is left outstanding, and no other is sent for the job until it returns.
+func (m *Magi) SetWaitTimeout(timeout time.Duration) {
+	m.waitTimeout = timeout
+}
+
+// wait extends the lease of the job, giving up after the wait timeout. The
+// WAIT given up on is kept in pending, and while it's outstanding the
+// attempts time out right away instead of sending another one.
+func (m *Magi) wait(id string, pending *chan error) error {
+	if *pending != nil {
+		select {
+		case <-*pending:
+			*pending = nil
+		default:
+			return ErrDisqueJobWaitTimeout
 		}
+	}
+	if m.waitTimeout <= 0 {
+		return m.dqCluster.Wait(id)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- m.dqCluster.Wait(id)
 	}()
+	select {
+	case err := <-done:
+		return err
+	case <-m.clock.After(m.waitTimeout):
+		*pending = done
+		return ErrDisqueJobWaitTimeout
+	}
+}
+
+// isRetryableWait returns whether the WAIT failure may go away by itself
+func isRetryableWait(err error) bool {
+	return err == ErrDisqueJobWaitTimeout || job.IsTransient(err)
+}
+
+// ErrLeaseOverrun is the error for the lease of a job lapsing before it's
+// extended, after which disque may deliver the job again
+var ErrLeaseOverrun = errors.New("Disque Error: job lease lapsed before it was extended!")
+
+func (m *Magi) process(queueName string, _job *job.Job) {
+	id := _job.ID
 	// Check if the processor is available
-	processor, exists := m.processors[queueName]
+	m.mutex.RLock()
+	reg, exists := m.processors[queueName]
+	policy, retry := m.retryPolicies[queueName]
+	m.mutex.RUnlock()
 	if !exists {
 		return
 	}
-	// Get job details
-	_job, err := m.GetJob(id)
-	if err != nil {
+	// Count the result of processing towards the circuit breaker of the queue,
+	// or let another probe through if the job is not processed
+	breaker := m.breaker(queueName)
+	processed := false
+	if breaker != nil {
+		defer func() {
+			if !processed {
+				breaker.cancelProbe()
+			}
+		}()
+	}
+	// Leave the jobs the processor turns down to the other workers
+	if m.reject(queueName, reg, _job) {
 		return
 	}
-	// Acquire lock
-	_lock = lock.CreateLock(m.rCluster, id)
-	result, err := _lock.Get((*processor).ShouldAutoRenew(_job))
-	// If lock cannot be acquired, return and do not acknowledge
+	// Acquire lock, which is renewed along with the disque lease instead of by
+	// its own auto renew timer, so that the two can not drift apart
+	_lock := lock.CreateLock(m.rCluster, id)
+	_lock.Clock = m.clock
+	if leased, ok := reg.processor.(LockDurationProcessor); ok {
+		if duration := leased.LockDuration(_job); duration > 0 {
+			_lock.Duration = duration
+		}
+	}
+	autoRenew := reg.processor.ShouldAutoRenew(_job)
+	result, err := _lock.Get(false)
 	if err != nil {
+		// If lock cannot be acquired, return and do not acknowledge, unless
+		// processing without the lock is allowed
+		degraded := m.lockUnavailablePolicy == LockUnavailableSkipLock
+		m.jobLogf(_job, "Error: %v", err)
+		if m.OnLockUnavailable != nil {
+			m.OnLockUnavailable(queueName, id, err, degraded)
+		}
+		if !degraded {
+			return
+		}
+	} else if !result {
+		m.lockContended(_job)
 		return
+	} else {
+		m.emitJob(EventLockAcquired, queueName, _job, nil)
+		m.lockAcquired(_job)
 	}
-	if !result {
+	// Discard the job instead of processing stale data
+	if m.isExpired(_job) {
+		if err := m.expire(queueName, _job, policy); err != nil {
+			m.jobLogf(_job, "Error: %v", err)
+		}
+		if result {
+			m.releaseLock(_lock, _job)
+		}
+		return
+	}
+	// Go through the motions without the side effects of the processor
+	if m.DryRun {
+		m.dryRun(queueName, reg, _job)
+		if result {
+			m.releaseLock(_lock, _job)
+		}
 		return
 	}
 	// Start the auto wait extension for the job in queue
+	var renew *lock.Lock
+	if result && autoRenew {
+		renew = _lock
+	}
+	// Ack the job before processing it if it must never run twice
+	if m.deliverySemantics(queueName) == AtMostOnce {
+		err = m.dqCluster.Ack(id)
+		if err == nil {
+			m.emitJob(EventAcked, queueName, _job, nil)
+			output, err := m.runProcessor(reg.ctx, queueName, reg, _job, breaker)
+			processed = err != ErrJobCancelled
+			if processed {
+				m.storeResult(_job, output, err, true)
+			} else {
+				m.emitJob(EventCancelled, queueName, _job, err)
+			}
+			if err == nil {
+				m.continueWith(_job, output)
+			}
+		}
+		if result {
+			m.releaseLock(_lock, _job)
+		}
+		return
+	}
+	// Give the job back before processing it if it could not be held for
+	// its manual ack, rather than after its side effects
+	if _, manual := reg.processor.(ManualAckProcessor); manual {
+		if !m.held.reserve() {
+			m.jobLogf(_job, "Too many jobs held for a manual ack, nacking the job")
+			if m.dqCluster.Nack(id) == nil {
+				m.emitJob(EventNacked, queueName, _job, nil)
+			}
+			m.releaseLock(_lock, _job)
+			return
+		}
+		defer m.held.unreserve()
+	}
+	// Losing the lease or the lock cancels the context of the job
+	ctx, cancel := context.WithCancel(reg.ctx)
+	defer cancel()
 	control := make(chan bool, 1)
+	lost := make(chan error, 1)
 	_job.IsProcessing = true
-	go m.autoWait(_job, &control)
+	go m.autoWait(_job, renew, &control, lost, cancel)
 	// Process the job
-	(*processor).Process(_job)
+	output, err := m.runProcessor(ctx, queueName, reg, _job, breaker)
+	select {
+	case e := <-lost:
+		// Another consumer may have the job by now, release the remaining
+		// lock segments and leave the job to disque
+		_job.IsProcessing = false
+		m.emitJob(EventLockLost, queueName, _job, e)
+		m.releaseLock(_lock, _job)
+		return
+	default:
+	}
+	if err == ErrJobCancelled {
+		// Leave the cancelled job to disque for redelivery
+		_job.IsProcessing = false
+		control <- true
+		m.emitJob(EventCancelled, queueName, _job, err)
+		m.releaseLock(_lock, _job)
+		return
+	}
+	processed = true
+	m.storeResult(_job, output, err, !retry)
+	manual, ok := reg.processor.(ManualAckProcessor)
+	held := err == nil && ok && manual.ManualAck(_job)
+	// Make sure the job is replicated before it's acked, if required, while
+	// its lease is still extended, and before its follow-up is added, so
+	// that the follow-up is not added again when the job is redelivered
+	if !held {
+		if e := m.confirmReplicated(queueName, id); e != nil {
+			_job.IsProcessing = false
+			control <- true
+			if m.dqCluster.Nack(id) == nil {
+				m.emitJob(EventNacked, queueName, _job, e)
+			}
+			m.releaseLock(_lock, _job)
+			return
+		}
+	}
+	if err == nil {
+		// Put the job back into the queue if the ack is not confirmed
+		if !held && m.ConfirmAck != nil && !m.ConfirmAck(_job, output) {
+			_job.IsProcessing = false
+			control <- true
+			if m.dqCluster.Nack(id) == nil {
+				m.emitJob(EventNacked, queueName, _job, nil)
+			}
+			m.releaseLock(_lock, _job)
+			return
+		}
+		// Add the follow-up job before acking, so that the job is redelivered
+		// if the follow-up can not be added
+		if e := m.continueWith(_job, output); e != nil {
+			_job.IsProcessing = false
+			control <- true
+			m.releaseLock(_lock, _job)
+			return
+		}
+		// Hold the job until it's manually acked
+		if held {
+			m.hold(queueName, _job, _lock, &control, lost)
+			return
+		}
+	}
 	// Stop the auto wait extension
 	_job.IsProcessing = false
 	control <- true
-	// Ack the job
-	err = m.dqCluster.Ack(id)
+	// Retry the failed job per the queue's policy
+	if retry && err != nil {
+		err = m.retry(queueName, _job, policy)
+		// If the job cannot be re-enqueued, leave it to disque for redelivery
+		if err != nil {
+			m.releaseLock(_lock, _job)
+			return
+		}
+	} else if retry && _job.Attempts() > 0 {
+		// Forget the failed attempts of a job that eventually succeeded
+		m.retryTracker.Reset(retryKey(_job))
+	}
+	// Ack the job, riding out transient failures
+	err = m.ack(queueName, _job)
 	if err != nil {
 		return
 	}
+	m.emitJob(EventAcked, queueName, _job, nil)
 	if !result {
 		return
 	}
 	// Release the lock
-	result, err = _lock.Release()
+	m.releaseLock(_lock, _job)
+}
+
+// runProcessor processes the job, recording the result
+func (m *Magi) runProcessor(parent context.Context, queueName string, reg *registration, _job *job.Job, breaker *circuitBreaker) (interface{}, error) {
+	ctx, cancel := m.jobContext(parent)
+	defer cancel()
+	connErrors := m.conn.count()
+	output, err := m.processRecovered(ctx, queueName, reg, _job)
+	m.history.add(_job.ID)
+	if err != nil && ctx.Err() != nil {
+		// Cancelled jobs don't count as failures
+		return nil, ErrJobCancelled
+	}
+	if breaker != nil && breaker.record(err == nil, m.clock.Now()) {
+		m.breakerChanged(queueName, breaker.current())
+	}
+	event := Event{
+		Type:       EventProcessed,
+		QueueName:  queueName,
+		JobID:      _job.ID,
+		ExternalID: _job.ExternalID(),
+		Time:       m.clock.Now(),
+		// A connection failing while the job is processed may have let
+		// another consumer take the job or its lock
+		ConnectivityDisrupted: m.conn.count() != connErrors,
+	}
 	if err != nil {
-		return
+		event.Type = EventFailed
+		event.Err = err
 	}
-	if !result {
-		return
+	m.emitEvent(event)
+	return output, err
+}
+
+// continueWith adds the follow-up job returned by processing the job, if any
+func (m *Magi) continueWith(_job *job.Job, output interface{}) error {
+	continuation, ok := output.(*job.Continuation)
+	if !ok || continuation == nil {
+		return nil
+	}
+	headers := map[string]string{
+		job.HeaderParentID: _job.ID,
 	}
-	return
+	ETA := continuation.ETA
+	now := m.clock.Now()
+	if ETA.IsZero() {
+		ETA = now
+	}
+	return m.addJob(job.New(continuation.Queue, continuation.Body, headers, ETA, now), nil)
 }
 
-func (m *Magi) autoWait(job *job.Job, control *chan bool) {
-	start := time.Now()
+// autoWait extends the disque lease of the job, and renews the lock if given,
+// on a single timer until told to stop. If either fails, it cancels the job
+// and reports the error on lost.
+func (m *Magi) autoWait(job *job.Job, renew *lock.Lock, control *chan bool, lost chan<- error, cancel func()) {
+	fail := func(err error) {
+		// Report before cancelling, so that the job returning early is
+		// known to have lost its lock
+		lost <- err
+		cancel()
+	}
+	// Extend at the midpoint of the shorter of the lease and the lock
+	interval := job.Raw.Retry
+	if renew != nil && (interval <= 0 || renew.Duration < interval) {
+		interval = renew.Duration
+	}
+	start := m.clock.Now()
+	// Time of the last extension of the lease, and whether its lapse is
+	// already reported
+	waited := start
+	overrun := false
+	// Time before which a failed wait is not tried again, and the wait timed
+	// out still outstanding
+	var retryAt time.Time
+	var pending chan error
+	checkLease := func() bool {
+		retry := job.Raw.Retry
+		if retry <= 0 || overrun || m.clock.Now().Sub(waited) <= retry {
+			return true
+		}
+		overrun = true
+		m.jobLogf(job, "Warning: lease lapsed before it was extended, the job may be delivered again")
+		m.emitJob(EventLeaseOverrun, job.QueueName, job, ErrLeaseOverrun)
+		if m.CancelOnLeaseOverrun {
+			fail(ErrLeaseOverrun)
+			return false
+		}
+		return true
+	}
+	ticker := m.clock.NewTicker(time.Millisecond)
+	defer ticker.Stop()
 	for {
 		select {
 		case command := <-*control:
 			if command {
 				return
 			}
-		default:
-			if !job.IsProcessing {
+		case <-ticker.C():
+			if !checkLease() {
 				return
 			}
 			// Check if a wait command is needed
-			elapse := float64(time.Now().Sub(start))
-			threshold := float64(job.Raw.Retry) * 0.5
-			if elapse >= threshold {
+			elapse := float64(m.clock.Now().Sub(start))
+			threshold := float64(interval) * 0.5
+			// A failed wait is tried again shortly rather than on every tick
+			if elapse >= threshold && !m.clock.Now().Before(retryAt) {
+				// Renew the lock
+				if renew != nil {
+					result, err := renew.Extend(renew.Duration)
+					if err == lock.ErrLockEmptyLock {
+						// The lock is released as the job finishes
+						return
+					}
+					if err != nil {
+						m.jobLogf(job, "%v", err)
+						m.conn.report("", err)
+					}
+					if err != nil || !result {
+						fail(lock.ErrLockLost)
+						return
+					}
+				}
 				// Issue wait
-				err := m.dqCluster.Wait(job.ID)
+				err := m.wait(job.ID, &pending)
 				if err != nil {
-					fmt.Println(err)
-					panic(ErrDisqueJobWaitFailed)
+					m.jobLogf(job, "%v", err)
+					m.conn.report("", err)
+					if isRetryableWait(err) {
+						retryAt = m.clock.Now().Add(WaitRetryInterval)
+						if !checkLease() {
+							return
+						}
+						continue
+					}
+					fail(ErrDisqueJobWaitFailed)
+					return
+				}
+				// The wait itself may take longer than the lease
+				if !checkLease() {
+					return
 				}
+				waited = m.clock.Now()
+				overrun = false
 				// Reset ticker
-				start = time.Now()
+				start = waited
 			}
-			time.Sleep(time.Millisecond)
 		}
 	}
 }
@@ -1,18 +1,30 @@
 package magi
 
 import (
+	"context"
 	"crypto/rand"
 	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/garyburd/redigo/redis"
+	"github.com/goware/disque"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/evanhuang8/magi/backoff"
+	"github.com/evanhuang8/magi/clock"
 	"github.com/evanhuang8/magi/cluster"
 	"github.com/evanhuang8/magi/job"
 	"github.com/evanhuang8/magi/lock"
@@ -121,6 +133,582 @@ func TestProducer(t *testing.T) {
 	assert.Equal(job.Body, _job.Body)
 }
 
+func TestProducerJobDetails(t *testing.T) {
+	assert := assert.New(t)
+	// Instantiation
+	producer, err := Producer(dqsConfig)
+	assert.Empty(err)
+	assert.NotEmpty(producer)
+	defer producer.Close()
+	queue := "jobq" + RandomKey()
+	// Add delayed job
+	conf := &cluster.DisqueOpConfig{
+		RetryAfter: 30 * time.Second,
+		TTL:        time.Hour,
+	}
+	job, err := producer.AddJob(queue, "job1", time.Now().Add(10*time.Second), conf)
+	assert.Empty(err)
+	// Get job details
+	details, err := producer.GetJobDetails(job.ID)
+	assert.Empty(err)
+	assert.NotEmpty(details)
+	assert.Equal(details.ID, job.ID)
+	assert.Equal(details.QueueName, queue)
+	assert.Equal(details.State, "active")
+	assert.Equal(details.Retry, 30*time.Second)
+	assert.True(details.TTL > 59*time.Minute && details.TTL <= time.Hour)
+	assert.True(details.Delay > 0)
+	assert.Equal(details.Nacks, 0)
+	// Unknown job
+	details, err = producer.GetJobDetails("D-00000000-000000000000000000000000-0000")
+	assert.Empty(err)
+	assert.Empty(details)
+}
+
+func TestProducerDelayed(t *testing.T) {
+	assert := assert.New(t)
+	// Instantiation
+	producer, err := Producer(dqsConfig)
+	assert.Empty(err)
+	assert.NotEmpty(producer)
+	defer producer.Close()
+	queue := "jobq" + RandomKey()
+	// Add delayed job
+	_job, err := producer.AddJobDelayed(queue, "job1", 30*time.Second, nil)
+	assert.Empty(err)
+	assert.NotEmpty(_job)
+	assert.Equal(_job.ETA.Sub(_job.CreatedAt), 30*time.Second)
+	details, err := producer.GetJobDetails(_job.ID)
+	assert.Empty(err)
+	assert.True(details.Delay > 25*time.Second && details.Delay <= 30*time.Second)
+	// The config passed should be left untouched
+	conf := &cluster.DisqueOpConfig{
+		TTL: time.Hour,
+	}
+	_, err = producer.AddJobDelayed(queue, "job2", time.Minute, conf)
+	assert.Empty(err)
+	assert.Equal(conf.Delay, time.Duration(0))
+}
+
+func TestProducerReplication(t *testing.T) {
+	assert := assert.New(t)
+	// Instantiation
+	producer, err := Producer(dqConfig)
+	assert.Empty(err)
+	assert.NotEmpty(producer)
+	defer producer.Close()
+	queue := "jobq" + RandomKey()
+	// Add a job replicated to all the nodes
+	conf := &cluster.DisqueOpConfig{
+		Replicate: 3,
+	}
+	_job, err := producer.AddJob(queue, "job1", time.Now(), conf)
+	assert.Empty(err)
+	assert.Equal(_job.Replicated, 3)
+	// Replication can not exceed the size of the cluster
+	conf = &cluster.DisqueOpConfig{
+		Replicate: 5,
+		Timeout:   100 * time.Millisecond,
+	}
+	_job, err = producer.AddJob(queue, "job2", time.Now(), conf)
+	assert.Equal(err, job.ErrJobNotReplicated)
+	assert.Empty(_job)
+}
+
+func TestProducerAddErrors(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	producer := ProducerWithBackend(mem)
+	defer producer.Close()
+	queue := "jobq" + RandomKey()
+	conf := &cluster.DisqueOpConfig{
+		MaxLen: 1,
+	}
+	_, err := producer.AddJob(queue, "job1", time.Now(), conf)
+	assert.Empty(err)
+	// Jobs rejected by the cluster should not be retried as is
+	_, err = producer.AddJob(queue, "job2", time.Now(), conf)
+	assert.Equal(job.ErrQueueFull, err)
+	assert.False(job.IsTransient(err))
+	// Jobs failing to reach enough nodes may be
+	_, err = producer.AddJob(queue, "job3", time.Now(), &cluster.DisqueOpConfig{
+		Replicate: 2,
+	})
+	assert.Equal(job.ErrJobNotReplicated, err)
+	assert.True(job.IsTransient(err))
+	assert.True(job.IsTransient(cluster.ErrClusterDown))
+	assert.True(job.IsTransient(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+	assert.False(job.IsTransient(errors.New("ERR syntax error")))
+	assert.False(job.IsTransient(nil))
+}
+
+func TestProducerBytes(t *testing.T) {
+	assert := assert.New(t)
+	// Instantiation
+	producer, err := Producer(dqConfig)
+	assert.Empty(err)
+	assert.NotEmpty(producer)
+	defer producer.Close()
+	queue := "jobq" + RandomKey()
+	// Add job with embedded NULs and invalid utf-8
+	body := []byte{0x1f, 0x8b, 0x00, 0x00, 0xff, 0xfe, 'm', 'a', 'g', 'i', 0x00}
+	eta := time.Now().Add(10 * time.Second)
+	job, err := producer.AddJobBytes(queue, body, eta, nil)
+	assert.Empty(err)
+	assert.NotEmpty(job)
+	assert.True(job.IsBinary())
+	assert.Equal(job.RawBody(), body)
+	// Get job
+	_job, err := producer.GetJob(job.ID)
+	assert.Empty(err)
+	assert.NotEmpty(_job)
+	assert.True(_job.IsBinary())
+	assert.Equal(_job.RawBody(), body)
+}
+
+type PrefixCodec struct{}
+
+func (c PrefixCodec) Encode(data *job.Data) (string, error) {
+	payload, err := job.JSONCodec{}.Encode(data)
+	return "magi:" + payload, err
+}
+
+func (c PrefixCodec) Decode(payload string) (*job.Data, error) {
+	if !strings.HasPrefix(payload, "magi:") {
+		return nil, job.ErrJobNoEnvelope
+	}
+	return job.JSONCodec{}.Decode(strings.TrimPrefix(payload, "magi:"))
+}
+
+func TestProducerEnvelopeCodec(t *testing.T) {
+	assert := assert.New(t)
+	// Instantiation
+	producer, err := Producer(dqsConfig)
+	assert.Empty(err)
+	assert.NotEmpty(producer)
+	defer producer.Close()
+	producer.SetEnvelopeCodec(PrefixCodec{})
+	queue := "jobq" + RandomKey()
+	// Jobs should be wrapped with the codec
+	headers := map[string]string{
+		"trace": "abc",
+	}
+	_job, err := producer.AddJobWithHeaders(queue, "job1", headers, time.Now(), nil)
+	assert.Empty(err)
+	details, err := producer.dqCluster.Get(_job.ID)
+	assert.Empty(err)
+	assert.True(strings.HasPrefix(details.Data, "magi:"))
+	_job, err = producer.GetJob(_job.ID)
+	assert.Empty(err)
+	assert.Equal(_job.Body, "job1")
+	assert.Equal(_job.Headers, headers)
+	// Plain bodies should be read as is, even if they are JSON
+	for _, body := range []string{"plain", `{"Body":"json"}`} {
+		added, err := producer.dqCluster.Add(queue, body, nil)
+		assert.Empty(err)
+		_job, err = producer.GetJob(added.ID)
+		assert.Empty(err)
+		assert.Equal(_job.Body, body)
+		producer.SetEnvelopeCodec(job.DefaultCodec)
+	}
+}
+
+func TestProducerMaxBodySize(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	producer := ProducerWithBackend(mem)
+	defer producer.Close()
+	queue := "jobq" + RandomKey()
+	producer.SetMaxBodySize(256)
+	// Small jobs should be added
+	_, err := producer.AddJob(queue, "job1", time.Now(), nil)
+	assert.Empty(err)
+	// Jobs over the limit once wrapped should be refused before reaching disque
+	_job, err := producer.AddJob(queue, strings.Repeat("x", 250), time.Now(), nil)
+	assert.Equal(err, ErrBodyTooLarge)
+	assert.Empty(_job)
+	options := &cluster.FetchOptions{
+		NoHang: true,
+	}
+	fetched, _, err := mem.FetchWithOptions(queue, nil, options)
+	assert.Empty(err)
+	assert.NotEmpty(fetched)
+	_, _, err = mem.FetchWithOptions(queue, nil, options)
+	assert.NotEmpty(err)
+	// Zero should lift the limit
+	producer.SetMaxBodySize(0)
+	_, err = producer.AddJob(queue, strings.Repeat("x", 250), time.Now(), nil)
+	assert.Empty(err)
+}
+
+func TestProducerCompression(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	consumer.SetCompression(64)
+	queue := "jobq" + RandomKey()
+	headers := map[string]string{
+		"trace": "abc",
+	}
+	large := strings.Repeat("x", 1024)
+	// Large bodies should be stored compressed and flagged
+	added, err := consumer.AddJobWithHeaders(queue, large, headers, time.Now(), nil)
+	assert.Empty(err)
+	assert.Len(headers, 1)
+	details, err := mem.Get(added.ID)
+	assert.Empty(err)
+	assert.True(len(details.Data) < len(large))
+	assert.Contains(details.Data, job.HeaderEncoding)
+	_job, err := consumer.GetJob(added.ID)
+	assert.Empty(err)
+	assert.Equal(large, _job.Body)
+	assert.Equal(headers, _job.Headers)
+	// Small bodies should be stored as they are
+	added, err = consumer.AddJob(queue, "job1", time.Now(), nil)
+	assert.Empty(err)
+	details, err = mem.Get(added.ID)
+	assert.Empty(err)
+	assert.NotContains(details.Data, job.HeaderEncoding)
+	// Uncompressed jobs added before should still be read
+	consumer.SetCompression(0)
+	_, err = consumer.AddJob(queue, large, time.Now(), nil)
+	assert.Empty(err)
+	// Processors should receive the original bodies
+	p := &DummyProcessor{}
+	consumer.Register(queue, p)
+	for i := 0; i < 3; i++ {
+		processed, err := consumer.ProcessOnce(queue)
+		assert.Empty(err)
+		assert.True(processed)
+	}
+	assert.Equal([]string{large + "dummy", "job1dummy", large + "dummy"}, p.Processed())
+}
+
+func TestProducerExternalID(t *testing.T) {
+	assert := assert.New(t)
+	// Instantiation
+	producer, err := IndexedProducer(dqConfig, rConfig)
+	assert.Empty(err)
+	assert.NotEmpty(producer)
+	defer producer.Close()
+	queue := "jobq" + RandomKey()
+	externalID := RandomKey()
+	// Add job
+	eta := time.Now().Add(10 * time.Second)
+	job, err := producer.AddJobWithExternalID(queue, externalID, "job1", eta, nil)
+	assert.Empty(err)
+	assert.NotEmpty(job)
+	assert.Equal(job.ExternalID(), externalID)
+	// Get job by external id
+	_job, err := producer.GetJobByExternalID(externalID)
+	assert.Empty(err)
+	assert.NotEmpty(_job)
+	assert.Equal(_job.ID, job.ID)
+	assert.Equal(_job.ExternalID(), externalID)
+	// Delete job by external id
+	result, err := producer.DeleteJobByExternalID(externalID)
+	assert.Empty(err)
+	assert.True(result)
+	_job, err = producer.GetJobByExternalID(externalID)
+	assert.Empty(err)
+	assert.Empty(_job)
+}
+
+// FailingSetLocks is a lock backend whose SET fails
+type FailingSetLocks struct {
+	cluster.LockBackend
+}
+
+func (c *FailingSetLocks) Set(key string, value string, ttl time.Duration) (bool, error) {
+	return false, &net.OpError{Op: "write", Err: syscall.ECONNRESET}
+}
+
+func TestProducerExternalIDIndexError(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, &FailingSetLocks{mem.Locks()})
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	// The job should not be left in the queue when it can not be indexed
+	_job, err := consumer.AddJobWithExternalID(queue, RandomKey(), "job1", time.Now(), nil)
+	assert.IsType(&net.OpError{}, err)
+	assert.Empty(_job)
+	length, err := mem.QueueLength(queue)
+	assert.Empty(err)
+	assert.Equal(0, length)
+}
+
+func TestDisqueOpConfigMerge(t *testing.T) {
+	assert := assert.New(t)
+	defaults := &cluster.DisqueOpConfig{
+		Replicate:  2,
+		RetryAfter: 30 * time.Second,
+		TTL:        time.Hour,
+	}
+	// Nil config inherits every default
+	var config *cluster.DisqueOpConfig
+	merged := config.Merge(defaults)
+	assert.Equal(merged.Replicate, 2)
+	assert.Equal(merged.RetryAfter, 30*time.Second)
+	assert.Equal(merged.TTL, time.Hour)
+	// Explicit fields override the defaults one by one
+	config = &cluster.DisqueOpConfig{
+		Replicate: 3,
+	}
+	merged = config.Merge(defaults)
+	assert.Equal(merged.Replicate, 3)
+	assert.Equal(merged.RetryAfter, 30*time.Second)
+	assert.Equal(merged.TTL, time.Hour)
+	assert.Equal(config.TTL, time.Duration(0))
+}
+
+func TestDisqueNodeForJob(t *testing.T) {
+	assert := assert.New(t)
+	// Instantiation
+	c, err := cluster.NewDisqueCluster(dqsConfig)
+	assert.Empty(err)
+	assert.NotEmpty(c)
+	defer c.Close()
+	queue := "jobq" + RandomKey()
+	// Add job
+	job, err := job.Add(c, queue, "job1", time.Now().Add(10*time.Second), nil)
+	assert.Empty(err)
+	assert.NotEmpty(job)
+	// Find the node of the job
+	address, err := c.NodeForJob(job.ID)
+	assert.Empty(err)
+	assert.Equal(address, "127.0.0.1:7711")
+	// Malformed job id
+	_, err = c.NodeForJob("notajobid")
+	assert.Equal(err, cluster.ErrDisqueInvalidJobID)
+}
+
+func TestProducerDequeue(t *testing.T) {
+	assert := assert.New(t)
+	// Instantiation
+	producer, err := Producer(dqsConfig)
+	assert.Empty(err)
+	assert.NotEmpty(producer)
+	defer producer.Close()
+	queue := "jobq" + RandomKey()
+	// Add job
+	job, err := producer.AddJob(queue, "job1", time.Now(), nil)
+	assert.Empty(err)
+	// Dequeue job
+	result, err := producer.DequeueJob(job.ID)
+	assert.Empty(err)
+	assert.True(result)
+	// The job is no longer queued, but still exists
+	result, err = producer.DequeueJob(job.ID)
+	assert.Empty(err)
+	assert.False(result)
+	_job, err := producer.GetJob(job.ID)
+	assert.Empty(err)
+	assert.NotEmpty(_job)
+}
+
+func TestProducerEnqueue(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	producer := ProducerWithBackend(mem)
+	defer producer.Close()
+	queue := "jobq" + RandomKey()
+	added, err := producer.AddJob(queue, "job1", time.Now(), nil)
+	assert.Empty(err)
+	// A dequeued job should be queued again by id
+	result, err := producer.DequeueJob(added.ID)
+	assert.Empty(err)
+	assert.True(result)
+	length, err := mem.QueueLength(queue)
+	assert.Empty(err)
+	assert.Equal(0, length)
+	err = producer.EnqueueJob(added.ID)
+	assert.Empty(err)
+	length, err = mem.QueueLength(queue)
+	assert.Empty(err)
+	assert.Equal(1, length)
+	// Enqueuing a queued job should leave it as is
+	err = producer.EnqueueJob(added.ID)
+	assert.Empty(err)
+	length, err = mem.QueueLength(queue)
+	assert.Empty(err)
+	assert.Equal(1, length)
+	// A delayed job should be available right away
+	delayed, err := producer.AddJob(queue, "job2", time.Now().Add(time.Hour), nil)
+	assert.Empty(err)
+	err = producer.EnqueueJob(delayed.ID)
+	assert.Empty(err)
+	options := &cluster.FetchOptions{
+		NoHang: true,
+	}
+	for i := 0; i < 2; i++ {
+		_, _, err = mem.FetchWithOptions(queue, nil, options)
+		assert.Empty(err)
+	}
+	// Jobs that are gone should be reported
+	_, err = producer.DeleteJob(added.ID)
+	assert.Empty(err)
+	err = producer.EnqueueJob(added.ID)
+	assert.Equal(ErrJobNotFound, err)
+}
+
+func TestProducerAsyncFlush(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	producer := ProducerWithBackend(&SlowAddBackend{mem, 20 * time.Millisecond})
+	queue := "jobq" + RandomKey()
+	results := []<-chan AsyncResult{}
+	for i := 0; i < 5; i++ {
+		results = append(results, producer.AddJobAsync(queue, "job", time.Now(), nil))
+	}
+	// Closing should wait for the jobs to be added
+	err := producer.Close()
+	assert.Empty(err)
+	length, err := mem.QueueLength(queue)
+	assert.Empty(err)
+	assert.Equal(5, length)
+	for _, result := range results {
+		added := <-result
+		assert.Empty(added.Err)
+		assert.NotEmpty(added.Job.ID)
+	}
+	// The jobs still in flight after the timeout should be reported
+	timeout := AsyncFlushTimeout
+	AsyncFlushTimeout = 10 * time.Millisecond
+	defer func() {
+		AsyncFlushTimeout = timeout
+	}()
+	producer = ProducerWithBackend(&SlowAddBackend{mem, 200 * time.Millisecond})
+	producer.AddJobAsync(queue, "job1", time.Now(), nil)
+	producer.AddJobAsync(queue, "job2", time.Now(), nil)
+	err = producer.Close()
+	flushErr, ok := err.(*AsyncFlushError)
+	assert.True(ok)
+	if ok {
+		assert.Len(flushErr.Jobs, 2)
+		assert.Equal("Magi Error: 2 async jobs are not confirmed ("+queue+": 2)!", flushErr.Error())
+	}
+}
+
+func TestProducerAddJobTracked(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	producer := ProducerWithBackend(mem)
+	defer producer.Close()
+	queue := "jobq" + RandomKey()
+	// The job should be returned with its id and confirmed once replicated
+	added, confirmed := producer.AddJobTracked(queue, "job1", time.Now(), nil)
+	assert.NotEmpty(added.ID)
+	assert.Empty(<-confirmed)
+	_, open := <-confirmed
+	assert.False(open)
+	length, err := mem.QueueLength(queue)
+	assert.Empty(err)
+	assert.Equal(1, length)
+	// Jobs that can not be added should fail right away
+	added, confirmed = producer.AddJobTracked(queue, "job2", time.Now(), &cluster.DisqueOpConfig{
+		Replicate: 2,
+	})
+	assert.Empty(added)
+	assert.Equal(job.ErrJobNotReplicated, <-confirmed)
+	_, open = <-confirmed
+	assert.False(open)
+	// Jobs that are not replicated in time should be reported
+	timeout := TrackedReplicationTimeout
+	TrackedReplicationTimeout = 50 * time.Millisecond
+	defer func() {
+		TrackedReplicationTimeout = timeout
+	}()
+	hidden := ProducerWithBackend(&HiddenJobsBackend{mem})
+	added, confirmed = hidden.AddJobTracked(queue, "job3", time.Now(), nil)
+	assert.NotEmpty(added.ID)
+	assert.Equal(job.ErrJobNotReplicated, <-confirmed)
+	_, open = <-confirmed
+	assert.False(open)
+	assert.Empty(hidden.Close())
+}
+
+func TestProducerQueues(t *testing.T) {
+	assert := assert.New(t)
+	// Instantiation
+	producer, err := Producer(dqConfig)
+	assert.Empty(err)
+	assert.NotEmpty(producer)
+	defer producer.Close()
+	prefix := "jobq" + RandomKey()
+	// Add jobs to a few queues
+	for _, suffix := range []string{"a", "b"} {
+		_, err := producer.AddJob(prefix+suffix, "job1", time.Now(), nil)
+		assert.Empty(err)
+	}
+	// List the queues
+	queues, err := producer.Queues(prefix + "*")
+	assert.Empty(err)
+	assert.Equal(len(queues), 2)
+	assert.Contains(queues, prefix+"a")
+	assert.Contains(queues, prefix+"b")
+	queues, err = producer.Queues(prefix + "a")
+	assert.Empty(err)
+	assert.Equal(queues, []string{prefix + "a"})
+}
+
+func TestClusterExec(t *testing.T) {
+	assert := assert.New(t)
+	// Disque commands should go through the cluster's pools
+	dq, err := cluster.NewDisqueCluster(dqsConfig)
+	assert.Empty(err)
+	defer dq.Close()
+	queue := "jobq" + RandomKey()
+	_, err = dq.Add(queue, "job1", nil)
+	assert.Empty(err)
+	size, err := redis.Int(dq.Exec("QLEN", queue))
+	assert.Empty(err)
+	assert.Equal(size, 1)
+	// Redis commands should go to the instance
+	c := cluster.NewRedisCluster(rConfig)
+	defer c.Close()
+	key := RandomKey()
+	_, err = c.Exec(1, "SET", key, "1")
+	assert.Empty(err)
+	value, err := redis.String(c.Exec(1, "GET", key))
+	assert.Empty(err)
+	assert.Equal(value, "1")
+	_, err = redis.String(c.Exec(0, "GET", key))
+	assert.Equal(err, redis.ErrNil)
+}
+
+func TestClusterConnHooks(t *testing.T) {
+	assert := assert.New(t)
+	connected := make(chan string, 10)
+	disconnected := make(chan string, 10)
+	failed := make(chan error, 10)
+	config := &cluster.RedisClusterConfig{
+		Hosts: append(redisHostsSingle, map[string]interface{}{
+			"address": "127.0.0.1:7770",
+		}),
+		ConnHooks: cluster.ConnHooks{
+			OnConnect: func(address string) {
+				connected <- address
+			},
+			OnDisconnect: func(address string) {
+				disconnected <- address
+			},
+			OnConnError: func(address string, err error) {
+				assert.Equal(address, "127.0.0.1:7770")
+				failed <- err
+			},
+		},
+	}
+	c := cluster.NewRedisCluster(config)
+	_, err := c.Set(RandomKey(), "1", time.Second)
+	assert.NotEmpty(err)
+	assert.Equal(<-connected, "127.0.0.1:7777")
+	assert.NotEmpty(<-failed)
+	c.Close()
+	assert.Equal(<-disconnected, "127.0.0.1:7777")
+}
+
 func TestLockAcquisition(t *testing.T) {
 	assert := assert.New(t)
 	// Instantiation
@@ -285,28 +873,59 @@ func TestLockAutoRenew(t *testing.T) {
 	assert.True(success)
 }
 
-func TestLockContestDuo(t *testing.T) {
+func TestLockRenewAhead(t *testing.T) {
 	assert := assert.New(t)
 	// Instantiation
-	c := cluster.NewRedisCluster(rConfig)
-	assert.NotEmpty(c)
+	c := cluster.NewMemoryCluster().Locks()
 	defer c.Close()
-	// Create 2 locks on the same key
+	// Create lock
 	key := RandomKey()
-	locks := []*lock.Lock{
-		lock.CreateLock(c, key),
-		lock.CreateLock(c, key),
+	l1 := lock.CreateLock(c, key)
+	l1.Duration = 300 * time.Millisecond
+	l1.RenewAhead = 0.66
+	l2 := lock.CreateLock(c, key)
+	// Hold the lock far past its initial duration
+	success, err := l1.Get(true)
+	assert.Empty(err)
+	assert.True(success)
+	for i := 0; i < 10; i++ {
+		time.Sleep(150 * time.Millisecond)
+		success, err = l2.Get(false)
+		assert.Empty(err)
+		assert.False(success)
 	}
-	// Unlease dogs of war
-	result := make(chan int, 2)
-	acquired := 0
-	for _, l := range locks {
+	assert.True(l1.IsActive())
+	// Release original lock
+	success, err = l1.Release()
+	assert.Empty(err)
+	assert.True(success)
+	success, err = l2.Get(false)
+	assert.Empty(err)
+	assert.True(success)
+}
+
+func TestLockContestDuo(t *testing.T) {
+	assert := assert.New(t)
+	// Instantiation
+	c := cluster.NewRedisCluster(rConfig)
+	assert.NotEmpty(c)
+	defer c.Close()
+	// Create 2 locks on the same key
+	key := RandomKey()
+	locks := []*lock.Lock{
+		lock.CreateLock(c, key),
+		lock.CreateLock(c, key),
+	}
+	// Unlease dogs of war
+	result := make(chan int, 2)
+	acquired := int32(0)
+	for _, l := range locks {
 		func(l *lock.Lock) {
 			go func() {
 				success, err := l.Get(false)
 				assert.Empty(err)
 				if success {
-					acquired++
+					atomic.AddInt32(&acquired, 1)
 				}
 				result <- 1
 			}()
@@ -315,7 +934,7 @@ func TestLockContestDuo(t *testing.T) {
 	// Wait for them to finish
 	<-result
 	<-result
-	assert.Equal(acquired, 1)
+	assert.Equal(atomic.LoadInt32(&acquired), int32(1))
 }
 
 func TestLockContestTrio(t *testing.T) {
@@ -340,14 +959,14 @@ func TestLockContestTrio(t *testing.T) {
 	}
 	// Unlease dogs of war
 	result := make(chan int, 3)
-	acquired := 0
+	acquired := int32(0)
 	for _, l := range locks {
 		func(l *lock.Lock) {
 			go func() {
 				success, err := l.Get(false)
 				assert.Empty(err)
 				if success {
-					acquired++
+					atomic.AddInt32(&acquired, 1)
 				}
 				result <- 1
 			}()
@@ -357,7 +976,351 @@ func TestLockContestTrio(t *testing.T) {
 	for i := 0; i < 3; i++ {
 		<-result
 	}
-	assert.True(acquired <= 1)
+	assert.True(atomic.LoadInt32(&acquired) <= 1)
+}
+
+func TestLockStats(t *testing.T) {
+	assert := assert.New(t)
+	// Instantiation
+	c := cluster.NewRedisCluster(rConfig)
+	assert.NotEmpty(c)
+	defer c.Close()
+	lock.EnableStats(true)
+	defer lock.EnableStats(false)
+	prefix := "stats" + RandomKey()
+	key := prefix + ":" + RandomKey()
+	// Acquire lock
+	l1 := lock.CreateLock(c, key)
+	success, err := l1.Get(false)
+	assert.Empty(err)
+	assert.True(success)
+	// Blocking acquisition should time out
+	l2 := lock.CreateLock(c, key)
+	success, err = l2.GetBlocking(false, time.Second)
+	assert.Empty(err)
+	assert.False(success)
+	// Blocking acquisition should succeed once the lock is released
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		l1.Release()
+	}()
+	success, err = l2.GetBlocking(false, 5*time.Second)
+	assert.Empty(err)
+	assert.True(success)
+	// Check the stats
+	stats := lock.Stats()[prefix]
+	assert.Equal(stats.Acquired, int64(2))
+	assert.True(stats.Failed >= 2)
+	assert.Equal(stats.Waits, int64(2))
+	assert.True(stats.AverageWait() >= 500*time.Millisecond)
+}
+
+// RecordingLocks records the times of the attempts to take a lock
+type RecordingLocks struct {
+	cluster.LockBackend
+	mutex    sync.Mutex
+	attempts []time.Time
+}
+
+func (c *RecordingLocks) SetNX(i int, key string, value string, ttl time.Duration) (bool, error) {
+	c.mutex.Lock()
+	c.attempts = append(c.attempts, time.Now())
+	c.mutex.Unlock()
+	return c.LockBackend.SetNX(i, key, value, ttl)
+}
+
+func TestLockContestBackoff(t *testing.T) {
+	assert := assert.New(t)
+	c := cluster.NewMemoryCluster().Locks()
+	defer c.Close()
+	key := RandomKey()
+	holder := lock.CreateLock(c, key)
+	success, err := holder.Get(false)
+	assert.Empty(err)
+	assert.True(success)
+	defer holder.Release()
+	// Contenders should back off between their attempts, never faster than
+	// the floor of the jittered delay
+	delay := 20 * time.Millisecond
+	floor := delay / 2
+	n := 10
+	contenders := make([]*RecordingLocks, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		contenders[i] = &RecordingLocks{
+			LockBackend: c,
+		}
+		wg.Add(1)
+		go func(recorder *RecordingLocks) {
+			defer wg.Done()
+			contender := lock.CreateLock(recorder, key)
+			contender.Delay = delay
+			contender.MaxDelay = 4 * delay
+			contender.Attempts = 1
+			success, err := contender.GetBlocking(false, 300*time.Millisecond)
+			assert.Empty(err)
+			assert.False(success)
+		}(contenders[i])
+	}
+	wg.Wait()
+	gaps := map[time.Duration]bool{}
+	for _, recorder := range contenders {
+		attempts := recorder.attempts
+		assert.True(len(attempts) > 2)
+		// Delays grow up to the cap
+		assert.True(len(attempts) < int(300*time.Millisecond/floor))
+		// The last attempt is made at the timeout, however close
+		for i := 1; i < len(attempts)-1; i++ {
+			gap := attempts[i].Sub(attempts[i-1])
+			assert.True(gap >= floor, "attempts %v apart", gap)
+			gaps[gap/time.Millisecond] = true
+		}
+	}
+	// Jitter should spread the contenders out
+	assert.True(len(gaps) > 1)
+}
+
+func TestLockElect(t *testing.T) {
+	assert := assert.New(t)
+	c := cluster.NewMemoryCluster().Locks()
+	key := RandomKey()
+	_, err := lock.Elect(c, key, 0)
+	assert.Equal(lock.ErrLockNoDuration, err)
+	within := func(ch <-chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		case <-time.After(time.Second):
+			return false
+		}
+	}
+	// The first contender should lead right away
+	first, err := lock.Elect(c, key, 100*time.Millisecond)
+	assert.Empty(err)
+	assert.True(within(first.Leading()))
+	assert.True(first.IsLeader())
+	second, err := lock.Elect(c, key, 100*time.Millisecond)
+	assert.Empty(err)
+	assert.False(second.IsLeader())
+	// The leadership should outlive the duration of the lock
+	time.Sleep(250 * time.Millisecond)
+	assert.True(first.IsLeader())
+	assert.False(second.IsLeader())
+	// Once the leader resigns, the other contender should take over
+	first.Resign()
+	assert.True(within(first.Resigned()))
+	assert.False(first.IsLeader())
+	assert.True(within(second.Leading()))
+	assert.True(second.IsLeader())
+	// The leader losing its lock should step down
+	_, err = lock.ForceRelease(c, key)
+	assert.Empty(err)
+	intruder := lock.CreateLock(c, key)
+	success, err := intruder.Get(false)
+	assert.Empty(err)
+	assert.True(success)
+	assert.True(within(second.Resigned()))
+	assert.False(second.IsLeader())
+	second.Resign()
+	intruder.Release()
+}
+
+func TestLockExtend(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	mock := clock.NewMock(time.Now())
+	mem.SetClock(mock)
+	c := mem.Locks()
+	key := RandomKey()
+	l := lock.CreateLock(c, key)
+	l.Clock = mock
+	l.Duration = time.Second
+	success, err := l.Get(false)
+	assert.Empty(err)
+	assert.True(success)
+	// The extended lock should outlive its original duration
+	mock.Add(800 * time.Millisecond)
+	success, err = l.Extend(2 * time.Second)
+	assert.Empty(err)
+	assert.True(success)
+	mock.Add(time.Second)
+	contender := lock.CreateLock(c, key)
+	contender.Clock = mock
+	success, err = contender.Get(false)
+	assert.Empty(err)
+	assert.False(success)
+	// Once it expires, another holder should get it, and the lock should no
+	// longer be extended
+	mock.Add(time.Second)
+	success, err = contender.Get(false)
+	assert.Empty(err)
+	assert.True(success)
+	success, err = l.Extend(2 * time.Second)
+	assert.Empty(err)
+	assert.False(success)
+	// Released locks can not be extended
+	_, err = contender.Release()
+	assert.Empty(err)
+	_, err = contender.Extend(time.Second)
+	assert.Equal(lock.ErrLockEmptyLock, err)
+}
+
+func TestLockGetContext(t *testing.T) {
+	assert := assert.New(t)
+	c := cluster.NewMemoryCluster().Locks()
+	defer c.Close()
+	key := RandomKey()
+	holder := lock.CreateLock(c, key)
+	success, err := holder.Get(false)
+	assert.Empty(err)
+	assert.True(success)
+	// A blocked acquisition should stop as soon as its context is cancelled,
+	// without waiting out its backoff
+	contender := lock.CreateLock(c, key)
+	contender.Delay = time.Second
+	contender.Attempts = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	success, err = contender.GetContext(ctx, false)
+	assert.Equal(context.Canceled, err)
+	assert.False(success)
+	assert.True(time.Since(start) < 500*time.Millisecond)
+	// It should give up at the timeout of the lock
+	contender.Delay = 10 * time.Millisecond
+	contender.Timeout = 50 * time.Millisecond
+	success, err = contender.GetContext(context.Background(), false)
+	assert.Empty(err)
+	assert.False(success)
+	// And get the lock once it's released
+	contender.Timeout = 0
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		holder.Release()
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	success, err = contender.GetContext(ctx, false)
+	assert.Empty(err)
+	assert.True(success)
+	contender.Release()
+}
+
+func TestLockBlockingFairness(t *testing.T) {
+	assert := assert.New(t)
+	// Instantiation
+	c := cluster.NewRedisCluster(rConfig)
+	assert.NotEmpty(c)
+	defer c.Close()
+	key := RandomKey()
+	// Acquire lock
+	l := lock.CreateLock(c, key)
+	success, err := l.Get(false)
+	assert.Empty(err)
+	assert.True(success)
+	// Queue up three blocked acquirers in order
+	order := make(chan int, 3)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			waiter := lock.CreateLock(c, key)
+			waiter.Delay = 20 * time.Millisecond
+			success, err := waiter.GetBlocking(false, 10*time.Second)
+			assert.Empty(err)
+			assert.True(success)
+			order <- i
+			time.Sleep(100 * time.Millisecond)
+			waiter.Release()
+		}(i)
+		time.Sleep(100 * time.Millisecond)
+	}
+	// The acquirers should get the lock in the order they waited
+	l.Release()
+	wg.Wait()
+	close(order)
+	acquired := []int{}
+	for i := range order {
+		acquired = append(acquired, i)
+	}
+	assert.Equal(acquired, []int{0, 1, 2})
+}
+
+func TestLockBlockingFairnessBackoff(t *testing.T) {
+	assert := assert.New(t)
+	// Instantiation
+	c := cluster.NewRedisCluster(rConfig)
+	assert.NotEmpty(c)
+	defer c.Close()
+	key := RandomKey()
+	// Acquire lock, and hold it long enough for the backoff of the blocked
+	// acquirers to grow past the ttl of their tickets
+	l := lock.CreateLock(c, key)
+	success, err := l.Get(false)
+	assert.Empty(err)
+	assert.True(success)
+	order := make(chan int, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			waiter := lock.CreateLock(c, key)
+			waiter.Delay = 20 * time.Millisecond
+			success, err := waiter.GetBlocking(false, 15*time.Second)
+			assert.Empty(err)
+			assert.True(success)
+			order <- i
+			time.Sleep(100 * time.Millisecond)
+			waiter.Release()
+		}(i)
+		time.Sleep(100 * time.Millisecond)
+	}
+	time.Sleep(3 * time.Second)
+	// The acquirers should keep their place in line over many attempts
+	l.Release()
+	wg.Wait()
+	close(order)
+	acquired := []int{}
+	for i := range order {
+		acquired = append(acquired, i)
+	}
+	assert.Equal(acquired, []int{0, 1, 2, 3})
+}
+
+func TestLockAcquireAll(t *testing.T) {
+	assert := assert.New(t)
+	// Instantiation
+	c := cluster.NewRedisCluster(rConfig)
+	assert.NotEmpty(c)
+	defer c.Close()
+	keys := []string{RandomKey(), RandomKey(), RandomKey()}
+	// Acquire all locks
+	multi, err := lock.AcquireAll(c, keys, 3*time.Second)
+	assert.Empty(err)
+	assert.NotEmpty(multi)
+	assert.True(multi.IsActive())
+	// Acquiring an overlapping set should fail and roll back
+	other := RandomKey()
+	_multi, err := lock.AcquireAll(c, []string{other, keys[1]}, 3*time.Second)
+	assert.Equal(err, lock.ErrLockMultiFailed)
+	assert.Empty(_multi)
+	l := lock.CreateLock(c, other)
+	success, err := l.Get(false)
+	assert.Empty(err)
+	assert.True(success)
+	// Release all locks
+	success, err = multi.Release()
+	assert.Empty(err)
+	assert.True(success)
+	assert.False(multi.IsActive())
+	_multi, err = lock.AcquireAll(c, keys, 3*time.Second)
+	assert.Empty(err)
+	assert.True(_multi.IsActive())
 }
 
 type DummyProcessor struct {
@@ -376,6 +1339,31 @@ func (p *DummyProcessor) ShouldAutoRenew(job *job.Job) bool {
 	return true
 }
 
+func (p *DummyProcessor) Processed() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	bodies := make([]string, len(p.Bodies))
+	copy(bodies, p.Bodies)
+	return bodies
+}
+
+// WaitProcessed waits for the consumer to report n more jobs processed, for
+// up to a few seconds, and returns whether it did
+func WaitProcessed(m *Magi, n int) bool {
+	timeout := time.After(2 * time.Second)
+	for n > 0 {
+		select {
+		case event := <-m.Events():
+			if event.Type == EventProcessed {
+				n--
+			}
+		case <-timeout:
+			return false
+		}
+	}
+	return true
+}
+
 func TestConsumer(t *testing.T) {
 	assert := assert.New(t)
 	FlushQueue()
@@ -400,7 +1388,7 @@ func TestConsumer(t *testing.T) {
 	assert.True(consumer.IsProcessing())
 	// Wait for it to be processed
 	time.Sleep(1 * time.Second)
-	assert.Equal(p.Bodies[0], job.Body+"dummy")
+	assert.Equal(p.Processed()[0], job.Body+"dummy")
 }
 
 func TestConsumerThroughPutSingleQueue(t *testing.T) {
@@ -439,10 +1427,10 @@ func TestConsumerThroughPutSingleQueue(t *testing.T) {
 	assert.True(consumer.IsProcessing())
 	// Wait for it to be processed
 	time.Sleep(2 * time.Second)
-	assert.Equal(len(p.Bodies), n)
+	assert.Equal(len(p.Processed()), n)
 	for _, body := range bodies {
 		isProcessed := false
-		for _, _body := range p.Bodies {
+		for _, _body := range p.Processed() {
 			if body+"dummy" == _body {
 				isProcessed = true
 			}
@@ -484,10 +1472,10 @@ func TestConsumerThroughPut(t *testing.T) {
 	assert.True(consumer.IsProcessing())
 	// Wait for it to be processed
 	time.Sleep(3 * time.Second)
-	assert.Equal(len(p.Bodies), n)
+	assert.Equal(len(p.Processed()), n)
 	for _, body := range bodies {
 		isProcessed := false
-		for _, _body := range p.Bodies {
+		for _, _body := range p.Processed() {
 			if body+"dummy" == _body {
 				isProcessed = true
 			}
@@ -496,92 +1484,739 @@ func TestConsumerThroughPut(t *testing.T) {
 	}
 }
 
-func TestConsumerDelay(t *testing.T) {
+func TestConsumerOrderingWindow(t *testing.T) {
 	assert := assert.New(t)
-	FlushQueue()
-	// Instantiation
-	consumer, err := Consumer(dqConfig, rConfig)
+	mem := cluster.NewMemoryCluster()
+	logger := &BufferLogger{}
+	consumer, err := New(WithBackends(mem, mem.Locks()), WithLogger(logger), WithConcurrency(1), WithBlockingTimeout(50*time.Millisecond))
 	assert.Empty(err)
-	assert.NotEmpty(consumer)
-	defer consumer.Close()
 	queue := "jobq" + RandomKey()
-	// Add delay job
-	eta := time.Now().Add(5 * time.Second)
-	body := RandomKey()
-	job, err := consumer.AddJob(queue, body, eta, nil)
+	consumer.SetOrderingWindow(queue, 200*time.Millisecond)
+	p := &DummyProcessor{}
+	consumer.Register(queue, p)
+	// Jobs delivered out of order should be processed in the order of their ETA
+	now := time.Now()
+	for i, body := range []string{"c", "b", "a"} {
+		_, err := consumer.AddJob(queue, body, now.Add(-time.Duration(i+1)*time.Millisecond), nil)
+		assert.Empty(err)
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- consumer.Process(queue)
+	}()
+	assert.True(WaitProcessed(consumer, 3))
+	assert.Equal([]string{"adummy", "bdummy", "cdummy"}, p.Processed())
+	// A job too late to be put in order should be processed with a warning
+	_, err = consumer.AddJob(queue, "late", now.Add(-time.Hour), nil)
 	assert.Empty(err)
-	assert.NotEmpty(job)
-	assert.NotEmpty(job.ID)
-	assert.Equal(job.Body, body)
-	// Setup the processor
-	p := &DummyProcessor{
-		Bodies: make([]string, 0, 1),
+	assert.True(WaitProcessed(consumer, 1))
+	assert.Equal([]string{"adummy", "bdummy", "cdummy", "latedummy"}, p.Processed())
+	warned := false
+	for _, message := range logger.Messages() {
+		warned = warned || strings.Contains(message, "out of order")
+	}
+	assert.True(warned)
+	consumer.Close()
+	assert.Empty(<-stopped)
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	assert := assert.New(t)
+	policy := &RetryPolicy{
+		MaxAttempts:  5,
+		InitialDelay: 100 * time.Millisecond,
+		MaxDelay:     time.Second,
+	}
+	// Delays should grow with each attempt until the cap
+	assert.Equal(policy.Delay(1), 100*time.Millisecond)
+	assert.Equal(policy.Delay(2), 200*time.Millisecond)
+	assert.Equal(policy.Delay(3), 400*time.Millisecond)
+	assert.Equal(policy.Delay(4), 800*time.Millisecond)
+	assert.Equal(policy.Delay(5), time.Second)
+	last := time.Duration(0)
+	for i := 1; i <= 5; i++ {
+		assert.True(policy.Delay(i) > last)
+		last = policy.Delay(i)
+	}
+	// The backoff overrides the exponential delay
+	policy.Backoff = backoff.NewConstant(50 * time.Millisecond)
+	assert.Equal(policy.Delay(1), 50*time.Millisecond)
+	assert.Equal(policy.Delay(5), 50*time.Millisecond)
+}
+
+func TestRetryTrackers(t *testing.T) {
+	assert := assert.New(t)
+	c := cluster.NewRedisCluster(rConfig)
+	defer c.Close()
+	trackers := []RetryTracker{
+		NewMemoryRetryTracker(),
+		NewRedisRetryTracker(c, time.Minute),
+	}
+	for _, tracker := range trackers {
+		id := RandomKey()
+		count, err := tracker.Count(id)
+		assert.Empty(err)
+		assert.Equal(count, 0)
+		for i := 1; i <= 3; i++ {
+			count, err = tracker.Increment(id)
+			assert.Empty(err)
+			assert.Equal(count, i)
+		}
+		count, err = tracker.Count(id)
+		assert.Empty(err)
+		assert.Equal(count, 3)
+		err = tracker.Reset(id)
+		assert.Empty(err)
+		count, err = tracker.Count(id)
+		assert.Empty(err)
+		assert.Equal(count, 0)
+	}
+}
+
+type FailingProcessor struct {
+	DummyProcessor
+}
+
+func (p *FailingProcessor) Process(job *job.Job) (interface{}, error) {
+	p.DummyProcessor.Process(job)
+	return nil, errors.New("Processing failed!")
+}
+
+// StatefulDummyProcessor counts its outcomes, failing the jobs with the body
+// "fail" and panicking on the ones with the body "panic"
+type StatefulDummyProcessor struct {
+	DummyProcessor
+	successes int
+	failures  []error
+}
+
+func (p *StatefulDummyProcessor) Process(job *job.Job) (interface{}, error) {
+	switch job.Body {
+	case "fail":
+		return nil, errors.New("Processing failed!")
+	case "panic":
+		panic("boom")
 	}
+	return p.DummyProcessor.Process(job)
+}
+
+func (p *StatefulDummyProcessor) OnSuccess() {
+	p.successes++
+}
+
+func (p *StatefulDummyProcessor) OnFailure(err error) {
+	p.failures = append(p.failures, err)
+}
+
+func TestConsumerStatefulProcessor(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	p := &StatefulDummyProcessor{}
 	consumer.Register(queue, p)
-	// Kick off processing
-	go consumer.Process(queue)
-	time.Sleep(2 * time.Second)
-	assert.True(consumer.IsProcessing())
-	// Check delay behavior
-	time.Sleep(time.Second)
-	assert.Equal(len(p.Bodies), 0)
-	time.Sleep(2 * time.Second)
-	assert.Equal(len(p.Bodies), 1)
-	assert.Equal(p.Bodies[0], body+"dummy")
+	for _, body := range []string{"job1", "fail", "job2"} {
+		_, err := consumer.AddJob(queue, body, time.Now(), nil)
+		assert.Empty(err)
+		processed, err := consumer.ProcessOnce(queue)
+		assert.Empty(err)
+		assert.True(processed)
+	}
+	// Each job should be reported once
+	assert.Equal(2, p.successes)
+	if assert.Len(p.failures, 1) {
+		assert.Equal("Processing failed!", p.failures[0].Error())
+	}
+	// A panic should be reported as a failure before it goes on
+	consumer.mutex.RLock()
+	reg := consumer.processors[queue]
+	consumer.mutex.RUnlock()
+	func() {
+		defer func() {
+			assert.Equal("boom", recover())
+		}()
+		reg.process(context.Background(), job.New(queue, "panic", nil, time.Now(), time.Now()))
+	}()
+	assert.Equal(2, p.successes)
+	if assert.Len(p.failures, 2) {
+		panicked, ok := p.failures[1].(*PanicError)
+		if assert.True(ok) {
+			assert.Equal("boom", panicked.Value)
+			assert.NotEmpty(panicked.Stack)
+		}
+	}
 }
 
-func TestConsumerDelayDelete(t *testing.T) {
+func TestConsumerPanicPolicy(t *testing.T) {
 	assert := assert.New(t)
-	FlushQueue()
-	// Instantiation
-	consumer, err := Consumer(dqConfig, rConfig)
+	mem := cluster.NewMemoryCluster()
+	logger := &BufferLogger{}
+	consumer, err := New(WithBackends(mem, mem.Locks()), WithLogger(logger))
 	assert.Empty(err)
-	assert.NotEmpty(consumer)
 	defer consumer.Close()
 	queue := "jobq" + RandomKey()
-	// Add delay job
-	eta := time.Now().Add(5 * time.Second)
-	body := RandomKey()
-	job, err := consumer.AddJob(queue, body, eta, nil)
+	consumer.Register(queue, &StatefulDummyProcessor{})
+	var reported *PanicError
+	consumer.OnPanic = func(queueName string, id string, err *PanicError) {
+		reported = err
+	}
+	// The panic should be reported with its stack, and go on by default
+	added, err := consumer.AddJob(queue, "panic", time.Now(), nil)
 	assert.Empty(err)
-	assert.NotEmpty(job)
-	assert.NotEmpty(job.ID)
-	assert.Equal(job.Body, body)
-	// Setup the processor
-	p := &DummyProcessor{
-		Bodies: make([]string, 0, 1),
+	func() {
+		defer func() {
+			assert.Equal("boom", recover())
+		}()
+		consumer.ProcessOnce(queue)
+	}()
+	if assert.NotNil(reported) {
+		assert.Equal("boom", reported.Value)
+		assert.Contains(string(reported.Stack), "StatefulDummyProcessor")
 	}
-	consumer.Register(queue, p)
-	// Kick off processing
-	go consumer.Process(queue)
-	time.Sleep(2 * time.Second)
-	assert.True(consumer.IsProcessing())
-	// Check delay behavior
-	time.Sleep(time.Second)
-	assert.Equal(len(p.Bodies), 0)
-	// Delete job
-	result, err := consumer.DeleteJob(job.ID)
+	messages := logger.Messages()
+	if assert.Len(messages, 1) {
+		assert.True(strings.HasPrefix(messages[0], "[job "+added.ID+"] Panic: boom"))
+		assert.Contains(messages[0], "StatefulDummyProcessor")
+	}
+	// Or fail the job if requested
+	consumer.SetPanicPolicy(PanicFail)
+	reported = nil
+	added, err = consumer.AddJob(queue, "panic", time.Now(), nil)
 	assert.Empty(err)
-	assert.True(result)
-	// Job should not be processed
-	time.Sleep(2 * time.Second)
-	assert.Equal(len(p.Bodies), 0)
-	// Get job
-	_job, err := consumer.GetJob(job.ID)
+	processed, err := consumer.ProcessOnce(queue)
 	assert.Empty(err)
-	assert.Empty(_job)
+	assert.True(processed)
+	assert.NotNil(reported)
+	var failed *Event
+	for len(consumer.Events()) > 0 {
+		event := <-consumer.Events()
+		if event.Type == EventFailed && event.JobID == added.ID {
+			failed = &event
+		}
+	}
+	if assert.NotNil(failed) {
+		assert.Equal(reported, failed.Err)
+	}
+}
+
+// ShardProcessor only takes the jobs with its shard in their headers
+type ShardProcessor struct {
+	DummyProcessor
+	shard string
+}
+
+func (p *ShardProcessor) ShouldProcess(job *job.Job) bool {
+	return job.Headers["shard"] == p.shard
 }
 
-func TestConsumerDelayOrder(t *testing.T) {
+func TestConsumerShouldProcess(t *testing.T) {
 	assert := assert.New(t)
-	FlushQueue()
-	// Instantiation
-	consumer, err := Consumer(dqsConfig, rConfig)
-	assert.Empty(err)
-	assert.NotEmpty(consumer)
-	defer consumer.Close()
+	mem := cluster.NewMemoryCluster()
 	queue := "jobq" + RandomKey()
-	// Add jobs
+	workers := map[string]*Magi{}
+	processors := map[string]*ShardProcessor{}
+	for _, shard := range []string{"a", "b"} {
+		consumer := ConsumerWithBackends(mem, mem.Locks())
+		defer consumer.Close()
+		processors[shard] = &ShardProcessor{shard: shard}
+		consumer.Register(queue, processors[shard])
+		workers[shard] = consumer
+	}
+	for _, body := range []string{"b1", "a1", "b2", "a2"} {
+		headers := map[string]string{
+			"shard": body[:1],
+		}
+		_, err := workers["a"].AddJobWithHeaders(queue, body, headers, time.Now(), nil)
+		assert.Empty(err)
+	}
+	// Each worker should only process the jobs of its shard, leaving the
+	// others to the other worker
+	for i := 0; i < 20; i++ {
+		for _, shard := range []string{"a", "b"} {
+			_, err := workers[shard].ProcessOnce(queue)
+			assert.Empty(err)
+		}
+	}
+	assert.Equal([]string{"a1dummy", "a2dummy"}, processors["a"].Processed())
+	assert.Equal([]string{"b1dummy", "b2dummy"}, processors["b"].Processed())
+	length, err := mem.QueueLength(queue)
+	assert.Empty(err)
+	assert.Equal(0, length)
+	rejected := 0
+	for len(workers["a"].Events()) > 0 {
+		event := <-workers["a"].Events()
+		if event.Type == EventRejected {
+			rejected++
+			assert.Empty(event.Err)
+		}
+	}
+	assert.True(rejected > 0)
+}
+
+func TestMockClock(t *testing.T) {
+	assert := assert.New(t)
+	start := time.Now()
+	c := clock.NewMock(start)
+	assert.Equal(c.Now(), start)
+	// Timers only fire when the clock moves
+	after := c.After(time.Second)
+	ticker := c.NewTicker(300 * time.Millisecond)
+	defer ticker.Stop()
+	select {
+	case <-after:
+		assert.Fail("timer fired before the clock moved")
+	default:
+	}
+	c.Add(500 * time.Millisecond)
+	assert.Equal(c.Now(), start.Add(500*time.Millisecond))
+	select {
+	case <-ticker.C():
+	default:
+		assert.Fail("ticker did not fire")
+	}
+	c.Add(500 * time.Millisecond)
+	select {
+	case <-after:
+	default:
+		assert.Fail("timer did not fire")
+	}
+}
+
+func TestLockMockClock(t *testing.T) {
+	assert := assert.New(t)
+	// Instantiation
+	c := cluster.NewRedisCluster(rConfig)
+	assert.NotEmpty(c)
+	defer c.Close()
+	mock := clock.NewMock(time.Now())
+	// Create lock
+	l := lock.CreateLock(c, RandomKey())
+	l.Clock = mock
+	l.Duration = 3 * time.Second
+	success, err := l.Get(true)
+	assert.Empty(err)
+	assert.True(success)
+	// Renewal is driven by the fake clock, not the wall clock
+	mock.Add(2 * time.Second)
+	time.Sleep(100 * time.Millisecond)
+	success, err = l.Release()
+	assert.Empty(err)
+	assert.True(success)
+}
+
+func TestConsumerEvents(t *testing.T) {
+	assert := assert.New(t)
+	FlushQueue()
+	// Instantiation
+	consumer, err := Consumer(dqsConfig, rConfig)
+	assert.Empty(err)
+	assert.NotEmpty(consumer)
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	// Add a job
+	job, err := consumer.AddJob(queue, RandomKey(), time.Now(), nil)
+	assert.Empty(err)
+	// Setup the processor
+	p := &DummyProcessor{}
+	consumer.Register(queue, p)
+	go consumer.Process(queue)
+	// Collect the events of the job
+	expected := []EventType{
+		EventEnqueued,
+		EventFetched,
+		EventLockAcquired,
+		EventProcessed,
+		EventAcked,
+	}
+	types := []EventType{}
+	timeout := time.After(5 * time.Second)
+	for len(types) < len(expected) {
+		select {
+		case event := <-consumer.Events():
+			assert.Equal(event.QueueName, queue)
+			assert.Equal(event.JobID, job.ID)
+			types = append(types, event.Type)
+		case <-timeout:
+			assert.Fail("timed out waiting for events")
+			return
+		}
+	}
+	assert.Equal(types, expected)
+}
+
+type SlowProcessor struct {
+	DummyProcessor
+	Duration time.Duration
+}
+
+func (p *SlowProcessor) Process(job *job.Job) (interface{}, error) {
+	time.Sleep(p.Duration)
+	return p.DummyProcessor.Process(job)
+}
+
+func TestConsumerRunUntilSignal(t *testing.T) {
+	assert := assert.New(t)
+	FlushQueue()
+	// Instantiation
+	consumer, err := Consumer(dqsConfig, rConfig)
+	assert.Empty(err)
+	assert.NotEmpty(consumer)
+	queue := "jobq" + RandomKey()
+	// Add a job
+	body := RandomKey()
+	_, err = consumer.AddJob(queue, body, time.Now(), nil)
+	assert.Empty(err)
+	// Setup the processor
+	p := &SlowProcessor{
+		Duration: 2 * time.Second,
+	}
+	consumer.Register(queue, p)
+	consumer.SetShutdownGracePeriod(5 * time.Second)
+	// Kick off processing until signaled
+	result := make(chan error, 1)
+	go func() {
+		result <- consumer.RunUntilSignal([]string{queue}, syscall.SIGUSR1)
+	}()
+	time.Sleep(time.Second)
+	assert.True(consumer.IsProcessing())
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	// The in-flight job should finish before shutdown returns
+	err = <-result
+	assert.Empty(err)
+	assert.False(consumer.IsProcessing())
+	assert.Equal(p.Processed(), []string{body + "dummy"})
+}
+
+func TestConsumerPool(t *testing.T) {
+	assert := assert.New(t)
+	FlushQueue()
+	// Instantiation
+	consumer, err := Consumer(dqsConfig, rConfig)
+	assert.Empty(err)
+	assert.NotEmpty(consumer)
+	defer consumer.Close()
+	consumer.SetConcurrency(4)
+	saturated := int32(0)
+	idle := int32(0)
+	consumer.OnPoolSaturated = func() {
+		atomic.AddInt32(&saturated, 1)
+	}
+	consumer.OnPoolIdle = func() {
+		atomic.AddInt32(&idle, 1)
+	}
+	queue := "jobq" + RandomKey()
+	// Add jobs
+	n := 8
+	for i := 0; i < n; i++ {
+		_, err := consumer.AddJob(queue, RandomKey(), time.Now(), nil)
+		assert.Empty(err)
+	}
+	// Setup the processor
+	p := &SlowProcessor{
+		Duration: 2 * time.Second,
+	}
+	consumer.Register(queue, p)
+	go consumer.Process(queue)
+	// All workers should be busy with the first batch
+	time.Sleep(time.Second)
+	assert.Equal(consumer.PoolUtilization(), 1.0)
+	assert.True(atomic.LoadInt32(&saturated) > 0)
+	assert.Equal(len(p.Processed()), 0)
+	// Both batches should be done
+	time.Sleep(4 * time.Second)
+	assert.Equal(len(p.Processed()), n)
+	assert.Equal(consumer.PoolUtilization(), 0.0)
+	assert.True(atomic.LoadInt32(&idle) > 0)
+}
+
+type ManualProcessor struct {
+	DummyProcessor
+	IDs chan string
+}
+
+func (p *ManualProcessor) Process(job *job.Job) (interface{}, error) {
+	p.IDs <- job.ID
+	return p.DummyProcessor.Process(job)
+}
+
+func (p *ManualProcessor) ManualAck(job *job.Job) bool {
+	return true
+}
+
+func TestConsumerMemoryProfile(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer, err := New(WithBackends(mem, mem.Locks()), WithEventBufferSize(4))
+	assert.Empty(err)
+	defer consumer.Close()
+	consumer.SetProcessedHistorySize(2)
+	// Held jobs should be unlimited by default
+	assert.Equal(-1, consumer.MemoryProfile().HeldJobsCapacity)
+	consumer.SetMaxHeldJobs(1)
+	queue := "jobq" + RandomKey()
+	p := &ManualProcessor{
+		IDs: make(chan string, 3),
+	}
+	consumer.Register(queue, p)
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		added, err := consumer.AddJob(queue, "job"+strconv.Itoa(i), time.Now(), nil)
+		assert.Empty(err)
+		ids = append(ids, added.ID)
+	}
+	for range ids {
+		processed, err := consumer.ProcessOnce(queue)
+		assert.Empty(err)
+		assert.True(processed)
+	}
+	other := "jobq" + RandomKey()
+	consumer.Register(other, &DummyProcessor{})
+	for i := 0; i < 2; i++ {
+		_, err := consumer.AddJob(other, "other"+strconv.Itoa(i), time.Now(), nil)
+		assert.Empty(err)
+		processed, err := consumer.ProcessOnce(other)
+		assert.Empty(err)
+		assert.True(processed)
+	}
+	// Every buffer should stay within its capacity
+	profile := consumer.MemoryProfile()
+	assert.Equal(4, profile.Events)
+	assert.Equal(4, profile.EventsCapacity)
+	assert.True(profile.DroppedEvents > 0)
+	assert.Equal(2, profile.ProcessedHistory)
+	assert.Equal(2, profile.ProcessedHistoryCapacity)
+	assert.Equal(1, profile.HeldJobs)
+	assert.Equal(1, profile.HeldJobsCapacity)
+	assert.Equal(0, profile.InFlight)
+	// The jobs beyond the held capacity should be given back to the queue
+	// without being processed
+	length, err := mem.QueueLength(queue)
+	assert.Empty(err)
+	assert.Equal(2, length)
+	assert.Equal([]string{"job0dummy"}, p.Processed())
+	err = consumer.AckJob(ids[0])
+	assert.Empty(err)
+	assert.Equal(0, consumer.MemoryProfile().HeldJobs)
+	consumer.SetMaxHeldJobs(-1)
+	assert.Equal(-1, consumer.MemoryProfile().HeldJobsCapacity)
+	// The failed attempts kept in memory should be reported
+	tracker := NewMemoryRetryTracker()
+	tracker.Increment(ids[1])
+	consumer.SetRetryTracker(tracker)
+	assert.Equal(1, consumer.MemoryProfile().RetryTracked)
+}
+
+func TestMemoryRetryTrackerTTL(t *testing.T) {
+	assert := assert.New(t)
+	mock := clock.NewMock(time.Now())
+	tracker := NewMemoryRetryTracker()
+	tracker.TTL = time.Hour
+	tracker.Clock = mock
+	count, err := tracker.Increment("job1")
+	assert.Empty(err)
+	assert.Equal(1, count)
+	// The attempts should be kept for the ttl since the last failure
+	mock.Add(50 * time.Minute)
+	count, err = tracker.Increment("job1")
+	assert.Empty(err)
+	assert.Equal(2, count)
+	tracker.Increment("job2")
+	mock.Add(50 * time.Minute)
+	count, err = tracker.Count("job1")
+	assert.Empty(err)
+	assert.Equal(2, count)
+	assert.Equal(2, tracker.Len())
+	// And then forgotten, e.g. for the jobs that vanished
+	mock.Add(10 * time.Minute)
+	count, err = tracker.Count("job1")
+	assert.Empty(err)
+	assert.Equal(0, count)
+	assert.Equal(0, tracker.Len())
+	count, err = tracker.Increment("job1")
+	assert.Empty(err)
+	assert.Equal(1, count)
+}
+
+func TestConsumerNackJobWithDelay(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	p := &ManualProcessor{
+		IDs: make(chan string, 1),
+	}
+	consumer.Register(queue, p)
+	headers := map[string]string{
+		"trace": "abc",
+	}
+	added, err := consumer.AddJobWithHeaders(queue, "job1", headers, time.Now(), nil)
+	assert.Empty(err)
+	processed, err := consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	// The held job should be redelivered only after the delay
+	delay := 100 * time.Millisecond
+	err = consumer.NackJobWithDelay(<-p.IDs, delay)
+	assert.Empty(err)
+	assert.Equal(0, consumer.MemoryProfile().HeldJobs)
+	_job, err := consumer.GetJob(added.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+	options := &cluster.FetchOptions{
+		NoHang: true,
+	}
+	_, _, err = mem.FetchWithOptions(queue, nil, options)
+	assert.NotEmpty(err)
+	time.Sleep(delay)
+	details, _, err := mem.FetchWithOptions(queue, nil, options)
+	assert.Empty(err)
+	if assert.NotEmpty(details) {
+		_job, err = job.FromDetails(details)
+		assert.Empty(err)
+		assert.Equal("job1", _job.Body)
+		assert.Equal("abc", _job.Headers["trace"])
+		assert.Equal(added.ID, _job.Headers[job.HeaderOriginID])
+	}
+	assert.Equal(ErrJobNotFound, consumer.NackJobWithDelay(added.ID, delay))
+}
+
+func TestConsumerManualAck(t *testing.T) {
+	assert := assert.New(t)
+	FlushQueue()
+	// Instantiation
+	consumer, err := Consumer(dqsConfig, rConfig)
+	assert.Empty(err)
+	assert.NotEmpty(consumer)
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	// Add a job with a short retry
+	conf := &cluster.DisqueOpConfig{
+		RetryAfter: time.Second,
+	}
+	job, err := consumer.AddJob(queue, RandomKey(), time.Now(), conf)
+	assert.Empty(err)
+	// Setup the processor
+	p := &ManualProcessor{
+		IDs: make(chan string, 10),
+	}
+	consumer.Register(queue, p)
+	go consumer.Process(queue)
+	id := <-p.IDs
+	assert.Equal(id, job.ID)
+	// The job is held past its retry without being redelivered
+	time.Sleep(3 * time.Second)
+	assert.Equal(len(p.Processed()), 1)
+	_job, err := consumer.GetJob(job.ID)
+	assert.Empty(err)
+	assert.NotEmpty(_job)
+	// Ack the job manually
+	err = consumer.AckJob(job.ID)
+	assert.Empty(err)
+	time.Sleep(time.Second)
+	_job, err = consumer.GetJob(job.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+}
+
+func TestConsumerLockUnavailable(t *testing.T) {
+	assert := assert.New(t)
+	FlushQueue()
+	// Instantiation with an unreachable redis
+	deadConfig := &cluster.RedisClusterConfig{
+		Hosts: []map[string]interface{}{
+			map[string]interface{}{
+				"address": "127.0.0.1:7770",
+			},
+		},
+	}
+	consumer, err := Consumer(dqsConfig, deadConfig)
+	assert.Empty(err)
+	assert.NotEmpty(consumer)
+	defer consumer.Close()
+	degraded := make(chan bool, 10)
+	consumer.OnLockUnavailable = func(queueName string, id string, err error, d bool) {
+		assert.NotEmpty(err)
+		degraded <- d
+	}
+	consumer.SetLockUnavailablePolicy(LockUnavailableSkipLock)
+	queue := "jobq" + RandomKey()
+	// Add a job
+	body := RandomKey()
+	_, err = consumer.AddJob(queue, body, time.Now(), nil)
+	assert.Empty(err)
+	// Setup the processor
+	p := &DummyProcessor{}
+	consumer.Register(queue, p)
+	go consumer.Process(queue)
+	// The job should be processed without the lock
+	assert.True(<-degraded)
+	time.Sleep(time.Second)
+	assert.Equal(p.Processed(), []string{body + "dummy"})
+}
+
+func TestConsumerLockHooks(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	calls := make(chan string, 10)
+	hook := func(name string) func(string, string) {
+		return func(queueName string, id string) {
+			assert.Equal(queue, queueName)
+			calls <- name + " " + id
+		}
+	}
+	consumer.OnLockAcquired = hook("acquired")
+	consumer.OnLockContended = hook("contended")
+	consumer.OnLockReleased = hook("released")
+	receive := func() string {
+		select {
+		case call := <-calls:
+			return call
+		case <-time.After(time.Second):
+			return ""
+		}
+	}
+	consumer.Register(queue, &DummyProcessor{})
+	// The lock on a processed job should be acquired and released, in order
+	for i := 0; i < 3; i++ {
+		added, err := consumer.AddJob(queue, "job1", time.Now(), nil)
+		assert.Empty(err)
+		processed, err := consumer.ProcessOnce(queue)
+		assert.Empty(err)
+		assert.True(processed)
+		assert.Equal("acquired "+added.ID, receive())
+		assert.Equal("released "+added.ID, receive())
+	}
+	assert.Empty(calls)
+	// The lock on a job held by another consumer should be contended
+	added, err := consumer.AddJob(queue, "job2", time.Now(), nil)
+	assert.Empty(err)
+	holder := lock.CreateLock(mem.Locks(), added.ID)
+	result, err := holder.Get(false)
+	assert.Empty(err)
+	assert.True(result)
+	defer holder.Release()
+	_, err = consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.Equal("contended "+added.ID, receive())
+	assert.Empty(calls)
+}
+
+func TestConsumerOrderedProcessing(t *testing.T) {
+	assert := assert.New(t)
+	FlushQueue()
+	// Instantiation with the full cluster
+	consumer, err := Consumer(dqConfig, rConfig)
+	assert.Empty(err)
+	assert.NotEmpty(consumer)
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	consumer.SetOrderedProcessing(queue, true)
+	// Add jobs
 	n := 20
 	bodies := make([]string, 0, n)
 	for i := 0; i < n; i++ {
@@ -590,8 +2225,6 @@ func TestConsumerDelayOrder(t *testing.T) {
 		job, err := consumer.AddJob(queue, body, eta, nil)
 		assert.Empty(err)
 		assert.NotEmpty(job)
-		assert.NotEmpty(job.ID)
-		assert.Equal(job.Body, body)
 		bodies = append(bodies, body)
 	}
 	// Setup the processor
@@ -599,14 +2232,2586 @@ func TestConsumerDelayOrder(t *testing.T) {
 		Bodies: make([]string, 0, n),
 	}
 	consumer.Register(queue, p)
-	// Kick off processing
 	go consumer.Process(queue)
-	time.Sleep(2 * time.Second)
-	assert.True(consumer.IsProcessing())
-	// Wait for it to be processed
-	time.Sleep(5 * time.Second)
-	assert.Equal(len(p.Bodies), n)
+	// Jobs should be processed in order
+	time.Sleep(7 * time.Second)
+	assert.Equal(len(p.Processed()), n)
 	for i, body := range bodies {
-		assert.Equal(p.Bodies[i], body+"dummy")
+		assert.Equal(p.Processed()[i], body+"dummy")
+	}
+}
+
+func TestConsumerDrainTo(t *testing.T) {
+	assert := assert.New(t)
+	FlushQueue()
+	// Instantiation
+	consumer, err := Consumer(dqsConfig, rConfig)
+	assert.Empty(err)
+	assert.NotEmpty(consumer)
+	defer consumer.Close()
+	src := "jobq" + RandomKey()
+	dst := "jobq" + RandomKey()
+	// Add jobs
+	n := 5
+	bodies := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		body := RandomKey()
+		_, err := consumer.AddJob(src, body, time.Now(), nil)
+		assert.Empty(err)
+		bodies = append(bodies, body)
+	}
+	// Drain with a limit
+	moved, err := consumer.DrainTo(src, dst, 2)
+	assert.Empty(err)
+	assert.Equal(moved, 2)
+	// Drain the rest
+	moved, err = consumer.DrainTo(src, dst, 0)
+	assert.Empty(err)
+	assert.Equal(moved, n-2)
+	// All jobs should be processed from the destination
+	p := &DummyProcessor{}
+	consumer.Register(dst, p)
+	go consumer.Process(dst)
+	time.Sleep(2 * time.Second)
+	assert.Equal(len(p.Processed()), n)
+	for _, body := range bodies {
+		assert.Contains(p.Processed(), body+"dummy")
+	}
+}
+
+func TestConsumerReplayDeadLetter(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	policy := RetryPolicy{
+		MaxAttempts: 3,
+	}
+	dlq := policy.deadLetterQueue(queue)
+	n := 3
+	for i := 0; i < n; i++ {
+		headers := map[string]string{
+			job.HeaderAttempts: "3",
+			job.HeaderOriginID: RandomKey(),
+			"trace":            strconv.Itoa(i),
+		}
+		_, err := consumer.AddJobWithHeaders(dlq, "job"+strconv.Itoa(i), headers, time.Now(), nil)
+		assert.Empty(err)
+	}
+	// Replaying should resume where a previous replay stopped
+	replayed, err := consumer.ReplayDeadLetter(dlq, queue, 1)
+	assert.Empty(err)
+	assert.Equal(1, replayed)
+	replayed, err = consumer.ReplayDeadLetter(dlq, queue, 0)
+	assert.Empty(err)
+	assert.Equal(n-1, replayed)
+	length, err := mem.QueueLength(dlq)
+	assert.Empty(err)
+	assert.Equal(0, length)
+	// The replayed jobs should keep their bodies and headers, without the
+	// retry attempts
+	for i := 0; i < n; i++ {
+		details, _, err := mem.FetchWithOptions(queue, nil, &cluster.FetchOptions{NoHang: true})
+		assert.Empty(err)
+		_job, err := job.FromDetails(details)
+		assert.Empty(err)
+		assert.Equal("job"+_job.Headers["trace"], _job.Body)
+		assert.Equal(0, _job.Attempts())
+		assert.Len(_job.Headers, 1)
+	}
+}
+
+func TestConsumerDrainAckMany(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	backend := &CountingBackend{
+		MemoryCluster: mem,
+	}
+	consumer := ConsumerWithBackends(backend, mem.Locks())
+	defer consumer.Close()
+	src := "jobq" + RandomKey()
+	dst := "jobq" + RandomKey()
+	n := 100
+	for i := 0; i < n; i++ {
+		_, err := consumer.AddJob(src, RandomKey(), time.Now(), nil)
+		assert.Empty(err)
+	}
+	// The moved jobs should be acked in batches
+	moved, err := consumer.DrainTo(src, dst, n)
+	assert.Empty(err)
+	assert.Equal(moved, n)
+	assert.Equal(atomic.LoadInt32(&backend.acks), int32((n+DrainAckBatchSize-1)/DrainAckBatchSize))
+}
+
+// FailingDrainBackend is a memory cluster whose fetches fail after the
+// first jobs, and whose acks fail
+type FailingDrainBackend struct {
+	*cluster.MemoryCluster
+	fetches int32 // number of fetches left before failing
+}
+
+func (c *FailingDrainBackend) Fetch(queueName string, config *cluster.DisqueOpConfig) (*disque.Job, error) {
+	if atomic.AddInt32(&c.fetches, -1) < 0 {
+		return nil, cluster.ErrClusterDown
+	}
+	return c.MemoryCluster.Fetch(queueName, config)
+}
+
+func (c *FailingDrainBackend) AckMany(ids []string) error {
+	return &net.OpError{Op: "write", Err: syscall.ECONNRESET}
+}
+
+func TestConsumerDrainAckError(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	backend := &FailingDrainBackend{
+		MemoryCluster: mem,
+		fetches:       2,
+	}
+	consumer := ConsumerWithBackends(backend, mem.Locks())
+	defer consumer.Close()
+	src := "jobq" + RandomKey()
+	dst := "jobq" + RandomKey()
+	for i := 0; i < 3; i++ {
+		_, err := consumer.AddJob(src, RandomKey(), time.Now(), nil)
+		assert.Empty(err)
+	}
+	// The failed ack of the moved jobs should be reported over the fetch error
+	moved, err := consumer.DrainTo(src, dst, 0)
+	assert.Equal(2, moved)
+	assert.IsType(&net.OpError{}, err)
+	// So should it once the drain is over
+	backend.fetches = 1
+	moved, err = consumer.DrainTo(src, dst, 1)
+	assert.Equal(1, moved)
+	assert.IsType(&net.OpError{}, err)
+}
+
+func TestDisqueOrderedFailover(t *testing.T) {
+	assert := assert.New(t)
+	failovers := make(chan string, 10)
+	config := &cluster.DisqueClusterConfig{
+		Hosts: []map[string]interface{}{
+			map[string]interface{}{
+				"address": "127.0.0.1:7710",
+			},
+			disqueHostsSingle[0],
+		},
+		OnFailover: func(queueName string, address string, err error) {
+			assert.NotEmpty(err)
+			failovers <- queueName + " " + address
+		},
+	}
+	dq, err := cluster.NewDisqueCluster(config)
+	assert.Empty(err)
+	defer dq.Close()
+	// Pick a queue designated to the unreachable node
+	queue := "jobq" + RandomKey()
+	for crc32.ChecksumIEEE([]byte(queue))%2 != 0 {
+		queue = "jobq" + RandomKey()
+	}
+	dq.SetOrdered(queue, true)
+	// The job should be added to the following node, reporting the failover
+	added, err := dq.Add(queue, RandomKey(), nil)
+	assert.Empty(err)
+	assert.NotEmpty(added)
+	assert.Equal(<-failovers, queue+" 127.0.0.1:7710")
+}
+
+func TestDisqueAckMany(t *testing.T) {
+	assert := assert.New(t)
+	dq, err := cluster.NewDisqueCluster(dqsConfig)
+	assert.Empty(err)
+	defer dq.Close()
+	queue := "jobq" + RandomKey()
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		added, err := dq.Add(queue, RandomKey(), nil)
+		assert.Empty(err)
+		ids = append(ids, added.ID)
+	}
+	// All jobs should be acked at once
+	assert.Empty(dq.AckMany(ids))
+	for _, id := range ids {
+		details, _ := dq.Get(id)
+		assert.Empty(details)
+	}
+	// Failed batches should be reported
+	size := cluster.DisqueAckBatchSize
+	cluster.DisqueAckBatchSize = 1
+	defer func() {
+		cluster.DisqueAckBatchSize = size
+	}()
+	added, err := dq.Add(queue, RandomKey(), nil)
+	assert.Empty(err)
+	err = dq.AckMany([]string{added.ID, "invalid"})
+	ackErr, ok := err.(*cluster.AckError)
+	assert.True(ok)
+	assert.Equal(ackErr.IDs, []string{"invalid"})
+}
+
+func TestDisqueGetMany(t *testing.T) {
+	assert := assert.New(t)
+	dq, err := cluster.NewDisqueCluster(dqsConfig)
+	assert.Empty(err)
+	defer dq.Close()
+	queue := "jobq" + RandomKey()
+	ids := []string{}
+	bodies := []string{}
+	for i := 0; i < 3; i++ {
+		body := RandomKey()
+		added, err := dq.Add(queue, body, nil)
+		assert.Empty(err)
+		acked, err := dq.Add(queue, RandomKey(), nil)
+		assert.Empty(err)
+		assert.Empty(dq.Ack(acked.ID))
+		ids = append(ids, added.ID, acked.ID)
+		bodies = append(bodies, body)
+	}
+	// The jobs should be in the order of the ids, nil for the unknown ones
+	jobs, err := dq.GetMany(ids)
+	assert.Empty(err)
+	assert.Len(jobs, len(ids))
+	for i, body := range bodies {
+		if assert.NotNil(jobs[2*i]) {
+			assert.Equal(ids[2*i], jobs[2*i].ID)
+			assert.Equal(queue, jobs[2*i].Queue)
+			assert.Equal(body, jobs[2*i].Data)
+		}
+		assert.Nil(jobs[2*i+1])
+	}
+}
+
+// PartialGetBackend is a memory cluster whose lookups miss the jobs on an
+// unreachable node
+type PartialGetBackend struct {
+	*cluster.MemoryCluster
+	unreachable map[string]bool
+}
+
+func (c *PartialGetBackend) GetMany(ids []string) ([]*disque.Job, error) {
+	jobs, _ := c.MemoryCluster.GetMany(ids)
+	missing := []string{}
+	for k, id := range ids {
+		if c.unreachable[id] {
+			jobs[k] = nil
+			missing = append(missing, id)
+		}
+	}
+	return jobs, &cluster.GetError{
+		IDs: missing,
+		Err: io.EOF,
+	}
+}
+
+func TestProducerGetJobs(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	producer := ProducerWithBackend(mem)
+	defer producer.Close()
+	queue := "jobq" + RandomKey()
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		added, err := producer.AddJob(queue, "job"+strconv.Itoa(i), time.Now(), nil)
+		assert.Empty(err)
+		ids = append(ids, added.ID)
+	}
+	// The jobs should be in the order of the ids, nil for the unknown ones
+	jobs, err := producer.GetJobs([]string{ids[2], "unknown", ids[0], ids[1]})
+	assert.Empty(err)
+	assert.Len(jobs, 4)
+	assert.Equal("job2", jobs[0].Body)
+	assert.Nil(jobs[1])
+	assert.Equal("job0", jobs[2].Body)
+	assert.Equal("job1", jobs[3].Body)
+	assert.Equal(queue, jobs[3].QueueName)
+	// The jobs found should be returned along with the ones not looked up
+	partial := ProducerWithBackend(&PartialGetBackend{mem, map[string]bool{ids[1]: true}})
+	defer partial.Close()
+	jobs, err = partial.GetJobs(ids)
+	getErr, ok := err.(*cluster.GetError)
+	if assert.True(ok) {
+		assert.Equal([]string{ids[1]}, getErr.IDs)
+	}
+	assert.Len(jobs, 3)
+	assert.Equal("job0", jobs[0].Body)
+	assert.Nil(jobs[1])
+	assert.Equal("job2", jobs[2].Body)
+}
+
+func TestConsumerQueueConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	FlushQueue()
+	// Instantiation
+	consumer, err := Consumer(dqsConfig, rConfig)
+	assert.Empty(err)
+	assert.NotEmpty(consumer)
+	defer consumer.Close()
+	consumer.SetConcurrency(4)
+	queue := "jobq" + RandomKey()
+	// Add jobs
+	n := 3
+	for i := 0; i < n; i++ {
+		_, err := consumer.AddJob(queue, RandomKey(), time.Now(), nil)
+		assert.Empty(err)
+	}
+	// Setup the processor to process one job at a time
+	p := &SlowProcessor{
+		Duration: time.Second,
+	}
+	consumer.RegisterWithConcurrency(queue, p, 1)
+	go consumer.Process(queue)
+	// Jobs should be processed one by one
+	time.Sleep(1500 * time.Millisecond)
+	assert.Equal(len(p.Processed()), 1)
+	assert.Equal(consumer.PoolUtilization(), 0.25)
+	time.Sleep(2 * time.Second)
+	assert.Equal(len(p.Processed()), n)
+}
+
+func TestConsumerSchedule(t *testing.T) {
+	assert := assert.New(t)
+	FlushQueue()
+	// Instantiation
+	consumer, err := Consumer(dqsConfig, rConfig)
+	assert.Empty(err)
+	assert.NotEmpty(consumer)
+	mock := clock.NewMock(time.Date(2020, 1, 1, 0, 0, 30, 0, time.UTC))
+	consumer.SetClock(mock)
+	queue := "jobq" + RandomKey()
+	body := RandomKey()
+	// Schedule a job every minute
+	id, err := consumer.Schedule(queue, body, "* * * * *", nil)
+	assert.Empty(err)
+	assert.NotEmpty(id)
+	defer consumer.Unschedule(id)
+	again, err := consumer.Schedule(queue, body, "* * * * *", nil)
+	assert.Empty(err)
+	assert.Equal(again, id)
+	_, err = consumer.Schedule(queue, body, "* * *", nil)
+	assert.NotEmpty(err)
+	// Setup the processor and the scheduler
+	p := &DummyProcessor{}
+	consumer.Register(queue, p)
+	go consumer.Process(queue)
+	go consumer.RunScheduler()
+	time.Sleep(100 * time.Millisecond)
+	// The job should be enqueued on the tick
+	mock.Add(30 * time.Second)
+	time.Sleep(time.Second)
+	assert.Equal(len(p.Processed()), 1)
+	// Missed ticks should be skipped by default
+	mock.Add(3*time.Minute + 30*time.Second)
+	time.Sleep(time.Second)
+	assert.Equal(len(p.Processed()), 1)
+	// Missed ticks should all be enqueued when catching up
+	consumer.SetCatchUpPolicy(CatchUpAll)
+	mock.Add(3 * time.Minute)
+	time.Sleep(time.Second)
+	assert.Equal(len(p.Processed()), 4)
+	assert.Empty(consumer.Shutdown(5 * time.Second))
+}
+
+func TestConsumerLockstepRenewal(t *testing.T) {
+	assert := assert.New(t)
+	FlushQueue()
+	queue := "jobq" + RandomKey()
+	// Add a job redelivered after a second
+	producer, err := Producer(dqsConfig)
+	assert.Empty(err)
+	defer producer.Close()
+	conf := &cluster.DisqueOpConfig{
+		RetryAfter: time.Second,
+	}
+	body := RandomKey()
+	_, err = producer.AddJob(queue, body, time.Now(), conf)
+	assert.Empty(err)
+	// Process it longer than both the retry and the lock duration, with
+	// competing consumers
+	processors := []*SlowProcessor{}
+	for i := 0; i < 2; i++ {
+		consumer, err := Consumer(dqsConfig, rConfig)
+		assert.Empty(err)
+		defer consumer.Close()
+		p := &SlowProcessor{
+			Duration: lock.DefaultDuration + 2*time.Second,
+		}
+		processors = append(processors, p)
+		consumer.Register(queue, p)
+		go consumer.Process(queue)
+	}
+	time.Sleep(lock.DefaultDuration + 5*time.Second)
+	// The job should only be processed once
+	processed := []string{}
+	for _, p := range processors {
+		processed = append(processed, p.Processed()...)
+	}
+	assert.Equal(processed, []string{body + "dummy"})
+}
+
+func TestDisqueFetchWithCounters(t *testing.T) {
+	assert := assert.New(t)
+	FlushQueue()
+	c, err := cluster.NewDisqueCluster(dqsConfig)
+	assert.Empty(err)
+	defer c.Close()
+	queue := "jobq" + RandomKey()
+	added, err := c.Add(queue, "job1", nil)
+	assert.Empty(err)
+	options := &cluster.FetchOptions{
+		WithCounters: true,
+	}
+	// The counters should increase with every nack
+	for i := 0; i < 3; i++ {
+		fetched, counters, err := c.FetchWithOptions(queue, nil, options)
+		assert.Empty(err)
+		assert.Equal(fetched.ID, added.ID)
+		assert.Equal(fetched.Data, "job1")
+		assert.Equal(counters.Nacks, i)
+		assert.Equal(counters.AdditionalDeliveries, 0)
+		assert.Empty(c.Nack(fetched.ID))
+	}
+	// No counters without the option
+	_, counters, err := c.FetchWithOptions(queue, nil, nil)
+	assert.Empty(err)
+	assert.Empty(counters)
+}
+
+func TestConsumerProcessOnce(t *testing.T) {
+	assert := assert.New(t)
+	FlushQueue()
+	// Instantiation
+	consumer, err := Consumer(dqsConfig, rConfig)
+	assert.Empty(err)
+	assert.NotEmpty(consumer)
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	p := &DummyProcessor{}
+	consumer.Register(queue, p)
+	// An empty queue should return immediately
+	start := time.Now()
+	processed, err := consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.False(processed)
+	assert.True(time.Since(start) < cluster.DisqueFetchTimeout)
+	// A job should be processed before returning
+	body := RandomKey()
+	_, err = consumer.AddJob(queue, body, time.Now(), nil)
+	assert.Empty(err)
+	processed, err = consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	assert.Equal(p.Processed(), []string{body + "dummy"})
+}
+
+func TestConsumerDidProcess(t *testing.T) {
+	assert := assert.New(t)
+	FlushQueue()
+	queue := "jobq" + RandomKey()
+	consumers := []*Magi{}
+	for i := 0; i < 2; i++ {
+		consumer, err := Consumer(dqsConfig, rConfig)
+		assert.Empty(err)
+		defer consumer.Close()
+		consumer.Register(queue, &DummyProcessor{})
+		consumers = append(consumers, consumer)
+	}
+	consumers[0].SetProcessedHistorySize(1)
+	// Only the consumer processing the job should own it
+	job1, err := consumers[0].AddJob(queue, RandomKey(), time.Now(), nil)
+	assert.Empty(err)
+	processed, err := consumers[0].ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	assert.True(consumers[0].DidProcess(job1.ID))
+	assert.False(consumers[1].DidProcess(job1.ID))
+	// The oldest jobs should be forgotten beyond the history size
+	job2, err := consumers[0].AddJob(queue, RandomKey(), time.Now(), nil)
+	assert.Empty(err)
+	processed, err = consumers[0].ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	assert.True(consumers[0].DidProcess(job2.ID))
+	assert.False(consumers[0].DidProcess(job1.ID))
+}
+
+func TestConsumerCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+	FlushQueue()
+	// Instantiation
+	consumer, err := Consumer(dqsConfig, rConfig)
+	assert.Empty(err)
+	assert.NotEmpty(consumer)
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	states := make(chan BreakerState, 10)
+	consumer.OnBreakerStateChange = func(queueName string, state BreakerState) {
+		assert.Equal(queueName, queue)
+		states <- state
+	}
+	consumer.SetCircuitBreaker(queue, 2, 2*time.Second)
+	// Add jobs failing to process
+	for i := 0; i < 4; i++ {
+		_, err = consumer.AddJob(queue, RandomKey(), time.Now(), nil)
+		assert.Empty(err)
+	}
+	p := &FailingProcessor{}
+	consumer.Register(queue, p)
+	go consumer.Process(queue)
+	// The breaker should open after two failures
+	assert.Equal(<-states, BreakerOpen)
+	time.Sleep(time.Second)
+	assert.Equal(len(p.Processed()), 2)
+	assert.Equal(consumer.Stats().Breakers[queue], BreakerOpen)
+	// A single probe job should be let through after the cooldown
+	assert.Equal(<-states, BreakerHalfOpen)
+	assert.Equal(<-states, BreakerOpen)
+	assert.Equal(len(p.Processed()), 3)
+}
+
+func TestMemoryCluster(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	mock := clock.NewMock(time.Now())
+	mem.SetClock(mock)
+	producer := ProducerWithBackend(mem)
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	p := &DummyProcessor{}
+	consumer.Register(queue, p)
+	// Add and process a job
+	body := RandomKey()
+	_job, err := producer.AddJob(queue, body, time.Now(), nil)
+	assert.Empty(err)
+	processed, err := consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	assert.Equal(p.Processed(), []string{body + "dummy"})
+	// The job should be acked
+	_job, err = consumer.GetJob(_job.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+	// Delayed jobs should wait for their ETA
+	_, err = producer.AddJob(queue, body, time.Now().Add(10*time.Second), nil)
+	assert.Empty(err)
+	processed, err = consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.False(processed)
+	mock.Add(11 * time.Second)
+	processed, err = consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	// Jobs not acked should be redelivered after their retry
+	conf := &cluster.DisqueOpConfig{
+		RetryAfter: time.Second,
+	}
+	added, err := mem.Add(queue, body, conf)
+	assert.Empty(err)
+	options := &cluster.FetchOptions{
+		WithCounters: true,
+		NoHang:       true,
+	}
+	fetched, _, err := mem.FetchWithOptions(queue, nil, options)
+	assert.Empty(err)
+	assert.Equal(fetched.ID, added.ID)
+	_, _, err = mem.FetchWithOptions(queue, nil, options)
+	assert.NotEmpty(err)
+	mock.Add(2 * time.Second)
+	fetched, counters, err := mem.FetchWithOptions(queue, nil, options)
+	assert.Empty(err)
+	assert.Equal(fetched.ID, added.ID)
+	assert.Equal(counters.AdditionalDeliveries, 1)
+	assert.Empty(mem.Ack(fetched.ID))
+	// Locks should be exclusive until released or expired
+	key := RandomKey()
+	l1 := lock.CreateLock(mem.Locks(), key)
+	l1.Clock = mock
+	l1.Duration = time.Second
+	success, err := l1.Get(false)
+	assert.Empty(err)
+	assert.True(success)
+	l2 := lock.CreateLock(mem.Locks(), key)
+	l2.Clock = mock
+	success, err = l2.Get(false)
+	assert.False(success)
+	mock.Add(2 * time.Second)
+	success, err = l2.Get(false)
+	assert.Empty(err)
+	assert.True(success)
+	success, err = l2.Release()
+	assert.Empty(err)
+	assert.True(success)
+}
+
+func TestBackendInterfaces(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	defer mem.Close()
+	// Jobs can be added directly to any job backend
+	queue := "jobq" + RandomKey()
+	body := RandomKey()
+	added, err := job.Add(mem, queue, body, time.Now(), nil)
+	assert.Empty(err)
+	assert.NotEmpty(added.ID)
+	_job, err := mem.Get(added.ID)
+	assert.Empty(err)
+	assert.Equal(_job.Queue, queue)
+	// Multi locks can be taken on any lock backend
+	keys := []string{RandomKey(), RandomKey()}
+	multi, err := lock.AcquireAll(mem.Locks(), keys, 3*time.Second)
+	assert.Empty(err)
+	assert.True(multi.IsActive())
+	_multi, err := lock.AcquireAll(mem.Locks(), keys[1:], 3*time.Second)
+	assert.Equal(err, lock.ErrLockMultiFailed)
+	assert.Empty(_multi)
+	success, err := multi.Release()
+	assert.Empty(err)
+	assert.True(success)
+}
+
+type CountingBackend struct {
+	*cluster.MemoryCluster
+	fetches int32
+	acks    int32 // number of ack round trips
+}
+
+func (c *CountingBackend) Ack(id string) error {
+	atomic.AddInt32(&c.acks, 1)
+	return c.MemoryCluster.Ack(id)
+}
+
+func (c *CountingBackend) AckMany(ids []string) error {
+	atomic.AddInt32(&c.acks, 1)
+	return c.MemoryCluster.AckMany(ids)
+}
+
+func (c *CountingBackend) FetchWithOptions(queueName string, config *cluster.DisqueOpConfig, options *cluster.FetchOptions) (*disque.Job, *cluster.Counters, error) {
+	atomic.AddInt32(&c.fetches, 1)
+	return c.MemoryCluster.FetchWithOptions(queueName, config, options)
+}
+
+func TestConsumerIdleBackoff(t *testing.T) {
+	assert := assert.New(t)
+	timeout := cluster.DisqueFetchTimeout
+	cluster.DisqueFetchTimeout = time.Millisecond
+	defer func() {
+		cluster.DisqueFetchTimeout = timeout
+	}()
+	mem := cluster.NewMemoryCluster()
+	backend := &CountingBackend{
+		MemoryCluster: mem,
+	}
+	consumer := ConsumerWithBackends(backend, mem.Locks())
+	defer consumer.Close()
+	consumer.SetIdleBackoff(10*time.Millisecond, 100*time.Millisecond)
+	queue := "jobq" + RandomKey()
+	p := &DummyProcessor{}
+	consumer.Register(queue, p)
+	go consumer.Process(queue)
+	// Fetches of the empty queue should back off
+	time.Sleep(300 * time.Millisecond)
+	assert.True(atomic.LoadInt32(&backend.fetches) < 20)
+	// Jobs should still be picked up within the cap
+	body := RandomKey()
+	_, err := job.Add(mem, queue, body, time.Now(), nil)
+	assert.Empty(err)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(p.Processed(), []string{body + "dummy"})
+}
+
+func TestRedisKeySlot(t *testing.T) {
+	assert := assert.New(t)
+	// Slots should match the ones of redis cluster
+	assert.Equal(cluster.KeySlot("123456789"), 12739)
+	assert.Equal(cluster.KeySlot("foo"), 12182)
+	// Keys sharing a hash tag should be on the same slot
+	assert.Equal(cluster.KeySlot("{user1000}.following"), cluster.KeySlot("{user1000}.followers"))
+	assert.Equal(cluster.KeySlot("{user1000}.following"), cluster.KeySlot("user1000"))
+	// Empty hash tags should hash the whole key
+	assert.NotEqual(cluster.KeySlot("foo{}{bar}"), cluster.KeySlot("bar"))
+}
+
+type ContextKey string
+
+type SharedDeps struct {
+	Prefix string
+}
+
+type ContextDummyProcessor struct {
+	DummyProcessor
+	seen []*SharedDeps
+}
+
+func (p *ContextDummyProcessor) ProcessContext(ctx context.Context, job *job.Job) (interface{}, error) {
+	deps := ctx.Value(ContextKey("deps")).(*SharedDeps)
+	p.mutex.Lock()
+	p.seen = append(p.seen, deps)
+	p.Bodies = append(p.Bodies, deps.Prefix+job.Body)
+	p.mutex.Unlock()
+	return true, nil
+}
+
+func TestConsumerRegisterWithContext(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	deps := &SharedDeps{
+		Prefix: "ctx:",
+	}
+	ctx := context.WithValue(context.Background(), ContextKey("deps"), deps)
+	p := &ContextDummyProcessor{}
+	consumer.RegisterWithContext(queue, ctx, p)
+	n := 10
+	for i := 0; i < n; i++ {
+		_, err := consumer.AddJob(queue, "job", time.Now(), nil)
+		assert.Empty(err)
+	}
+	go consumer.Process(queue)
+	time.Sleep(500 * time.Millisecond)
+	// Every job should have been processed with the shared dependencies
+	assert.Len(p.Processed(), n)
+	for _, body := range p.Processed() {
+		assert.Equal(body, "ctx:job")
+	}
+	p.mutex.Lock()
+	for _, seen := range p.seen {
+		assert.True(seen == deps)
+	}
+	p.mutex.Unlock()
+}
+
+type UnavailableBackend struct {
+	CountingBackend
+	down int32 // number of fetches failing with the cluster down
+}
+
+func (c *UnavailableBackend) FetchWithOptions(queueName string, config *cluster.DisqueOpConfig, options *cluster.FetchOptions) (*disque.Job, *cluster.Counters, error) {
+	if atomic.AddInt32(&c.down, -1) >= 0 {
+		atomic.AddInt32(&c.fetches, 1)
+		return nil, nil, cluster.ErrClusterDown
+	}
+	return c.CountingBackend.FetchWithOptions(queueName, config, options)
+}
+
+func TestConsumerClusterDown(t *testing.T) {
+	assert := assert.New(t)
+	b := UnavailableBackoff
+	UnavailableBackoff = backoff.NewConstant(100 * time.Millisecond)
+	defer func() {
+		UnavailableBackoff = b
+	}()
+	mem := cluster.NewMemoryCluster()
+	backend := &UnavailableBackend{
+		CountingBackend: CountingBackend{
+			MemoryCluster: mem,
+		},
+		down: 3,
+	}
+	consumer := ConsumerWithBackends(backend, mem.Locks())
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	p := &DummyProcessor{}
+	consumer.Register(queue, p)
+	body := RandomKey()
+	_, err := consumer.AddJob(queue, body, time.Now(), nil)
+	assert.Empty(err)
+	go consumer.Process(queue)
+	// Fetches should back off while the cluster is down
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(atomic.LoadInt32(&backend.fetches), int32(2))
+	assert.Empty(p.Processed())
+	// The job should be processed once the cluster is back
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(p.Processed(), []string{body + "dummy"})
+}
+
+func TestConsumerCloseTwice(t *testing.T) {
+	assert := assert.New(t)
+	timeout := cluster.DisqueFetchTimeout
+	cluster.DisqueFetchTimeout = 20 * time.Millisecond
+	defer func() {
+		cluster.DisqueFetchTimeout = timeout
+	}()
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	queue := "jobq" + RandomKey()
+	consumer.Register(queue, &DummyProcessor{})
+	go consumer.Process(queue)
+	go consumer.Process(queue)
+	time.Sleep(50 * time.Millisecond)
+	assert.True(consumer.IsProcessing())
+	// Closing should stop every processing loop
+	assert.Empty(consumer.Close())
+	time.Sleep(100 * time.Millisecond)
+	assert.False(consumer.IsProcessing())
+	// Closing again should neither block nor fail
+	done := make(chan error)
+	go func() {
+		done <- consumer.Close()
+	}()
+	select {
+	case err := <-done:
+		assert.Empty(err)
+	case <-time.After(time.Second):
+		assert.Fail("Close blocked")
+	}
+	assert.Empty(consumer.Shutdown(time.Second))
+}
+
+func TestConsumerPrefetch(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	backend := &CountingBackend{
+		MemoryCluster: mem,
+	}
+	consumer := ConsumerWithBackends(backend, mem.Locks())
+	defer consumer.Close()
+	consumer.SetPrefetch(2)
+	queue := "jobq" + RandomKey()
+	p := &SlowProcessor{
+		Duration: 50 * time.Millisecond,
+	}
+	consumer.Register(queue, p)
+	n := 8
+	for i := 0; i < n; i++ {
+		_, err := consumer.AddJob(queue, RandomKey(), time.Now(), nil)
+		assert.Empty(err)
+	}
+	go consumer.Process(queue)
+	// Jobs waiting for the single worker should never exceed the prefetch
+	max := 0
+	for i := 0; i < 100; i++ {
+		prefetched := consumer.Stats().Prefetched
+		if prefetched > max {
+			max = prefetched
+		}
+		// Fetched jobs are either processed, processing or prefetched
+		fetched := int(atomic.LoadInt32(&backend.fetches))
+		assert.True(fetched <= len(p.Processed())+1+2+1)
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(max, 2)
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(p.Processed(), n)
+}
+
+func TestJobParseID(t *testing.T) {
+	assert := assert.New(t)
+	raw := "D-dcb833cf-8YL1NT17e9+wsA/09NqxscQI-05a1"
+	id, err := job.ParseID(raw)
+	assert.Empty(err)
+	assert.Equal(id.Node, "dcb833cf")
+	assert.Equal(id.Random, "8YL1NT17e9+wsA/09NqxscQI")
+	assert.Equal(id.TTL, 1441*time.Minute)
+	assert.Equal(id.String(), raw)
+	// Malformed ids should be refused
+	for _, invalid := range []string{
+		"",
+		"D-dcb833cf-8YL1NT17e9+wsA/09NqxscQI",
+		"X-dcb833cf-8YL1NT17e9+wsA/09NqxscQI-05a1",
+		"D-dcb833zz-8YL1NT17e9+wsA/09NqxscQI-05a1",
+		"D-dcb833cf-short-05a1",
+		"D-dcb833cf-8YL1NT17e9+wsA/09NqxscQI-05g1",
+	} {
+		id, err = job.ParseID(invalid)
+		assert.Equal(err, job.ErrJobInvalidID)
+		assert.Empty(id)
+	}
+}
+
+func TestJobParseAddedID(t *testing.T) {
+	assert := assert.New(t)
+	// Instantiation
+	producer, err := Producer(dqsConfig)
+	assert.Empty(err)
+	defer producer.Close()
+	conf := &cluster.DisqueOpConfig{
+		TTL: time.Hour,
+	}
+	_job, err := producer.AddJob("jobq"+RandomKey(), "job1", time.Now(), conf)
+	assert.Empty(err)
+	id, err := job.ParseID(_job.ID)
+	assert.Empty(err)
+	assert.Equal(id.TTL, time.Hour)
+}
+
+type LeaseProcessor struct {
+	DummyProcessor
+	Lease time.Duration
+	Locks cluster.LockBackend
+	Held  chan bool
+}
+
+func (p *LeaseProcessor) Process(job *job.Job) (interface{}, error) {
+	time.Sleep(200 * time.Millisecond)
+	l := lock.CreateLock(p.Locks, job.ID)
+	success, _ := l.Get(false)
+	if success {
+		l.Release()
+	}
+	p.Held <- !success
+	return true, nil
+}
+
+func (p *LeaseProcessor) ShouldAutoRenew(job *job.Job) bool {
+	return false
+}
+
+func (p *LeaseProcessor) LockDuration(job *job.Job) time.Duration {
+	return p.Lease
+}
+
+func TestConsumerLockDuration(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	p := &LeaseProcessor{
+		Locks: mem.Locks(),
+		Held:  make(chan bool, 1),
+	}
+	consumer.Register(queue, p)
+	// The default lease should outlast the job
+	_, err := consumer.AddJob(queue, "job1", time.Now(), nil)
+	assert.Empty(err)
+	processed, err := consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	assert.True(<-p.Held)
+	// A shorter lease requested by the processor should expire during the job
+	p.Lease = 100 * time.Millisecond
+	_, err = consumer.AddJob(queue, "job2", time.Now(), nil)
+	assert.Empty(err)
+	processed, err = consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	assert.False(<-p.Held)
+}
+
+type AckCheckProcessor struct {
+	FailingProcessor
+	Jobs  cluster.JobBackend
+	Acked []bool
+}
+
+func (p *AckCheckProcessor) Process(job *job.Job) (interface{}, error) {
+	_, err := p.Jobs.Get(job.ID)
+	p.mutex.Lock()
+	p.Acked = append(p.Acked, err != nil)
+	p.mutex.Unlock()
+	return p.FailingProcessor.Process(job)
+}
+
+func TestConsumerAtMostOnce(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	p := &AckCheckProcessor{
+		Jobs: mem,
+	}
+	consumer.Register(queue, p)
+	consumer.SetRetryPolicy(queue, RetryPolicy{
+		MaxAttempts: 3,
+	})
+	// Jobs should be acked before they're processed
+	consumer.SetDeliverySemantics(queue, AtMostOnce)
+	conf := &cluster.DisqueOpConfig{
+		RetryAfter: time.Second,
+	}
+	_, err := consumer.AddJob(queue, "job1", time.Now(), conf)
+	assert.Empty(err)
+	processed, err := consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	assert.Equal(p.Acked, []bool{true})
+	// Failed jobs should neither be retried nor redelivered
+	time.Sleep(1100 * time.Millisecond)
+	processed, err = consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.False(processed)
+	// At least once should remain the default
+	consumer.SetDeliverySemantics(queue, AtLeastOnce)
+	_, err = consumer.AddJob(queue, "job2", time.Now(), conf)
+	assert.Empty(err)
+	processed, err = consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	assert.Equal(p.Acked, []bool{true, false})
+}
+
+func TestLockScanAndForceRelease(t *testing.T) {
+	assert := assert.New(t)
+	c := cluster.NewMemoryCluster().Locks()
+	defer c.Close()
+	prefix := RandomKey()
+	l1 := lock.CreateLock(c, prefix+":a")
+	l1.Duration = time.Minute
+	l2 := lock.CreateLock(c, prefix+":b")
+	other := lock.CreateLock(c, RandomKey())
+	for _, l := range []*lock.Lock{l1, l2, other} {
+		success, err := l.Get(false)
+		assert.Empty(err)
+		assert.True(success)
+	}
+	// Locks should be listed with their remaining ttl
+	locks, err := lock.ScanLocks(c, prefix+":*")
+	assert.Empty(err)
+	assert.Len(locks, 2)
+	assert.Equal(locks[0].Key, prefix+":a")
+	assert.Equal(locks[1].Key, prefix+":b")
+	assert.NotEmpty(locks[0].Value)
+	assert.True(locks[0].TTL > 50*time.Second && locks[0].TTL <= time.Minute)
+	assert.True(locks[0].IsHeld(c))
+	// Force released locks should be available again
+	released, err := lock.ForceRelease(c, prefix+":a")
+	assert.Empty(err)
+	assert.Equal(locks[0].Value, released.Value)
+	locks, err = lock.ScanLocks(c, prefix+":*")
+	assert.Empty(err)
+	assert.Len(locks, 1)
+	l3 := lock.CreateLock(c, prefix+":a")
+	success, err := l3.Get(false)
+	assert.Empty(err)
+	assert.True(success)
+}
+
+func TestLockPrefixKeys(t *testing.T) {
+	assert := assert.New(t)
+	c := cluster.NewMemoryCluster().Locks()
+	defer c.Close()
+	key := RandomKey()
+	// Locks should be stored under their key by default
+	l := lock.CreateLock(c, key)
+	success, err := l.Get(false)
+	assert.Empty(err)
+	assert.True(success)
+	keys, err := c.Scan(0, "*"+key)
+	assert.Empty(err)
+	assert.Equal([]string{key}, keys)
+	l.Release()
+	// And under the prefixed key once it's switched on
+	lock.PrefixKeys = true
+	defer func() {
+		lock.PrefixKeys = false
+	}()
+	l = lock.CreateLock(c, key)
+	success, err = l.Get(false)
+	assert.Empty(err)
+	assert.True(success)
+	keys, err = c.Scan(0, "*"+key)
+	assert.Empty(err)
+	assert.Equal([]string{cluster.GetKey(key)}, keys)
+	locks, err := lock.ScanLocks(c, key)
+	assert.Empty(err)
+	if assert.Len(locks, 1) {
+		assert.Equal(key, locks[0].Key)
+	}
+	l.Release()
+}
+
+type ChainProcessor struct {
+	DummyProcessor
+	Next string
+}
+
+func (p *ChainProcessor) Process(_job *job.Job) (interface{}, error) {
+	p.DummyProcessor.Process(_job)
+	return &job.Continuation{
+		Queue: p.Next,
+		Body:  _job.Body + "-step2",
+	}, nil
+}
+
+type ParentProcessor struct {
+	DummyProcessor
+	Parents []string
+}
+
+func (p *ParentProcessor) Process(_job *job.Job) (interface{}, error) {
+	p.mutex.Lock()
+	p.Parents = append(p.Parents, _job.Headers[job.HeaderParentID])
+	p.mutex.Unlock()
+	return p.DummyProcessor.Process(_job)
+}
+
+func TestConsumerContinuation(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	first := "jobq" + RandomKey()
+	second := "jobq" + RandomKey()
+	p1 := &ChainProcessor{
+		Next: second,
+	}
+	p2 := &ParentProcessor{}
+	consumer.Register(first, p1)
+	consumer.Register(second, p2)
+	// The follow-up job should be added once the first step is processed
+	added, err := consumer.AddJob(first, "job1", time.Now(), nil)
+	assert.Empty(err)
+	processed, err := consumer.ProcessOnce(first)
+	assert.Empty(err)
+	assert.True(processed)
+	_job, err := consumer.GetJob(added.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+	processed, err = consumer.ProcessOnce(second)
+	assert.Empty(err)
+	assert.True(processed)
+	assert.Equal(p2.Processed(), []string{"job1-step2dummy"})
+	assert.Equal(p2.Parents, []string{added.ID})
+	// The first step should not be acked if the follow-up can not be added
+	added, err = consumer.AddJob(first, "job2", time.Now(), nil)
+	assert.Empty(err)
+	consumer.SetMaxBodySize(1)
+	processed, err = consumer.ProcessOnce(first)
+	assert.Empty(err)
+	assert.True(processed)
+	_job, err = consumer.GetJob(added.ID)
+	assert.Empty(err)
+	assert.NotEmpty(_job)
+}
+
+func TestProducerAddJobAndWait(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	consumer.SetResultStorage(time.Minute)
+	queue := "jobq" + RandomKey()
+	failing := "jobq" + RandomKey()
+	consumer.Register(queue, &DummyProcessor{})
+	consumer.Register(failing, &FailingProcessor{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			consumer.ProcessOnce(queue)
+			consumer.ProcessOnce(failing)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	// The result of the processor should be returned
+	result, err := consumer.AddJobAndWait(queue, "job1", 5*time.Second)
+	assert.Empty(err)
+	assert.Equal(true, result)
+	// The error of the processor should be returned
+	result, err = consumer.AddJobAndWait(failing, "job2", 5*time.Second)
+	assert.Equal("Processing failed!", err.Error())
+	assert.Empty(result)
+	// Jobs not processed in time should time out
+	result, err = consumer.AddJobAndWait("jobq"+RandomKey(), "job3", 100*time.Millisecond)
+	assert.Equal(ErrResultTimeout, err)
+	assert.Empty(result)
+	// Waiting requires a redis cluster
+	producer := ConsumerWithBackends(mem, nil)
+	_, err = producer.AddJobAndWait(queue, "job4", time.Second)
+	assert.Equal(ErrNoResultStorage, err)
+}
+
+func TestConsumerNoProcessor(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	consumer.Register(queue, &DummyProcessor{})
+	// Queues without a processor should be rejected before fetching
+	_, err := consumer.AddJob("jobq"+RandomKey(), "job1", time.Now(), nil)
+	assert.Empty(err)
+	assert.Equal(ErrNoProcessor, consumer.Process(queue+"typo"))
+	processed, err := consumer.ProcessOnce(queue + "typo")
+	assert.Equal(ErrNoProcessor, err)
+	assert.False(processed)
+	assert.Equal(ErrNoProcessor, consumer.RunUntilSignal([]string{queue, queue + "typo"}))
+}
+
+func TestConsumerProcessGroup(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	consumer.SetBlockingTimeout(10 * time.Millisecond)
+	queues := []string{"jobq" + RandomKey(), "jobq" + RandomKey()}
+	p := &DummyProcessor{}
+	for _, queue := range queues {
+		consumer.Register(queue, p)
+		_, err := consumer.AddJob(queue, queue, time.Now(), nil)
+		assert.Empty(err)
+	}
+	assert.Equal(ErrNoProcessor, consumer.ProcessGroup(context.Background(), queues[0], "typo"))
+	// The loops should run until the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- consumer.ProcessGroup(ctx, queues...)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for len(p.Processed()) < len(queues) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Len(p.Processed(), len(queues))
+	assert.True(consumer.IsProcessing())
+	cancel()
+	select {
+	case err := <-done:
+		assert.Empty(err)
+	case <-time.After(time.Second):
+		assert.Fail("processing should stop once the context is cancelled")
+	}
+	assert.False(consumer.IsProcessing())
+}
+
+func TestConsumerAckReplication(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	timeout := AckReplicationTimeout
+	AckReplicationTimeout = 100 * time.Millisecond
+	defer func() {
+		AckReplicationTimeout = timeout
+	}()
+	queue := "jobq" + RandomKey()
+	p := &DummyProcessor{}
+	consumer.Register(queue, p)
+	// Jobs replicated to enough nodes should be acked
+	consumer.SetAckReplication(queue, 1)
+	added, err := consumer.AddJob(queue, "job1", time.Now(), nil)
+	assert.Empty(err)
+	processed, err := consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	_job, err := consumer.GetJob(added.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+	// Jobs living on fewer nodes should be nacked once the check times out
+	consumer.SetAckReplication(queue, 2)
+	added, err = consumer.AddJob(queue, "job2", time.Now(), nil)
+	assert.Empty(err)
+	start := time.Now()
+	processed, err = consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	assert.True(time.Since(start) >= AckReplicationTimeout)
+	length, err := mem.QueueLength(queue)
+	assert.Empty(err)
+	assert.Equal(1, length)
+	var nacked *Event
+	for len(consumer.Events()) > 0 {
+		event := <-consumer.Events()
+		if event.Type == EventNacked {
+			nacked = &event
+		}
+		if event.Type == EventAcked {
+			assert.NotEqual(added.ID, event.JobID)
+		}
+	}
+	if assert.NotNil(nacked) {
+		assert.Equal(added.ID, nacked.JobID)
+		assert.Equal(job.ErrJobNotReplicated, nacked.Err)
+	}
+	assert.Equal([]string{"job1dummy", "job2dummy"}, p.Processed())
+	// The follow-up of a job not replicated should not be added, since the
+	// job is redelivered
+	chained := "jobq" + RandomKey()
+	next := "jobq" + RandomKey()
+	consumer.Register(chained, &ChainProcessor{Next: next})
+	consumer.SetAckReplication(chained, 2)
+	_, err = consumer.AddJob(chained, "job3", time.Now(), nil)
+	assert.Empty(err)
+	processed, err = consumer.ProcessOnce(chained)
+	assert.Empty(err)
+	assert.True(processed)
+	length, err = mem.QueueLength(next)
+	assert.Empty(err)
+	assert.Equal(0, length)
+}
+
+func TestConsumerProcessWeighted(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	consumer.SetConcurrency(1)
+	premium := "jobq" + RandomKey()
+	basic := "jobq" + RandomKey()
+	p := &DummyProcessor{}
+	consumer.Register(premium, p)
+	consumer.Register(basic, p)
+	assert.Equal(ErrNoProcessor, consumer.ProcessWeighted(map[string]int{premium: 3, "typo": 1}))
+	n := 40
+	for i := 0; i < n; i++ {
+		for _, queue := range []string{premium, basic} {
+			_, err := consumer.AddJob(queue, queue, time.Now(), nil)
+			assert.Empty(err)
+		}
+	}
+	go consumer.ProcessWeighted(map[string]int{
+		premium: 3,
+		basic:   1,
+	})
+	assert.True(WaitProcessed(consumer, n))
+	// While both queues have jobs, the processed ratio should follow the weights
+	counts := map[string]int{}
+	processed := p.Processed()
+	if assert.True(len(processed) >= n) {
+		for _, body := range processed[:n] {
+			counts[strings.TrimSuffix(body, "dummy")]++
+		}
+	}
+	assert.InDelta(3*n/4, counts[premium], 2)
+	assert.InDelta(n/4, counts[basic], 2)
+	// The low weight queue should keep being processed once the other is empty
+	assert.True(WaitProcessed(consumer, n))
+	assert.Len(p.Processed(), 2*n)
+}
+
+func TestConsumerProcessPattern(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	interval := PatternScanInterval
+	PatternScanInterval = 50 * time.Millisecond
+	defer func() {
+		PatternScanInterval = interval
+	}()
+	prefix := "user" + RandomKey()
+	p := &DummyProcessor{}
+	for _, queue := range []string{prefix + ":1:tasks", prefix + ":1:other"} {
+		_, err := consumer.AddJob(queue, queue, time.Now(), nil)
+		assert.Empty(err)
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- consumer.ProcessPattern(prefix+":*:tasks", p)
+	}()
+	assert.True(WaitProcessed(consumer, 1))
+	assert.Equal([]string{prefix + ":1:tasksdummy"}, p.Processed())
+	// Queues created later should be picked up by the next scan
+	for _, id := range []string{"2", "3"} {
+		_, err := consumer.AddJob(prefix+":"+id+":tasks", id, time.Now(), nil)
+		assert.Empty(err)
+	}
+	assert.True(WaitProcessed(consumer, 2))
+	assert.Len(p.Processed(), 3)
+	assert.Contains(p.Processed(), "2dummy")
+	assert.Contains(p.Processed(), "3dummy")
+	// As well as queues coming back after they are dropped for being empty
+	_, err := consumer.AddJob(prefix+":1:tasks", "again", time.Now(), nil)
+	assert.Empty(err)
+	assert.True(WaitProcessed(consumer, 1))
+	assert.Len(p.Processed(), 4)
+	// Queues not matching the pattern should be left alone
+	length, err := mem.QueueLength(prefix + ":1:other")
+	assert.Empty(err)
+	assert.Equal(1, length)
+	assert.False(consumer.hasProcessor(prefix + ":1:other"))
+	// Queues staying empty should be unregistered by the next scan
+	deadline := time.Now().Add(2 * time.Second)
+	for (consumer.hasProcessor(prefix+":1:tasks") || consumer.hasProcessor(prefix+":2:tasks")) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		assert.False(consumer.hasProcessor(prefix + ":" + id + ":tasks"))
+		assert.NotContains(consumer.Stats().Fetches, prefix+":"+id+":tasks")
+	}
+	consumer.Close()
+	assert.Empty(<-stopped)
+}
+
+func TestConsumerProcessSharded(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	base := "jobq" + RandomKey()
+	_, err := consumer.AddJobSharded(base, 0, "", "job", time.Now(), nil)
+	assert.Equal(ErrInvalidShards, err)
+	// A key should always land on the same shard
+	shards := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		added, err := consumer.AddJobSharded(base, 4, "user1", "job"+strconv.Itoa(i), time.Now(), nil)
+		assert.Empty(err)
+		assert.Equal(ShardQueue(base, 4, "user1"), added.QueueName)
+		shards[added.QueueName] = true
+	}
+	assert.Len(shards, 1)
+	// While the bodies without a key should spread over the shards
+	for i := 0; i < 20; i++ {
+		added, err := consumer.AddJobSharded(base, 4, "", "body"+strconv.Itoa(i), time.Now(), nil)
+		assert.Empty(err)
+		assert.Equal(ShardQueue(base, 4, "body"+strconv.Itoa(i)), added.QueueName)
+		shards[added.QueueName] = true
+	}
+	assert.Len(shards, 4)
+	// All the shards should be processed
+	p := &DummyProcessor{}
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- consumer.ProcessSharded(base, 4, p)
+	}()
+	assert.True(WaitProcessed(consumer, 25))
+	assert.Len(p.Processed(), 25)
+	consumer.Close()
+	assert.Empty(<-stopped)
+}
+
+func TestDisqueNodeSelection(t *testing.T) {
+	assert := assert.New(t)
+	queue := "jobq" + RandomKey()
+	modes := []cluster.DisqueClusterLBMode{
+		cluster.DisqueClusterLBModeRoundRobin,
+		cluster.DisqueClusterLBModeRandom,
+		cluster.DisqueClusterLBModeLatencyWeighted,
+	}
+	for _, mode := range modes {
+		dq, err := cluster.NewDisqueCluster(&cluster.DisqueClusterConfig{
+			Hosts:  disqueHosts,
+			LBMode: mode,
+		})
+		assert.Empty(err)
+		for i := 0; i < 30; i++ {
+			_, err := dq.Add(queue, RandomKey(), nil)
+			assert.Empty(err)
+		}
+		// The response times of the nodes used should be tracked
+		measured := 0
+		for _, latency := range dq.Latencies() {
+			if latency > 0 {
+				measured++
+			}
+		}
+		assert.True(measured > 0)
+		// Chained operations should stay on the pinned node
+		dq.ChainTo(2)
+		for i := 0; i < 3; i++ {
+			added, err := dq.Add(queue, RandomKey(), nil)
+			assert.Empty(err)
+			address, err := dq.NodeForJob(added.ID)
+			assert.Empty(err)
+			assert.Equal(disqueHosts[2]["address"], address)
+		}
+		dq.Unchain()
+		dq.Close()
+	}
+}
+
+func TestDisqueDrainNode(t *testing.T) {
+	assert := assert.New(t)
+	queue := "jobq" + RandomKey()
+	dq, err := cluster.NewDisqueCluster(dqConfig)
+	assert.Empty(err)
+	defer dq.Close()
+	assert.Equal(cluster.ErrDisqueUnknownNode, dq.DrainNode("127.0.0.1:1"))
+	// The consumers should drain the nodes of their disque cluster
+	consumer, err := New(WithBackends(dq, nil), WithNamespace("app:"))
+	assert.Empty(err)
+	assert.Equal(cluster.ErrDisqueUnknownNode, consumer.DrainNode("127.0.0.1:1"))
+	mem := cluster.NewMemoryCluster()
+	assert.Equal(ErrNoNodeDrain, ConsumerWithBackends(mem, mem.Locks()).DrainNode("127.0.0.1:1"))
+	// Jobs added to a drained node should not be fetched from it
+	dq.ChainTo(0)
+	added, err := dq.Add(queue, RandomKey(), nil)
+	assert.Empty(err)
+	dq.Unchain()
+	address := disqueHosts[0]["address"].(string)
+	assert.Empty(dq.DrainNode(address))
+	assert.Equal([]string{address}, dq.DrainedNodes())
+	options := &cluster.FetchOptions{
+		NoHang: true,
+	}
+	for i := 0; i < 10; i++ {
+		fetched, _, _ := dq.FetchWithOptions(queue, nil, options)
+		assert.Empty(fetched)
+	}
+	// Nor from any node while all of them are drained
+	for _, host := range disqueHosts {
+		assert.Empty(dq.DrainNode(host["address"].(string)))
+	}
+	_, _, err = dq.FetchWithOptions(queue, nil, options)
+	assert.Equal("no data available", err.Error())
+	// Undrained nodes should be fetched from again
+	for _, host := range disqueHosts {
+		assert.Empty(dq.UndrainNode(host["address"].(string)))
+	}
+	assert.Empty(dq.DrainedNodes())
+	dq.ChainTo(0)
+	fetched, _, err := dq.FetchWithOptions(queue, nil, options)
+	dq.Unchain()
+	assert.Empty(err)
+	if assert.NotEmpty(fetched) {
+		assert.Equal(added.ID, fetched.ID)
+		assert.Empty(dq.Ack(fetched.ID))
+	}
+}
+
+type BlockingProcessor struct {
+	DummyProcessor
+	started chan string
+}
+
+func (p *BlockingProcessor) ProcessContext(ctx context.Context, job *job.Job) (interface{}, error) {
+	p.started <- job.ID
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestConsumerShutdownCancel(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	queue := "jobq" + RandomKey()
+	p := &BlockingProcessor{
+		started: make(chan string, 1),
+	}
+	consumer.Register(queue, p)
+	added, err := consumer.AddJob(queue, "job1", time.Now(), nil)
+	assert.Empty(err)
+	go consumer.Process(queue)
+	assert.Equal(added.ID, <-p.started)
+	// The job running past the grace period should be cancelled
+	assert.Equal(ErrShutdownTimeout, consumer.Shutdown(50*time.Millisecond))
+	events := []EventType{}
+	for len(consumer.Events()) > 0 {
+		events = append(events, (<-consumer.Events()).Type)
+	}
+	assert.Contains(events, EventCancelled)
+	assert.NotContains(events, EventAcked)
+	assert.NotContains(events, EventFailed)
+	// The job should be left for redelivery, and its lock released
+	_job, err := consumer.GetJob(added.ID)
+	assert.Empty(err)
+	assert.NotEmpty(_job)
+	acquired, err := lock.CreateLock(mem.Locks(), added.ID).Get(false)
+	assert.Empty(err)
+	assert.True(acquired)
+}
+
+type BufferLogger struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (l *BufferLogger) Printf(format string, v ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func (l *BufferLogger) Messages() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string{}, l.messages...)
+}
+
+func TestNewWithOptions(t *testing.T) {
+	assert := assert.New(t)
+	// A job backend should be required
+	_, err := New(WithConcurrency(2))
+	assert.Equal(ErrNoJobBackend, err)
+	// Instances without locks should be producers
+	mem := cluster.NewMemoryCluster()
+	producer, err := New(WithBackends(mem, nil))
+	assert.Empty(err)
+	assert.Equal(ErrNoResultStorage, func() error {
+		_, err := producer.AddJobAndWait("jobq", "job", time.Millisecond)
+		return err
+	}())
+	// The settings should apply to the consumer
+	logger := &BufferLogger{}
+	consumer, err := New(
+		WithBackends(&ErrorBackend{MemoryCluster: mem}, mem.Locks()),
+		WithLogger(logger),
+		WithConcurrency(3),
+		WithBlockingTimeout(10*time.Millisecond),
+	)
+	assert.Empty(err)
+	assert.Equal(3, cap(consumer.workers))
+	queue := "jobq" + RandomKey()
+	consumer.Register(queue, &DummyProcessor{})
+	go consumer.Process(queue)
+	time.Sleep(50 * time.Millisecond)
+	consumer.Close()
+	assert.Contains(logger.Messages(), "Error: fetch failed")
+}
+
+type ErrorBackend struct {
+	*cluster.MemoryCluster
+}
+
+func (c *ErrorBackend) FetchWithOptions(queueName string, config *cluster.DisqueOpConfig, options *cluster.FetchOptions) (*disque.Job, *cluster.Counters, error) {
+	return nil, nil, errors.New("fetch failed")
+}
+
+func TestConsumerAckRetry(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	backend := &FlakyAckBackend{mem, 0}
+	consumer := ConsumerWithBackends(backend, mem.Locks())
+	defer consumer.Close()
+	retryBackoff := AckRetryBackoff
+	AckRetryBackoff = backoff.NewConstant(time.Millisecond)
+	defer func() {
+		AckRetryBackoff = retryBackoff
+	}()
+	queue := "jobq" + RandomKey()
+	consumer.Register(queue, &DummyProcessor{})
+	// A blip should not get the job delivered again
+	atomic.StoreInt32(&backend.failures, int32(AckAttempts-1))
+	added, err := consumer.AddJob(queue, "job1", time.Now(), nil)
+	assert.Empty(err)
+	processed, err := consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	_job, err := consumer.GetJob(added.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+	// A longer outage should be reported
+	atomic.StoreInt32(&backend.failures, int32(AckAttempts))
+	added, err = consumer.AddJob(queue, "job2", time.Now(), nil)
+	assert.Empty(err)
+	processed, err = consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	_job, err = consumer.GetJob(added.ID)
+	assert.Empty(err)
+	assert.NotEmpty(_job)
+	types := map[string][]EventType{}
+	for len(consumer.Events()) > 0 {
+		event := <-consumer.Events()
+		types[event.JobID] = append(types[event.JobID], event.Type)
+	}
+	assert.Contains(types[added.ID], EventAckFailed)
+	assert.NotContains(types[added.ID], EventAcked)
+	for id, events := range types {
+		if id != added.ID {
+			assert.Contains(events, EventAcked)
+			assert.NotContains(events, EventAckFailed)
+		}
+	}
+}
+
+func TestConsumerFetchStats(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	consumer.Register(queue, &DummyProcessor{})
+	// Fetches should be counted by their outcome
+	processed, err := consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.False(processed)
+	for i := 0; i < 2; i++ {
+		_, err = consumer.AddJob(queue, "job", time.Now(), nil)
+		assert.Empty(err)
+		processed, err = consumer.ProcessOnce(queue)
+		assert.Empty(err)
+		assert.True(processed)
+	}
+	assert.Equal(FetchStats{Jobs: 2, Empty: 1}, consumer.Stats().Fetches[queue])
+	failing := ConsumerWithBackends(&ErrorBackend{mem}, mem.Locks())
+	defer failing.Close()
+	failing.Register(queue, &DummyProcessor{})
+	_, err = failing.ProcessOnce(queue)
+	assert.NotEmpty(err)
+	assert.Equal(FetchStats{Errors: 1}, failing.Stats().Fetches[queue])
+}
+
+func TestConsumerDeadline(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	consumer.SetDeadlineHeader(job.HeaderProcessBy)
+	queue := "jobq" + RandomKey()
+	p := &DummyProcessor{}
+	dlq := &DummyProcessor{}
+	consumer.Register(queue, p)
+	consumer.Register(queue+":dlq", dlq)
+	past := map[string]string{
+		job.HeaderProcessBy: time.Now().Add(-time.Minute).Format(time.RFC3339Nano),
+	}
+	future := map[string]string{
+		job.HeaderProcessBy: time.Now().Add(time.Minute).Format(time.RFC3339Nano),
+	}
+	// Jobs past their deadline should be acked without processing
+	expired, err := consumer.AddJobWithHeaders(queue, "job1", past, time.Now(), nil)
+	assert.Empty(err)
+	processed, err := consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	assert.Empty(p.Processed())
+	_job, err := consumer.GetJob(expired.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+	events := []EventType{}
+	for len(consumer.Events()) > 0 {
+		events = append(events, (<-consumer.Events()).Type)
+	}
+	assert.Contains(events, EventExpired)
+	assert.NotContains(events, EventProcessed)
+	// Jobs within their deadline should be processed
+	_, err = consumer.AddJobWithHeaders(queue, "job2", future, time.Now(), nil)
+	assert.Empty(err)
+	processed, err = consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	assert.Equal([]string{"job2dummy"}, p.Processed())
+	// Expired jobs should be routed to the dead letter queue of the retry policy
+	consumer.SetRetryPolicy(queue, RetryPolicy{
+		MaxAttempts: 3,
+	})
+	_, err = consumer.AddJobWithHeaders(queue, "job3", past, time.Now(), nil)
+	assert.Empty(err)
+	processed, err = consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	assert.Equal([]string{"job2dummy"}, p.Processed())
+	processed, err = consumer.ProcessOnce(queue + ":dlq")
+	assert.Empty(err)
+	assert.True(processed)
+	assert.Equal([]string{"job3dummy"}, dlq.Processed())
+}
+
+func TestConsumerAdaptiveConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	consumer.SetAdaptiveConcurrency(AdaptiveConcurrency{
+		Min:           1,
+		Max:           4,
+		JobsPerWorker: 2,
+		Interval:      10 * time.Millisecond,
+	})
+	assert.Equal(1, consumer.Stats().Workers)
+	queue := "jobq" + RandomKey()
+	p := &SlowProcessor{
+		Duration: 50 * time.Millisecond,
+	}
+	consumer.Register(queue, p)
+	// The pool should grow with the depth of the queue
+	for i := 0; i < 20; i++ {
+		_, err := consumer.AddJob(queue, "job", time.Now(), nil)
+		assert.Empty(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(4, consumer.Stats().Workers)
+	// The pool should shrink once the queue is drained
+	go consumer.Process(queue)
+	for i := 0; i < 100 && len(p.Processed()) < 20; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(20, len(p.Processed()))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(1, consumer.Stats().Workers)
+	// Setting the concurrency again should stop the scaler
+	done := consumer.scalerDone
+	consumer.SetAdaptiveConcurrency(AdaptiveConcurrency{
+		Min: 2,
+		Max: 3,
+	})
+	assert.Equal(2, consumer.Stats().Workers)
+	select {
+	case <-done:
+	default:
+		assert.Fail("scaler still running")
+	}
+	done = consumer.scalerDone
+	consumer.SetConcurrency(5)
+	assert.Equal(5, consumer.Stats().Workers)
+	select {
+	case <-done:
+	default:
+		assert.Fail("scaler still running")
+	}
+	assert.Nil(consumer.scalerDone)
+}
+
+func TestLockMetadata(t *testing.T) {
+	assert := assert.New(t)
+	c := cluster.NewMemoryCluster().Locks()
+	defer c.Close()
+	key := RandomKey()
+	l := lock.CreateLock(c, key, "host-1", "job-1")
+	success, err := l.Get(false)
+	assert.Empty(err)
+	assert.True(success)
+	// The metadata should be reported apart from the value
+	locks, err := lock.ScanLocks(c, key)
+	assert.Empty(err)
+	assert.Len(locks, 1)
+	assert.Equal("host-1|job-1", locks[0].Metadata)
+	assert.NotContains(locks[0].Value, "host-1")
+	assert.True(locks[0].IsHeld(c))
+	// The lock should still be extended and released by its holder only
+	other := lock.CreateLock(c, key, "host-2")
+	success, err = other.Get(false)
+	assert.Empty(err)
+	assert.False(success)
+	success, err = l.Extend(time.Minute)
+	assert.Empty(err)
+	assert.True(success)
+	success, err = l.Release()
+	assert.Empty(err)
+	assert.True(success)
+	// Force releasing should report the metadata of the holder
+	success, err = other.Get(false)
+	assert.Empty(err)
+	assert.True(success)
+	released, err := lock.ForceRelease(c, key)
+	assert.Empty(err)
+	assert.Equal("host-2", released.Metadata)
+	released, err = lock.ForceRelease(c, key)
+	assert.Empty(err)
+	assert.Empty(released)
+}
+
+type LockLosingProcessor struct {
+	DummyProcessor
+	started chan string
+}
+
+func (p *LockLosingProcessor) LockDuration(job *job.Job) time.Duration {
+	return 100 * time.Millisecond
+}
+
+func (p *LockLosingProcessor) ProcessContext(ctx context.Context, job *job.Job) (interface{}, error) {
+	p.started <- job.ID
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(2 * time.Second):
+		return true, nil
+	}
+}
+
+func TestConsumerLockLost(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	p := &LockLosingProcessor{
+		started: make(chan string, 1),
+	}
+	consumer.Register(queue, p)
+	added, err := consumer.AddJob(queue, "job1", time.Now(), nil)
+	assert.Empty(err)
+	done := make(chan bool)
+	go func() {
+		processed, _ := consumer.ProcessOnce(queue)
+		done <- processed
+	}()
+	id := <-p.started
+	assert.Equal(added.ID, id)
+	// Losing the lock should cancel the job instead of panicking
+	_, err = lock.ForceRelease(mem.Locks(), id)
+	assert.Empty(err)
+	select {
+	case processed := <-done:
+		assert.True(processed)
+	case <-time.After(time.Second):
+		assert.Fail("job should be cancelled once its lock is lost")
+	}
+	var lost *Event
+	for len(consumer.Events()) > 0 {
+		event := <-consumer.Events()
+		if event.Type == EventLockLost {
+			lost = &event
+		}
+		assert.NotEqual(EventAcked, event.Type)
+		assert.NotEqual(EventCancelled, event.Type)
+	}
+	if assert.NotNil(lost) {
+		assert.Equal(lock.ErrLockLost, lost.Err)
+	}
+	// The job should be left for redelivery
+	_job, err := consumer.GetJob(added.ID)
+	assert.Empty(err)
+	assert.NotEmpty(_job)
+}
+
+// SlowWaitBackend is a memory cluster whose WAIT takes longer than the retry of the jobs
+type SlowWaitBackend struct {
+	*cluster.MemoryCluster
+	Delay time.Duration
+}
+
+func (c *SlowWaitBackend) Wait(id string) error {
+	time.Sleep(c.Delay)
+	return c.MemoryCluster.Wait(id)
+}
+
+// OverlapWaitBackend is a slow WAIT backend counting the most WAITs
+// outstanding at once
+type OverlapWaitBackend struct {
+	SlowWaitBackend
+	outstanding int32
+	overlap     int32
+}
+
+func (c *OverlapWaitBackend) Wait(id string) error {
+	n := atomic.AddInt32(&c.outstanding, 1)
+	defer atomic.AddInt32(&c.outstanding, -1)
+	for {
+		overlap := atomic.LoadInt32(&c.overlap)
+		if n <= overlap || atomic.CompareAndSwapInt32(&c.overlap, overlap, n) {
+			break
+		}
+	}
+	return c.SlowWaitBackend.Wait(id)
+}
+
+// SlowAddBackend is a memory cluster whose ADDJOB takes a while
+type SlowAddBackend struct {
+	*cluster.MemoryCluster
+	Delay time.Duration
+}
+
+func (c *SlowAddBackend) Add(queueName string, data string, config *cluster.DisqueOpConfig) (*disque.Job, error) {
+	time.Sleep(c.Delay)
+	return c.MemoryCluster.Add(queueName, data, config)
+}
+
+// HiddenJobsBackend is a memory cluster whose SHOW never finds a job
+type HiddenJobsBackend struct {
+	*cluster.MemoryCluster
+}
+
+func (c *HiddenJobsBackend) Show(id string) (map[string]interface{}, error) {
+	return nil, nil
+}
+
+// FlakyAckBackend is a memory cluster whose ACKJOB fails with a network
+// error a number of times
+type FlakyAckBackend struct {
+	*cluster.MemoryCluster
+	failures int32
+}
+
+func (c *FlakyAckBackend) Ack(id string) error {
+	if atomic.AddInt32(&c.failures, -1) >= 0 {
+		return &net.OpError{Op: "write", Err: syscall.ECONNRESET}
+	}
+	return c.MemoryCluster.Ack(id)
+}
+
+// FailingWaitBackend is a memory cluster whose WAIT fails with the error
+type FailingWaitBackend struct {
+	*cluster.MemoryCluster
+	err error
+}
+
+func (c *FailingWaitBackend) Wait(id string) error {
+	return c.err
+}
+
+// DisruptingProcessor reports a connection error while processing the jobs with the body "disrupt"
+type DisruptingProcessor struct {
+	DummyProcessor
+	m *Magi
+}
+
+func (p *DisruptingProcessor) Process(job *job.Job) (interface{}, error) {
+	if job.Body == "disrupt" {
+		p.m.ReportConnError("127.0.0.1:7711", errors.New("connection reset"))
+	}
+	return p.DummyProcessor.Process(job)
+}
+
+func TestConsumerConnectivityDisrupted(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	consumer.Register(queue, &DisruptingProcessor{
+		m: consumer,
+	})
+	ids := []string{}
+	for _, body := range []string{"job1", "disrupt", "job2"} {
+		added, err := consumer.AddJob(queue, body, time.Now(), nil)
+		assert.Empty(err)
+		ids = append(ids, added.ID)
+	}
+	for range ids {
+		processed, err := consumer.ProcessOnce(queue)
+		assert.Empty(err)
+		assert.True(processed)
+	}
+	// Only the job processed across the connection error should be flagged
+	disrupted := map[string]bool{}
+	for len(consumer.Events()) > 0 {
+		event := <-consumer.Events()
+		if event.Type == EventProcessed {
+			disrupted[event.JobID] = event.ConnectivityDisrupted
+		} else {
+			assert.False(event.ConnectivityDisrupted)
+		}
+	}
+	assert.Equal(map[string]bool{
+		ids[0]: false,
+		ids[1]: true,
+		ids[2]: false,
+	}, disrupted)
+}
+
+func TestConsumerWaitTimeout(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	logger := &BufferLogger{}
+	backend := &OverlapWaitBackend{
+		SlowWaitBackend: SlowWaitBackend{mem, 50 * time.Millisecond},
+	}
+	consumer, err := New(WithBackends(backend, mem.Locks()), WithLogger(logger))
+	assert.Empty(err)
+	defer consumer.Close()
+	consumer.SetWaitTimeout(5 * time.Millisecond)
+	interval := WaitRetryInterval
+	WaitRetryInterval = 10 * time.Millisecond
+	defer func() {
+		WaitRetryInterval = interval
+	}()
+	queue := "jobq" + RandomKey()
+	p := &SlowProcessor{
+		Duration: 100 * time.Millisecond,
+	}
+	consumer.Register(queue, p)
+	config := &cluster.DisqueOpConfig{
+		RetryAfter: 20 * time.Millisecond,
+	}
+	// Waits timing out should be tried again rather than cancel the job
+	added, err := consumer.AddJob(queue, "job1", time.Now(), config)
+	assert.Empty(err)
+	processed, err := consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	assert.Equal([]string{"job1dummy"}, p.Processed())
+	_job, err := consumer.GetJob(added.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+	timeouts := 0
+	for _, message := range logger.Messages() {
+		if strings.HasSuffix(message, ErrDisqueJobWaitTimeout.Error()) {
+			timeouts++
+		}
+	}
+	assert.True(timeouts > 1)
+	// Without sending another WAIT while one is outstanding
+	assert.Equal(int32(1), atomic.LoadInt32(&backend.overlap))
+	for len(consumer.Events()) > 0 {
+		event := <-consumer.Events()
+		assert.NotEqual(EventLockLost, event.Type)
+	}
+	// Other failures should cancel the job
+	failing := ConsumerWithBackends(&FailingWaitBackend{mem, redis.Error("ERR unknown job")}, mem.Locks())
+	defer failing.Close()
+	blocking := &BlockingProcessor{
+		started: make(chan string, 1),
+	}
+	failing.Register(queue, blocking)
+	added, err = failing.AddJob(queue, "job2", time.Now(), config)
+	assert.Empty(err)
+	processed, err = failing.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	var lost *Event
+	for len(failing.Events()) > 0 {
+		event := <-failing.Events()
+		if event.Type == EventLockLost {
+			lost = &event
+		}
+	}
+	if assert.NotNil(lost) {
+		assert.Equal(added.ID, lost.JobID)
+		assert.Equal(ErrDisqueJobWaitFailed, lost.Err)
+	}
+}
+
+func TestConsumerCorrelation(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	backend := &SlowWaitBackend{mem, 30 * time.Millisecond}
+	logger := &BufferLogger{}
+	consumer, err := New(WithBackends(backend, mem.Locks()), WithLogger(logger))
+	assert.Empty(err)
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	p := &SlowProcessor{
+		Duration: 50 * time.Millisecond,
+	}
+	consumer.Register(queue, p)
+	config := &cluster.DisqueOpConfig{
+		RetryAfter: 5 * time.Millisecond,
+	}
+	added, err := consumer.AddJobWithExternalID(queue, "order-42", "job1", time.Now(), config)
+	assert.Empty(err)
+	processed, err := consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	// Every event of the job from its fetch on should carry both of its ids
+	types := []EventType{}
+	for len(consumer.Events()) > 0 {
+		event := <-consumer.Events()
+		if event.Type == EventEnqueued {
+			continue
+		}
+		types = append(types, event.Type)
+		assert.Equal(added.ID, event.JobID)
+		assert.Equal("order-42", event.ExternalID)
+	}
+	assert.Contains(types, EventFetched)
+	assert.Contains(types, EventLeaseOverrun)
+	assert.Contains(types, EventProcessed)
+	assert.Contains(types, EventAcked)
+	// So should the messages logged about it
+	messages := logger.Messages()
+	assert.NotEmpty(messages)
+	for _, message := range messages {
+		assert.True(strings.HasPrefix(message, "[job "+added.ID+" external-id order-42] "), message)
+	}
+}
+
+func TestLockAutoRenewLost(t *testing.T) {
+	assert := assert.New(t)
+	c := cluster.NewMemoryCluster().Locks()
+	defer c.Close()
+	key := RandomKey()
+	l := lock.CreateLock(c, key)
+	l.Duration = 100 * time.Millisecond
+	success, err := l.Get(true)
+	assert.Empty(err)
+	assert.True(success)
+	assert.Empty(l.Err())
+	// Failing to renew should be reported instead of panicking
+	_, err = lock.ForceRelease(c, key)
+	assert.Empty(err)
+	select {
+	case <-l.Lost():
+	case <-time.After(time.Second):
+		assert.Fail("lock should be reported lost")
+	}
+	assert.Equal(lock.ErrLockLost, l.Err())
+	success, err = l.Release()
+	assert.Empty(err)
+	assert.False(success)
+}
+
+func TestLoadConfig(t *testing.T) {
+	assert := assert.New(t)
+	// Configs should be loaded from JSON
+	source := `{
+		"disque": {
+			"hosts": [{"address": "127.0.0.1:7711"}, {"address": "127.0.0.1:7712"}],
+			"lb_mode": "random"
+		},
+		"redis": {
+			"hosts": [{"address": "127.0.0.1:7777", "auth": "secret", "db": "1"}]
+		}
+	}`
+	config, err := cluster.LoadConfigFromJSON(strings.NewReader(source))
+	assert.Empty(err)
+	assert.Equal(cluster.HostMaps(cluster.Host{Address: "127.0.0.1:7711"}, cluster.Host{Address: "127.0.0.1:7712"}), config.Disque.Hosts)
+	assert.Equal(cluster.DisqueClusterLBMode(cluster.DisqueClusterLBModeRandom), config.Disque.LBMode)
+	assert.Equal([]map[string]interface{}{
+		{
+			"address": "127.0.0.1:7777",
+			"auth":    "secret",
+			"db":      "1",
+		},
+	}, config.Redis.Hosts)
+	// Misspelled keys and missing addresses should fail the loading
+	_, err = cluster.LoadConfigFromJSON(strings.NewReader(`{"disque": {"hosts": [{"adress": "127.0.0.1:7711"}]}}`))
+	assert.Equal(`Config Error: unknown key "adress"!`, err.Error())
+	_, err = cluster.LoadConfigFromJSON(strings.NewReader(`{"redis": {"hosts": [{"db": "1"}]}}`))
+	assert.Equal(cluster.ErrConfigNoAddress, err)
+	// Configs should be loaded from the environment
+	prefix := "MAGI_TEST_" + RandomKey() + "_"
+	os.Setenv(prefix+"DISQUE_HOSTS", "127.0.0.1:7711, 127.0.0.1:7712")
+	os.Setenv(prefix+"REDIS_HOSTS", "127.0.0.1:7777")
+	os.Setenv(prefix+"REDIS_DB", "2")
+	os.Setenv(prefix+"LOG_LEVEL", "debug")
+	config, err = cluster.LoadConfigFromEnv(prefix)
+	assert.Empty(err)
+	assert.Len(config.Disque.Hosts, 2)
+	assert.Equal("127.0.0.1:7712", config.Disque.Hosts[1]["address"])
+	assert.Equal(cluster.HostMaps(cluster.Host{Address: "127.0.0.1:7777", DB: "2"}), config.Redis.Hosts)
+	os.Setenv(prefix+"REDIS_PASSWORD", "secret")
+	_, err = cluster.LoadConfigFromEnv(prefix)
+	assert.Equal(`Config Error: unknown key "`+prefix+`REDIS_PASSWORD"!`, err.Error())
+	for _, key := range []string{"DISQUE_HOSTS", "REDIS_HOSTS", "REDIS_DB", "REDIS_PASSWORD", "LOG_LEVEL"} {
+		os.Unsetenv(prefix + key)
+	}
+	_, err = cluster.LoadConfigFromEnv("")
+	assert.Equal(cluster.ErrConfigNoPrefix, err)
+	// Missing clusters should be left out
+	config, err = cluster.LoadConfigFromEnv(prefix)
+	assert.Empty(err)
+	assert.Nil(config.Disque)
+	assert.Nil(config.Redis)
+}
+
+func TestNamespace(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	namespace := "app" + RandomKey() + ":"
+	producer, err := New(WithBackends(mem, nil), WithNamespace(namespace))
+	assert.Empty(err)
+	defer producer.Close()
+	consumer, err := New(WithBackends(mem, mem.Locks()), WithNamespace(namespace))
+	assert.Empty(err)
+	defer consumer.Close()
+	other := ConsumerWithBackends(mem, mem.Locks())
+	defer other.Close()
+	queue := "jobq" + RandomKey()
+	// Jobs should be added to the namespaced queue
+	added, err := producer.AddJob(queue, "job1", time.Now(), nil)
+	assert.Empty(err)
+	assert.Equal(queue, added.QueueName)
+	length, err := mem.QueueLength(namespace + queue)
+	assert.Empty(err)
+	assert.Equal(1, length)
+	queues, err := consumer.Queues("*")
+	assert.Empty(err)
+	assert.Equal([]string{queue}, queues)
+	_job, err := consumer.GetJob(added.ID)
+	assert.Empty(err)
+	assert.Equal(queue, _job.QueueName)
+	// Consumers outside the namespace should not see the job
+	other.Register(queue, &DummyProcessor{})
+	processed, err := other.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.False(processed)
+	// The consumer in the namespace should process it, locking a namespaced key
+	p := &ManualProcessor{
+		IDs: make(chan string, 1),
+	}
+	consumer.Register(queue, p)
+	processed, err = consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	assert.Equal(added.ID, <-p.IDs)
+	keys, err := mem.Locks().Scan(0, namespace+added.ID)
+	assert.Empty(err)
+	assert.Equal([]string{namespace + added.ID}, keys)
+	locks, err := lock.ScanLocks(consumer.rCluster, added.ID)
+	assert.Empty(err)
+	if assert.Len(locks, 1) {
+		assert.Equal(added.ID, locks[0].Key)
+	}
+	err = consumer.AckJob(added.ID)
+	assert.Empty(err)
+	// Dead letter queues should be in the namespace too
+	consumer.SetRetryPolicy(queue, RetryPolicy{
+		MaxAttempts: 1,
+	})
+	consumer.Register(queue, &FailingProcessor{})
+	_, err = producer.AddJob(queue, "job2", time.Now(), nil)
+	assert.Empty(err)
+	processed, err = consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	length, err = mem.QueueLength(namespace + queue + ":dlq")
+	assert.Empty(err)
+	assert.Equal(1, length)
+}
+
+func TestLockSharding(t *testing.T) {
+	assert := assert.New(t)
+	shards := []cluster.LockBackend{
+		cluster.NewMemoryCluster().Locks(),
+		cluster.NewMemoryCluster().Locks(),
+	}
+	_, err := cluster.NewShardedLockBackend()
+	assert.Equal(cluster.ErrNoShards, err)
+	_, err = New(WithBackends(cluster.NewMemoryCluster(), nil), WithRedisShards([]*cluster.RedisClusterConfig{}...))
+	assert.Equal(cluster.ErrNoShards, err)
+	c, err := cluster.NewShardedLockBackend(shards...)
+	assert.Empty(err)
+	defer c.Close()
+	prefix := RandomKey()
+	n := 50
+	for i := 0; i < n; i++ {
+		l := lock.CreateLock(c, prefix+":"+strconv.Itoa(i))
+		l.Duration = time.Minute
+		success, err := l.Get(false)
+		assert.Empty(err)
+		assert.True(success)
+	}
+	// Each lock should live on a single shard, and the shards share the load
+	total := 0
+	for _, shard := range shards {
+		locks, err := lock.ScanLocks(shard, prefix+":*")
+		assert.Empty(err)
+		assert.True(len(locks) > 0)
+		total += len(locks)
+	}
+	assert.Equal(n, total)
+	// The sharded backend should see all the locks
+	locks, err := lock.ScanLocks(c, prefix+":*")
+	assert.Empty(err)
+	assert.Len(locks, n)
+	// Keys should always be routed to the same shard
+	key := prefix + ":0"
+	l := lock.CreateLock(c, key)
+	success, err := l.Get(false)
+	assert.Empty(err)
+	assert.False(success)
+	released, err := lock.ForceRelease(c, key)
+	assert.Empty(err)
+	assert.NotEmpty(released)
+	success, err = l.Get(false)
+	assert.Empty(err)
+	assert.True(success)
+}
+
+type DryRunDummyProcessor struct {
+	DummyProcessor
+	checked []string
+}
+
+func (p *DryRunDummyProcessor) DryRun(job *job.Job) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.checked = append(p.checked, job.Body)
+	if job.Body == "invalid" {
+		return errors.New("invalid job")
+	}
+	return nil
+}
+
+func TestConsumerDryRun(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	logger := &BufferLogger{}
+	consumer, err := New(WithBackends(mem, mem.Locks()), WithLogger(logger))
+	assert.Empty(err)
+	defer consumer.Close()
+	consumer.DryRun = true
+	queue := "jobq" + RandomKey()
+	p := &DryRunDummyProcessor{}
+	consumer.Register(queue, p)
+	ids := []string{}
+	for _, body := range []string{"job1", "invalid"} {
+		added, err := consumer.AddJob(queue, body, time.Now(), nil)
+		assert.Empty(err)
+		ids = append(ids, added.ID)
+	}
+	for range ids {
+		processed, err := consumer.ProcessOnce(queue)
+		assert.Empty(err)
+		assert.True(processed)
+	}
+	// Jobs should be checked and acked without being processed
+	assert.Empty(p.Processed())
+	assert.Equal([]string{"job1", "invalid"}, p.checked)
+	for _, id := range ids {
+		_job, err := consumer.GetJob(id)
+		assert.Empty(err)
+		assert.Empty(_job)
+	}
+	dryRuns := map[string]error{}
+	for len(consumer.Events()) > 0 {
+		event := <-consumer.Events()
+		assert.NotEqual(EventProcessed, event.Type)
+		if event.Type == EventDryRun {
+			dryRuns[event.JobID] = event.Err
+		}
+	}
+	assert.Len(dryRuns, 2)
+	assert.Empty(dryRuns[ids[0]])
+	assert.Equal("invalid job", dryRuns[ids[1]].Error())
+	assert.Len(logger.Messages(), 2)
+}
+
+func TestConsumerQueueLatency(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	consumer.Register(queue, &DummyProcessor{})
+	added, err := consumer.AddJob(queue, "job1", time.Now(), nil)
+	assert.Empty(err)
+	time.Sleep(50 * time.Millisecond)
+	processed, err := consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	// The time waited in the queue should be reported on the fetched event
+	var fetched *Event
+	for len(consumer.Events()) > 0 {
+		event := <-consumer.Events()
+		if event.Type == EventFetched {
+			fetched = &event
+		}
+	}
+	if assert.NotNil(fetched) {
+		assert.Equal(added.ID, fetched.JobID)
+		assert.True(fetched.Latency >= 50*time.Millisecond)
+		assert.True(fetched.Latency < time.Second)
+		assert.Equal(fetched.Latency, consumer.Stats().QueueLatency[queue])
+	}
+}
+
+func TestConsumerConfirmAck(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	confirmed := map[string]interface{}{}
+	vetoed := 0
+	consumer.ConfirmAck = func(_job *job.Job, result interface{}) bool {
+		confirmed[_job.Body] = result
+		if _job.Body == "job2" && vetoed == 0 {
+			vetoed++
+			return false
+		}
+		return true
+	}
+	queue := "jobq" + RandomKey()
+	p := &DummyProcessor{}
+	consumer.Register(queue, p)
+	added1, err := consumer.AddJob(queue, "job1", time.Now(), nil)
+	assert.Empty(err)
+	added2, err := consumer.AddJob(queue, "job2", time.Now(), nil)
+	assert.Empty(err)
+	// Confirmed jobs should be acked
+	processed, err := consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	assert.Equal(true, confirmed["job1"])
+	_job, err := consumer.GetJob(added1.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+	// Vetoed jobs should be nacked back into the queue
+	processed, err = consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	_job, err = consumer.GetJob(added2.ID)
+	assert.Empty(err)
+	assert.NotEmpty(_job)
+	_, err = consumer.AddJob(queue, "job3", time.Now(), nil)
+	assert.Empty(err)
+	for i := 0; i < 2; i++ {
+		processed, err = consumer.ProcessOnce(queue)
+		assert.Empty(err)
+		assert.True(processed)
+	}
+	assert.Len(p.Processed(), 4)
+	assert.Equal(1, vetoed)
+	_job, err = consumer.GetJob(added2.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+}
+
+func TestLockZeroDuration(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	mock := clock.NewMock(time.Now())
+	mem.SetClock(mock)
+	c := mem.Locks()
+	key := RandomKey()
+	l := lock.CreateLock(c, key)
+	l.Duration = 0
+	l.Clock = mock
+	success, err := l.Get(true)
+	assert.Empty(err)
+	assert.True(success)
+	// The lock should be held long past any expiry
+	mock.Add(24 * time.Hour)
+	other := lock.CreateLock(c, key)
+	other.Clock = mock
+	success, err = other.Get(false)
+	assert.Empty(err)
+	assert.False(success)
+	locks, err := lock.ScanLocks(c, key)
+	assert.Empty(err)
+	assert.Len(locks, 1)
+	success, err = l.Extend(time.Minute)
+	assert.Empty(err)
+	assert.True(success)
+	// Until it's released
+	success, err = l.Release()
+	assert.Empty(err)
+	assert.True(success)
+	success, err = other.Get(false)
+	assert.Empty(err)
+	assert.True(success)
+}
+
+func TestProducerJobETA(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	consumer.Register(queue, &DummyProcessor{})
+	// Delayed jobs should be due after their delay
+	delayed, err := consumer.AddJobDelayed(queue, "job1", 2*time.Minute, nil)
+	assert.Empty(err)
+	details, err := consumer.GetJobDetails(delayed.ID)
+	assert.Empty(err)
+	assert.Equal("active", details.State)
+	eta, err := consumer.JobETA(delayed.ID)
+	assert.Empty(err)
+	assert.WithinDuration(time.Now().Add(2*time.Minute), eta, time.Second)
+	// Queued jobs should be due now
+	queued, err := consumer.AddJob(queue, "job2", time.Now(), nil)
+	assert.Empty(err)
+	eta, err = consumer.JobETA(queued.ID)
+	assert.Empty(err)
+	assert.WithinDuration(time.Now(), eta, time.Second)
+	// Jobs being processed or gone should be reported
+	_, _, err = mem.FetchWithOptions(queue, nil, &cluster.FetchOptions{NoHang: true})
+	assert.Empty(err)
+	details, err = consumer.GetJobDetails(queued.ID)
+	assert.Empty(err)
+	assert.Equal("active", details.State)
+	assert.True(details.NextAwakeWithin > 0)
+	_, err = consumer.JobETA(queued.ID)
+	assert.Equal(ErrJobActive, err)
+	_, err = consumer.DeleteJob(queued.ID)
+	assert.Empty(err)
+	_, err = consumer.JobETA(queued.ID)
+	assert.Equal(ErrJobNotFound, err)
+}
+
+func TestConsumerCloseStopsAllLoops(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	consumer.SetBlockingTimeout(20 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		queue := "jobq" + RandomKey()
+		consumer.Register(queue, &DummyProcessor{})
+		go consumer.Process(queue)
+	}
+	for i := 0; i < 50 && !consumer.IsProcessing(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(consumer.IsProcessing())
+	// Closing should stop every loop without blocking, however many there are
+	done := make(chan struct{})
+	go func() {
+		consumer.Close()
+		consumer.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail("closing should never block")
+	}
+	for i := 0; i < 50 && consumer.IsProcessing(); i++ {
+		time.Sleep(10 * time.Millisecond)
 	}
+	assert.False(consumer.IsProcessing())
 }
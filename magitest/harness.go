@@ -0,0 +1,185 @@
+// Package magitest provides a harness for testing processors against an
+// in-memory cluster and a fake clock, so that tests step through delays,
+// retries and leases deterministically instead of sleeping.
+package magitest
+
+import (
+	"time"
+
+	"github.com/evanhuang8/magi"
+	"github.com/evanhuang8/magi/clock"
+	"github.com/evanhuang8/magi/cluster"
+	"github.com/evanhuang8/magi/job"
+)
+
+// TestingT is the part of *testing.T the harness reports failures to
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+}
+
+// Start is the time the fake clock of a harness starts at
+var Start = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Harness is a consumer wired to an in-memory cluster and a fake clock. Jobs
+// are only processed by Drain, one at a time on the calling goroutine, and
+// time only moves with Advance.
+type Harness struct {
+	Magi    *magi.Magi
+	Cluster *cluster.MemoryCluster
+	Clock   *clock.Mock
+
+	t         TestingT
+	bodies    map[string]string // bodies of the jobs enqueued, by id
+	processed []string          // bodies of the jobs processed, in order
+	failed    []string          // bodies of the jobs that failed, in order
+}
+
+// NewHarness creates a harness reporting to t, with the options applied to
+// its consumer after the backends and the clock
+func NewHarness(t TestingT, opts ...magi.Option) *Harness {
+	mock := clock.NewMock(Start)
+	mem := cluster.NewMemoryCluster()
+	mem.SetClock(mock)
+	opts = append([]magi.Option{
+		magi.WithBackends(mem, mem.Locks()),
+		magi.WithClock(mock),
+	}, opts...)
+	m, err := magi.New(opts...)
+	if err != nil {
+		t.Errorf("magitest: %v", err)
+		return nil
+	}
+	return &Harness{
+		Magi:    m,
+		Cluster: mem,
+		Clock:   mock,
+		t:       t,
+		bodies:  make(map[string]string),
+	}
+}
+
+// Register adds a processor for a queue
+func (h *Harness) Register(queueName string, processor magi.Processor) {
+	h.Magi.Register(queueName, processor)
+}
+
+// Enqueue adds a job to the queue, available right away
+func (h *Harness) Enqueue(queueName string, body string) *job.Job {
+	return h.EnqueueAfter(queueName, body, 0)
+}
+
+// EnqueueAfter adds a job to the queue, available once the clock is advanced
+// by the delay
+func (h *Harness) EnqueueAfter(queueName string, body string, delay time.Duration) *job.Job {
+	_job, err := h.Magi.AddJob(queueName, body, h.Clock.Now().Add(delay), nil)
+	if err != nil {
+		h.t.Errorf("magitest: fail to enqueue %q: %v", body, err)
+		return nil
+	}
+	h.bodies[_job.ID] = body
+	h.collect()
+	return _job
+}
+
+// Advance moves the clock forward by the duration, making the delayed jobs
+// and the retries due by then available
+func (h *Harness) Advance(d time.Duration) {
+	h.Clock.Add(d)
+}
+
+// Drain processes the jobs available in the queues, visiting them in turn
+// until none has a job left, and returns the number of jobs processed. Jobs
+// added while draining, e.g. follow-up jobs, are processed too if available.
+func (h *Harness) Drain(queueNames ...string) int {
+	n := 0
+	for {
+		found := false
+		for _, queueName := range queueNames {
+			processed, err := h.Magi.ProcessOnce(queueName)
+			h.collect()
+			if err != nil {
+				h.t.Errorf("magitest: fail to process queue %s: %v", queueName, err)
+				return n
+			}
+			if processed {
+				found = true
+				n++
+			}
+		}
+		if !found {
+			return n
+		}
+	}
+}
+
+// collect records the jobs added, processed and failed since the last call
+// from the events of the consumer
+func (h *Harness) collect() {
+	for {
+		select {
+		case event := <-h.Magi.Events():
+			h.record(event)
+		default:
+			return
+		}
+	}
+}
+
+func (h *Harness) record(event magi.Event) {
+	switch event.Type {
+	case magi.EventEnqueued:
+		// Jobs added by the processors are still in their queue
+		if _, exists := h.bodies[event.JobID]; !exists {
+			_job, err := h.Magi.GetJob(event.JobID)
+			if err == nil && _job != nil {
+				h.bodies[event.JobID] = _job.Body
+			}
+		}
+	case magi.EventProcessed:
+		h.processed = append(h.processed, h.bodies[event.JobID])
+	case magi.EventFailed:
+		h.failed = append(h.failed, h.bodies[event.JobID])
+	}
+}
+
+// Processed returns the bodies of the jobs processed successfully, in order
+func (h *Harness) Processed() []string {
+	return h.processed
+}
+
+// Failed returns the bodies of the jobs whose processing failed, in order
+func (h *Harness) Failed() []string {
+	return h.failed
+}
+
+// AssertProcessed checks that a job with the body was processed successfully
+func (h *Harness) AssertProcessed(body string) bool {
+	for _, processed := range h.processed {
+		if processed == body {
+			return true
+		}
+	}
+	h.t.Errorf("magitest: job %q is not processed, processed %q", body, h.processed)
+	return false
+}
+
+// AssertOrder checks that the jobs with the bodies were processed
+// successfully in the order given, other jobs may be processed in between
+func (h *Harness) AssertOrder(bodies ...string) bool {
+	i := 0
+	for _, processed := range h.processed {
+		if i < len(bodies) && processed == bodies[i] {
+			i++
+		}
+	}
+	if i < len(bodies) {
+		h.t.Errorf("magitest: jobs %q are not processed in order, processed %q", bodies, h.processed)
+		return false
+	}
+	return true
+}
+
+// Close closes the consumer of the harness
+func (h *Harness) Close() error {
+	return h.Magi.Close()
+}
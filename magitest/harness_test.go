@@ -0,0 +1,228 @@
+package magitest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/evanhuang8/magi"
+	"github.com/evanhuang8/magi/job"
+	"github.com/evanhuang8/magi/magitest"
+)
+
+// FlakyProcessor fails the jobs with the body "flaky" the first time and the
+// ones with the body "broken" every time, and chains a follow-up job to the
+// ones with the body "chain"
+type FlakyProcessor struct {
+	attempts map[string]int
+}
+
+func (p *FlakyProcessor) Process(_job *job.Job) (interface{}, error) {
+	p.attempts[_job.Body]++
+	switch _job.Body {
+	case "flaky":
+		if p.attempts[_job.Body] == 1 {
+			return nil, errors.New("Processing failed!")
+		}
+	case "broken":
+		return nil, errors.New("Processing failed!")
+	case "chain":
+		return &job.Continuation{
+			Queue: _job.QueueName,
+			Body:  "chained",
+		}, nil
+	}
+	return nil, nil
+}
+
+func (p *FlakyProcessor) ShouldAutoRenew(_job *job.Job) bool {
+	return false
+}
+
+// LapseProcessor moves the clock past the lease of the jobs it processes,
+// until the consumer reports the lapse, or until the job is cancelled
+type LapseProcessor struct {
+	h       *magitest.Harness
+	lapse   time.Duration
+	overrun []magi.Event
+}
+
+func (p *LapseProcessor) Process(_job *job.Job) (interface{}, error) {
+	return p.ProcessContext(context.Background(), _job)
+}
+
+func (p *LapseProcessor) ProcessContext(ctx context.Context, _job *job.Job) (interface{}, error) {
+	for {
+		// The lease is extended in the background, moving the clock again
+		// until it's noticed
+		p.h.Advance(p.lapse)
+		select {
+		case event := <-p.h.Magi.Events():
+			if event.Type == magi.EventLeaseOverrun {
+				p.overrun = append(p.overrun, event)
+				if !p.h.Magi.CancelOnLeaseOverrun {
+					return nil, nil
+				}
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func (p *LapseProcessor) ShouldAutoRenew(_job *job.Job) bool {
+	return false
+}
+
+// recorder collects the failures of the harness
+type recorder struct {
+	errors []string
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, format)
+}
+
+func TestHarness(t *testing.T) {
+	assert := assert.New(t)
+	h := magitest.NewHarness(t)
+	defer h.Close()
+	p := &FlakyProcessor{
+		attempts: map[string]int{},
+	}
+	h.Register("q1", p)
+	h.Register("q2", p)
+	h.Magi.SetRetryPolicy("q1", magi.RetryPolicy{
+		MaxAttempts:  3,
+		InitialDelay: time.Minute,
+	})
+	h.Enqueue("q1", "job1")
+	h.EnqueueAfter("q1", "later", time.Hour)
+	h.Enqueue("q1", "flaky")
+	h.Enqueue("q2", "chain")
+	// Jobs should be processed in turn, with their follow-ups
+	assert.Equal(4, h.Drain("q1", "q2"))
+	h.AssertOrder("job1", "chain", "chained")
+	assert.Equal([]string{"flaky"}, h.Failed())
+	// Retries and delayed jobs should wait for the clock
+	assert.Equal(0, h.Drain("q1", "q2"))
+	h.Advance(time.Minute)
+	assert.Equal(1, h.Drain("q1"))
+	h.AssertProcessed("flaky")
+	h.Advance(time.Hour)
+	assert.Equal(1, h.Drain("q1"))
+	h.AssertOrder("job1", "flaky", "later")
+	// Failed assertions should be reported
+	r := &recorder{}
+	failing := magitest.NewHarness(r)
+	defer failing.Close()
+	assert.False(failing.AssertProcessed("job1"))
+	assert.False(failing.AssertOrder("later", "job1"))
+	assert.Len(r.errors, 2)
+}
+
+func TestHarnessDelay(t *testing.T) {
+	assert := assert.New(t)
+	h := magitest.NewHarness(t)
+	defer h.Close()
+	p := &FlakyProcessor{
+		attempts: map[string]int{},
+	}
+	h.Register("q1", p)
+	// Delayed jobs should wait for the clock
+	h.EnqueueAfter("q1", "job1", 5*time.Second)
+	deleted := h.EnqueueAfter("q1", "job2", 5*time.Second)
+	h.Advance(3 * time.Second)
+	assert.Equal(0, h.Drain("q1"))
+	// Deleted jobs should not be processed once due
+	result, err := h.Magi.DeleteJob(deleted.ID)
+	assert.Empty(err)
+	assert.True(result)
+	h.Advance(2 * time.Second)
+	assert.Equal(1, h.Drain("q1"))
+	assert.Equal([]string{"job1"}, h.Processed())
+	_job, err := h.Magi.GetJob(deleted.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+}
+
+func TestHarnessDelayOrder(t *testing.T) {
+	h := magitest.NewHarness(t)
+	defer h.Close()
+	p := &FlakyProcessor{
+		attempts: map[string]int{},
+	}
+	h.Register("q1", p)
+	// Jobs added in any order should be processed as they are due
+	bodies := []string{"job1", "job2", "job3", "job4", "job5"}
+	for i := len(bodies) - 1; i >= 0; i-- {
+		h.EnqueueAfter("q1", bodies[i], time.Duration(i*100)*time.Millisecond)
+	}
+	for range bodies {
+		h.Drain("q1")
+		h.Advance(100 * time.Millisecond)
+	}
+	h.AssertOrder(bodies...)
+}
+
+func TestHarnessRetryDeadLetter(t *testing.T) {
+	assert := assert.New(t)
+	h := magitest.NewHarness(t)
+	defer h.Close()
+	p := &FlakyProcessor{
+		attempts: map[string]int{},
+	}
+	h.Register("q1", p)
+	h.Register("q1:dlq", p)
+	h.Magi.SetRetryPolicy("q1", magi.RetryPolicy{
+		MaxAttempts:  3,
+		InitialDelay: 500 * time.Millisecond,
+	})
+	h.Enqueue("q1", "broken")
+	// Attempts happen at 0s, 0.5s and 1.5s
+	assert.Equal(1, h.Drain("q1", "q1:dlq"))
+	h.Advance(500 * time.Millisecond)
+	assert.Equal(1, h.Drain("q1", "q1:dlq"))
+	h.Advance(500 * time.Millisecond)
+	assert.Equal(0, h.Drain("q1", "q1:dlq"))
+	h.Advance(500 * time.Millisecond)
+	// Until the job is dead-lettered
+	assert.Equal(2, h.Drain("q1", "q1:dlq"))
+	assert.Equal([]string{"broken", "broken", "broken", "broken"}, h.Failed())
+	assert.Equal(4, p.attempts["broken"])
+}
+
+func TestHarnessLeaseOverrun(t *testing.T) {
+	assert := assert.New(t)
+	h := magitest.NewHarness(t)
+	defer h.Close()
+	p := &LapseProcessor{
+		h:     h,
+		lapse: 15 * time.Minute,
+	}
+	h.Register("q1", p)
+	// The lapse should be reported while the job is still processed
+	added := h.Enqueue("q1", "job1")
+	assert.Equal(1, h.Drain("q1"))
+	h.AssertProcessed("job1")
+	if assert.Len(p.overrun, 1) {
+		assert.Equal(added.ID, p.overrun[0].JobID)
+		assert.Equal(magi.ErrLeaseOverrun, p.overrun[0].Err)
+	}
+	// The job should be cancelled and left to disque if requested, which
+	// delivers it again as its lease is over
+	h.Magi.CancelOnLeaseOverrun = true
+	added = h.Enqueue("q1", "job2")
+	processed, err := h.Magi.ProcessOnce("q1")
+	assert.Empty(err)
+	assert.True(processed)
+	assert.Equal([]string{"job1"}, h.Processed())
+	assert.Len(p.overrun, 2)
+	_job, err := h.Magi.GetJob(added.ID)
+	assert.Empty(err)
+	assert.NotEmpty(_job)
+}
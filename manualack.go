@@ -0,0 +1,185 @@
+package magi
+
+import (
+	"sync"
+	"time"
+
+	"github.com/evanhuang8/magi/job"
+	"github.com/evanhuang8/magi/lock"
+)
+
+// ManualAckTimeout is the maximum time a manually acked job is held before
+// it's nacked back into the queue
+var ManualAckTimeout = 10 * time.Minute
+
+// ManualAckProcessor is an optional interface for processors that hand jobs off
+// to another system and acknowledge them later.
+//
+// When ManualAck returns true for a job that is processed without error, magi
+// does not ack the job when Process returns. Instead it keeps holding the lock
+// on the job, and keeps extending the job's lease in disque with WAIT, until
+// AckJob or NackJob is called with the job's id, or until ManualAckTimeout
+// passes, at which point the job is nacked so that it can be redelivered.
+// Magi.ConfirmAck is not called for the held jobs, the processor confirms
+// them by calling AckJob.
+type ManualAckProcessor interface {
+	Processor
+	ManualAck(*job.Job) bool
+}
+
+// heldJob is a processed job waiting for a manual ack
+type heldJob struct {
+	queueName string
+	job       *job.Job
+	lock      *lock.Lock
+	control   *chan bool
+	done      chan struct{}
+}
+
+type heldJobs struct {
+	jobs     map[string]*heldJob
+	reserved int // jobs of a ManualAckProcessor being processed, which may be held next
+	max      int // unlimited if not positive
+	mutex    sync.Mutex
+}
+
+// SetMaxHeldJobs sets the number of jobs held for a manual ack at once. Once
+// it's reached, along with the jobs of ManualAckProcessors being processed,
+// the jobs fetched for a ManualAckProcessor are nacked right away instead of
+// processed, so that they're redelivered rather than piling up. A size that
+// is not positive, the default, lifts the limit.
+func (m *Magi) SetMaxHeldJobs(size int) {
+	m.held.mutex.Lock()
+	defer m.held.mutex.Unlock()
+	m.held.max = size
+}
+
+// limit returns the number of jobs that can be held, negative if unlimited
+func (h *heldJobs) limit() int {
+	if h.max <= 0 {
+		return -1
+	}
+	return h.max
+}
+
+// reserve takes a place among the held jobs for a job about to be
+// processed, returning false if there's none left
+func (h *heldJobs) reserve() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if limit := h.limit(); limit >= 0 && len(h.jobs)+h.reserved >= limit {
+		return false
+	}
+	h.reserved++
+	return true
+}
+
+// unreserve gives back the place taken by reserve once the job is processed
+func (h *heldJobs) unreserve() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.reserved--
+}
+
+// hold keeps the lease and the lock on the job until it's manually acked
+func (m *Magi) hold(queueName string, _job *job.Job, _lock *lock.Lock, control *chan bool, lost <-chan error) {
+	held := &heldJob{
+		queueName: queueName,
+		job:       _job,
+		lock:      _lock,
+		control:   control,
+		done:      make(chan struct{}),
+	}
+	m.held.mutex.Lock()
+	if m.held.jobs == nil {
+		m.held.jobs = make(map[string]*heldJob)
+	}
+	m.held.jobs[_job.ID] = held
+	m.held.mutex.Unlock()
+	go func() {
+		select {
+		case <-held.done:
+		case <-m.clock.After(ManualAckTimeout):
+			m.NackJob(_job.ID)
+		case err := <-lost:
+			// Leave the job to disque, it may be redelivered before it's acked
+			if m.unhold(_job.ID) != nil {
+				m.emitJob(EventLockLost, queueName, _job, err)
+			}
+		}
+	}()
+}
+
+// unhold stops the lease extension and releases the lock of a held job
+func (m *Magi) unhold(id string) *heldJob {
+	m.held.mutex.Lock()
+	held, exists := m.held.jobs[id]
+	delete(m.held.jobs, id)
+	m.held.mutex.Unlock()
+	if !exists {
+		return nil
+	}
+	*held.control <- true
+	close(held.done)
+	m.releaseLock(held.lock, held.job)
+	return held
+}
+
+// AckJob acknowledges a job as done, used with manual ack processors
+func (m *Magi) AckJob(id string) error {
+	held := m.unhold(id)
+	err := m.dqCluster.Ack(id)
+	if err != nil {
+		return err
+	}
+	if held != nil {
+		m.emitJob(EventAcked, held.queueName, held.job, nil)
+	}
+	return nil
+}
+
+// NackJob puts a job back into the queue, used with manual ack processors
+func (m *Magi) NackJob(id string) error {
+	held := m.unhold(id)
+	err := m.dqCluster.Nack(id)
+	if err != nil {
+		return err
+	}
+	if held != nil {
+		m.emitJob(EventNacked, held.queueName, held.job, nil)
+	}
+	return nil
+}
+
+// NackJobWithDelay puts a job back into its queue to be redelivered after
+// the delay, instead of right away like NackJob. Since disque can not delay
+// a job it already has, the job is added again with its body and headers,
+// under a new id, and the original job is acked. The failed attempts tracked
+// by a retry policy carry over, but the delivery counters of disque start
+// over. It fails with ErrJobNotFound for unknown jobs.
+func (m *Magi) NackJobWithDelay(id string, delay time.Duration) error {
+	_job, err := m.GetJob(id)
+	if err != nil {
+		return err
+	}
+	if _job == nil {
+		return ErrJobNotFound
+	}
+	headers := make(map[string]string, len(_job.Headers)+1)
+	for key, value := range _job.Headers {
+		headers[key] = value
+	}
+	headers[job.HeaderOriginID] = retryKey(_job)
+	// Add the job again before acking it, so that it's never lost
+	err = m.requeue(_job.QueueName, _job, headers, m.clock.Now().Add(delay))
+	if err != nil {
+		return err
+	}
+	m.unhold(id)
+	err = m.dqCluster.Ack(id)
+	if err != nil {
+		return err
+	}
+	m.emitJob(EventNacked, _job.QueueName, _job, nil)
+	return nil
+}
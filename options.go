@@ -0,0 +1,252 @@
+package magi
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/evanhuang8/magi/clock"
+	"github.com/evanhuang8/magi/cluster"
+	"github.com/evanhuang8/magi/job"
+)
+
+// Logger is the interface for the messages logged by magi, which the
+// standard library's *log.Logger implements
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// DefaultLogger is the logger of the instances without one of their own
+var DefaultLogger Logger = log.New(os.Stdout, "", 0)
+
+// SetLogger replaces the logger of the instance, a nil logger discards the messages
+func (m *Magi) SetLogger(logger Logger) {
+	m.logger = logger
+}
+
+// logf logs a message with the logger of the instance
+func (m *Magi) logf(format string, v ...interface{}) {
+	if m.logger != nil {
+		m.logger.Printf(format, v...)
+	}
+}
+
+// jobLogf logs a message about the job, prefixed with its ids so that the
+// messages of a job can be correlated with each other and with its events
+func (m *Magi) jobLogf(_job *job.Job, format string, v ...interface{}) {
+	prefix := "[job " + _job.ID
+	if externalID := _job.ExternalID(); externalID != "" {
+		prefix += " external-id " + externalID
+	}
+	m.logf(prefix+"] "+format, v...)
+}
+
+// SetBlockingTimeout sets the time a fetch waits for a job before the
+// processing loop tries again, cluster.DisqueFetchTimeout if zero
+func (m *Magi) SetBlockingTimeout(timeout time.Duration) {
+	m.blockingTimeout = timeout
+}
+
+// ErrNoJobBackend is the error for creating an instance without a disque cluster
+var ErrNoJobBackend = errors.New("Magi Error: a disque cluster or job backend is required!")
+
+// Option configures an instance created by New
+type Option func(*options)
+
+// options are the settings collected from the options of New
+type options struct {
+	dqConfig  *cluster.DisqueClusterConfig
+	rConfig   *cluster.RedisClusterConfig
+	rShards   []*cluster.RedisClusterConfig
+	namespace string
+	jobs      cluster.JobBackend
+	locks     cluster.LockBackend
+	apply     []func(*Magi)
+}
+
+// WithDisque connects the instance to the disque cluster
+func WithDisque(config *cluster.DisqueClusterConfig) Option {
+	return func(o *options) {
+		o.dqConfig = config
+	}
+}
+
+// WithRedis connects the instance to the redis cluster for the locks on the
+// jobs, which makes it a consumer
+func WithRedis(config *cluster.RedisClusterConfig) Option {
+	return func(o *options) {
+		o.rConfig = config
+	}
+}
+
+// WithRedisShards spreads the locks on the jobs over the redis clusters by
+// consistent hashing, see cluster.ShardedLockBackend, which makes the
+// instance a consumer
+func WithRedisShards(configs ...*cluster.RedisClusterConfig) Option {
+	return func(o *options) {
+		o.rShards = configs
+	}
+}
+
+// WithConfig connects the instance to the clusters of the loaded config, see
+// cluster.LoadConfigFromJSON and cluster.LoadConfigFromEnv
+func WithConfig(config *cluster.Config) Option {
+	return func(o *options) {
+		if config.Disque != nil {
+			o.dqConfig = config.Disque
+		}
+		if config.Redis != nil {
+			o.rConfig = config.Redis
+		}
+	}
+}
+
+// WithBackends uses the backends for the jobs and the locks instead of
+// connecting to the clusters, e.g. cluster.MemoryCluster in tests. A nil
+// lock backend makes the instance a producer.
+func WithBackends(jobs cluster.JobBackend, locks cluster.LockBackend) Option {
+	return func(o *options) {
+		o.jobs = jobs
+		o.locks = locks
+	}
+}
+
+// WithNamespace prefixes the names of the queues, and the keys of the locks
+// and the indexes, with the namespace, e.g. "myapp:", so that several
+// applications can share the clusters. The queue names passed to and
+// reported by the instance are the ones without the namespace, including
+// the dead letter queues, and producers and consumers of a queue must use
+// the same namespace. Fair locks are not available in a namespace.
+func WithNamespace(namespace string) Option {
+	return func(o *options) {
+		o.namespace = namespace
+	}
+}
+
+// WithLogger sets the logger of the instance, see SetLogger
+func WithLogger(logger Logger) Option {
+	return withSetting(func(m *Magi) {
+		m.SetLogger(logger)
+	})
+}
+
+// WithBlockingTimeout sets the time a fetch waits for a job, see SetBlockingTimeout
+func WithBlockingTimeout(timeout time.Duration) Option {
+	return withSetting(func(m *Magi) {
+		m.SetBlockingTimeout(timeout)
+	})
+}
+
+// WithConcurrency sets the size of the worker pool, see SetConcurrency
+func WithConcurrency(n int) Option {
+	return withSetting(func(m *Magi) {
+		m.SetConcurrency(n)
+	})
+}
+
+// WithShutdownGracePeriod sets the grace period of RunUntilSignal, see SetShutdownGracePeriod
+func WithShutdownGracePeriod(grace time.Duration) Option {
+	return withSetting(func(m *Magi) {
+		m.SetShutdownGracePeriod(grace)
+	})
+}
+
+// WithEnvelopeCodec sets the codec wrapping the data of the jobs, see SetEnvelopeCodec
+func WithEnvelopeCodec(codec job.EnvelopeCodec) Option {
+	return withSetting(func(m *Magi) {
+		m.SetEnvelopeCodec(codec)
+	})
+}
+
+// WithEventBufferSize sets the number of events buffered for a slow
+// subscriber of the instance before new events are dropped, EventBufferSize
+// by default
+func WithEventBufferSize(size int) Option {
+	return withSetting(func(m *Magi) {
+		m.events = make(chan Event, size)
+	})
+}
+
+// WithClock sets the source of time of the instance, see SetClock
+func WithClock(c clock.Clock) Option {
+	return withSetting(func(m *Magi) {
+		m.SetClock(c)
+	})
+}
+
+// withSetting creates an option applying the setting once the instance is created
+func withSetting(setting func(*Magi)) Option {
+	return func(o *options) {
+		o.apply = append(o.apply, setting)
+	}
+}
+
+// New creates a Magi instance from the options. A disque cluster, or a job
+// backend, is required. With a redis cluster, or a lock backend, the
+// instance is a consumer, otherwise it's a producer.
+func New(opts ...Option) (*Magi, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	// Count the connection errors of the clusters, on copies of the configs
+	// so that the configs of the caller are left untouched
+	conn := &connectivity{}
+	var m *Magi
+	jobs := o.jobs
+	if jobs == nil {
+		if o.dqConfig == nil {
+			return nil, ErrNoJobBackend
+		}
+		dqConfig := *o.dqConfig
+		dqConfig.ConnHooks = conn.hooked(dqConfig.ConnHooks)
+		onFailover := dqConfig.OnFailover
+		dqConfig.OnFailover = func(queueName string, address string, err error) {
+			m.logf("Warning: queue %s failing over from node %s, error: %v", queueName, address, err)
+			if onFailover != nil {
+				onFailover(queueName, address, err)
+			}
+		}
+		dqCluster, err := cluster.NewDisqueCluster(&dqConfig)
+		if err != nil {
+			return nil, err
+		}
+		jobs = dqCluster
+	}
+	locks := o.locks
+	if locks == nil && o.rShards != nil {
+		shards := make([]*cluster.RedisClusterConfig, len(o.rShards))
+		for i, shard := range o.rShards {
+			rConfig := *shard
+			rConfig.ConnHooks = conn.hooked(rConfig.ConnHooks)
+			shards[i] = &rConfig
+		}
+		sharded, err := cluster.NewShardedRedisCluster(shards...)
+		if err != nil {
+			return nil, err
+		}
+		locks = sharded
+	}
+	if locks == nil && o.rConfig != nil {
+		rConfig := *o.rConfig
+		rConfig.ConnHooks = conn.hooked(rConfig.ConnHooks)
+		locks = cluster.NewRedisCluster(&rConfig)
+	}
+	if o.namespace != "" {
+		jobs = cluster.NewNamespacedJobBackend(jobs, o.namespace)
+		if locks != nil {
+			locks = cluster.NewNamespacedLockBackend(locks, o.namespace)
+		}
+	}
+	if locks != nil {
+		m = ConsumerWithBackends(jobs, locks)
+	} else {
+		m = ProducerWithBackend(jobs)
+	}
+	m.conn = conn
+	for _, setting := range o.apply {
+		setting(m)
+	}
+	return m, nil
+}
@@ -0,0 +1,116 @@
+package magi
+
+import (
+	"sort"
+	"time"
+
+	"github.com/evanhuang8/magi/job"
+)
+
+// OrderingBufferSize is the number of jobs held at once by a processing loop
+// putting the jobs of its queue in order, unless a larger prefetch is set
+var OrderingBufferSize = 256
+
+// SetOrderingWindow makes the jobs of the queue processed in the order of
+// their ETA on a best effort basis, without pinning the queue to a single
+// node like SetOrderedProcessing. Each job fetched is held for the window,
+// so that the jobs with an earlier ETA delivered by other nodes in the
+// meantime go ahead of it. A job fetched after a later one is released is
+// processed right away, out of order, with a warning. A zero window, the
+// default, processes the jobs as they are fetched. It must be called before
+// processing starts, and only applies to the queue processed with Process,
+// like SetPrefetch.
+//
+// Held jobs are not extended in disque until they're processed, so the
+// window should be well within the retry of the queue's jobs.
+func (m *Magi) SetOrderingWindow(queueName string, window time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.orderingWindows == nil {
+		m.orderingWindows = make(map[string]time.Duration)
+	}
+	if window > 0 {
+		m.orderingWindows[queueName] = window
+	} else {
+		delete(m.orderingWindows, queueName)
+	}
+}
+
+// orderingWindow returns the time the jobs of the queue are held to be put in order
+func (m *Magi) orderingWindow(queueName string) time.Duration {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.orderingWindows[queueName]
+}
+
+// orderedJob is a job held until its ordering window is over
+type orderedJob struct {
+	job   *job.Job
+	until time.Time
+}
+
+// runOrdered holds the buffered jobs for the ordering window and dispatches
+// them in the order of their ETA, until the buffer is closed. Once the window
+// of a job is over, it's released along with the jobs due before it. Jobs
+// still held on shutdown are nacked, so that they're redelivered right away.
+func (m *Magi) runOrdered(p *prefetcher) {
+	held := []orderedJob{} // sorted by ETA, then by fetch
+	var released time.Time // ETA of the last job released
+	// A single timer is pending at a time, for the first window to be over,
+	// since the jobs fetched later are held until later
+	var expired <-chan time.Time
+	var armed time.Time // time the pending timer fires at
+	for {
+		if len(held) > 0 {
+			until := held[0].until
+			for _, ordered := range held {
+				if ordered.until.Before(until) {
+					until = ordered.until
+				}
+			}
+			if expired == nil || until.Before(armed) {
+				expired = m.clock.After(until.Sub(m.clock.Now()))
+				armed = until
+			}
+		}
+		select {
+		case _job, ok := <-p.jobs:
+			if !ok {
+				for _, ordered := range held {
+					m.releasePrefetch(p)
+					m.nackBuffered(p, ordered.job)
+				}
+				return
+			}
+			if _job.ETA.Before(released) {
+				m.jobLogf(_job, "Warning: job fetched after the later jobs of the queue are processed, processing it out of order")
+				m.handOver(p, _job)
+				continue
+			}
+			i := sort.Search(len(held), func(i int) bool {
+				return held[i].job.ETA.After(_job.ETA)
+			})
+			held = append(held, orderedJob{})
+			copy(held[i+1:], held[i:])
+			held[i] = orderedJob{
+				job:   _job,
+				until: m.clock.Now().Add(p.window),
+			}
+		case <-expired:
+			expired = nil
+			// Release up to the last job whose window is over
+			now := m.clock.Now()
+			n := 0
+			for i, ordered := range held {
+				if !ordered.until.After(now) {
+					n = i + 1
+				}
+			}
+			for _, ordered := range held[:n] {
+				released = ordered.job.ETA
+				m.handOver(p, ordered.job)
+			}
+			held = held[n:]
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package magi
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/evanhuang8/magi/job"
+)
+
+// PanicPolicy is the type for handling the panics of the processors
+type PanicPolicy int
+
+const (
+	// PanicCrash lets the panic of a processor go on once it's logged and
+	// reported to OnPanic, crashing the program. This is the default.
+	PanicCrash PanicPolicy = iota
+	// PanicFail recovers the panic of a processor and fails the job with a
+	// *PanicError, like a processor returning an error
+	PanicFail
+)
+
+// SetPanicPolicy sets how the panics of the processors are handled,
+// defaulting to PanicCrash
+func (m *Magi) SetPanicPolicy(policy PanicPolicy) {
+	m.panicPolicy = policy
+}
+
+// PanicError is the error for a job whose processing panicked, with the
+// value passed to panic and the stack trace of the goroutine at the panic
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Magi Error: processor panicked: %v!", e.Value)
+}
+
+// processRecovered runs the processor on the job, logging and reporting its
+// panic with the stack trace before handling it per the panic policy
+func (m *Magi) processRecovered(ctx context.Context, queueName string, reg *registration, _job *job.Job) (output interface{}, err error) {
+	defer func() {
+		value := recover()
+		if value == nil {
+			return
+		}
+		// The stack is not unwound yet, so it still shows where the panic is
+		panicked := &PanicError{
+			Value: value,
+			Stack: debug.Stack(),
+		}
+		m.jobLogf(_job, "Panic: %v\n%s", value, panicked.Stack)
+		if m.OnPanic != nil {
+			m.OnPanic(queueName, _job.ID, panicked)
+		}
+		if m.panicPolicy != PanicFail {
+			panic(value)
+		}
+		output, err = nil, panicked
+	}()
+	return reg.process(ctx, _job)
+}
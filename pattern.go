@@ -0,0 +1,139 @@
+package magi
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/evanhuang8/magi/cluster"
+	"github.com/evanhuang8/magi/job"
+)
+
+// PatternScanInterval is the time between the scans of ProcessPattern for
+// the queues matching its pattern
+var PatternScanInterval = 5 * time.Second
+
+// ProcessPattern processes all the queues matching the glob pattern with the
+// processor, e.g. "user:*:tasks" for queues created per user, in a single
+// loop taking the queues in turn like ProcessWeighted with equal weights.
+// The queues are found by scanning the cluster every PatternScanInterval, so
+// that new queues join the rotation by the next scan, while the queues found
+// empty leave it until a scan finds them with jobs again. The processor is
+// registered for the queues found without one, and unregistered once a scan
+// finds them empty or no longer matching, so that a pattern matching many
+// short-lived queues does not pile up their registrations.
+//
+// It returns the error of the first scan without processing any queue.
+func (m *Magi) ProcessPattern(pattern string, processor Processor) error {
+	rotation := []string{}
+	registered := make(map[string]bool) // queues registered for the pattern
+	scan := func() error {
+		queues, err := m.dqCluster.ListQueues(pattern)
+		if err != nil {
+			return err
+		}
+		found := make(map[string]bool, len(queues))
+		next := make([]string, 0, len(queues))
+		for _, queueName := range queues {
+			if length, err := m.dqCluster.QueueLength(queueName); err == nil && length == 0 {
+				continue
+			}
+			found[queueName] = true
+			next = append(next, queueName)
+			if !m.hasProcessor(queueName) {
+				m.Register(queueName, processor)
+				registered[queueName] = true
+			}
+		}
+		for queueName := range registered {
+			if !found[queueName] {
+				m.Unregister(queueName)
+				delete(registered, queueName)
+			}
+		}
+		rotation = next
+		return nil
+	}
+	err := scan()
+	if err != nil {
+		return err
+	}
+	m.processing.Add(1)
+	defer m.processing.Done()
+	atomic.AddInt32(&m.isProcessing, 1)
+	defer atomic.AddInt32(&m.isProcessing, -1)
+	scanned := m.clock.Now()
+	scheduler := newWeightedScheduler(equalWeights(rotation))
+	options := &cluster.FetchOptions{
+		NoHang: true,
+	}
+	idle := 0 // number of consecutive rounds finding all the queues empty
+	for {
+		select {
+		case <-m.quit:
+			return nil
+		default:
+		}
+		if m.clock.Now().Sub(scanned) >= PatternScanInterval {
+			err = scan()
+			if err != nil {
+				m.logf("Error: %v", err)
+			} else {
+				scheduler = newWeightedScheduler(equalWeights(rotation))
+			}
+			scanned = m.clock.Now()
+		}
+		if !m.acquireWorker(nil) {
+			return nil
+		}
+		start := m.clock.Now()
+		var _job *job.Job
+		var queueName string
+		var slots chan struct{}
+		dropped := false
+		for i := 0; i < len(scheduler.queues) && _job == nil; i++ {
+			queueName = scheduler.next()
+			_job, slots = m.fetchTurn(queueName, options)
+			// Drop the queue from the rotation if it's empty, rather than
+			// held back by its breaker or concurrency limit
+			if _job == nil {
+				if length, err := m.dqCluster.QueueLength(queueName); err == nil && length == 0 {
+					rotation = withoutQueue(rotation, queueName)
+					dropped = true
+				}
+			}
+		}
+		if dropped {
+			scheduler = newWeightedScheduler(equalWeights(rotation))
+		}
+		if _job == nil {
+			m.releaseWorker(nil)
+			idle++
+			if !m.backoffWait(m.idleBackoff, idle, m.clock.Now().Sub(start)) {
+				return nil
+			}
+			continue
+		}
+		idle = 0
+		m.dispatch(queueName, _job, slots)
+	}
+}
+
+// equalWeights weights the queues equally
+func equalWeights(queues []string) map[string]int {
+	weights := make(map[string]int, len(queues))
+	for _, queueName := range queues {
+		weights[queueName] = 1
+	}
+	return weights
+}
+
+// withoutQueue returns the queues without the queue
+func withoutQueue(queues []string, queueName string) []string {
+	remaining := make([]string, 0, len(queues))
+	for _, name := range queues {
+		if name != queueName {
+			remaining = append(remaining, name)
+		}
+	}
+	return remaining
+}
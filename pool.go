@@ -0,0 +1,104 @@
+package magi
+
+import (
+	"sync/atomic"
+
+	"github.com/evanhuang8/magi/job"
+)
+
+// DefaultConcurrency is the default number of jobs processed at the same time
+var DefaultConcurrency = 1
+
+// SetConcurrency sets the number of jobs processed at the same time across
+// all queues, it must be called before processing starts
+func (m *Magi) SetConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	m.stopScaler()
+	m.workers = make(chan struct{}, n)
+	atomic.StoreInt32(&m.activeWorkers, 0)
+}
+
+// RegisterWithConcurrency adds a processor for a queue, processing at most
+// maxConcurrency jobs of the queue at the same time, within the limit of the
+// worker pool. A maxConcurrency of 1 processes the jobs of the queue one at a time.
+func (m *Magi) RegisterWithConcurrency(queueName string, processor Processor, maxConcurrency int) {
+	m.Register(queueName, processor)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.queueSlots == nil {
+		m.queueSlots = make(map[string]chan struct{})
+	}
+	if maxConcurrency > 0 {
+		m.queueSlots[queueName] = make(chan struct{}, maxConcurrency)
+	} else {
+		delete(m.queueSlots, queueName)
+	}
+}
+
+// PoolUtilization returns the fraction of workers busy processing jobs
+func (m *Magi) PoolUtilization() float64 {
+	workers := m.Workers()
+	if workers == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt32(&m.busy)) / float64(workers)
+}
+
+// acquireWorker takes a slot of the queue, if the queue's concurrency is
+// limited, and then a worker slot, blocking until both are available or
+// processing is shut down
+func (m *Magi) acquireWorker(slots chan struct{}) bool {
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		case <-m.quit:
+			return false
+		}
+	}
+	select {
+	case m.workers <- struct{}{}:
+		return true
+	default:
+	}
+	// All workers are busy
+	if m.OnPoolSaturated != nil {
+		m.OnPoolSaturated()
+	}
+	select {
+	case m.workers <- struct{}{}:
+		return true
+	case <-m.quit:
+		if slots != nil {
+			<-slots
+		}
+		return false
+	}
+}
+
+// releaseWorker gives back the worker slot and the slot of the queue
+func (m *Magi) releaseWorker(slots chan struct{}) {
+	<-m.workers
+	if slots != nil {
+		<-slots
+	}
+}
+
+// dispatch processes the job on the acquired worker slot
+func (m *Magi) dispatch(queueName string, _job *job.Job, slots chan struct{}) {
+	atomic.AddInt32(&m.busy, 1)
+	m.processing.Add(1)
+	go func() {
+		defer m.processing.Done()
+		// Free the worker slot even if processing panics
+		defer func() {
+			busy := atomic.AddInt32(&m.busy, -1)
+			m.releaseWorker(slots)
+			if busy == 0 && m.OnPoolIdle != nil {
+				m.OnPoolIdle()
+			}
+		}()
+		m.process(queueName, _job)
+	}()
+}
@@ -0,0 +1,99 @@
+package magi
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/evanhuang8/magi/job"
+)
+
+// SetPrefetch sets the number of jobs a processing loop fetches ahead of the
+// workers, so that a worker never waits on a fetch. At most n jobs are held
+// in memory waiting for a worker, and fetching pauses while they are. Zero,
+// the default, fetches a job only once a worker is free. It must be called
+// before processing starts.
+//
+// Prefetched jobs are not extended in disque until they're processed, so the
+// buffer should be drained well within the retry of the queue's jobs.
+func (m *Magi) SetPrefetch(n int) {
+	if n < 0 {
+		n = 0
+	}
+	m.prefetch = n
+}
+
+// prefetcher buffers the jobs fetched by a processing loop until a worker is free
+type prefetcher struct {
+	queueName string
+	slots     chan struct{}
+	tokens    chan struct{} // held by each job fetched but not yet handed to a worker
+	jobs      chan *job.Job
+	window    time.Duration // time the jobs are held to be put in order, see SetOrderingWindow
+}
+
+// newPrefetcher starts handing the jobs buffered for the queue to the workers
+func (m *Magi) newPrefetcher(queueName string, slots chan struct{}, n int, window time.Duration) *prefetcher {
+	p := &prefetcher{
+		queueName: queueName,
+		slots:     slots,
+		tokens:    make(chan struct{}, n),
+		jobs:      make(chan *job.Job, n),
+		window:    window,
+	}
+	m.processing.Add(1)
+	go func() {
+		defer m.processing.Done()
+		if window > 0 {
+			m.runOrdered(p)
+		} else {
+			m.runPrefetcher(p)
+		}
+	}()
+	return p
+}
+
+// acquirePrefetch takes a place in the buffer for a job to be fetched, blocking until
+// one is free or processing is shut down
+func (m *Magi) acquirePrefetch(p *prefetcher) bool {
+	select {
+	case p.tokens <- struct{}{}:
+		atomic.AddInt32(&m.prefetched, 1)
+		return true
+	case <-m.quit:
+		return false
+	}
+}
+
+// releasePrefetch gives back the place of a job in the buffer
+func (m *Magi) releasePrefetch(p *prefetcher) {
+	atomic.AddInt32(&m.prefetched, -1)
+	<-p.tokens
+}
+
+// runPrefetcher dispatches the buffered jobs as workers become free, until
+// the buffer is closed. Jobs still buffered on shutdown are nacked, so that
+// they're redelivered right away.
+func (m *Magi) runPrefetcher(p *prefetcher) {
+	for _job := range p.jobs {
+		m.handOver(p, _job)
+	}
+}
+
+// handOver dispatches the buffered job once a worker is free, or nacks it if
+// processing is shut down in the meantime
+func (m *Magi) handOver(p *prefetcher, _job *job.Job) {
+	if !m.acquireWorker(p.slots) {
+		m.releasePrefetch(p)
+		m.nackBuffered(p, _job)
+		return
+	}
+	m.releasePrefetch(p)
+	m.dispatch(p.queueName, _job, p.slots)
+}
+
+// nackBuffered puts back a buffered job, so that it's redelivered right away
+func (m *Magi) nackBuffered(p *prefetcher, _job *job.Job) {
+	if m.dqCluster.Nack(_job.ID) == nil {
+		m.emitJob(EventNacked, p.queueName, _job, nil)
+	}
+}
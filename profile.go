@@ -0,0 +1,59 @@
+package magi
+
+import (
+	"sync/atomic"
+)
+
+// MemoryProfile reports the sizes of the buffers of a Magi instance along
+// with their capacities. The buffers are bounded:
+//
+//   - events beyond the capacity of the buffer are dropped, see
+//     WithEventBufferSize
+//   - the least recently processed ids are forgotten, see
+//     SetProcessedHistorySize
+//   - jobs beyond the capacity of held jobs are nacked instead of processed,
+//     if one is set with SetMaxHeldJobs
+//   - no job is fetched ahead of the workers beyond the prefetch, see
+//     SetPrefetch
+//
+// The failed attempts kept by a MemoryRetryTracker have no capacity, they're
+// forgotten once the job succeeds or is dead lettered.
+//
+// A capacity of -1 means unlimited.
+type MemoryProfile struct {
+	Events                   int // events waiting for the subscriber
+	EventsCapacity           int // events buffered before new ones are dropped
+	DroppedEvents            int // events dropped since the instance is created
+	ProcessedHistory         int // processed job ids remembered
+	ProcessedHistoryCapacity int // processed job ids remembered at most
+	HeldJobs                 int // jobs held for a manual ack
+	HeldJobsCapacity         int // jobs held for a manual ack at most
+	Prefetched               int // jobs fetched ahead and waiting for a worker
+	PrefetchCapacity         int // jobs fetched ahead at most
+	InFlight                 int // jobs being processed
+	RetryTracked             int // jobs whose failed attempts are kept in memory, see MemoryRetryTracker
+}
+
+// MemoryProfile returns the current sizes of the buffers of the instance
+func (m *Magi) MemoryProfile() MemoryProfile {
+	profile := MemoryProfile{
+		Events:           len(m.events),
+		EventsCapacity:   cap(m.events),
+		DroppedEvents:    int(atomic.LoadInt32(&m.droppedEvents)),
+		Prefetched:       int(atomic.LoadInt32(&m.prefetched)),
+		PrefetchCapacity: m.prefetch,
+		InFlight:         int(atomic.LoadInt32(&m.busy)),
+	}
+	profile.ProcessedHistory, profile.ProcessedHistoryCapacity = m.history.len()
+	m.held.mutex.Lock()
+	profile.HeldJobs = len(m.held.jobs)
+	profile.HeldJobsCapacity = m.held.limit()
+	m.held.mutex.Unlock()
+	if profile.HeldJobsCapacity < 0 {
+		profile.HeldJobsCapacity = -1
+	}
+	if tracker, ok := m.retryTracker.(*MemoryRetryTracker); ok {
+		profile.RetryTracked = tracker.Len()
+	}
+	return profile
+}
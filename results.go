@@ -0,0 +1,102 @@
+package magi
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/evanhuang8/magi/job"
+)
+
+// ResultPollInterval is the interval at which AddJobAndWait checks for the result of the job
+var ResultPollInterval = 50 * time.Millisecond
+
+var (
+	// ErrNoResultStorage is the error for waiting on a job without a redis cluster to read the result from
+	ErrNoResultStorage = errors.New("Magi Error: waiting for results requires a redis cluster!")
+	// ErrResultTimeout is the error for a job not processed before the timeout
+	ErrResultTimeout = errors.New("Magi Error: timed out waiting for the job result!")
+)
+
+// storedResult is the result of processing a job, as stored in redis
+type storedResult struct {
+	Result interface{} `json:",omitempty"`
+	Error  string      `json:",omitempty"`
+}
+
+// SetResultStorage stores the results of the processed jobs in the redis
+// cluster for the ttl, for producers waiting on them with AddJobAndWait. The
+// result returned by a processor must be encodable to JSON. A zero ttl, the
+// default, disables the storage.
+func (m *Magi) SetResultStorage(ttl time.Duration) {
+	m.resultTTL = ttl
+}
+
+// storeResult stores the result of processing the job if the storage is
+// enabled. Errors are only stored once they're final, i.e. when the job is
+// not going to be retried.
+func (m *Magi) storeResult(_job *job.Job, output interface{}, err error, final bool) {
+	if m.resultTTL <= 0 || m.rCluster == nil || (err != nil && !final) {
+		return
+	}
+	stored := &storedResult{
+		Result: output,
+	}
+	if err != nil {
+		stored.Result = nil
+		stored.Error = err.Error()
+	}
+	data, e := json.Marshal(stored)
+	if e != nil {
+		// Keep the outcome of the job even if its result can not be encoded
+		data, _ = json.Marshal(&storedResult{
+			Error: stored.Error,
+		})
+	}
+	m.rCluster.Set(resultKey(_job.ID), string(data), m.resultTTL)
+}
+
+// AddJobAndWait adds a job to the queue and blocks until it's processed,
+// returning the result of processing it, or the error returned by the
+// processor. The result is decoded from JSON, so structs are returned as
+// maps and numbers as float64.
+//
+// It requires a producer with a redis cluster, see IndexedProducer, and the
+// consumers of the queue to store results with SetResultStorage, otherwise it
+// waits until the timeout and fails with ErrResultTimeout.
+func (m *Magi) AddJobAndWait(queueName string, body string, timeout time.Duration) (interface{}, error) {
+	if m.rCluster == nil {
+		return nil, ErrNoResultStorage
+	}
+	start := m.clock.Now()
+	_job, err := m.AddJob(queueName, body, start, nil)
+	if err != nil {
+		return nil, err
+	}
+	key := resultKey(_job.ID)
+	for {
+		data, err := m.rCluster.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if data != "" {
+			stored := &storedResult{}
+			err = json.Unmarshal([]byte(data), stored)
+			if err != nil {
+				return nil, err
+			}
+			if stored.Error != "" {
+				return nil, errors.New(stored.Error)
+			}
+			return stored.Result, nil
+		}
+		if m.clock.Now().Sub(start) >= timeout {
+			return nil, ErrResultTimeout
+		}
+		<-m.clock.After(ResultPollInterval)
+	}
+}
+
+func resultKey(id string) string {
+	return "result:" + id
+}
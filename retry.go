@@ -0,0 +1,246 @@
+package magi
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/evanhuang8/magi/backoff"
+	"github.com/evanhuang8/magi/clock"
+	"github.com/evanhuang8/magi/cluster"
+	"github.com/evanhuang8/magi/job"
+)
+
+// RetryPolicy describes how the failed jobs of a queue are retried
+type RetryPolicy struct {
+	MaxAttempts     int           // attempts before the job is routed to the dead letter queue
+	InitialDelay    time.Duration // delay before the first retry
+	MaxDelay        time.Duration // upper bound of the delay, no bound if zero
+	Factor          float64       // growth factor of the delay between attempts, 2 if zero
+	DeadLetterQueue string        // queue receiving the exhausted jobs, <queue>:dlq if empty
+	// Backoff overrides the exponential delay described by the fields above
+	Backoff backoff.Backoff
+}
+
+// Delay returns the delay before the given attempt is retried, starting from 1
+func (policy *RetryPolicy) Delay(attempt int) time.Duration {
+	if policy.Backoff != nil {
+		return policy.Backoff.Next(attempt)
+	}
+	return backoff.NewExponential(policy.InitialDelay, policy.MaxDelay, policy.Factor).Next(attempt)
+}
+
+// deadLetterQueue returns the name of the dead letter queue for the queue
+func (policy *RetryPolicy) deadLetterQueue(queueName string) string {
+	if policy.DeadLetterQueue != "" {
+		return policy.DeadLetterQueue
+	}
+	return queueName + ":dlq"
+}
+
+// SetRetryPolicy sets the retry policy for the failed jobs of a queue.
+// Instead of letting disque redeliver a failed job on its fixed retry timer,
+// the job is re-enqueued with a delay growing with the number of attempts,
+// and routed to the dead letter queue after the maximum attempts.
+func (m *Magi) SetRetryPolicy(queueName string, policy RetryPolicy) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.retryPolicies == nil {
+		m.retryPolicies = make(map[string]*RetryPolicy)
+	}
+	m.retryPolicies[queueName] = &policy
+}
+
+// RetryTracker keeps track of the failed attempts of jobs, independently of
+// the job's body, so that the counts survive disque redelivering a job
+type RetryTracker interface {
+	Increment(id string) (int, error)
+	Count(id string) (int, error)
+	Reset(id string) error
+}
+
+// DefaultRetryTrackerTTL is the time failed attempts are remembered for
+var DefaultRetryTrackerTTL = 24 * time.Hour
+
+// RedisRetryTracker keeps track of failed attempts in the redis cluster
+type RedisRetryTracker struct {
+	cluster cluster.LockBackend
+	ttl     time.Duration
+}
+
+// NewRedisRetryTracker creates a retry tracker keeping counts in the redis cluster for the ttl
+func NewRedisRetryTracker(cluster cluster.LockBackend, ttl time.Duration) *RedisRetryTracker {
+	return &RedisRetryTracker{
+		cluster: cluster,
+		ttl:     ttl,
+	}
+}
+
+// Increment increments the failed attempts of the job
+func (tracker *RedisRetryTracker) Increment(id string) (int, error) {
+	return tracker.cluster.Incr(retriesKey(id), tracker.ttl)
+}
+
+// Count returns the failed attempts of the job
+func (tracker *RedisRetryTracker) Count(id string) (int, error) {
+	value, err := tracker.cluster.Get(retriesKey(id))
+	if err != nil || value == "" {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// Reset clears the failed attempts of the job
+func (tracker *RedisRetryTracker) Reset(id string) error {
+	return tracker.cluster.Del(retriesKey(id))
+}
+
+func retriesKey(id string) string {
+	return "retries:" + id
+}
+
+// MemoryRetryTracker keeps track of failed attempts in memory, for setups
+// with a single consumer. Like in redis, the attempts of a job are forgotten
+// once the ttl has passed since its last failure, so that the jobs that
+// vanish before they succeed or are dead-lettered are not kept for good.
+type MemoryRetryTracker struct {
+	TTL   time.Duration // time failed attempts are remembered for, forever if zero
+	Clock clock.Clock
+
+	counts map[string]*retryCount
+	mutex  sync.Mutex
+}
+
+// retryCount is the failed attempts of a job kept in memory
+type retryCount struct {
+	attempts  int
+	expiresAt time.Time // never if zero
+}
+
+// NewMemoryRetryTracker creates a retry tracker keeping counts in memory for DefaultRetryTrackerTTL
+func NewMemoryRetryTracker() *MemoryRetryTracker {
+	return &MemoryRetryTracker{
+		TTL:    DefaultRetryTrackerTTL,
+		Clock:  clock.New(),
+		counts: make(map[string]*retryCount),
+	}
+}
+
+// Increment increments the failed attempts of the job
+func (tracker *MemoryRetryTracker) Increment(id string) (int, error) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	now := tracker.Clock.Now()
+	count := tracker.count(id, now)
+	if count == nil {
+		// Forget the expired attempts as new jobs are tracked
+		tracker.evict(now)
+		count = &retryCount{}
+		tracker.counts[id] = count
+	}
+	count.attempts++
+	if tracker.TTL > 0 {
+		count.expiresAt = now.Add(tracker.TTL)
+	}
+	return count.attempts, nil
+}
+
+// Count returns the failed attempts of the job
+func (tracker *MemoryRetryTracker) Count(id string) (int, error) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	count := tracker.count(id, tracker.Clock.Now())
+	if count == nil {
+		return 0, nil
+	}
+	return count.attempts, nil
+}
+
+// Reset clears the failed attempts of the job
+func (tracker *MemoryRetryTracker) Reset(id string) error {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	delete(tracker.counts, id)
+	return nil
+}
+
+// Len returns the number of jobs whose failed attempts are kept
+func (tracker *MemoryRetryTracker) Len() int {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.evict(tracker.Clock.Now())
+	return len(tracker.counts)
+}
+
+// count returns the attempts of the job unless they expired, must be called
+// with the mutex held
+func (tracker *MemoryRetryTracker) count(id string, now time.Time) *retryCount {
+	count, exists := tracker.counts[id]
+	if !exists || count.expired(now) {
+		return nil
+	}
+	return count
+}
+
+// evict forgets the expired attempts, must be called with the mutex held
+func (tracker *MemoryRetryTracker) evict(now time.Time) {
+	for id, count := range tracker.counts {
+		if count.expired(now) {
+			delete(tracker.counts, id)
+		}
+	}
+}
+
+func (count *retryCount) expired(now time.Time) bool {
+	return !count.expiresAt.IsZero() && !count.expiresAt.After(now)
+}
+
+// SetRetryTracker sets where the failed attempts of jobs are kept, which is
+// the redis cluster by default
+func (m *Magi) SetRetryTracker(tracker RetryTracker) {
+	m.retryTracker = tracker
+}
+
+// retryKey returns the id the attempts of the job are tracked under, which
+// is the id of the job first added, since retried jobs are added again
+func retryKey(_job *job.Job) string {
+	if origin := _job.Headers[job.HeaderOriginID]; origin != "" {
+		return origin
+	}
+	return _job.ID
+}
+
+// retry re-enqueues the failed job according to the policy
+func (m *Magi) retry(queueName string, _job *job.Job, policy *RetryPolicy) error {
+	key := retryKey(_job)
+	attempts, err := m.retryTracker.Increment(key)
+	if err != nil {
+		return err
+	}
+	headers := make(map[string]string, len(_job.Headers)+2)
+	for key, value := range _job.Headers {
+		headers[key] = value
+	}
+	headers[job.HeaderAttempts] = strconv.Itoa(attempts)
+	headers[job.HeaderOriginID] = key
+	now := m.clock.Now()
+	if attempts >= policy.MaxAttempts {
+		err = m.requeue(policy.deadLetterQueue(queueName), _job, headers, now)
+		if err != nil {
+			return err
+		}
+		return m.retryTracker.Reset(key)
+	}
+	return m.requeue(queueName, _job, headers, now.Add(policy.Delay(attempts)))
+}
+
+// requeue adds the body of the job to the queue again with the headers
+func (m *Magi) requeue(queueName string, _job *job.Job, headers map[string]string, ETA time.Time) error {
+	var requeued *job.Job
+	if _job.IsBinary() {
+		requeued = job.NewBytes(queueName, _job.RawBody(), headers, ETA, m.clock.Now())
+	} else {
+		requeued = job.New(queueName, _job.Body, headers, ETA, m.clock.Now())
+	}
+	return m.addJob(requeued, nil)
+}
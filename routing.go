@@ -0,0 +1,33 @@
+package magi
+
+import (
+	"github.com/evanhuang8/magi/job"
+)
+
+// RoutingProcessor is an optional interface for processors taking only some
+// of the jobs of their queue, e.g. the jobs of their shard as told by a
+// header, so that a pool of different workers can share a queue. A job
+// ShouldProcess turns down is nacked before its lock is taken, for another
+// worker to take it, with a rejected event, and does not count as processed.
+//
+// Disque redelivers a nacked job right away, possibly to the same worker, so
+// a queue should not hold many jobs no worker takes.
+type RoutingProcessor interface {
+	Processor
+	ShouldProcess(*job.Job) bool
+}
+
+// reject puts the job back into its queue if the processor turns it down,
+// returning whether it did
+func (m *Magi) reject(queueName string, reg *registration, _job *job.Job) bool {
+	processor, ok := reg.processor.(RoutingProcessor)
+	if !ok || processor.ShouldProcess(_job) {
+		return false
+	}
+	err := m.dqCluster.Nack(_job.ID)
+	if err != nil {
+		m.jobLogf(_job, "Error: %v", err)
+	}
+	m.emitJob(EventRejected, queueName, _job, err)
+	return true
+}
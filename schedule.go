@@ -0,0 +1,225 @@
+package magi
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/evanhuang8/magi/cluster"
+	"github.com/evanhuang8/magi/cron"
+	"github.com/evanhuang8/magi/lock"
+)
+
+// CatchUpPolicy decides what happens to the ticks of a schedule missed while
+// no scheduler was running
+type CatchUpPolicy int
+
+const (
+	// CatchUpNone skips the missed ticks, like the classic cron
+	CatchUpNone CatchUpPolicy = iota
+	// CatchUpOnce enqueues a single job for all the missed ticks
+	CatchUpOnce
+	// CatchUpAll enqueues a job for every missed tick, up to MaxCatchUpTicks
+	CatchUpAll
+)
+
+var (
+	// SchedulerInterval is the time between the checks of the scheduler
+	SchedulerInterval = time.Second
+	// MaxCatchUpTicks is the most jobs enqueued for the missed ticks of a schedule
+	MaxCatchUpTicks = 100
+	// ScheduleHistoryTTL is the time the last tick of a schedule is remembered for
+	ScheduleHistoryTTL = 30 * 24 * time.Hour
+	// ScheduleTickLockDuration is the time a tick is claimed by a scheduler for
+	ScheduleTickLockDuration = time.Hour
+)
+
+// ErrScheduleNoRedis is the error for managing schedules without a redis cluster
+var ErrScheduleNoRedis = errors.New("Magi Error: schedules require a redis cluster!")
+
+// schedulesKey is the redis hash holding all the schedules
+const schedulesKey = "schedules"
+
+// schedule is a recurring job stored in redis
+type schedule struct {
+	ID        string
+	QueueName string
+	Body      string
+	Cron      string
+	Config    *cluster.DisqueOpConfig `json:",omitempty"`
+	CreatedAt time.Time
+}
+
+// Schedule stores a recurring job, added to the queue at every tick of the
+// cron expression by the consumers running RunScheduler. Scheduling the same
+// job twice has no effect, and the id returned can be used to unschedule it.
+func (m *Magi) Schedule(queueName string, body string, cronExpr string, config *cluster.DisqueOpConfig) (string, error) {
+	if m.rCluster == nil {
+		return "", ErrScheduleNoRedis
+	}
+	if _, err := cron.Parse(cronExpr); err != nil {
+		return "", err
+	}
+	hash := sha1.Sum([]byte(queueName + "\n" + cronExpr + "\n" + body))
+	s := &schedule{
+		ID:        hex.EncodeToString(hash[:]),
+		QueueName: queueName,
+		Body:      body,
+		Cron:      cronExpr,
+		Config:    config,
+		CreatedAt: m.clock.Now(),
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	_, err = m.rCluster.HSet(schedulesKey, s.ID, string(data))
+	if err != nil {
+		return "", err
+	}
+	return s.ID, nil
+}
+
+// Unschedule removes the recurring job with the id
+func (m *Magi) Unschedule(id string) error {
+	if m.rCluster == nil {
+		return ErrScheduleNoRedis
+	}
+	err := m.rCluster.HDel(schedulesKey, id)
+	if err != nil {
+		return err
+	}
+	return m.rCluster.Del(scheduleLastKey(id))
+}
+
+// SetCatchUpPolicy sets how the scheduler handles the ticks missed while it was down
+func (m *Magi) SetCatchUpPolicy(policy CatchUpPolicy) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.catchUpPolicy = policy
+}
+
+// RunScheduler enqueues the scheduled jobs at their ticks until shutdown.
+// Several consumers can run the scheduler, each tick is only enqueued once.
+func (m *Magi) RunScheduler() error {
+	if m.rCluster == nil {
+		return ErrScheduleNoRedis
+	}
+	m.processing.Add(1)
+	defer m.processing.Done()
+	ticker := m.clock.NewTicker(SchedulerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.quit:
+			return nil
+		case <-ticker.C():
+			err := m.runSchedules()
+			if err != nil {
+				m.logf("Error: %v", err)
+			}
+		}
+	}
+}
+
+// runSchedules enqueues the jobs of the schedules that are due
+func (m *Magi) runSchedules() error {
+	schedules, err := m.rCluster.HGetAll(schedulesKey)
+	if err != nil {
+		return err
+	}
+	for _, data := range schedules {
+		var s schedule
+		err := json.Unmarshal([]byte(data), &s)
+		if err != nil {
+			m.logf("Error: %v", err)
+			continue
+		}
+		err = m.runSchedule(&s)
+		if err != nil {
+			m.logf("Error: %v", err)
+		}
+	}
+	return nil
+}
+
+// runSchedule enqueues the jobs for the ticks of the schedule since the last run
+func (m *Magi) runSchedule(s *schedule) error {
+	expr, err := cron.Parse(s.Cron)
+	if err != nil {
+		return err
+	}
+	last := s.CreatedAt
+	value, err := m.rCluster.Get(scheduleLastKey(s.ID))
+	if err != nil {
+		return err
+	}
+	if value != "" {
+		last, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return err
+		}
+	}
+	now := m.clock.Now()
+	ticks := []time.Time{}
+	for tick := expr.Next(last); !tick.IsZero() && !tick.After(now); tick = expr.Next(tick) {
+		ticks = append(ticks, tick)
+	}
+	if len(ticks) == 0 {
+		return nil
+	}
+	latest := ticks[len(ticks)-1]
+	m.mutex.RLock()
+	policy := m.catchUpPolicy
+	m.mutex.RUnlock()
+	// Ticks further behind than the scheduler checks are missed ticks
+	due := []time.Time{}
+	for _, tick := range ticks {
+		if now.Sub(tick) <= 2*SchedulerInterval {
+			due = append(due, tick)
+		}
+	}
+	switch policy {
+	case CatchUpOnce:
+		due = []time.Time{latest}
+	case CatchUpAll:
+		due = ticks
+		if len(due) > MaxCatchUpTicks {
+			due = due[len(due)-MaxCatchUpTicks:]
+		}
+	}
+	for _, tick := range due {
+		err = m.enqueueTick(s, tick)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = m.rCluster.Set(scheduleLastKey(s.ID), latest.Format(time.RFC3339), ScheduleHistoryTTL)
+	return err
+}
+
+// enqueueTick adds the job for the tick, unless another scheduler already did
+func (m *Magi) enqueueTick(s *schedule, tick time.Time) error {
+	_lock := lock.CreateLock(m.rCluster, fmt.Sprintf("schedule:%s:%d", s.ID, tick.Unix()))
+	_lock.Duration = ScheduleTickLockDuration
+	result, err := _lock.Get(false)
+	if err != nil && err != lock.ErrLockFailedAfterMaxAttempts {
+		return err
+	}
+	if !result {
+		return nil
+	}
+	_, err = m.AddJob(s.QueueName, s.Body, m.clock.Now(), s.Config)
+	if err != nil {
+		// Let the tick be claimed again
+		_lock.Release()
+	}
+	return err
+}
+
+func scheduleLastKey(id string) string {
+	return "schedule:last:" + id
+}
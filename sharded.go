@@ -0,0 +1,61 @@
+package magi
+
+import (
+	"errors"
+	"hash/crc32"
+	"strconv"
+	"time"
+
+	"github.com/evanhuang8/magi/cluster"
+	"github.com/evanhuang8/magi/job"
+)
+
+// ErrInvalidShards is the error for sharding a queue in less than one shard
+var ErrInvalidShards = errors.New("Magi Error: the number of shards must be positive!")
+
+// ShardQueue returns the shard of the base queue the key belongs to, of the
+// form "<baseQueue>:shard<N>" with N from 0 to shards-1. A key always maps
+// to the same shard as long as the number of shards does not change.
+func ShardQueue(baseQueue string, shards int, key string) string {
+	shard := crc32.ChecksumIEEE([]byte(key)) % uint32(shards)
+	return baseQueue + ":shard" + strconv.Itoa(int(shard))
+}
+
+// shardQueues returns all the shards of the base queue
+func shardQueues(baseQueue string, shards int) []string {
+	queues := make([]string, shards)
+	for i := range queues {
+		queues[i] = baseQueue + ":shard" + strconv.Itoa(i)
+	}
+	return queues
+}
+
+// AddJobSharded adds a job to one of the shards of the base queue, spreading
+// the load of a busy queue over several queues, and so over the nodes owning
+// them. The shard is picked by the hash of the key, or of the body if the
+// key is empty, so that the related jobs sharing a key land on the same
+// shard. The shards are processed with ProcessSharded.
+func (m *Magi) AddJobSharded(baseQueue string, shards int, key string, body string, ETA time.Time, config *cluster.DisqueOpConfig) (*job.Job, error) {
+	if shards < 1 {
+		return nil, ErrInvalidShards
+	}
+	if key == "" {
+		key = body
+	}
+	return m.AddJob(ShardQueue(baseQueue, shards, key), body, ETA, config)
+}
+
+// ProcessSharded processes all the shards of the base queue with the
+// processor, in a single loop taking the shards in turn like ProcessWeighted
+// with equal weights. The processor is registered for every shard. It runs
+// until the instance is closed.
+func (m *Magi) ProcessSharded(baseQueue string, shards int, processor Processor) error {
+	if shards < 1 {
+		return ErrInvalidShards
+	}
+	queues := shardQueues(baseQueue, shards)
+	for _, queueName := range queues {
+		m.Register(queueName, processor)
+	}
+	return m.ProcessWeighted(equalWeights(queues))
+}
@@ -0,0 +1,111 @@
+package magi
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// DefaultShutdownGracePeriod is the default time given to in-flight jobs to finish on shutdown
+var DefaultShutdownGracePeriod = 30 * time.Second
+
+// ErrShutdownTimeout is the error for in-flight jobs not finishing within the grace period
+var ErrShutdownTimeout = errors.New("Magi Error: jobs did not finish within the shutdown grace period!")
+
+// SetShutdownGracePeriod sets the time given to in-flight jobs to finish on RunUntilSignal
+func (m *Magi) SetShutdownGracePeriod(grace time.Duration) {
+	m.shutdownGrace = grace
+}
+
+// ShutdownCancelTimeout is the time given to the jobs cancelled on shutdown
+// to return and release their locks
+var ShutdownCancelTimeout = 5 * time.Second
+
+// Shutdown stops fetching new jobs, waits up to the grace period for the
+// jobs being processed to finish, and then closes all connections. Jobs
+// still running after the grace period have their context cancelled, see
+// ContextProcessor, and are left for redelivery.
+func (m *Magi) Shutdown(grace time.Duration) error {
+	m.quitOnce.Do(func() {
+		close(m.quit)
+	})
+	done := make(chan struct{})
+	go func() {
+		m.processing.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-m.clock.After(grace):
+		err = ErrShutdownTimeout
+		m.cancelOnce.Do(func() {
+			close(m.cancelled)
+		})
+		select {
+		case <-done:
+		case <-m.clock.After(ShutdownCancelTimeout):
+		}
+	}
+	closeErr := m.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// RunUntilSignal processes the queues until one of the signals is received,
+// then shuts down gracefully. SIGINT and SIGTERM are used if no signal is given.
+// It returns ErrNoProcessor without processing any queue if one of them has no
+// registered processor.
+func (m *Magi) RunUntilSignal(queues []string, signals ...os.Signal) error {
+	for _, queueName := range queues {
+		if !m.hasProcessor(queueName) {
+			return ErrNoProcessor
+		}
+	}
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+	defer signal.Stop(c)
+	for _, queueName := range queues {
+		go m.Process(queueName)
+	}
+	<-c
+	return m.Shutdown(m.shutdownGrace)
+}
+
+// ProcessGroup processes the queues, each in its own loop, until the context
+// is done or one of the loops stops, then shuts down gracefully like
+// RunUntilSignal, and returns the error of the loop that stopped, if any, or
+// else the error of the shutdown. It returns ErrNoProcessor without
+// processing any queue if one of them has no registered processor. It fits
+// in the goroutines of an errgroup.Group, whose context cancels it.
+func (m *Magi) ProcessGroup(ctx context.Context, queues ...string) error {
+	for _, queueName := range queues {
+		if !m.hasProcessor(queueName) {
+			return ErrNoProcessor
+		}
+	}
+	stopped := make(chan error, len(queues))
+	for _, queueName := range queues {
+		go func(queueName string) {
+			stopped <- m.Process(queueName)
+		}(queueName)
+	}
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-stopped:
+	}
+	shutdownErr := m.Shutdown(m.shutdownGrace)
+	if err != nil {
+		return err
+	}
+	return shutdownErr
+}
@@ -0,0 +1,41 @@
+package magi
+
+import (
+	"runtime/debug"
+)
+
+// StatefulProcessor is an optional interface for processors keeping their
+// own metrics, e.g. counters of the jobs they processed. Magi calls OnSuccess
+// or OnFailure exactly once per job after Process returns, with the error of
+// Process, or with a *PanicError if it panicked, before the panic is handled
+// per the panic policy.
+type StatefulProcessor interface {
+	Processor
+	OnSuccess()
+	OnFailure(error)
+}
+
+// processStateful runs the processor on the job, reporting the outcome to it
+func processStateful(processor StatefulProcessor, run func() (interface{}, error)) (output interface{}, err error) {
+	reported := false
+	defer func() {
+		if reported {
+			return
+		}
+		if value := recover(); value != nil {
+			processor.OnFailure(&PanicError{
+				Value: value,
+				Stack: debug.Stack(),
+			})
+			panic(value)
+		}
+	}()
+	output, err = run()
+	reported = true
+	if err != nil {
+		processor.OnFailure(err)
+	} else {
+		processor.OnSuccess()
+	}
+	return output, err
+}
@@ -0,0 +1,75 @@
+package magi
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/evanhuang8/magi/job"
+)
+
+// Stats is a snapshot of the state of a Magi instance
+type Stats struct {
+	Busy            int                      // workers busy processing jobs
+	PoolUtilization float64                  // fraction of workers busy processing jobs
+	Breakers        map[string]BreakerState  // state of the circuit breakers by queue
+	Prefetched      int                      // jobs fetched ahead and waiting for a worker
+	Workers         int                      // workers of the pool
+	QueueLatency    map[string]time.Duration // time the last job fetched waited in the queue, by queue
+	Fetches         map[string]FetchStats    // outcomes of the fetches, by queue
+}
+
+// FetchStats counts the outcomes of the fetches of a queue by the processing
+// loops. Many empty fetches tell that the workers are starved, and few of
+// them that the workers are saturated and the queue backs up.
+type FetchStats struct {
+	Jobs   int // fetches receiving a job
+	Empty  int // fetches finding the queue empty, right away or at the blocking timeout
+	Errors int // fetches failing
+}
+
+// Stats returns a snapshot of the state of the instance
+func (m *Magi) Stats() Stats {
+	stats := Stats{
+		Busy:            int(atomic.LoadInt32(&m.busy)),
+		PoolUtilization: m.PoolUtilization(),
+		Breakers:        make(map[string]BreakerState),
+		Prefetched:      int(atomic.LoadInt32(&m.prefetched)),
+		Workers:         m.Workers(),
+		QueueLatency:    make(map[string]time.Duration),
+		Fetches:         make(map[string]FetchStats),
+	}
+	m.mutex.RLock()
+	for queueName, breaker := range m.breakers {
+		stats.Breakers[queueName] = breaker.current()
+	}
+	for queueName, latency := range m.latencies {
+		stats.QueueLatency[queueName] = latency
+	}
+	for queueName, fetches := range m.fetches {
+		stats.Fetches[queueName] = *fetches
+	}
+	m.mutex.RUnlock()
+	return stats
+}
+
+// countFetch counts the outcome of a fetch from the queue
+func (m *Magi) countFetch(queueName string, _job *job.Job, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.fetches == nil {
+		m.fetches = make(map[string]*FetchStats)
+	}
+	fetches := m.fetches[queueName]
+	if fetches == nil {
+		fetches = &FetchStats{}
+		m.fetches[queueName] = fetches
+	}
+	switch {
+	case err != nil:
+		fetches.Errors++
+	case _job != nil:
+		fetches.Jobs++
+	default:
+		fetches.Empty++
+	}
+}
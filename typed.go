@@ -0,0 +1,55 @@
+//go:build go1.18
+// +build go1.18
+
+package magi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/evanhuang8/magi/job"
+)
+
+// ErrJobDecode is the error for a job whose payload can not be decoded by a typed processor
+var ErrJobDecode = errors.New("Magi Error: fail to decode the job payload!")
+
+// TypedProcessor is a processor handing the payload of the jobs, decoded to
+// T, to a typed handler. Jobs failing to decode are failed with an error
+// wrapping ErrJobDecode, without reaching the handler.
+type TypedProcessor[T any] struct {
+	Decode    func(*job.Job) (T, error) // decodes the payload of a job
+	Handle    func(T) error             // processes a decoded payload
+	AutoRenew bool                      // whether the lock on the jobs is auto renewed
+}
+
+// Process decodes the payload of the job and hands it to the handler
+func (p *TypedProcessor[T]) Process(_job *job.Job) (interface{}, error) {
+	payload, err := p.Decode(_job)
+	if err != nil {
+		return nil, fmt.Errorf("%w (%v)", ErrJobDecode, err)
+	}
+	return nil, p.Handle(payload)
+}
+
+// ShouldAutoRenew returns whether the lock on the job is auto renewed
+func (p *TypedProcessor[T]) ShouldAutoRenew(_job *job.Job) bool {
+	return p.AutoRenew
+}
+
+// RegisterTyped adds a processor for a queue that decodes the payload of the
+// jobs with decode, and processes the decoded payload with process
+func RegisterTyped[T any](m *Magi, queueName string, decode func(*job.Job) (T, error), process func(T) error) {
+	m.Register(queueName, &TypedProcessor[T]{
+		Decode:    decode,
+		Handle:    process,
+		AutoRenew: true,
+	})
+}
+
+// DecodeJSON decodes the body of the job as JSON, to be used as the decoder of a typed processor
+func DecodeJSON[T any](_job *job.Job) (T, error) {
+	var payload T
+	err := json.Unmarshal(_job.RawBody(), &payload)
+	return payload, err
+}
@@ -0,0 +1,94 @@
+//go:build go1.18
+// +build go1.18
+
+package magi
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/evanhuang8/magi/cluster"
+	"github.com/evanhuang8/magi/job"
+)
+
+type Order struct {
+	ID     string
+	Amount int
+}
+
+func TestConsumerTyped(t *testing.T) {
+	assert := assert.New(t)
+	mem := cluster.NewMemoryCluster()
+	consumer := ConsumerWithBackends(mem, mem.Locks())
+	defer consumer.Close()
+	queue := "jobq" + RandomKey()
+	orders := []Order{}
+	handlerErr := errors.New("declined")
+	RegisterTyped(consumer, queue, DecodeJSON[Order], func(order Order) error {
+		orders = append(orders, order)
+		if order.Amount < 0 {
+			return handlerErr
+		}
+		return nil
+	})
+	// nextFailure returns the error of the next failed event, if any
+	nextFailure := func() error {
+		for {
+			select {
+			case event := <-consumer.Events():
+				if event.Type == EventFailed {
+					return event.Err
+				}
+			default:
+				return nil
+			}
+		}
+	}
+	// Payloads should be decoded for the handler
+	_, err := consumer.AddJob(queue, `{"ID":"o1","Amount":42}`, time.Now(), nil)
+	assert.Empty(err)
+	processed, err := consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	assert.Equal(orders, []Order{{ID: "o1", Amount: 42}})
+	assert.Empty(nextFailure())
+	// Jobs failing to decode should not reach the handler
+	_, err = consumer.AddJob(queue, "not json", time.Now(), nil)
+	assert.Empty(err)
+	processed, err = consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	assert.Len(orders, 1)
+	assert.True(errors.Is(nextFailure(), ErrJobDecode))
+	// Errors of the handler should fail the job as is
+	_, err = consumer.AddJob(queue, `{"ID":"o2","Amount":-1}`, time.Now(), nil)
+	assert.Empty(err)
+	processed, err = consumer.ProcessOnce(queue)
+	assert.Empty(err)
+	assert.True(processed)
+	assert.Len(orders, 2)
+	assert.Equal(nextFailure(), handlerErr)
+}
+
+func TestTypedProcessorCustomDecode(t *testing.T) {
+	assert := assert.New(t)
+	p := &TypedProcessor[int]{
+		Decode: func(_job *job.Job) (int, error) {
+			return len(_job.Body), nil
+		},
+		Handle: func(n int) error {
+			if n > 3 {
+				return errors.New("too long")
+			}
+			return nil
+		},
+	}
+	_, err := p.Process(&job.Job{Body: "abc"})
+	assert.Empty(err)
+	_, err = p.Process(&job.Job{Body: "abcd"})
+	assert.NotEmpty(err)
+	assert.False(p.ShouldAutoRenew(nil))
+}
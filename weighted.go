@@ -0,0 +1,155 @@
+package magi
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/evanhuang8/magi/cluster"
+	"github.com/evanhuang8/magi/job"
+)
+
+// weightedScheduler picks the queues in turn by smooth weighted round robin,
+// so that over a round of as many turns as the sum of the weights each queue
+// gets as many turns as its weight, spread out rather than in bursts
+type weightedScheduler struct {
+	queues  []string
+	weights []int
+	current []int
+	total   int
+}
+
+// newWeightedScheduler creates a scheduler of the queues, counting the
+// weights below 1 as 1 so that no queue is starved
+func newWeightedScheduler(weights map[string]int) *weightedScheduler {
+	s := &weightedScheduler{}
+	for queueName := range weights {
+		s.queues = append(s.queues, queueName)
+	}
+	sort.Strings(s.queues)
+	s.weights = make([]int, len(s.queues))
+	s.current = make([]int, len(s.queues))
+	for i, queueName := range s.queues {
+		weight := weights[queueName]
+		if weight < 1 {
+			weight = 1
+		}
+		s.weights[i] = weight
+		s.total += weight
+	}
+	return s
+}
+
+// next returns the queue whose turn it is
+func (s *weightedScheduler) next() string {
+	best := 0
+	for i := range s.queues {
+		s.current[i] += s.weights[i]
+		if s.current[i] > s.current[best] {
+			best = i
+		}
+	}
+	s.current[best] -= s.total
+	return s.queues[best]
+}
+
+// ProcessWeighted processes the queues in a single loop, sharing the workers
+// between them in proportion to their weights, e.g. a queue weighted 3 gets
+// three times as many jobs fetched as a queue weighted 1 while both have
+// jobs. Every queue gets its turn in each round, so none is starved, and the
+// turn of a queue that is empty, or paused by its circuit breaker or
+// concurrency limit, passes to the next one. Weights below 1 count as 1.
+// Prefetching and ordering windows do not apply to the queues processed
+// this way.
+//
+// It returns ErrNoProcessor without processing any queue if one of them has
+// no registered processor.
+func (m *Magi) ProcessWeighted(weights map[string]int) error {
+	for queueName := range weights {
+		if !m.hasProcessor(queueName) {
+			return ErrNoProcessor
+		}
+	}
+	if len(weights) == 0 {
+		return nil
+	}
+	m.processing.Add(1)
+	defer m.processing.Done()
+	atomic.AddInt32(&m.isProcessing, 1)
+	defer atomic.AddInt32(&m.isProcessing, -1)
+	scheduler := newWeightedScheduler(weights)
+	options := &cluster.FetchOptions{
+		NoHang: true,
+	}
+	idle := 0 // number of consecutive rounds finding all the queues empty
+	for {
+		select {
+		case <-m.quit:
+			return nil
+		default:
+		}
+		if !m.acquireWorker(nil) {
+			return nil
+		}
+		start := m.clock.Now()
+		var _job *job.Job
+		var queueName string
+		var slots chan struct{}
+		for i := 0; i < len(scheduler.queues) && _job == nil; i++ {
+			queueName = scheduler.next()
+			_job, slots = m.fetchTurn(queueName, options)
+		}
+		if _job == nil {
+			m.releaseWorker(nil)
+			idle++
+			if !m.backoffWait(m.idleBackoff, idle, m.clock.Now().Sub(start)) {
+				return nil
+			}
+			continue
+		}
+		idle = 0
+		m.dispatch(queueName, _job, slots)
+	}
+}
+
+// fetchTurn fetches a job from the queue on its turn, unless its circuit
+// breaker or its concurrency limit holds it back, returning the job with
+// the concurrency slot taken for it
+func (m *Magi) fetchTurn(queueName string, options *cluster.FetchOptions) (*job.Job, chan struct{}) {
+	m.mutex.RLock()
+	slots := m.queueSlots[queueName]
+	m.mutex.RUnlock()
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		default:
+			return nil, nil
+		}
+	}
+	breaker := m.breaker(queueName)
+	if breaker != nil {
+		allowed, _, changed := breaker.allow(m.clock.Now())
+		if changed {
+			m.breakerChanged(queueName, BreakerHalfOpen)
+		}
+		if !allowed {
+			if slots != nil {
+				<-slots
+			}
+			return nil, nil
+		}
+	}
+	_job, err := m.fetch(queueName, options)
+	if err != nil {
+		m.logf("Error: %v", err)
+	}
+	if _job == nil {
+		if breaker != nil {
+			breaker.cancelProbe()
+		}
+		if slots != nil {
+			<-slots
+		}
+		return nil, nil
+	}
+	return _job, slots
+}